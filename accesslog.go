@@ -4,64 +4,70 @@ import (
 	"bufio"
 	"io"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
-const defaultFormatExpression = `^` +
+// the prefix of the groups in the access log format that capture labels
+const labelGroupPrefix = "label_"
 
-	// remote address:
-	`(([0-9.]+(\s*,\s*[0-9.]+)*)|-)\s*` +
-
-	// client identity:
-	`([a-zA-Z0-9_.]+|-)\s*` +
-
-	// user id:
-	`([a-zA-Z0-9_.]+|-)\s*` +
-
-	// time:
-	`([[]([^]])*[]]|-)\s*` +
-
-	// message:
-	`"(?P<method>[^ ^"]+)\s+(?P<path>[^ ^"]+)\s+([^ ^"]+)"\s*` +
-
-	// status:
-	`([0-9]+)\s*` +
-
-	// response size:
-	`([0-9]+)\s*` +
-
-	// referrer (the comma must be a mistake):
-	`("([^"]+)",?\s*)?` +
+type reader struct {
+	scanner    *bufio.Scanner
+	lineParser Parser
+	session    *sessionExtractor
+	filter     *entryFilter
+	dedup      *deduplicator
+	log        Logger
+}
 
-	// user agent:
-	`("(?P<useragent>[^"]+)"\s*)?` +
+// regexpParser parses the log entries with the custom format set in the options
+type regexpParser struct {
+	format     *regexp.Regexp
+	names      []string
+	timeFormat string
+	log        Logger
+}
 
-	// duration:
-	`(([0-9]+)\s*)?` +
+// absoluteForm handles the request paths logged as absolute URLs, e.g. by forward
+// proxies: GET http://www.example.org/foo HTTP/1.1. The scheme and the host are taken
+// from the URL, and the path is set to the rest of it. Like in HTTP, the host of the URL
+// takes precedence over the logged host.
+func absoluteForm(r *Request) {
+	i := strings.Index(r.Path, "://")
+	if i < 0 {
+		return
+	}
 
-	// host:
-	`((?P<host>\S+)\s*)?` +
+	scheme := strings.ToLower(r.Path[:i])
+	if scheme != "http" && scheme != "https" {
+		return
+	}
 
-	`$`
+	rest := r.Path[i+3:]
+	path := "/"
+	if j := strings.IndexAny(rest, "/?"); j >= 0 {
+		rest, path = rest[:j], rest[j:]
+		if path[0] == '?' {
+			path = "/" + path
+		}
+	}
 
-var (
-	defaultFormat = regexp.MustCompile(defaultFormatExpression)
-	defaultNames  = defaultFormat.SubexpNames()
-)
+	// user info:
+	if j := strings.LastIndex(rest, "@"); j >= 0 {
+		rest = rest[j+1:]
+	}
 
-type reader struct {
-	scanner    *bufio.Scanner
-	lineParser Parser
-	log        Logger
-}
+	if rest == "" {
+		return
+	}
 
-type defaultParser struct {
-	format *regexp.Regexp
-	names  []string
-	log    Logger
+	r.Scheme = scheme
+	r.Host = rest
+	r.Path = path
 }
 
-func (p *defaultParser) Parse(l string) *Request {
+func (p *regexpParser) Parse(l string) *Request {
 	r := &Request{}
 	m := p.format.FindStringSubmatch(l)
 	for i, ni := range p.names {
@@ -69,6 +75,14 @@ func (p *defaultParser) Parse(l string) *Request {
 			break
 		}
 
+		if ni != "" && m[i] != "" {
+			if r.Fields == nil {
+				r.Fields = make(map[string]string)
+			}
+
+			r.Fields[ni] = m[i]
+		}
+
 		switch ni {
 		case "method":
 			r.Method = m[i]
@@ -76,52 +90,162 @@ func (p *defaultParser) Parse(l string) *Request {
 			r.Host = m[i]
 		case "path":
 			r.Path = m[i]
+		case "protocol":
+			r.Protocol = m[i]
 		case "useragent":
 			r.UserAgent = m[i]
+		case "remoteaddress":
+			r.RemoteAddress = m[i]
+		case "session":
+			r.Session = m[i]
+		case "status":
+			if s, err := strconv.Atoi(m[i]); err == nil {
+				r.LoggedStatus = s
+			}
+		case "size":
+			if s, err := strconv.ParseInt(m[i], 10, 64); err == nil {
+				r.LoggedSize = s
+			}
+		case "duration":
+			if d, err := strconv.ParseInt(m[i], 10, 64); err == nil {
+				r.LoggedDuration = time.Duration(d) * time.Millisecond
+			}
+		case "time":
+			if m[i] == "" {
+				break
+			}
+
+			t, err := parseTime(p.timeFormat, m[i])
+			if err != nil {
+				p.log.Debugln("failed to parse the time of the log entry:", err)
+				break
+			}
+
+			r.Time = t
+		case "body":
+			if m[i] != "" {
+				r.Body = []byte(m[i])
+			}
+		default:
+			if strings.HasPrefix(ni, labelGroupPrefix) && m[i] != "" {
+				if r.Labels == nil {
+					r.Labels = make(map[string]string)
+				}
+
+				r.Labels[strings.TrimPrefix(ni, labelGroupPrefix)] = m[i]
+			}
 		}
 	}
 
+	absoluteForm(r)
 	return r
 }
 
-func newReader(input io.Reader, format string, p Parser, log Logger) (*reader, error) {
+func newReader(o Options, log Logger) (*reader, error) {
+	p := o.Parser
 	if p == nil {
-		rx := defaultFormat
-		if format != "" {
-			var err error
-			rx, err = regexp.Compile(format)
+		tf := o.AccessLogTimeFormat
+		if tf == "" {
+			tf = DefaultTimeFormat
+		}
+
+		if o.AccessLogFormat == "" {
+			p = &combinedParser{timeFormat: tf, log: log}
+		} else {
+			rx, err := regexp.Compile(o.AccessLogFormat)
 			if err != nil {
 				return nil, err
 			}
+
+			p = &regexpParser{format: rx, names: rx.SubexpNames(), timeFormat: tf, log: log}
 		}
+	}
+
+	se, err := newSessionExtractor(o)
+	if err != nil {
+		return nil, err
+	}
 
-		p = &defaultParser{format: rx, names: rx.SubexpNames(), log: log}
+	f, err := newEntryFilter(o)
+	if err != nil {
+		return nil, err
 	}
 
 	return &reader{
-		scanner:    bufio.NewScanner(input),
+		scanner:    bufio.NewScanner(o.AccessLog),
 		lineParser: p,
+		session:    se,
+		filter:     f,
+		dedup:      newDeduplicator(o),
 		log:        log,
 	}, nil
 }
 
 // document default token size
 func (r *reader) ReadRequest() (req *Request, err error) {
-	if !r.scanner.Scan() {
-		if err = r.scanner.Err(); err != nil {
+	for {
+		if !r.scanner.Scan() {
+			if err = r.scanner.Err(); err != nil {
+				return
+			}
+
+			err = io.EOF
 			return
 		}
 
-		err = io.EOF
+		l := r.scanner.Text()
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+
+		req = r.lineParser.Parse(l)
+		if req == nil {
+			return
+		}
+
+		if !r.filter.accept(req) || r.dedup.duplicate(req) {
+			continue
+		}
+
+		if req.Session == "" {
+			req.Session = r.session.extract(l, req)
+		}
+
 		return
 	}
+}
 
-	l := r.scanner.Text()
-	l = strings.TrimSpace(l)
-	if l == "" {
-		return r.ReadRequest()
+// ReadRequests reads all the requests from the access log set in the options. Only
+// the parsing related options are applied: AccessLog, AccessLogFormat,
+// AccessLogTimeFormat, Parser, the session extraction options, the filters, Log and
+// LogLevels.
+func ReadRequests(o Options) ([]*Request, error) {
+	if o.AccessLog == nil {
+		return nil, nil
 	}
 
-	req = r.lineParser.Parse(l)
-	return
+	if o.Log == nil {
+		o.Log = newDefaultLog(o.LogLevels)
+	}
+
+	log := newComponentLog(o.Log, ParserComponent, o.LogLevels)
+	r, err := newReader(o, log)
+	if err != nil {
+		return nil, err
+	}
+
+	var requests []*Request
+	for {
+		ri, err := r.ReadRequest()
+		if err == io.EOF {
+			return requests, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		requests = append(requests, ri)
+	}
 }
@@ -0,0 +1,159 @@
+package logreplay
+
+import "time"
+
+// DefaultAdaptiveInterval is the period of checking the health of the target when not
+// specified otherwise.
+const DefaultAdaptiveInterval = 10 * time.Second
+
+// DefaultAdaptiveMinRate is the request per second rate below which the adaptive
+// throttling doesn't reduce the rate, when not specified otherwise.
+const DefaultAdaptiveMinRate = 1
+
+const (
+
+	// the percentile of the response times checked against AdaptiveLatency
+	adaptivePercentile = .95
+
+	// the rate is halved when the target is unhealthy, and increased by a tenth of the
+	// original rate in every healthy interval
+	adaptiveDecrease = .5
+	adaptiveIncrease = .1
+)
+
+// adaptiveThrottle reduces the rate when the target is unhealthy, and ramps it back up
+// when it recovers. It is used only from the goroutine of the Player, except for the
+// target rate, which is set by SetThrottle().
+type adaptiveThrottle struct {
+	errorRate float64
+	latency   time.Duration
+	interval  time.Duration
+	minRate   float64
+	target    *rate
+
+	// the rate to recover to, when the target rate is unlimited
+	ceiling float64
+	reduced bool
+
+	start     time.Time
+	requests  int
+	errors    int
+	latencies histogram
+}
+
+func newAdaptiveThrottle(o Options) *adaptiveThrottle {
+	if o.AdaptiveErrorRate <= 0 && o.AdaptiveLatency <= 0 {
+		return nil
+	}
+
+	interval := o.AdaptiveInterval
+	if interval <= 0 {
+		interval = DefaultAdaptiveInterval
+	}
+
+	minRate := o.AdaptiveMinRate
+	if minRate <= 0 {
+		minRate = DefaultAdaptiveMinRate
+	}
+
+	return &adaptiveThrottle{
+		errorRate: o.AdaptiveErrorRate,
+		latency:   o.AdaptiveLatency,
+		interval:  interval,
+		minRate:   minRate,
+		target:    newRate(o.Throttle),
+		start:     time.Now(),
+	}
+}
+
+// add counts a result, and returns true when the interval was closed
+func (a *adaptiveThrottle) add(r result, now time.Time) bool {
+	a.requests++
+	if r.status == 0 || r.status >= 500 {
+		a.errors++
+	} else {
+		a.latencies.add(r.latency)
+	}
+
+	return now.Sub(a.start) >= a.interval
+}
+
+func (a *adaptiveThrottle) healthy() bool {
+	if a.errorRate > 0 && float64(a.errors)/float64(a.requests) > a.errorRate {
+		return false
+	}
+
+	return a.latency <= 0 || a.latencies.percentile(adaptivePercentile) <= a.latency
+}
+
+// next returns the rate for the next interval, based on the current rate, and the
+// results of the closed interval. Zero means unlimited.
+func (a *adaptiveThrottle) next(current float64, elapsed time.Duration) (float64, bool) {
+	target := a.target.get()
+	if !a.healthy() {
+		if current <= 0 {
+			current = float64(a.requests) / elapsed.Seconds()
+		}
+
+		if !a.reduced {
+			a.ceiling = current
+			a.reduced = true
+		}
+
+		next := current * adaptiveDecrease
+		if next < a.minRate {
+			next = a.minRate
+		}
+
+		return next, next != current
+	}
+
+	if !a.reduced {
+		return current, false
+	}
+
+	ceiling := a.ceiling
+	if target > 0 {
+		ceiling = target
+	}
+
+	next := current + ceiling*adaptiveIncrease
+	if next >= ceiling {
+		a.reduced = false
+		return target, true
+	}
+
+	return next, true
+}
+
+func (a *adaptiveThrottle) reset(now time.Time) {
+	a.start = now
+	a.requests = 0
+	a.errors = 0
+	a.latencies = histogram{}
+}
+
+// adaptThrottle adjusts the rate at the end of every interval
+func (p *Player) adaptThrottle(r result) {
+	now := time.Now()
+	if p.adaptive == nil || !p.adaptive.add(r, now) {
+		return
+	}
+
+	defer p.adaptive.reset(now)
+	current := p.shared.rate.get()
+	next, changed := p.adaptive.next(current, now.Sub(p.adaptive.start))
+	if !changed {
+		return
+	}
+
+	p.shared.rate.set(next)
+	switch {
+	case !p.adaptive.reduced:
+		p.options.Log.Infoln("target recovered, restoring the rate to:", next)
+	case next < current || current <= 0:
+		p.options.Log.Warnln("target unhealthy, reducing the rate to:", next)
+	default:
+		p.options.Log.Infoln("target healthy, increasing the rate to:", next)
+	}
+}
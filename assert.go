@@ -0,0 +1,157 @@
+package logreplay
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Assertion defines the expectations that the responses need to meet. The failed
+// assertions are counted in the statistics, and can make the player halt, when
+// AssertionThreshold is set.
+type Assertion struct {
+
+	// PathPattern, when set, is a regular expression that the path of the request needs
+	// to match for the assertion to be applied.
+	PathPattern string
+
+	// Status, when set, contains the accepted status codes.
+	Status []int
+
+	// Headers contains the expected values of the response headers.
+	Headers map[string]string
+
+	// Body, when set, is a regular expression that the response body needs to match.
+	// Setting it requires the response bodies to be kept in memory while the
+	// assertion is checked.
+	Body string
+
+	// MaxLatency, when set, is the maximum accepted response time.
+	MaxLatency time.Duration
+}
+
+type regexpCache struct {
+	mx      sync.Mutex
+	regexps map[string]*regexp.Regexp
+}
+
+func newRegexpCache() *regexpCache {
+	return &regexpCache{regexps: make(map[string]*regexp.Regexp)}
+}
+
+func (rc *regexpCache) get(expr string) (*regexp.Regexp, error) {
+	rc.mx.Lock()
+	defer rc.mx.Unlock()
+
+	if rx, ok := rc.regexps[expr]; ok {
+		return rx, nil
+	}
+
+	rx, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.regexps[expr] = rx
+	return rx, nil
+}
+
+// validateAssertions compiles, and this way caches, the regular expressions of the
+// assertions
+func validateAssertions(rc *regexpCache, a []Assertion) error {
+	for _, ai := range a {
+		for _, expr := range []string{ai.PathPattern, ai.Body} {
+			if expr == "" {
+				continue
+			}
+
+			if _, err := rc.get(expr); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func hasBodyAssertion(a []Assertion) bool {
+	for _, ai := range a {
+		if ai.Body != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *client) keepBody(r *Request) bool {
+	return hasBodyAssertion(c.options.Assertions) ||
+		hasBodyAssertion(r.Assertions) ||
+		hasBodyExtraction(c.options.Extractions) ||
+		c.options.OnResponse != nil
+}
+
+func (c *client) match(expr string, b []byte) bool {
+	rx, err := c.shared.regexps.get(expr)
+	return err == nil && rx.Match(b)
+}
+
+// checkAssertion returns an empty string when the response meets the assertion, or the
+// reason otherwise
+func (c *client) checkAssertion(a Assertion, path string, rsp response) string {
+	if a.PathPattern != "" && !c.match(a.PathPattern, []byte(path)) {
+		return ""
+	}
+
+	if len(a.Status) > 0 {
+		var found bool
+		for _, s := range a.Status {
+			if s == rsp.status {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Sprintf("unexpected status: %d", rsp.status)
+		}
+	}
+
+	for name, value := range a.Headers {
+		if v := rsp.header.Get(name); v != value {
+			return fmt.Sprintf("unexpected header value: %s: %s", name, v)
+		}
+	}
+
+	if a.Body != "" && !c.match(a.Body, rsp.body) {
+		return "response body doesn't match"
+	}
+
+	if a.MaxLatency > 0 && rsp.latency > a.MaxLatency {
+		return fmt.Sprintf("response time exceeded: %v", rsp.latency)
+	}
+
+	return ""
+}
+
+// assert checks the global and the request specific assertions, and the response hook,
+// and returns false if any of them failed. Responses are not checked when the request
+// failed.
+func (c *client) assert(o *outgoing, rsp response) bool {
+	if rsp.status == 0 {
+		return true
+	}
+
+	path := o.httpRequest.URL.Path
+	for _, a := range [][]Assertion{c.options.Assertions, o.request.Assertions} {
+		for _, ai := range a {
+			if reason := c.checkAssertion(ai, path, rsp); reason != "" {
+				c.options.Log.Warnln("assertion failed:", o.httpRequest.Method, path, reason)
+				return false
+			}
+		}
+	}
+
+	return c.onResponse(o.httpRequest, rsp)
+}
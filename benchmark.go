@@ -0,0 +1,102 @@
+package logreplay
+
+import "time"
+
+// BenchmarkOptions define an A/B benchmark, where the same requests are replayed once
+// against two different servers.
+type BenchmarkOptions struct {
+
+	// Options define the replayed requests and the player settings. The access log, if
+	// set, is read completely before the benchmark starts. Server, Servers and Shadow
+	// are ignored.
+	Options
+
+	// A and B are the network addresses of the compared servers.
+	A string
+	B string
+
+	// Batches tells the benchmark to split the requests into batches, and replay them
+	// alternately against A and B, batch by batch. This way the effect of the changing
+	// conditions during the benchmark gets distributed between the two servers. When
+	// not set, all the requests are replayed first against A and then against B.
+	Batches int
+}
+
+// BenchmarkReport contains the statistics of an A/B benchmark.
+type BenchmarkReport struct {
+	A Stats
+	B Stats
+}
+
+// batch returns the i-th of n batches of the items, as an index range
+func batch(count, n, i int) (int, int) {
+	return count * i / n, count * (i + 1) / n
+}
+
+func benchmarkBatch(o Options, server string, logEntries, requests []*Request) (*stats, error) {
+	o.Server = server
+	o.Servers = nil
+	o.Shadow = ""
+	o.AccessLog = nil
+	o.Requests = requests
+	p, err := New(o)
+	if err != nil {
+		return nil, err
+	}
+
+	p.logEntries = &entryStore{memory: logEntries}
+	err = p.Once()
+	if err == ErrNoRequests {
+		err = nil
+	}
+
+	return p.stats.merged(), err
+}
+
+// Benchmark replays the same requests against two servers, and returns the statistics
+// collected for each. The random decisions, e.g. the generated payloads, are the same
+// for both servers. When a replay fails, e.g. because the halt threshold was reached,
+// Benchmark returns the statistics collected until the failure, together with the
+// error.
+func Benchmark(o BenchmarkOptions) (BenchmarkReport, error) {
+	logEntries, err := ReadRequests(o.Options)
+	if err != nil {
+		return BenchmarkReport{}, err
+	}
+
+	batches := o.Batches
+	if batches <= 0 {
+		batches = 1
+	}
+
+	if o.RandomSeed == 0 {
+		o.RandomSeed = time.Now().UnixNano()
+	}
+
+	sa, sb := newStats(), newStats()
+	for i := 0; i < batches; i++ {
+		bo := o.Options
+		bo.RandomSeed = o.RandomSeed + int64(i)
+		if bo.ShuffleSeed != 0 {
+			bo.ShuffleSeed += int64(i)
+		}
+
+		lfrom, lto := batch(len(logEntries), batches, i)
+		rfrom, rto := batch(len(o.Requests), batches, i)
+		for _, side := range []struct {
+			server string
+			stats  *stats
+		}{{o.A, sa}, {o.B, sb}} {
+			s, err := benchmarkBatch(bo, side.server, logEntries[lfrom:lto], o.Requests[rfrom:rto])
+			if s != nil {
+				side.stats.merge(s)
+			}
+
+			if err != nil {
+				return BenchmarkReport{A: sa.get(), B: sb.get()}, err
+			}
+		}
+	}
+
+	return BenchmarkReport{A: sa.get(), B: sb.get()}, nil
+}
@@ -0,0 +1,284 @@
+package logreplay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+)
+
+// BodyFormat defines how the random request payload is generated.
+type BodyFormat int
+
+const (
+
+	// TextBody tells the player to send random text as the request payload.
+	TextBody BodyFormat = iota
+
+	// FormBody tells the player to send an application/x-www-form-urlencoded request
+	// payload, with random field values.
+	FormBody
+
+	// MultipartBody tells the player to send a multipart/form-data request payload,
+	// with random field values.
+	MultipartBody
+)
+
+// BodyFile maps the requests with a matching path to a file, whose content is sent as the
+// request payload.
+type BodyFile struct {
+
+	// PathPattern is a regular expression matched against the request path.
+	PathPattern string
+
+	// File is the path of the file containing the payload.
+	File string
+}
+
+type bodyFile struct {
+	path *regexp.Regexp
+	file string
+}
+
+func compileBodyFiles(bf []BodyFile) ([]bodyFile, error) {
+	var c []bodyFile
+	for _, bfi := range bf {
+		rx, err := regexp.Compile(bfi.PathPattern)
+		if err != nil {
+			return nil, err
+		}
+
+		c = append(c, bodyFile{path: rx, file: bfi.File})
+	}
+
+	return c, nil
+}
+
+func matchBodyFile(bf []bodyFile, path string) string {
+	for _, bfi := range bf {
+		if bfi.path.MatchString(path) {
+			return bfi.file
+		}
+	}
+
+	return ""
+}
+
+type chunkReader struct {
+	reader  io.Reader
+	size    int
+	delay   time.Duration
+	started bool
+}
+
+type requestBody struct {
+	reader          io.Reader
+	length          int64
+	contentType     string
+	contentEncoding string
+}
+
+// every read results in a separate chunk when the request is sent with chunked transfer
+// encoding
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.size > 0 && len(p) > r.size {
+		p = p[:r.size]
+	}
+
+	if r.started && r.delay > 0 {
+		time.Sleep(r.delay)
+	}
+
+	r.started = true
+	return r.reader.Read(p)
+}
+
+func (r *chunkReader) Close() error {
+	if c, ok := r.reader.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// the default boundary of the multipart writer is not affected by the random seed
+func randomBoundary(rnd *rand.Rand) string {
+	return fmt.Sprintf("%x", randomBytes(rnd, "", 30))
+}
+
+func formFieldName(i int) string {
+	return fmt.Sprintf("field%d", i+1)
+}
+
+func formBody(rnd *rand.Rand, fields, size int) requestBody {
+	v := make(url.Values)
+	for i := 0; i < fields; i++ {
+		v.Set(formFieldName(i), randomText(rnd, size))
+	}
+
+	b := []byte(v.Encode())
+	return requestBody{
+		reader:      bytes.NewReader(b),
+		length:      int64(len(b)),
+		contentType: "application/x-www-form-urlencoded",
+	}
+}
+
+func multipartBody(rnd *rand.Rand, fields, size int) (requestBody, error) {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	if err := w.SetBoundary(randomBoundary(rnd)); err != nil {
+		return requestBody{}, err
+	}
+
+	for i := 0; i < fields; i++ {
+		if err := w.WriteField(formFieldName(i), randomText(rnd, size)); err != nil {
+			return requestBody{}, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return requestBody{}, err
+	}
+
+	return requestBody{
+		reader:      bytes.NewReader(b.Bytes()),
+		length:      int64(b.Len()),
+		contentType: w.FormDataContentType(),
+	}, nil
+}
+
+func fileBody(name string) (requestBody, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return requestBody{}, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return requestBody{}, err
+	}
+
+	return requestBody{reader: f, length: fi.Size()}, nil
+}
+
+func compressBody(b requestBody) (requestBody, error) {
+	if c, ok := b.reader.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := io.Copy(w, b.reader); err != nil {
+		return requestBody{}, err
+	}
+
+	if err := w.Close(); err != nil {
+		return requestBody{}, err
+	}
+
+	return requestBody{
+		reader:          bytes.NewReader(buf.Bytes()),
+		length:          int64(buf.Len()),
+		contentType:     b.contentType,
+		contentEncoding: "gzip",
+	}, nil
+}
+
+func isPost(method string) bool {
+	switch method {
+	case "POST", "PUT", "PATCH":
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *client) createBody(r *Request, ts *templateScope) (requestBody, error) {
+	b, err := c.createPlainBody(r, ts)
+	if err != nil || b.reader == nil {
+		return b, err
+	}
+
+	if c.options.CompressBody {
+		if b, err = compressBody(b); err != nil {
+			return b, err
+		}
+	}
+
+	if r.Chunked {
+		b.reader = &chunkReader{
+			reader: b.reader,
+			size:   c.options.ChunkSize,
+			delay:  c.options.ChunkDelay,
+		}
+
+		b.length = -1
+	}
+
+	return b, nil
+}
+
+func (c *client) createPlainBody(r *Request, ts *templateScope) (requestBody, error) {
+	switch {
+	case len(r.Body) > 0:
+		return requestBody{reader: bytes.NewReader(r.Body)}, nil
+	case r.BodyFile != "":
+		return fileBody(r.BodyFile)
+	case r.BodyTemplate != "":
+		b, err := c.templates.execute(r.BodyTemplate, ts)
+		if err != nil {
+			return requestBody{}, err
+		}
+
+		return requestBody{reader: bytes.NewReader(b)}, nil
+	case isPost(r.Method) && len(c.shared.corpora) > 0:
+		if b, ok := pickCorpusPayload(c.random, c.shared.corpora, r.Path); ok {
+			return requestBody{reader: bytes.NewReader(b)}, nil
+		}
+
+		return c.createGeneratedBody(r)
+	default:
+		return c.createGeneratedBody(r)
+	}
+}
+
+func (c *client) createGeneratedBody(r *Request) (requestBody, error) {
+	switch {
+	case r.BodyFormat == FormBody || r.BodyFormat == MultipartBody:
+		fields := r.FormFields
+		if fields <= 0 {
+			fields = 1
+		}
+
+		if r.BodyFormat == FormBody {
+			return formBody(c.random, fields, r.FormFieldSize), nil
+		}
+
+		return multipartBody(c.random, fields, r.FormFieldSize)
+	case r.ContentLength > 0 || r.ContentLengthDeviation > 0:
+		contentLength := deviateMin(c.random, r.ContentLength, r.ContentLengthDeviation)
+		b := requestBody{reader: newPayloadBody(
+			c.random,
+			c.shared.payloads,
+			c.options.Payload,
+			c.options.PayloadSample,
+			contentLength,
+		)}
+
+		if r.SetContentLength {
+			b.length = int64(contentLength)
+		}
+
+		return b, nil
+	default:
+		return requestBody{}, nil
+	}
+}
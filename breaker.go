@@ -0,0 +1,78 @@
+package logreplay
+
+import "time"
+
+// DefaultCircuitBreakerTimeout is the time while the requests to a failing host are
+// skipped, when the circuit breaker is enabled.
+const DefaultCircuitBreakerTimeout = 30 * time.Second
+
+// breaker tracks the consecutive failures per host. It is used only from the goroutine
+// of the Player.
+type breaker struct {
+	threshold int
+	timeout   time.Duration
+	log       Logger
+	failures  map[string]int
+	openUntil map[string]time.Time
+}
+
+func newBreaker(o Options) *breaker {
+	if o.CircuitBreakerThreshold <= 0 {
+		return nil
+	}
+
+	timeout := o.CircuitBreakerTimeout
+	if timeout <= 0 {
+		timeout = DefaultCircuitBreakerTimeout
+	}
+
+	return &breaker{
+		threshold: o.CircuitBreakerThreshold,
+		timeout:   timeout,
+		log:       o.Log,
+		failures:  make(map[string]int),
+		openUntil: make(map[string]time.Time),
+	}
+}
+
+func (b *breaker) allow(host string) bool {
+	if b == nil {
+		return true
+	}
+
+	until, ok := b.openUntil[host]
+	if !ok {
+		return true
+	}
+
+	if time.Now().Before(until) {
+		return false
+	}
+
+	// after the timeout, the requests are let through again, but the next failure
+	// opens the circuit again:
+	delete(b.openUntil, host)
+	return true
+}
+
+func (b *breaker) report(host string, failed bool) {
+	if b == nil {
+		return
+	}
+
+	if !failed {
+		delete(b.failures, host)
+		return
+	}
+
+	b.failures[host]++
+	if b.failures[host] < b.threshold {
+		return
+	}
+
+	if _, open := b.openUntil[host]; !open {
+		b.log.Warnln("circuit opened for host:", host)
+	}
+
+	b.openUntil[host] = time.Now().Add(b.timeout)
+}
@@ -0,0 +1,165 @@
+package logreplay
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the status codes of the responses stored by the client cache, when they have an
+// explicit expiration time
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// clientCache holds the expiration time of the responses received in a session, like the
+// private cache of a browser. Only the freshness is tracked, the responses themselves are
+// not stored. The responses may be received on a different goroutine than where the next
+// request is prepared.
+type clientCache struct {
+	mx      sync.Mutex
+	expires map[string]time.Time
+}
+
+func (cc *clientCache) fresh(key string, now time.Time) bool {
+	cc.mx.Lock()
+	defer cc.mx.Unlock()
+	exp, ok := cc.expires[key]
+	if !ok {
+		return false
+	}
+
+	if !now.Before(exp) {
+		delete(cc.expires, key)
+		return false
+	}
+
+	return true
+}
+
+func (cc *clientCache) set(key string, exp time.Time) {
+	cc.mx.Lock()
+	defer cc.mx.Unlock()
+	if cc.expires == nil {
+		cc.expires = make(map[string]time.Time)
+	}
+
+	cc.expires[key] = exp
+}
+
+func (cc *clientCache) remove(key string) {
+	cc.mx.Lock()
+	defer cc.mx.Unlock()
+	delete(cc.expires, key)
+}
+
+// cacheControl parses the directives of a Cache-Control header. The names are lower case.
+func cacheControl(h http.Header) map[string]string {
+	d := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for _, di := range strings.Split(v, ",") {
+			name, value := strings.TrimSpace(di), ""
+			if i := strings.IndexByte(name, '='); i >= 0 {
+				name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), "\"")
+			}
+
+			if name != "" {
+				d[strings.ToLower(name)] = value
+			}
+		}
+	}
+
+	return d
+}
+
+// freshnessLifetime returns how long a response can be served from the cache, based on
+// the max-age directive, or on the Expires and the Date headers, reduced by the Age of the
+// response. It returns false, when the response cannot be cached.
+func freshnessLifetime(h http.Header, now time.Time) (time.Duration, bool) {
+	cc := cacheControl(h)
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+
+	if _, ok := cc["no-cache"]; ok {
+		return 0, false
+	}
+
+	if strings.TrimSpace(h.Get("Vary")) == "*" {
+		return 0, false
+	}
+
+	var lifetime time.Duration
+	if maxAge, ok := cc["max-age"]; ok {
+		s, err := strconv.Atoi(maxAge)
+		if err != nil {
+			return 0, false
+		}
+
+		lifetime = time.Duration(s) * time.Second
+	} else if e := h.Get("Expires"); e != "" {
+		exp, err := http.ParseTime(e)
+		if err != nil {
+			// invalid values, e.g. 0, mean already expired:
+			return 0, false
+		}
+
+		date := now
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+
+		lifetime = exp.Sub(date)
+	} else {
+		return 0, false
+	}
+
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil {
+		lifetime -= time.Duration(age) * time.Second
+	}
+
+	return lifetime, lifetime > 0
+}
+
+// cached tells whether a fresh response to the request is available in the client cache
+func (c *client) cached(hr *http.Request) bool {
+	if !c.options.ClientCache {
+		return false
+	}
+
+	key, ok := validatorKey(hr)
+	if !ok {
+		return false
+	}
+
+	return c.cache.fresh(key, time.Now())
+}
+
+// storeCache stores the expiration time of a response in the client cache, or removes the
+// previous one, when the response cannot be cached
+func (c *client) storeCache(hr *http.Request, rsp response) {
+	if !c.options.ClientCache || rsp.status == 0 {
+		return
+	}
+
+	key, ok := validatorKey(hr)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	lifetime, ok := freshnessLifetime(rsp.header, now)
+	if !ok || !cacheableStatus[rsp.status] {
+		c.cache.remove(key)
+		return
+	}
+
+	c.cache.set(key, now.Add(lifetime))
+}
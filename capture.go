@@ -0,0 +1,81 @@
+package logreplay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+)
+
+// CaptureMode defines which response bodies are saved, when CaptureDir is set.
+type CaptureMode int
+
+const (
+
+	// CaptureAll tells the player to save every response body.
+	CaptureAll CaptureMode = iota
+
+	// CaptureErrors tells the player to save the response bodies only when the request
+	// failed, the status code of the response was 4xx or 5xx, or the response failed
+	// to meet the assertions.
+	CaptureErrors
+
+	// CaptureDifferences tells the player to save the response bodies only when the
+	// responses of the primary and the shadow server didn't match.
+	CaptureDifferences
+)
+
+// captureBuffer stores the data written to it up to a limit, and discards the rest
+type captureBuffer struct {
+	data  []byte
+	limit int64
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.limit > 0 {
+		if free := b.limit - int64(len(b.data)); int64(len(p)) > free {
+			p = p[:free]
+		}
+	}
+
+	b.data = append(b.data, p...)
+	return n, nil
+}
+
+func (c *client) shouldCapture(r result) bool {
+	switch c.options.CaptureMode {
+	case CaptureErrors:
+		return r.err != nil || r.status >= http.StatusBadRequest || r.assertionFailed
+	case CaptureDifferences:
+		return r.diff != nil
+	default:
+		return true
+	}
+}
+
+func (c *client) writeCapture(name string, body []byte) {
+	if c.options.CaptureSizeLimit > 0 && int64(len(body)) > c.options.CaptureSizeLimit {
+		body = body[:c.options.CaptureSizeLimit]
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(c.options.CaptureDir, name), body, 0644); err != nil {
+		c.options.Log.Errorln("failed to save response body", err)
+	}
+}
+
+// capture saves the response bodies in the capture directory, named after the sequence
+// number of the request
+func (c *client) capture(o *outgoing, r result, rsp response, shadowRsp *response) {
+	if c.options.CaptureDir == "" || !c.shouldCapture(r) {
+		return
+	}
+
+	if rsp.status != 0 {
+		c.writeCapture(fmt.Sprintf("%d.body", o.seq), rsp.body)
+	}
+
+	if shadowRsp != nil && shadowRsp.status != 0 {
+		c.writeCapture(fmt.Sprintf("%d.shadow.body", o.seq), shadowRsp.body)
+	}
+}
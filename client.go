@@ -1,135 +1,616 @@
 package logreplay
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type client struct {
 	options    Options
+	shared     *shared
+	random     *rand.Rand
+	templates  *sessionTemplates
 	httpClient *http.Client
+	vars       sessionVars
+	validators validatorCache
+	cache      clientCache
+	servers    serverCache
 }
 
-func newClient(o Options) *client {
-	c := &client{options: o}
+func newClient(o Options, s *shared, rnd *rand.Rand) *client {
+	o.Log = newComponentLog(o.Log, ClientComponent, o.LogLevels)
+	c := &client{options: o, shared: s, random: rnd, templates: newSessionTemplates(s.templates, rnd)}
 	c.httpClient = &http.Client{
-		Transport:     &http.Transport{},
+		Transport:     newTransport(o, s.transport),
 		CheckRedirect: c.checkRedirect,
+		Timeout:       o.RequestTimeout,
 	}
 
 	return c
 }
 
+// requestClient returns the HTTP client with the timeout of the request, when it has one
+func (c *client) requestClient(r *Request) *http.Client {
+	if r.Timeout <= 0 || r.Timeout == c.httpClient.Timeout {
+		return c.httpClient
+	}
+
+	hc := *c.httpClient
+	hc.Timeout = r.Timeout
+	return &hc
+}
+
+// the context key of the redirect behavior set for a request
+type redirectBehaviorKey struct{}
+
 func (c *client) checkRedirect(rn *http.Request, rp []*http.Request) error {
-	switch c.options.RedirectBehavior {
+	behavior := c.options.RedirectBehavior
+	if b, ok := rn.Context().Value(redirectBehaviorKey{}).(RedirectBehavior); ok {
+		behavior = b
+	}
+
+	switch behavior {
 	case FollowSameHost:
 		if rn.URL.Host != rp[0].URL.Host {
 			return http.ErrUseLastResponse
 		}
 
-		return nil
+		return c.checkMaxRedirects(rp)
 	case FollowRedirect:
-		return nil
+		return c.checkMaxRedirects(rp)
+	case FollowAllowedDomains:
+		if !c.allowedDomain(rn.URL.Hostname()) {
+			return http.ErrUseLastResponse
+		}
+
+		return c.checkMaxRedirects(rp)
 	default:
 		return http.ErrUseLastResponse
 	}
 }
 
-func (c *client) createHTTPRequest(r *Request) (*http.Request, error) {
+func (c *client) allowedDomain(host string) bool {
+	host = strings.ToLower(host)
+	for _, d := range c.options.RedirectAllowedDomains {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *client) checkMaxRedirects(rp []*http.Request) error {
+	max := c.options.MaxRedirects
+	if max <= 0 {
+		max = DefaultMaxRedirects
+	}
+
+	if len(rp) > max {
+		return ErrTooManyRedirects
+	}
+
+	return nil
+}
+
+// redirects returns the number of the redirects followed before the response
+func redirects(rsp *http.Response) int {
+	var n int
+	for r := rsp.Request; r != nil && r.Response != nil; r = r.Response.Request {
+		n++
+	}
+
+	return n
+}
+
+// server returns the address of the target server, selected from Servers when set
+func (c *client) server(seq uint64) string {
+	if len(c.options.Servers) == 0 {
+		return c.options.Server
+	}
+
+	switch c.options.ServerBalancing {
+	case RandomServer:
+		return c.options.Servers[c.random.Intn(len(c.options.Servers))]
+	default:
+		return c.options.Servers[(seq-1)%uint64(len(c.options.Servers))]
+	}
+}
+
+// parseAddress parses a network address, with or without a scheme
+func (c *client) parseAddress(a string) (*url.URL, error) {
+	if !strings.HasPrefix(a, "http://") && !strings.HasPrefix(a, "https://") {
+		a = c.options.DefaultScheme + "://" + a
+	}
+
+	u, err := url.Parse(a)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+
+	return u, nil
+}
+
+// serverCache holds the parsed server addresses, to avoid parsing them for every request.
+// The shadow requests may be created on a different goroutine than where the next request
+// is prepared.
+type serverCache struct {
+	mx     sync.Mutex
+	values map[string]*url.URL
+}
+
+func (sc *serverCache) get(a string) (*url.URL, bool) {
+	sc.mx.Lock()
+	defer sc.mx.Unlock()
+	u, ok := sc.values[a]
+	return u, ok
+}
+
+func (sc *serverCache) set(a string, u *url.URL) {
+	sc.mx.Lock()
+	defer sc.mx.Unlock()
+	if sc.values == nil {
+		sc.values = make(map[string]*url.URL)
+	}
+
+	sc.values[a] = u
+}
+
+// serverURL returns a copy of the parsed server address, parsing it only on the first use
+func (c *client) serverURL(a string) (*url.URL, error) {
+	u, ok := c.servers.get(a)
+	if !ok {
+		var err error
+		if u, err = c.parseAddress(a); err != nil {
+			return nil, err
+		}
+
+		c.servers.set(a, u)
+	}
+
+	uc := *u
+	return &uc, nil
+}
+
+func (c *client) createHTTPRequest(r *Request, seq uint64) (*http.Request, error) {
 	m := r.Method
 	if m == "" {
 		m = "GET"
 	}
 
-	a := c.options.Server
+	a := c.server(seq)
 	if a == "" {
 		if r.Host == "" {
 			a = "localhost"
 		} else {
 			a = r.Host
 		}
-	}
 
-	if !strings.HasPrefix(a, "http://") && !strings.HasPrefix(a, "https://") {
-		a = c.options.DefaultScheme + "://" + a
+		if r.Scheme != "" {
+			a = r.Scheme + "://" + a
+		}
 	}
 
-	u, err := url.Parse(a)
+	u, err := c.serverURL(a)
 	if err != nil {
 		return nil, err
 	}
 
-	if u.Scheme == "" {
-		u.Scheme = "http"
+	ts := &templateScope{random: c.random, request: r, seq: seq, vars: c.vars.snapshot()}
+	e, ok := c.shared.resolved.get(r)
+	if ok {
+		e = &resolvedEntry{path: e.path, query: e.query, header: e.header.Clone(), host: e.host}
+	} else if e, err = c.resolve(r, ts); err != nil {
+		return nil, err
 	}
 
-	u.Path = r.Path
-
-	hasContent := r.ContentLength > 0 || r.ContentLengthDeviation > 0
-	var (
-		body          io.ReadCloser
-		contentLength int
-	)
-
-	if hasContent {
-		contentLength = deviateMin(r.ContentLength, r.ContentLengthDeviation)
-		body = ioutil.NopCloser(randomText(contentLength))
+	u.Path = e.path
+	u.RawQuery = c.cacheBust(c.fuzzQuery(e.query), seq)
+	b, err := c.createBody(r, ts)
+	if err != nil {
+		return nil, err
 	}
 
-	hr, err := http.NewRequest(m, u.String(), body)
+	hr, err := newRequest(m, u, b.reader)
 	if err != nil {
+		if c, ok := b.reader.(io.Closer); ok {
+			c.Close()
+		}
+
 		return nil, err
 	}
 
-	if hasContent && r.SetContentLength {
-		hr.ContentLength = int64(contentLength)
+	switch {
+	case b.length > 0:
+		hr.ContentLength = b.length
+	case b.length < 0:
+		hr.ContentLength = -1
+		hr.TransferEncoding = []string{"chunked"}
+	}
+
+	hr.Header = e.header
+	if e.host != "" {
+		hr.Host = e.host
 	}
 
-	h := r.Host
-	if h == "" {
-		h = c.options.Server
+	// HTTP/1.0 clients don't keep the connection alive by default:
+	if c.options.PreserveHTTP10 && r.Protocol == "HTTP/1.0" {
+		hr.Close = true
 	}
 
-	if h == "" {
-		h = "localhost"
+	c.setHeader(hr, "Content-Type", b.contentType)
+	c.setHeader(hr, "Content-Encoding", b.contentEncoding)
+	// the length of the body is unknown when it is zero or negative:
+	if t := c.options.ExpectContinueThreshold; t > 0 && hr.Body != nil && hr.Body != http.NoBody &&
+		(hr.ContentLength >= t || hr.ContentLength <= 0) {
+		c.setHeader(hr, "Expect", "100-continue")
 	}
 
-	hr.Host = h
+	if c.shared.tokens != nil {
+		token, err := c.shared.tokens.Token()
+		if err != nil {
+			if hr.Body != nil {
+				hr.Body.Close()
+			}
+
+			return nil, err
+		}
+
+		c.setHeader(hr, "Authorization", "Bearer "+token)
+	}
 
-	if r.UserAgent != "" {
-		hr.Header.Set("User-Agent", r.UserAgent)
+	// an Authorization header set in the options takes precedence:
+	if user, password, ok := c.basicAuth(hr.Host); ok && hr.Header.Get("Authorization") == "" {
+		hr.SetBasicAuth(user, password)
 	}
 
 	return hr, nil
 }
 
-func (c *client) do(r *Request) error {
-	hr, err := c.createHTTPRequest(r)
+// cacheBust appends the cache-busting parameter to the query, when it is set in the
+// options. The sequence number makes the value unique even when the random values repeat
+// in the looped sessions.
+func (c *client) cacheBust(q string, seq uint64) string {
+	if c.options.CacheBustParam == "" {
+		return q
+	}
+
+	var b strings.Builder
+	b.Grow(len(q) + len(c.options.CacheBustParam) + 60)
+	if q != "" {
+		b.WriteString(q)
+		b.WriteByte('&')
+	}
+
+	b.WriteString(url.QueryEscape(c.options.CacheBustParam))
+	b.WriteByte('=')
+	b.WriteString(newUUID(c.random))
+	b.WriteByte('-')
+	b.WriteString(strconv.FormatUint(seq, 10))
+	return b.String()
+}
+
+// basicAuth returns the credentials for a host, either in the host:port or in the host
+// form
+func (c *client) basicAuth(host string) (string, string, bool) {
+	auth, ok := c.options.HostBasicAuth[host]
+	if !ok {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			auth, ok = c.options.HostBasicAuth[h]
+		}
+	}
+
+	if !ok {
+		auth = c.options.BasicAuth
+	}
+
+	if auth == "" {
+		return "", "", false
+	}
+
+	i := strings.Index(auth, ":")
+	if i < 0 {
+		return auth, "", true
+	}
+
+	return auth[:i], auth[i+1:], true
+}
+
+// outgoing holds a request prepared to be sent
+type outgoing struct {
+	request     *Request
+	httpClient  *http.Client
+	httpRequest *http.Request
+	seq         uint64
+	id          string
+	keepBody    bool
+	cached      bool
+}
+
+func (c *client) requestID(seq uint64) string {
+	if c.options.RequestIDHeader == "" {
+		return ""
+	}
+
+	if c.options.RequestIDFormat == SequenceRequestID {
+		return strconv.FormatUint(seq, 10)
+	}
+
+	return newUUID(c.random)
+}
+
+// prepare is called from the goroutine of the session, while send may be called from a
+// different one
+func (c *client) prepare(r *Request) (*outgoing, error) {
+	seq := c.shared.next()
+	hr, err := c.createHTTPRequest(r, seq)
 	if err != nil {
 		c.options.Log.Errorln("failed to create request", err)
-		return err
+		return nil, err
+	}
+
+	if r.RedirectBehavior != nil {
+		hr = hr.WithContext(context.WithValue(hr.Context(), redirectBehaviorKey{}, *r.RedirectBehavior))
+	}
+
+	id := c.requestID(seq)
+	if id != "" {
+		hr.Header.Set(c.options.RequestIDHeader, id)
+	}
+
+	if c.cached(hr) {
+		if hr.Body != nil {
+			hr.Body.Close()
+		}
+
+		return &outgoing{request: r, httpRequest: hr, seq: seq, cached: true}, nil
+	}
+
+	c.conditional(hr)
+	if err := c.onRequest(hr); err != nil {
+		if hr.Body != nil {
+			hr.Body.Close()
+		}
+
+		return nil, err
+	}
+
+	c.logRequestDetails(hr)
+
+	return &outgoing{
+		request:     r,
+		httpClient:  c.requestClient(r),
+		httpRequest: hr,
+		seq:         seq,
+		id:          id,
+		keepBody:    c.keepBody(r),
+	}, nil
+}
+
+// receive makes the request, and reads the response. When keepBody is true, the complete
+// response body is kept in memory.
+func (c *client) receive(hc *http.Client, hr *http.Request, keepBody bool) (response, error) {
+	var trace connTrace
+	rsp, err := hc.Do(trace.withTrace(hr))
+	if errors.Is(err, ErrTooManyRedirects) {
+		err = ErrTooManyRedirects
 	}
 
-	rsp, err := c.httpClient.Do(hr)
 	if err != nil {
-		c.options.Log.Warnln("error while making request:", err)
-		return err
+		var res response
+		trace.apply(&res)
+		return res, err
 	}
 
 	defer rsp.Body.Close()
 
+	var (
+		w   []io.Writer
+		h   hash.Hash
+		buf *captureBuffer
+	)
+
+	if c.options.CompareBodies {
+		h = sha256.New()
+		w = append(w, h)
+	}
+
+	if keepBody || c.options.CaptureDir != "" {
+		buf = &captureBuffer{}
+		if !keepBody {
+			buf.limit = c.options.CaptureSizeLimit
+		}
+
+		w = append(w, buf)
+	}
+
+	body := ioutil.Discard
+	if len(w) > 0 {
+		body = io.MultiWriter(w...)
+	}
+
+	var src io.Reader = rsp.Body
+	if c.options.MaxResponseBytes > 0 {
+		src = io.LimitReader(rsp.Body, c.options.MaxResponseBytes)
+	}
+
+	counter := &countingReader{reader: src}
+	n, err := io.Copy(body, c.responseBody(rsp, counter))
+	res := response{
+		status:    rsp.StatusCode,
+		protocol:  rsp.Proto,
+		header:    rsp.Header,
+		redirects: redirects(rsp),
+		latency:   time.Since(trace.start),
+	}
+
+	trace.apply(&res)
+	res.size, res.uncompressedSize = counter.count, n
+	if c.options.MaxResponseBytes > 0 && counter.count >= c.options.MaxResponseBytes {
+		// decompressing the truncated body may fail:
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+
+		res.truncated = hasMore(rsp.Body)
+	}
+	if h != nil {
+		res.bodyHash = hex.EncodeToString(h.Sum(nil))
+	}
+
+	if buf != nil {
+		res.body = buf.data
+	}
+
 	if rsp.StatusCode >= http.StatusInternalServerError {
-		return ErrServerError
+		err = ErrServerError
 	}
 
-	_, err = ioutil.ReadAll(rsp.Body)
-	if err != nil {
+	return res, err
+}
+
+// hasMore tells whether the response body has unread data
+func hasMore(body io.Reader) bool {
+	var b [1]byte
+	n, _ := io.ReadFull(body, b[:])
+	return n > 0
+}
+
+func (c *client) exchange(o *outgoing) result {
+	if c.options.Shadow != "" {
+		return c.sendShadow(o)
+	}
+
+	rsp, err := c.receive(o.httpClient, o.httpRequest, o.keepBody)
+	c.checkToken(o.httpRequest, rsp.status)
+	res := c.result(rsp, err)
+	res.host = o.request.Host
+	res.assertionFailed = !c.assert(o, rsp)
+	res.sizeDeviated = !c.checkSize(o, rsp)
+	res.regression = c.regression(o, rsp)
+	res.loggedDuration = o.request.LoggedDuration
+	c.extract(o, rsp)
+	c.storeValidators(o.httpRequest, rsp)
+	c.storeCache(o.httpRequest, rsp)
+	c.capture(o, res, rsp, nil)
+	return res
+}
+
+// logResult logs a replayed request with the method, the URL, the status code and the
+// response time, on the warning level when warn is true, otherwise on the info level
+func (c *client) logResult(o *outgoing, r result, warn bool, message string) {
+	method, url := o.httpRequest.Method, o.httpRequest.URL.String()
+	log := c.options.Log
+	var args []interface{}
+	if fl, ok := log.(FieldLogger); ok {
+		fields := map[string]interface{}{
+			"method":  method,
+			"url":     url,
+			"status":  r.status,
+			"latency": r.latency,
+		}
+
+		if o.id != "" {
+			fields["requestId"] = o.id
+		}
+
+		log = fl.WithFields(fields)
+		args = []interface{}{message}
+	} else {
+		args = []interface{}{message + ":", method, url, r.status, r.latency}
+		if o.id != "" {
+			args = append(args, o.id)
+		}
+	}
+
+	if warn {
+		log.Warnln(args...)
+		return
+	}
+
+	log.Infoln(args...)
+}
+
+func (c *client) logRequest(o *outgoing, r result) {
+	if c.options.LogRequests {
+		c.logResult(o, r, false, "request replayed")
+	}
+}
+
+// logSlow logs the requests whose response time exceeded the SlowThreshold
+func (c *client) logSlow(o *outgoing, r result) {
+	if c.options.SlowThreshold > 0 && r.latency > c.options.SlowThreshold {
+		c.logResult(o, r, true, "slow request")
+	}
+}
+
+func (c *client) send(o *outgoing) result {
+	if o.cached {
+		c.options.Log.Debugln("served from the client cache:", o.httpRequest.Method, o.httpRequest.URL)
+		return result{cacheHit: true, host: o.request.Host}
+	}
+
+	c.emitRequest(RequestSent, o, result{})
+	start := time.Now()
+	res := c.exchange(o)
+	res.logEntry = c.resultEntry(o, start, res)
+	res.labels = c.labels(o.request)
+	c.logRequest(o, res)
+	c.logSlow(o, res)
+	c.emitResult(o, res)
+	return res
+}
+
+func (c *client) result(rsp response, err error) result {
+	res := result{
+		status:      rsp.status,
+		protocol:    rsp.protocol,
+		latency:     rsp.latency,
+		newConns:    rsp.newConns,
+		reusedConns: rsp.reusedConns,
+		timings:     rsp.timings,
+		redirects:   rsp.redirects,
+		err:         err,
+	}
+
+	res.size, res.uncompressedSize = rsp.size, rsp.uncompressedSize
+	res.truncated = rsp.truncated
+
+	switch {
+	case err == ErrServerError:
+	case err != nil && rsp.status == 0:
+		c.options.Log.Warnln("error while making request:", err)
+	case err != nil:
 		c.options.Log.Warnln("error while reading request body:", err)
-		return err
 	}
 
-	return nil
+	return res
+}
+
+func (c *client) do(r *Request) result {
+	o, err := c.prepare(r)
+	if err != nil {
+		c.shared.events.emit(Event{Type: RequestError, Request: r, Err: err})
+		return result{err: err, host: r.Host, labels: c.labels(r)}
+	}
+
+	return c.send(o)
 }
@@ -1,105 +1,1635 @@
 package main
 
 import (
-	"github.com/aryszka/logreplay"
-	"flag"
+	"crypto/tls"
 	"errors"
+	"flag"
+	"fmt"
+	"github.com/aryszka/logreplay"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var (
-	options logreplay.Options
-	redirectBehavior string
-	once bool
-	errInvalidRedirectBehavior = errors.New("invalid redirect behavior")
-)
+// the default length of the random field values in the form payloads, so that the
+// backends receive fields with a value
+const defaultPostFormFieldSize = 16
+
+type bodyFileFlags []logreplay.BodyFile
+
+type corpusFlags []logreplay.Corpus
+
+type resolveFlags map[string]string
+
+type headerFlags map[string]string
+
+type requestHeaderFlags http.Header
+
+type hostAuthFlags map[string]string
+
+type haltRuleFlags map[string]int
+
+type pathRuleFlags []logreplay.PathRule
+
+type extractionFlags []logreplay.Extraction
+
+type labelRuleFlags []logreplay.LabelRule
+
+var (
+	options                    logreplay.Options
+	redirectBehavior           string
+	redirectAllow              string
+	servers                    string
+	compareHeaders             string
+	benchmark                  string
+	captureMode                string
+	assertStatus               string
+	redactHeaders              string
+	redactBody                 string
+	oauth2Scopes               string
+	assertion                  logreplay.Assertion
+	benchmarkBatches           int
+	diffLog                    string
+	resultLog                  string
+	resultLogFormat            string
+	serverBalancing            string
+	addressFamily              string
+	tlsMinVersion              string
+	tlsMaxVersion              string
+	tlsCiphers                 string
+	postBodyFormat             string
+	payload                    string
+	payloadSample              string
+	fuzzWordlist               string
+	scriptFile                 string
+	fromTime                   string
+	toTime                     string
+	startAt                    string
+	methods                    string
+	excludeMethods             string
+	statuses                   string
+	excludeStatuses            string
+	requestIDFormat            string
+	once                       bool
+	verbose                    bool
+	quiet                      bool
+	showDashboard              bool
+	rpsInterval                time.Duration
+	rampDown                   time.Duration
+	controlAddr                string
+	controlToken               string
+	configFile                 string
+	statsFile                  string
+	fileConfig                 config
+	failOnErrorRate            float64
+	failOnP99                  time.Duration
+	errInvalidRedirectBehavior = errors.New("invalid redirect behavior")
+	errInvalidServerBalancing  = errors.New("invalid server balancing")
+	errInvalidAddressFamily    = errors.New("invalid address family")
+	errInvalidTLSVersion       = errors.New("invalid TLS version, expected: 1.0, 1.1, 1.2 or 1.3")
+	errInvalidCipherSuite      = errors.New("invalid cipher suite")
+	errInvalidCaptureMode      = errors.New("invalid capture mode")
+	errInvalidResultLogFormat  = errors.New("invalid result log format")
+	errInvalidPayload          = errors.New("invalid payload")
+	errInvalidRequestIDFormat  = errors.New("invalid request ID format")
+	errInvalidBodyFormat       = errors.New("invalid body format")
+	errInvalidBodyFile         = errors.New("invalid body file, expected: pattern=file")
+	errInvalidResolve          = errors.New("invalid resolve, expected: host=address")
+	errInvalidHeader           = errors.New("invalid header, expected: name=value")
+	errInvalidRequestHeader    = errors.New("invalid header, expected: Name: value")
+	errInvalidHostAuth         = errors.New("invalid host basic auth, expected: host=user:password")
+	errInvalidHaltRule         = errors.New("invalid halt rule, expected: status=threshold")
+	errInvalidPathRule         = errors.New("invalid path rule, expected: pattern -> replacement")
+	errInvalidTime             = errors.New("invalid time, expected e.g.: 2006-01-02 15:04")
+	errInvalidLabelRule        = errors.New("invalid label rule, expected: pattern=name:value")
+	errInvalidExtraction       = errors.New("invalid extraction, expected: name=json|regexp|header:expression")
+	errVerboseAndQuiet         = errors.New("verbose and quiet cannot be set at the same time")
+)
+
+// the TLS versions accepted by the flags
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	if v == "" {
+		return 0, nil
+	}
+
+	tv, ok := tlsVersions[v]
+	if !ok {
+		return 0, errInvalidTLSVersion
+	}
+
+	return tv, nil
+}
+
+// parseCipherSuites parses a comma separated list of cipher suite names, as defined in
+// the crypto/tls package, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+func parseCipherSuites(v string) ([]uint16, error) {
+	ids := make(map[string]uint16)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ids[cs.Name] = cs.ID
+	}
+
+	var suites []uint16
+	for _, name := range strings.Split(v, ",") {
+		id, ok := ids[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errInvalidCipherSuite, name)
+		}
+
+		suites = append(suites, id)
+	}
+
+	return suites, nil
+}
+
+// splits pattern=value flags at the last equal sign
+func splitPatternFlag(v string) (string, string, bool) {
+	i := strings.LastIndex(v, "=")
+	if i < 0 || i == len(v)-1 {
+		return "", "", false
+	}
+
+	return v[:i], v[i+1:], true
+}
+
+func (bf *bodyFileFlags) String() string {
+	var s []string
+	for _, bfi := range *bf {
+		s = append(s, bfi.PathPattern+"="+bfi.File)
+	}
+
+	return strings.Join(s, ", ")
+}
+
+func (bf *bodyFileFlags) Set(v string) error {
+	pattern, file, ok := splitPatternFlag(v)
+	if !ok || pattern == "" {
+		return errInvalidBodyFile
+	}
+
+	*bf = append(*bf, logreplay.BodyFile{PathPattern: pattern, File: file})
+	return nil
+}
+
+func (c *corpusFlags) String() string {
+	var s []string
+	for _, ci := range *c {
+		s = append(s, ci.PathPattern+"="+ci.Path)
+	}
+
+	return strings.Join(s, ", ")
+}
+
+func (c *corpusFlags) Set(v string) error {
+	pattern, path, ok := splitPatternFlag(v)
+	if !ok {
+		pattern, path = "", v
+	}
+
+	*c = append(*c, logreplay.Corpus{PathPattern: pattern, Path: path})
+	return nil
+}
+
+func (r *resolveFlags) String() string {
+	if r == nil {
+		return ""
+	}
+
+	var s []string
+	for host, address := range *r {
+		s = append(s, host+"="+address)
+	}
+
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
+
+func (r *resolveFlags) Set(v string) error {
+	host, address, ok := splitPatternFlag(v)
+	if !ok || host == "" {
+		return errInvalidResolve
+	}
+
+	if *r == nil {
+		*r = make(resolveFlags)
+	}
+
+	(*r)[host] = address
+	return nil
+}
+
+func (pr *pathRuleFlags) String() string {
+	var s []string
+	for _, r := range *pr {
+		s = append(s, r.Pattern+" -> "+r.Replacement)
+	}
+
+	return strings.Join(s, ", ")
+}
+
+func (pr *pathRuleFlags) Set(v string) error {
+	i := strings.Index(v, "->")
+	if i < 0 {
+		return errInvalidPathRule
+	}
+
+	pattern, replacement := strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+2:])
+	if pattern == "" {
+		return errInvalidPathRule
+	}
+
+	*pr = append(*pr, logreplay.PathRule{Pattern: pattern, Replacement: replacement})
+	return nil
+}
+
+func (l *labelRuleFlags) String() string {
+	var s []string
+	for _, r := range *l {
+		s = append(s, r.PathPattern+"="+r.Name+":"+r.Value)
+	}
+
+	return strings.Join(s, ", ")
+}
+
+func (l *labelRuleFlags) Set(v string) error {
+	pattern, label, ok := splitPatternFlag(v)
+	if !ok {
+		return errInvalidLabelRule
+	}
+
+	i := strings.Index(label, ":")
+	if i <= 0 {
+		return errInvalidLabelRule
+	}
+
+	*l = append(*l, logreplay.LabelRule{PathPattern: pattern, Name: label[:i], Value: label[i+1:]})
+	return nil
+}
+
+func (e *extractionFlags) String() string {
+	var s []string
+	for _, ei := range *e {
+		switch {
+		case ei.JSONPath != "":
+			s = append(s, ei.Name+"=json:"+ei.JSONPath)
+		case ei.Regexp != "":
+			s = append(s, ei.Name+"=regexp:"+ei.Regexp)
+		default:
+			s = append(s, ei.Name+"=header:"+ei.Header)
+		}
+	}
+
+	return strings.Join(s, ", ")
+}
+
+func (e *extractionFlags) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return errInvalidExtraction
+	}
+
+	ei := logreplay.Extraction{Name: v[:i]}
+	kind, expr := v[i+1:], ""
+	if j := strings.Index(kind, ":"); j >= 0 {
+		kind, expr = kind[:j], kind[j+1:]
+	}
+
+	if expr == "" {
+		return errInvalidExtraction
+	}
+
+	switch kind {
+	case "json":
+		ei.JSONPath = expr
+	case "regexp":
+		ei.Regexp = expr
+	case "header":
+		ei.Header = expr
+	default:
+		return errInvalidExtraction
+	}
+
+	*e = append(*e, ei)
+	return nil
+}
+
+func (h *headerFlags) String() string {
+	if h == nil {
+		return ""
+	}
+
+	var s []string
+	for name, value := range *h {
+		s = append(s, name+"="+value)
+	}
+
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
+
+func (h *headerFlags) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return errInvalidHeader
+	}
+
+	if *h == nil {
+		*h = make(headerFlags)
+	}
+
+	(*h)[v[:i]] = v[i+1:]
+	return nil
+}
+
+func (h *requestHeaderFlags) String() string {
+	if h == nil {
+		return ""
+	}
+
+	var s []string
+	for name, values := range *h {
+		for _, v := range values {
+			s = append(s, name+": "+v)
+		}
+	}
+
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
+
+func (h *requestHeaderFlags) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i <= 0 {
+		return errInvalidRequestHeader
+	}
+
+	if *h == nil {
+		*h = make(requestHeaderFlags)
+	}
+
+	http.Header(*h).Add(strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:]))
+	return nil
+}
+
+func (a *hostAuthFlags) String() string {
+	if a == nil {
+		return ""
+	}
+
+	var s []string
+	for host := range *a {
+		s = append(s, host+"=***")
+	}
+
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
+
+func (a *hostAuthFlags) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return errInvalidHostAuth
+	}
+
+	if *a == nil {
+		*a = make(hostAuthFlags)
+	}
+
+	(*a)[v[:i]] = v[i+1:]
+	return nil
+}
+
+func (h *haltRuleFlags) String() string {
+	if h == nil {
+		return ""
+	}
+
+	var s []string
+	for status, threshold := range *h {
+		s = append(s, status+"="+strconv.Itoa(threshold))
+	}
+
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
+
+func (h *haltRuleFlags) Set(v string) error {
+	status, threshold, ok := splitPatternFlag(v)
+	if !ok || status == "" {
+		return errInvalidHaltRule
+	}
+
+	t, err := strconv.Atoi(threshold)
+	if err != nil {
+		return errInvalidHaltRule
+	}
+
+	if *h == nil {
+		*h = make(haltRuleFlags)
+	}
+
+	(*h)[status] = t
+	return nil
+}
+
+// the accepted formats of the time range flags, in the local time zone, unless the
+// zone is specified
+var timeFlagFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func parseTimeFlag(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	for _, f := range timeFlagFormats {
+		if t, err := time.ParseInLocation(f, v, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%w: %s", errInvalidTime, v)
+}
+
+// registerReplayFlags defines the flags of the play and once commands
+func registerReplayFlags(fs *flag.FlagSet) {
+	fs.StringVar(
+		&options.AccessLogFormat,
+		"log-format",
+		"",
+		"a regexp for parsing the log entries, when not set, the Apache2 Combined log format with Skipper extensions (Duration and Host) is expected",
+	)
+
+	fs.StringVar(
+		&options.AccessLogTimeFormat,
+		"log-time-format",
+		"",
+		"the layout of the time in the log entries, as in the Go time package, defaults to the Apache format, 02/Jan/2006:15:04:05 -0700",
+	)
+
+	fs.StringVar(
+		&fromTime,
+		"from",
+		"",
+		"replay only the log entries from this time, e.g. '2006-01-02 14:00' in the local time zone, or in RFC3339",
+	)
+
+	fs.StringVar(
+		&toTime,
+		"to",
+		"",
+		"replay only the log entries before this time, e.g. '2006-01-02 14:15' in the local time zone, or in RFC3339",
+	)
+
+	fs.StringVar(
+		&methods,
+		"methods",
+		"",
+		"comma separated list of the HTTP methods of the log entries to replay, e.g. GET,HEAD",
+	)
+
+	fs.StringVar(
+		&excludeMethods,
+		"exclude-methods",
+		"",
+		"comma separated list of the HTTP methods of the log entries not to replay, e.g. DELETE",
+	)
+
+	fs.StringVar(
+		&statuses,
+		"statuses",
+		"",
+		"comma separated list of the logged status codes or classes of the log entries to replay, e.g. 500,503 or 5xx",
+	)
+
+	fs.StringVar(
+		&excludeStatuses,
+		"exclude-statuses",
+		"",
+		"comma separated list of the logged status codes or classes of the log entries not to replay, e.g. 4xx",
+	)
+
+	fs.BoolVar(
+		&options.Deduplicate,
+		"dedup",
+		false,
+		"replay only the first one of the log entries with the same method, host, path and query",
+	)
+
+	fs.BoolVar(
+		&options.DeduplicateWeights,
+		"dedup-weights",
+		false,
+		"count the duplicates of the log entries as their weight, when deduplicating, to be used with -weighted",
+	)
+
+	fs.StringVar(
+		&options.Server,
+		"server",
+		"",
+		"the HTTP network address to send the requests to. If not specified, it is taken from the request definitions, or defaults to localhost",
+	)
+
+	fs.StringVar(
+		&servers,
+		"servers",
+		"",
+		"comma separated list of network addresses to distribute the requests between, overrides -server",
+	)
+
+	fs.StringVar(
+		&serverBalancing,
+		"server-balancing",
+		"roundrobin",
+		"distribution of the requests between the servers (roundrobin, random)",
+	)
+
+	fs.StringVar(
+		&options.Shadow,
+		"shadow",
+		"",
+		"network address of a shadow server, every request is sent to both servers and the responses are compared",
+	)
+
+	fs.StringVar(
+		&compareHeaders,
+		"compare-headers",
+		"",
+		"comma separated list of the response headers to compare in shadow mode",
+	)
+
+	fs.BoolVar(
+		&options.CompareBodies,
+		"compare-bodies",
+		false,
+		"compare the response bodies in shadow mode",
+	)
+
+	fs.StringVar(
+		&diffLog,
+		"diff-log",
+		"",
+		"file to write the differences found in shadow mode to, in JSON lines",
+	)
+
+	fs.StringVar(
+		&resultLog,
+		"result-log",
+		"",
+		"file to write a log line to for every replayed request, with the status, size and duration of the replayed response",
+	)
+
+	fs.StringVar(
+		&resultLogFormat,
+		"result-log-format",
+		"combined",
+		"the format of the result log (combined, json). The combined format can be replayed again",
+	)
+
+	fs.StringVar(
+		&options.CaptureDir,
+		"capture-dir",
+		"",
+		"directory to save the response bodies in, named after the sequence number of the requests",
+	)
+
+	fs.StringVar(
+		&captureMode,
+		"capture",
+		"all",
+		"which response bodies to save when -capture-dir is set (all, errors, differences)",
+	)
+
+	fs.Int64Var(
+		&options.CaptureSizeLimit,
+		"capture-size-limit",
+		0,
+		"maximum number of bytes saved from each response body, 0 means no limit",
+	)
+
+	fs.Int64Var(
+		&options.MaxMemory,
+		"max-memory",
+		0,
+		"the approximate memory in bytes used to keep the log entries, above which they are spilled to a temporary file, 0 means no limit",
+	)
+
+	fs.Int64Var(
+		&options.MaxResponseBytes,
+		"max-response-bytes",
+		0,
+		"read at most this many bytes of the response bodies, 0 means no limit",
+	)
+
+	fs.StringVar(
+		&benchmark,
+		"benchmark",
+		"",
+		"network address of a second server, when set, the requests are replayed once against -server and once against this one, and the results are compared",
+	)
+
+	fs.IntVar(
+		&benchmarkBatches,
+		"benchmark-batches",
+		1,
+		"the number of batches to replay the requests in alternately against the benchmarked servers",
+	)
+
+	fs.StringVar(
+		&options.DefaultScheme,
+		"default-scheme",
+		"http",
+		"http scheme to be used when otherwise not inferrable from the server option or the log entry",
+	)
+
+	fs.Var(
+		(*requestHeaderFlags)(&options.Headers),
+		"header",
+		"a header set on every request, in the form of 'Name: value', where the value can be a template, e.g. 'X-Correlation-Id: {{uuid}}', can be repeated",
+	)
+
+	fs.BoolVar(
+		&options.ExpandEnv,
+		"expand-env",
+		false,
+		"replace the ${NAME} references with environment variables in the server addresses, headers, credentials, resolve rules and body templates",
+	)
+
+	fs.StringVar(
+		&options.BasicAuth,
+		"basic-auth",
+		"",
+		"basic authentication credentials sent with every request, in the form of user:password",
+	)
+
+	fs.Var(
+		(*hostAuthFlags)(&options.HostBasicAuth),
+		"host-basic-auth",
+		"basic authentication credentials for the requests to a host, in the form of host[:port]=user:password, can be repeated",
+	)
+
+	fs.StringVar(
+		&options.OAuth2TokenURL,
+		"oauth2-token-url",
+		"",
+		"acquire bearer tokens with the OAuth2 client credentials flow from this endpoint, and refresh them when they expire",
+	)
+
+	fs.StringVar(
+		&options.OAuth2ClientID,
+		"oauth2-client-id",
+		"",
+		"client ID used to acquire the bearer tokens",
+	)
+
+	fs.StringVar(
+		&options.OAuth2ClientSecret,
+		"oauth2-client-secret",
+		"",
+		"client secret used to acquire the bearer tokens",
+	)
+
+	fs.StringVar(
+		&oauth2Scopes,
+		"oauth2-scopes",
+		"",
+		"comma separated list of the scopes requested for the bearer tokens",
+	)
+
+	fs.BoolVar(
+		&options.ForwardRemoteAddress,
+		"forward-remote-address",
+		false,
+		"send the address of the original client taken from the log entries in the header set by -remote-address-header",
+	)
+
+	fs.StringVar(
+		&options.RemoteAddressHeader,
+		"remote-address-header",
+		logreplay.DefaultRemoteAddressHeader,
+		"the header used to forward the address of the original client",
+	)
+
+	fs.StringVar(
+		&options.RequestIDHeader,
+		"request-id-header",
+		"",
+		"when set, a unique ID is sent with every request in this header, e.g. X-Request-Id",
+	)
+
+	fs.StringVar(
+		&requestIDFormat,
+		"request-id-format",
+		"uuid",
+		"format of the request IDs (uuid, sequence)",
+	)
+
+	fs.BoolVar(
+		&options.HTTP2,
+		"http2",
+		false,
+		"enable HTTP/2 for the requests made over TLS",
+	)
+
+	fs.BoolVar(
+		&options.H2C,
+		"h2c",
+		false,
+		"use cleartext HTTP/2 with prior knowledge for the requests not made over TLS",
+	)
+
+	fs.BoolVar(
+		&options.HTTP3,
+		"http3",
+		false,
+		"experimental: make the requests over HTTP/3 (QUIC), works only with TLS",
+	)
+
+	fs.StringVar(
+		&options.ProxyURL,
+		"proxy",
+		"",
+		"forward proxy to send the requests through",
+	)
+
+	fs.BoolVar(
+		&options.ProxyFromEnvironment,
+		"proxy-from-env",
+		false,
+		"use the proxy set in the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables",
+	)
+
+	fs.Var(
+		(*resolveFlags)(&options.Resolve),
+		"resolve",
+		"connect to a different address for a host, in the form of host[:port]=address[:port], can be repeated",
+	)
+
+	fs.BoolVar(
+		&options.DisableKeepAlives,
+		"disable-keepalive",
+		false,
+		"open a new connection for every request",
+	)
+
+	fs.BoolVar(
+		&options.PreserveHTTP10,
+		"preserve-http10",
+		false,
+		"close the connection after the requests logged with HTTP/1.0, like the legacy clients without keep-alive",
+	)
+
+	fs.DurationVar(
+		&options.DialTimeout,
+		"dial-timeout",
+		0,
+		"timeout of establishing a connection, 0 means no timeout",
+	)
+
+	fs.StringVar(
+		&addressFamily,
+		"address-family",
+		"dual",
+		"the IP versions used to connect to the servers (dual, ipv4, ipv6)",
+	)
+
+	fs.DurationVar(
+		&options.TLSHandshakeTimeout,
+		"tls-handshake-timeout",
+		0,
+		"timeout of the TLS handshake, 0 means no timeout",
+	)
+
+	fs.Int64Var(
+		&options.ExpectContinueThreshold,
+		"expect-continue-threshold",
+		0,
+		"send Expect: 100-continue with the request bodies of at least this many bytes, and with the chunked bodies, 0 means never",
+	)
+
+	fs.DurationVar(
+		&options.ExpectContinueTimeout,
+		"expect-continue-timeout",
+		logreplay.DefaultExpectContinueTimeout,
+		"how long to wait for the 100 Continue response before sending the body anyway",
+	)
+
+	fs.DurationVar(
+		&options.ResponseHeaderTimeout,
+		"response-header-timeout",
+		0,
+		"timeout of waiting for the response headers, 0 means no timeout",
+	)
+
+	fs.DurationVar(
+		&options.RequestTimeout,
+		"request-timeout",
+		0,
+		"overall timeout of a request, including reading the response body, 0 means no timeout",
+	)
+
+	fs.StringVar(
+		&options.ClientCertFile,
+		"client-cert",
+		"",
+		"PEM encoded client certificate file for mutual TLS, requires -client-key",
+	)
+
+	fs.StringVar(
+		&options.ClientKeyFile,
+		"client-key",
+		"",
+		"PEM encoded client key file for mutual TLS, requires -client-cert",
+	)
+
+	fs.StringVar(
+		&options.ServerName,
+		"server-name",
+		"",
+		"TLS server name (SNI) used instead of the host of the request URL",
+	)
+
+	fs.StringVar(
+		&options.CAFile,
+		"ca-file",
+		"",
+		"PEM encoded CA certificates to verify the server certificates with",
+	)
+
+	fs.BoolVar(
+		&options.InsecureSkipVerify,
+		"insecure",
+		false,
+		"don't verify the server certificates",
+	)
+
+	fs.StringVar(
+		&tlsMinVersion,
+		"tls-min-version",
+		"",
+		"the minimum TLS version offered in the handshake (1.0, 1.1, 1.2, 1.3)",
+	)
+
+	fs.StringVar(
+		&tlsMaxVersion,
+		"tls-max-version",
+		"",
+		"the maximum TLS version offered in the handshake (1.0, 1.1, 1.2, 1.3)",
+	)
+
+	fs.StringVar(
+		&tlsCiphers,
+		"tls-ciphers",
+		"",
+		"comma separated list of the cipher suites offered in the handshake up to TLS 1.2, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	)
+
+	fs.IntVar(
+		&options.ConcurrentSessions,
+		"concurrent-sessions",
+		1,
+		"number of concurrent sessions to run",
+	)
+
+	fs.StringVar(
+		&redirectBehavior,
+		"redirect-behavior",
+		"nofollow",
+		"behavior applied when a redirect response was received from the server (nofollow, samehost, follow, allowed)",
+	)
+
+	fs.StringVar(
+		&redirectAllow,
+		"redirect-allow",
+		"",
+		"comma separated list of the domains to follow the redirects to, when the redirect behavior is allowed",
+	)
+
+	fs.IntVar(
+		&options.MaxRedirects,
+		"max-redirects",
+		logreplay.DefaultMaxRedirects,
+		"the maximum number of redirects followed for a single request",
+	)
+
+	fs.IntVar(
+		&options.PostContentLength,
+		"post-content-length",
+		0,
+		"content length to be sent with P* requests",
+	)
+
+	fs.Float64Var(
+		&options.PostContentLengthDeviation,
+		"post-content-length-deviation",
+		0,
+		"variance in content length to be sent with P* requests",
+	)
+
+	fs.BoolVar(
+		&options.PostSetContentLength,
+		"post-set-content-length",
+		false,
+		"indicates whether the HTTP Content-Length header should be set",
+	)
+
+	fs.StringVar(
+		&postBodyFormat,
+		"post-body-format",
+		"text",
+		"format of the random payload sent with P* requests (text, form, multipart)",
+	)
+
+	fs.IntVar(
+		&options.PostFormFields,
+		"post-form-fields",
+		1,
+		"number of fields in the form payload sent with P* requests",
+	)
+
+	fs.IntVar(
+		&options.PostFormFieldSize,
+		"post-form-field-size",
+		defaultPostFormFieldSize,
+		"length of the random field values in the form payload sent with P* requests",
+	)
+
+	fs.StringVar(
+		&options.PostBodyTemplate,
+		"post-body-template",
+		"",
+		"a text/template used to generate the payload of P* requests, e.g. {\"id\": \"{{uuid}}\", \"n\": {{rand 1 100}}}",
+	)
+
+	fs.BoolVar(
+		&options.PostChunked,
+		"post-chunked",
+		false,
+		"send the payload of P* requests with chunked transfer encoding",
+	)
+
+	fs.IntVar(
+		&options.ChunkSize,
+		"chunk-size",
+		0,
+		"maximum size of the chunks when sending payload with chunked transfer encoding",
+	)
+
+	fs.DurationVar(
+		&options.ChunkDelay,
+		"chunk-delay",
+		0,
+		"delay between the chunks when sending payload with chunked transfer encoding",
+	)
 
-func init() {
-	flag.StringVar(
-		&options.AccessLogFormat,
-		"log-format",
+	fs.StringVar(
+		&payload,
+		"payload",
+		"text",
+		"kind of the random request payloads (text, json, binary, sample)",
+	)
+
+	fs.StringVar(
+		&payloadSample,
+		"payload-sample",
 		"",
-		"a regexp for parsing the log entries, defaults to Apache2 Combined log format with Skipper extensions (Duration and Host)",
+		"a file whose bytes are used to generate the random payloads, when the payload is set to sample",
 	)
 
-	flag.StringVar(
-		&options.Server,
-		"server",
+	fs.Float64Var(
+		&options.QueryFuzzRate,
+		"fuzz-query",
+		0,
+		"the probability of replacing a query parameter value with a random string, a boundary number or a word from the fuzz wordlist, between 0 and 1",
+	)
+
+	fs.StringVar(
+		&fuzzWordlist,
+		"fuzz-wordlist",
 		"",
-		"the HTTP network address to send the requests to. If not specified, it is taken from the request definitions, or defaults to localhost",
+		"a file with the values used when fuzzing the query parameters, one per line",
 	)
 
-	flag.StringVar(
-		&options.DefaultScheme,
-		"default-scheme",
-		"http",
-		"http scheme to be used when otherwise not inferrable from the server option or the log entry",
+	fs.StringVar(
+		&options.AcceptEncoding,
+		"accept-encoding",
+		"",
+		"the Accept-Encoding header sent with every request, e.g. gzip, br. When set, the responses are counted with their compressed size",
 	)
 
-	flag.IntVar(
-		&options.ConcurrentSessions,
-		"concurrent-sessions",
-		1,
-		"number of concurrent sessions to run",
+	fs.BoolVar(
+		&options.DecompressResponses,
+		"decompress",
+		false,
+		"decompress the gzip and deflate encoded responses before the assertions, the extractions, the comparison and the capture, and report their uncompressed size",
 	)
 
-	flag.StringVar(
-		&redirectBehavior,
-		"redirect-behavior",
-		"nofollow",
-		"behavior applied when a redirect response was received from the server (nofollow, samehost, follow)",
+	fs.BoolVar(
+		&options.ClientCache,
+		"client-cache",
+		false,
+		"skip the requests whose earlier response in the same session is still fresh according to Cache-Control or Expires, like the cache of a browser",
 	)
 
-	flag.IntVar(
-		&options.PostContentLength,
-		"post-content-length",
+	fs.BoolVar(
+		&options.ConditionalRequests,
+		"conditional",
+		false,
+		"send If-None-Match and If-Modified-Since with the validators received earlier in the same session, when the same URL is requested again",
+	)
+
+	fs.StringVar(
+		&options.CacheBustParam,
+		"cache-bust",
+		"",
+		"the name of a query parameter appended to every request with a unique value, to bypass the caches in front of the target",
+	)
+
+	fs.Var(
+		(*pathRuleFlags)(&options.PathRules),
+		"path-rule",
+		"rewrites the request paths, in the form of 'pattern -> replacement', where the replacement can contain {rand:min..max} placeholders, e.g. '/users/\\d+ -> /users/{rand:1..100000}', can be repeated",
+	)
+
+	fs.StringVar(
+		&scriptFile,
+		"script",
+		"",
+		"a Lua script defining a request(r) function, that can modify the requests, and/or a response(r) function, that can reject the responses by returning false",
+	)
+
+	fs.Var(
+		(*labelRuleFlags)(&options.LabelRules),
+		"label",
+		"sets a label on the requests whose path matches, to group the statistics, in the form of pattern=name:value, e.g. ^/api/=route:api, can be repeated. Labels can be captured from the access log, too, with groups named label_name",
+	)
+
+	fs.Var(
+		(*extractionFlags)(&options.Extractions),
+		"extract",
+		"stores a value from the responses in a session variable, available in the templates as {{.Vars.name}}, in the form of name=json:path, name=regexp:expression or name=header:name, e.g. id=json:$.items[0].id, can be repeated",
+	)
+
+	fs.Var(
+		(*corpusFlags)(&options.Corpora),
+		"corpus",
+		"a directory or archive of sample payloads for P* requests, optionally for the matching paths only, in the form of [pattern=]path, can be repeated",
+	)
+
+	fs.BoolVar(
+		&options.CompressBody,
+		"compress-body",
+		false,
+		"compress the request payloads with gzip",
+	)
+
+	fs.Var(
+		(*bodyFileFlags)(&options.BodyFiles),
+		"body-file",
+		"a file to be sent as the payload of the requests with a matching path, in the form of pattern=file, can be repeated",
+	)
+
+	fs.DurationVar(
+		&options.ThinkTime,
+		"think-time",
 		0,
-		"content length to be sent with P* requests",
+		"time to wait before each request taken from the access log",
 	)
 
-	flag.Float64Var(
-		&options.PostContentLengthDeviation,
-		"post-content-length-deviation",
+	fs.Float64Var(
+		&options.ThinkTimeDeviation,
+		"think-time-deviation",
 		0,
-		"variance in content length to be sent with P* requests",
+		"variance in the time to wait before each request",
 	)
 
-	flag.BoolVar(
-		&options.PostSetContentLength,
-		"post-set-content-length",
-		false,
-		"indicates whether the HTTP Content-Length header should be set",
+	fs.DurationVar(
+		&options.Jitter,
+		"jitter",
+		0,
+		"maximum random wait time applied before each request",
 	)
 
-	flag.BoolVar(
+	fs.BoolVar(
 		&options.HaltOn500,
 		"halt-on-500",
 		false,
 		"inidicates whether the replay should halt on 5xx errors or only on client errors",
 	)
 
-	flag.IntVar(
+	fs.Var(
+		(*haltRuleFlags)(&options.HaltRules),
+		"halt-rule",
+		"halt after the given number of consecutive responses with a status code or class, in the form of status=threshold, e.g. 503=10 or 5xx=20, a threshold of 0 means that the status is not an error, can be repeated",
+	)
+
+	fs.IntVar(
 		&options.HaltThreshold,
 		"halt-threshold",
 		logreplay.DefaultHaltThreshold,
 		"the limit that continuous failures need to reach to make the player halt",
 	)
 
-	flag.Float64Var(
+	fs.StringVar(
+		&assertStatus,
+		"assert-status",
+		"",
+		"comma separated list of the accepted response status codes",
+	)
+
+	fs.Var(
+		(*headerFlags)(&assertion.Headers),
+		"assert-header",
+		"expected response header in the form of name=value, can be repeated",
+	)
+
+	fs.StringVar(
+		&assertion.Body,
+		"assert-body",
+		"",
+		"regular expression that the response bodies need to match",
+	)
+
+	fs.DurationVar(
+		&assertion.MaxLatency,
+		"assert-max-latency",
+		0,
+		"maximum accepted response time",
+	)
+
+	fs.IntVar(
+		&options.AssertionThreshold,
+		"assertion-threshold",
+		0,
+		"stop after this many responses failed to meet the assertions, 0 means never",
+	)
+
+	fs.Float64Var(
+		&options.SizeTolerance,
+		"size-tolerance",
+		0,
+		"the accepted deviation of the response sizes from the logged sizes, as a ratio, e.g. 0.1 for 10%, 0 means no comparison",
+	)
+
+	fs.IntVar(
+		&options.SizeDeviationThreshold,
+		"size-deviation-threshold",
+		0,
+		"stop after this many responses deviated from the logged size, 0 means never",
+	)
+
+	fs.Float64Var(
+		&options.LatencyRegressionFactor,
+		"latency-regression-factor",
+		0,
+		"report the endpoints whose response times exceeded the logged duration multiplied by this factor, 0 means no comparison",
+	)
+
+	fs.IntVar(
+		&options.CircuitBreakerThreshold,
+		"circuit-breaker-threshold",
+		0,
+		"skip the requests to a host after this many consecutive failures, 0 means never",
+	)
+
+	fs.DurationVar(
+		&options.CircuitBreakerTimeout,
+		"circuit-breaker-timeout",
+		logreplay.DefaultCircuitBreakerTimeout,
+		"how long to skip the requests to a failing host",
+	)
+
+	fs.IntVar(
+		&options.MaxConcurrencyPerHost,
+		"max-concurrency-per-host",
+		0,
+		"the maximum number of the requests in flight to the same host, the requests above it are deferred while the sessions continue with the other hosts, 0 means unlimited",
+	)
+
+	fs.DurationVar(
+		&options.LatencySLO,
+		"latency-slo",
+		0,
+		"stop when the percentile of the response times over the window exceeds this value, 0 means never",
+	)
+
+	fs.Float64Var(
+		&options.LatencySLOPercentile,
+		"latency-slo-percentile",
+		logreplay.DefaultLatencySLOPercentile,
+		"the percentile of the response times checked against -latency-slo, between 0 and 1",
+	)
+
+	fs.DurationVar(
+		&options.LatencySLOWindow,
+		"latency-slo-window",
+		logreplay.DefaultLatencySLOWindow,
+		"the duration over which the response times are checked against -latency-slo",
+	)
+
+	fs.Float64Var(
 		&options.Throttle,
 		"throttle",
 		0,
 		"maximum outgoing overall request per second rate",
 	)
 
-	flag.BoolVar(
+	fs.StringVar(
+		&startAt,
+		"start-at",
+		"",
+		"read the access log and resolve the host names immediately, but start sending the requests only at this time, e.g. '2006-01-02 14:00:30' in the local time zone, or in RFC3339",
+	)
+
+	fs.Float64Var(
+		&options.AdaptiveErrorRate,
+		"adaptive-error-rate",
+		0,
+		"halve the rate when the ratio of the failed requests and the 5xx responses exceeds this value, and ramp it back up when the target recovers, 0 means never",
+	)
+
+	fs.DurationVar(
+		&options.AdaptiveLatency,
+		"adaptive-latency",
+		0,
+		"halve the rate when the 95th percentile of the response times exceeds this value, and ramp it back up when the target recovers, 0 means never",
+	)
+
+	fs.DurationVar(
+		&options.AdaptiveInterval,
+		"adaptive-interval",
+		logreplay.DefaultAdaptiveInterval,
+		"the period of checking the health of the target for -adaptive-error-rate and -adaptive-latency",
+	)
+
+	fs.Float64Var(
+		&options.AdaptiveMinRate,
+		"adaptive-min-rate",
+		logreplay.DefaultAdaptiveMinRate,
+		"the request per second rate below which the adaptive throttling doesn't reduce the rate",
+	)
+
+	fs.BoolVar(
+		&options.Shuffle,
+		"shuffle",
+		false,
+		"replay the requests in a random order, different in every iteration",
+	)
+
+	fs.Int64Var(
+		&options.ShuffleSeed,
+		"shuffle-seed",
+		0,
+		"seed used for the random order of the requests, defaults to the random seed",
+	)
+
+	fs.Int64Var(
+		&options.RandomSeed,
+		"random-seed",
+		0,
+		"seed used for all the random decisions of the player, time based when not set",
+	)
+
+	fs.BoolVar(
+		&options.Weighted,
+		"weighted",
+		false,
+		"pick the requests randomly, according to their weight, instead of replaying them in order",
+	)
+
+	fs.BoolVar(
+		&options.PreserveSessions,
+		"preserve-sessions",
+		false,
+		"split the requests into user sessions by the client address, or as set by the -session-* flags, and replay every user session in a single session, in its original order",
+	)
+
+	fs.StringVar(
+		&options.SessionField,
+		"session-field",
+		"",
+		"a named group of the log format, whose value identifies the user sessions",
+	)
+
+	fs.StringVar(
+		&options.SessionCookie,
+		"session-cookie",
+		"",
+		"the name of the cookie that identifies the user sessions, taken from the cookie group of the log format, or from -session-field when set",
+	)
+
+	fs.StringVar(
+		&options.SessionPattern,
+		"session-pattern",
+		"",
+		"a regexp applied to the log entries, whose first submatch identifies the user sessions",
+	)
+
+	fs.BoolVar(
+		&options.OpenLoop,
+		"open-loop",
+		false,
+		"issue the requests at the throttle rate with random, exponentially distributed gaps, independent of the response times",
+	)
+
+	fs.IntVar(
+		&options.MaxOpenRequests,
+		"max-open-requests",
+		logreplay.DefaultMaxOpenRequests,
+		"the maximum number of the requests in flight per session in open loop mode. The requests over the limit are dropped",
+	)
+
+	fs.Float64Var(
+		&failOnErrorRate,
+		"fail-on-error-rate",
+		-1,
+		"exit with a non-zero code when the rate of the failed requests and 5xx responses exceeds this value, between 0 and 1, negative means disabled",
+	)
+
+	fs.DurationVar(
+		&failOnP99,
+		"fail-on-p99",
+		0,
+		"exit with a non-zero code when the 99th percentile of the response times exceeds this value, 0 means disabled. Not supported by the coordinate command",
+	)
+
+	fs.BoolVar(
 		&once,
 		"once",
 		false,
 		"tells the player to replay the input scenario only once and exit",
 	)
 
-	flag.Parse()
+	fs.BoolVar(
+		&verbose,
+		"verbose",
+		false,
+		"log debug messages and every replayed request with the method, URL, status code and response time, and with the headers and the body",
+	)
+
+	fs.BoolVar(
+		&quiet,
+		"quiet",
+		false,
+		"log only errors, and print the summary of the replay when it completes",
+	)
+
+	fs.BoolVar(
+		&options.LogRequests,
+		"log-requests",
+		false,
+		"log every replayed request with the method, URL, status code and response time",
+	)
+
+	fs.DurationVar(
+		&options.SlowThreshold,
+		"slow-threshold",
+		0,
+		"log the requests whose response time exceeded this duration immediately, 0 means never",
+	)
+
+	fs.StringVar(
+		&redactHeaders,
+		"redact-headers",
+		strings.Join(logreplay.DefaultRedactHeaders, ","),
+		"comma separated list of the request headers whose values are not logged in verbose mode",
+	)
+
+	fs.StringVar(
+		&redactBody,
+		"redact-body",
+		"",
+		"a regexp whose matches in the request bodies are not logged in verbose mode, e.g. password=[^&]*",
+	)
+
+	fs.BoolVar(
+		&showDashboard,
+		"dashboard",
+		false,
+		"show a live dashboard with the request rate, the in-flight requests, the status codes and the response times, refreshed every second",
+	)
+
+	fs.DurationVar(
+		&rpsInterval,
+		"rps-interval",
+		10*time.Second,
+		"print the request rate averaged over the last 1s, 10s and 60s at this interval, unless quiet or showing the dashboard, 0 means never",
+	)
+
+	fs.DurationVar(
+		&rampDown,
+		"ramp-down",
+		0,
+		"reduce the concurrency and the throttle gradually over this duration, before stopping at the end of the load profile or on SIGTERM and SIGINT, 0 means stopping immediately",
+	)
+
+	fs.StringVar(
+		&controlAddr,
+		"control-addr",
+		"",
+		"address of an HTTP API for controlling the replay remotely, with the endpoints: POST /pause, /resume, /stop, /throttle?rps=N, /concurrency?sessions=N, and GET /status. Without -control-token, it must be a loopback address, e.g. localhost:9191",
+	)
+
+	fs.StringVar(
+		&controlToken,
+		"control-token",
+		os.Getenv(controlTokenEnv),
+		"the bearer token required by the control API, defaults to the "+controlTokenEnv+" environment variable",
+	)
+
+	fs.StringVar(
+		&statsFile,
+		"stats-file",
+		"",
+		"file to save the final statistics to as JSON, that can be printed later with the report command",
+	)
+
+	fs.StringVar(
+		&configFile,
+		"config",
+		"",
+		"YAML file with the settings, where the keys are the names of the flags, and additionally, inputs can list multiple access log files, and stages can define a load profile with duration, throttle and concurrency. The flags set on the command line override the values in the file",
+	)
+}
+
+// parseReplayFlags parses the flags of the play and once commands, and applies them
+// to the options
+func parseReplayFlags(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+
+	if configFile != "" {
+		var err error
+		fileConfig, err = readConfig(fs, configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	switch {
+	case verbose && quiet:
+		fs.PrintDefaults()
+		log.Fatal(errVerboseAndQuiet)
+	case verbose:
+		logrus.SetLevel(logrus.DebugLevel)
+		options.LogRequests = true
+		options.LogRequestDetails = true
+	case quiet:
+		logrus.SetLevel(logrus.ErrorLevel)
+	}
+
+	if servers != "" {
+		options.Servers = strings.Split(servers, ",")
+	}
+
+	if methods != "" {
+		options.Methods = strings.Split(methods, ",")
+	}
+
+	if excludeMethods != "" {
+		options.ExcludeMethods = strings.Split(excludeMethods, ",")
+	}
+
+	if statuses != "" {
+		options.Statuses = strings.Split(statuses, ",")
+	}
+
+	if excludeStatuses != "" {
+		options.ExcludeStatuses = strings.Split(excludeStatuses, ",")
+	}
+
+	options.RedactHeaders = []string{}
+	if redactHeaders != "" {
+		options.RedactHeaders = strings.Split(redactHeaders, ",")
+	}
+
+	if redactBody != "" {
+		options.RedactBodyPatterns = []string{redactBody}
+	}
+
+	if oauth2Scopes != "" {
+		options.OAuth2Scopes = strings.Split(oauth2Scopes, ",")
+	}
+
+	if compareHeaders != "" {
+		options.CompareHeaders = strings.Split(compareHeaders, ",")
+	}
+
+	if diffLog != "" {
+		f, err := os.Create(diffLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		options.DiffLog = f
+	}
+
+	if resultLog != "" {
+		f, err := os.Create(resultLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		options.ResultLog = f
+	}
+
+	switch resultLogFormat {
+	case "combined":
+		options.ResultLogFormat = logreplay.CombinedResultLog
+	case "json":
+		options.ResultLogFormat = logreplay.JSONResultLog
+	default:
+		fs.PrintDefaults()
+		log.Fatal(errInvalidResultLogFormat)
+	}
+
+	if assertStatus != "" {
+		for _, si := range strings.Split(assertStatus, ",") {
+			status, err := strconv.Atoi(strings.TrimSpace(si))
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			assertion.Status = append(assertion.Status, status)
+		}
+	}
+
+	if len(assertion.Status) > 0 || len(assertion.Headers) > 0 || assertion.Body != "" || assertion.MaxLatency > 0 {
+		options.Assertions = []logreplay.Assertion{assertion}
+	}
+
+	switch captureMode {
+	case "all":
+		options.CaptureMode = logreplay.CaptureAll
+	case "errors":
+		options.CaptureMode = logreplay.CaptureErrors
+	case "differences":
+		options.CaptureMode = logreplay.CaptureDifferences
+	default:
+		fs.PrintDefaults()
+		log.Fatal(errInvalidCaptureMode)
+	}
+
+	switch serverBalancing {
+	case "roundrobin":
+		options.ServerBalancing = logreplay.RoundRobin
+	case "random":
+		options.ServerBalancing = logreplay.RandomServer
+	default:
+		fs.PrintDefaults()
+		log.Fatal(errInvalidServerBalancing)
+	}
+
+	for _, v := range []struct {
+		value string
+		to    *uint16
+	}{{tlsMinVersion, &options.MinTLSVersion}, {tlsMaxVersion, &options.MaxTLSVersion}} {
+		var err error
+		if *v.to, err = parseTLSVersion(v.value); err != nil {
+			fs.PrintDefaults()
+			log.Fatal(err)
+		}
+	}
+
+	if tlsCiphers != "" {
+		var err error
+		if options.CipherSuites, err = parseCipherSuites(tlsCiphers); err != nil {
+			fs.PrintDefaults()
+			log.Fatal(err)
+		}
+	}
+
+	switch addressFamily {
+	case "dual":
+		options.AddressFamily = logreplay.DualStack
+	case "ipv4":
+		options.AddressFamily = logreplay.IPv4Only
+	case "ipv6":
+		options.AddressFamily = logreplay.IPv6Only
+	default:
+		fs.PrintDefaults()
+		log.Fatal(errInvalidAddressFamily)
+	}
+
+	if redirectAllow != "" {
+		options.RedirectAllowedDomains = strings.Split(redirectAllow, ",")
+	}
 
 	switch redirectBehavior {
 	case "nofollow":
@@ -108,8 +1638,87 @@ func init() {
 		options.RedirectBehavior = logreplay.FollowSameHost
 	case "follow":
 		options.RedirectBehavior = logreplay.FollowRedirect
+	case "allowed":
+		options.RedirectBehavior = logreplay.FollowAllowedDomains
 	default:
-		flag.PrintDefaults()
+		fs.PrintDefaults()
 		log.Fatal(errInvalidRedirectBehavior)
 	}
+
+	switch requestIDFormat {
+	case "uuid":
+		options.RequestIDFormat = logreplay.UUIDRequestID
+	case "sequence":
+		options.RequestIDFormat = logreplay.SequenceRequestID
+	default:
+		fs.PrintDefaults()
+		log.Fatal(errInvalidRequestIDFormat)
+	}
+
+	switch payload {
+	case "text":
+		options.Payload = logreplay.TextPayload
+	case "json":
+		options.Payload = logreplay.JSONPayload
+	case "binary":
+		options.Payload = logreplay.BinaryPayload
+	case "sample":
+		options.Payload = logreplay.SamplePayload
+	default:
+		fs.PrintDefaults()
+		log.Fatal(errInvalidPayload)
+	}
+
+	if payloadSample != "" {
+		var err error
+		options.PayloadSample, err = ioutil.ReadFile(payloadSample)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, t := range []struct {
+		value string
+		to    *time.Time
+	}{{fromTime, &options.From}, {toTime, &options.To}, {startAt, &options.StartAt}} {
+		var err error
+		if *t.to, err = parseTimeFlag(t.value); err != nil {
+			fs.PrintDefaults()
+			log.Fatal(err)
+		}
+	}
+
+	if scriptFile != "" {
+		s, err := loadScript(scriptFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s.apply(&options)
+	}
+
+	if fuzzWordlist != "" {
+		b, err := ioutil.ReadFile(fuzzWordlist)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, w := range strings.Split(string(b), "\n") {
+			if w = strings.TrimRight(w, "\r"); w != "" {
+				options.QueryFuzzWords = append(options.QueryFuzzWords, w)
+			}
+		}
+	}
+
+	switch postBodyFormat {
+	case "text":
+		options.PostBodyFormat = logreplay.TextBody
+	case "form":
+		options.PostBodyFormat = logreplay.FormBody
+	case "multipart":
+		options.PostBodyFormat = logreplay.MultipartBody
+	default:
+		fs.PrintDefaults()
+		log.Fatal(errInvalidBodyFormat)
+	}
 }
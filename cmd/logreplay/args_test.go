@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"github.com/aryszka/logreplay"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestPostFormFieldSize(t *testing.T) {
+	var (
+		mx     sync.Mutex
+		fields []string
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if b := params["boundary"]; b != "" {
+			part, err := multipart.NewReader(r.Body, b).NextPart()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			v, _ := ioutil.ReadAll(part)
+			fields = append(fields, string(v))
+			return
+		}
+
+		b, _ := ioutil.ReadAll(r.Body)
+		v, err := url.ParseQuery(string(b))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		fields = append(fields, v.Get("field1"))
+	}))
+
+	defer s.Close()
+
+	for _, format := range []string{"form", "multipart"} {
+		t.Run(format, func(t *testing.T) {
+			fields = nil
+			options = logreplay.Options{}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			registerReplayFlags(fs)
+			parseReplayFlags(fs, []string{"-server", s.URL, "-post-body-format", format, "-quiet"})
+			options.AccessLog = bytes.NewBufferString(`1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "POST /foo HTTP/1.1" 200 0`)
+			p, err := logreplay.New(options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := p.Once(); err != nil {
+				t.Fatal(err)
+			}
+
+			mx.Lock()
+			defer mx.Unlock()
+			if len(fields) != 1 || len(fields[0]) != defaultPostFormFieldSize {
+				t.Error("failed to send the form fields with values", fields)
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/aryszka/logreplay"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type command struct {
+	description string
+	run         func(args []string)
+}
+
+var commands = map[string]command{
+	"play":       {"replay the requests infinitely, this is the default", runPlay},
+	"once":       {"replay the requests once and exit", runOnce},
+	"parse":      {"parse an access log and print the requests as JSON lines", runParse},
+	"validate":   {"check the flags, the config file and the access log without making requests", runValidate},
+	"record":     {"record the received requests as an access log, optionally forwarding them to a server", runRecord},
+	"report":     {"print the summary of the statistics saved with -stats-file", runReport},
+	"worker":     {"receive replays from a coordinator, and report their statistics", runWorker},
+	"coordinate": {"distribute a replay between workers, and print the combined statistics", runCoordinate},
+	"schedule":   {"rerun the replay on a recurring schedule, and write a dated report of every run", runSchedule},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [command] [flags] [access log]\n\ncommands:\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s%s\n", name, commands[name].description)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nrun %s <command> -help for the flags of a command\n", os.Args[0])
+}
+
+// openInput returns stdin when no file is specified
+func openInput(args []string) (io.Reader, error) {
+	switch len(args) {
+	case 0:
+		return os.Stdin, nil
+	case 1:
+		return os.Open(args[0])
+	default:
+		return nil, errTooManyInput
+	}
+}
+
+func runPlay(args []string) {
+	fs := flag.NewFlagSet("play", flag.ExitOnError)
+	registerReplayFlags(fs)
+	parseReplayFlags(fs, args)
+	replay(fs.Args())
+}
+
+func runOnce(args []string) {
+	fs := flag.NewFlagSet("once", flag.ExitOnError)
+	registerReplayFlags(fs)
+	parseReplayFlags(fs, args)
+	once = true
+	replay(fs.Args())
+}
+
+func runParse(args []string) {
+	fs := flag.NewFlagSet("parse", flag.ExitOnError)
+	fs.StringVar(
+		&options.AccessLogFormat,
+		"log-format",
+		"",
+		"a regexp for parsing the log entries, when not set, the Apache2 Combined log format with Skipper extensions (Duration and Host) is expected",
+	)
+
+	fs.Parse(args)
+	in, err := openInput(fs.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	options.AccessLog = in
+	requests, err := logreplay.ReadRequests(options)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, r := range requests {
+		if err := enc.Encode(struct {
+			Method         string            `json:"method,omitempty"`
+			Scheme         string            `json:"scheme,omitempty"`
+			Host           string            `json:"host,omitempty"`
+			Path           string            `json:"path,omitempty"`
+			Protocol       string            `json:"protocol,omitempty"`
+			UserAgent      string            `json:"userAgent,omitempty"`
+			RemoteAddress  string            `json:"remoteAddress,omitempty"`
+			Session        string            `json:"session,omitempty"`
+			LoggedStatus   int               `json:"loggedStatus,omitempty"`
+			LoggedSize     int64             `json:"loggedSize,omitempty"`
+			LoggedDuration time.Duration     `json:"loggedDuration,omitempty"`
+			Fields         map[string]string `json:"fields,omitempty"`
+			Labels         map[string]string `json:"labels,omitempty"`
+		}{
+			r.Method,
+			r.Scheme,
+			r.Host,
+			r.Path,
+			r.Protocol,
+			r.UserAgent,
+			r.RemoteAddress,
+			r.Session,
+			r.LoggedStatus,
+			r.LoggedSize,
+			r.LoggedDuration,
+			r.Fields,
+			r.Labels,
+		}); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func runValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	registerReplayFlags(fs)
+	parseReplayFlags(fs, args)
+
+	in, err := input(fs.Args())
+	if err != nil && err != errNoInput {
+		log.Fatal(err)
+	}
+
+	options.AccessLog = in
+	requests, err := logreplay.ReadRequests(options)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var unparsed int
+	for _, r := range requests {
+		if r.Method == "" && r.Path == "" {
+			unparsed++
+		}
+	}
+
+	// the parsed requests are not replayed, so only the remaining options are checked:
+	options.AccessLog = nil
+	if _, err := logreplay.New(options); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("requests: %d, unparsed: %d\n", len(requests), unparsed)
+	if unparsed > 0 {
+		os.Exit(1)
+	}
+}
+
+// recorder writes the received requests to an access log in the default format
+type recorder struct {
+	mx    sync.Mutex
+	out   io.Writer
+	proxy http.Handler
+}
+
+// responseRecorder tracks the status and the size of the forwarded responses
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+
+	n, err := rr.ResponseWriter.Write(b)
+	rr.size += n
+	return n, err
+}
+
+// only IPv4 addresses are accepted by the default format
+func remoteAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "-"
+	}
+
+	if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+		return "-"
+	}
+
+	return host
+}
+
+func quoted(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+func (rec *recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rr := &responseRecorder{ResponseWriter: w}
+	if rec.proxy != nil {
+		rec.proxy.ServeHTTP(rr, r)
+	}
+
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+
+	rec.mx.Lock()
+	defer rec.mx.Unlock()
+	if _, err := fmt.Fprintf(
+		rec.out,
+		"%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\" %d %s\n",
+		remoteAddress(r),
+		start.Format(logreplay.DefaultTimeFormat),
+		r.Method,
+		r.URL.RequestURI(),
+		r.Proto,
+		rr.status,
+		rr.size,
+		quoted(r.Referer()),
+		quoted(r.UserAgent()),
+		time.Since(start)/time.Millisecond,
+		r.Host,
+	); err != nil {
+		log.Println(err)
+	}
+}
+
+func runRecord(args []string) {
+	var (
+		listen  string
+		server  string
+		outFile string
+	)
+
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	fs.StringVar(
+		&listen,
+		"listen",
+		":8080",
+		"the address to receive the recorded requests on",
+	)
+
+	fs.StringVar(
+		&server,
+		"server",
+		"",
+		"when set, the recorded requests are forwarded to this server, otherwise they are answered with 200 OK",
+	)
+
+	fs.StringVar(
+		&outFile,
+		"out",
+		"",
+		"the access log file to write, defaults to stdout",
+	)
+
+	fs.Parse(args)
+
+	rec := &recorder{out: os.Stdout}
+	if outFile != "" {
+		f, err := os.Create(outFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer f.Close()
+		rec.out = f
+	}
+
+	if server != "" {
+		u, err := url.Parse(server)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		rec.proxy = httputil.NewSingleHostReverseProxy(u)
+	}
+
+	log.Fatal(http.ListenAndServe(listen, rec))
+}
+
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	fs.Parse(args)
+	in, err := openInput(fs.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var s logreplay.Stats
+	if err := json.NewDecoder(in).Decode(&s); err != nil {
+		log.Fatal(err)
+	}
+
+	printSummary(s)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aryszka/logreplay"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// stage is a step of the load profile
+type stage struct {
+	Duration    time.Duration `yaml:"duration"`
+	Throttle    float64       `yaml:"throttle"`
+	Concurrency int           `yaml:"concurrency"`
+}
+
+// config contains the settings that cannot be expressed with flags
+type config struct {
+	Inputs []string `yaml:"inputs"`
+	Stages []stage  `yaml:"stages"`
+}
+
+var (
+	errUnknownConfigKey   = errors.New("unknown config key")
+	errInvalidConfigValue = errors.New("invalid config value")
+)
+
+// applies a list value from the config file. The repeatable flags are set once for
+// every item, while the standard flags, that implement flag.Getter, receive a comma
+// separated list.
+func setConfigList(f *flag.Flag, l []interface{}) error {
+	var s []string
+	for _, li := range l {
+		s = append(s, fmt.Sprint(li))
+	}
+
+	if _, ok := f.Value.(flag.Getter); ok {
+		return f.Value.Set(strings.Join(s, ","))
+	}
+
+	for _, si := range s {
+		if err := f.Value.Set(si); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applies a map value from the config file, e.g. headers, as name=value items
+func setConfigMap(f *flag.Flag, m map[string]interface{}) error {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := f.Value.Set(fmt.Sprintf("%s=%v", k, m[k])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setConfigValue(f *flag.Flag, v interface{}) error {
+	switch vt := v.(type) {
+	case []interface{}:
+		return setConfigList(f, vt)
+	case map[string]interface{}:
+		return setConfigMap(f, vt)
+	default:
+		return f.Value.Set(fmt.Sprint(vt))
+	}
+}
+
+// readConfig reads a YAML config file. Its keys are the names of the flags, and
+// additionally:
+//
+//	inputs: a list of access log files, replayed one after the other
+//	stages: a list of load profile steps, with duration, throttle and concurrency
+//
+// The flags set on the command line override the values in the file.
+func readConfig(fs *flag.FlagSet, file string) (config, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return config{}, err
+	}
+
+	var c config
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return config{}, err
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return config{}, err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for key, v := range values {
+		if key == "inputs" || key == "stages" || set[key] {
+			continue
+		}
+
+		f := fs.Lookup(key)
+		if f == nil || key == "config" {
+			return config{}, fmt.Errorf("%w: %s", errUnknownConfigKey, key)
+		}
+
+		if err := setConfigValue(f, v); err != nil {
+			return config{}, fmt.Errorf("%w: %s: %v", errInvalidConfigValue, key, err)
+		}
+	}
+
+	return c, nil
+}
+
+// runStages applies the load profile, and stops the replay after the last stage, with
+// ramp-down when set
+func runStages(p *logreplay.Player, stages []stage) {
+	for _, s := range stages {
+		if s.Throttle > 0 {
+			p.SetThrottle(s.Throttle)
+		}
+
+		if s.Concurrency > 0 {
+			p.SetConcurrency(s.Concurrency)
+		}
+
+		log.Println("stage:", s.Duration, "throttle:", p.Throttle(), "concurrency:", p.Concurrency())
+		time.Sleep(s.Duration)
+	}
+
+	log.Println("load profile completed")
+	rampDownReplay(p)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/aryszka/logreplay"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// the environment variable used as the default of the control API token
+const controlTokenEnv = "LOGREPLAY_CONTROL_TOKEN"
+
+var errNoControlToken = errors.New(
+	"the control API requires a token, set it with -control-token or " + controlTokenEnv +
+		", or listen on a loopback address",
+)
+
+// controller serves the HTTP API for controlling a running replay. The pause state is
+// taken from the player, because the replay can be paused also by a signal or from the
+// terminal.
+type controller struct {
+	player *logreplay.Player
+}
+
+type controlStatus struct {
+	Paused      bool            `json:"paused"`
+	Throttle    float64         `json:"throttle"`
+	Concurrency int             `json:"concurrency"`
+	Stats       logreplay.Stats `json:"stats"`
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	return true
+}
+
+func (c *controller) pause(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+
+	// with drain, the response is sent only when the requests in flight have completed:
+	if r.URL.Query().Get("drain") == "true" {
+		c.player.PauseAndDrain()
+		return
+	}
+
+	c.player.Pause()
+}
+
+func (c *controller) resume(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+
+	if !c.player.Paused() {
+		return
+	}
+
+	// the outcome of the replay is handled by the initial call to play:
+	go playFunc(c.player)()
+}
+
+func (c *controller) stop(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+
+	c.player.Stop()
+}
+
+func (c *controller) setThrottle(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+
+	rps, err := strconv.ParseFloat(r.URL.Query().Get("rps"), 64)
+	if err != nil {
+		http.Error(w, "invalid rps", http.StatusBadRequest)
+		return
+	}
+
+	c.player.SetThrottle(rps)
+}
+
+func (c *controller) setConcurrency(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+
+	n, err := strconv.Atoi(r.URL.Query().Get("sessions"))
+	if err != nil || n < 1 {
+		http.Error(w, "invalid sessions", http.StatusBadRequest)
+		return
+	}
+
+	c.player.SetConcurrency(n)
+}
+
+func (c *controller) status(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(controlStatus{
+		Paused:      c.player.Paused(),
+		Throttle:    c.player.Throttle(),
+		Concurrency: c.player.Concurrency(),
+		Stats:       c.player.Stats(),
+	}); err != nil {
+		log.Println(err)
+	}
+}
+
+// requireToken checks the bearer token of the requests, when the token is set
+func requireToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validToken(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// loopbackAddr tells whether the address accepts only local connections
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveControl serves the control API:
+//
+//	POST /pause[?drain=true]
+//	POST /resume
+//	POST /stop
+//	POST /throttle?rps=<requests per second>
+//	POST /concurrency?sessions=<number of sessions>
+//	GET /status
+//
+// When the token is set, the requests need to send it as a bearer token. Without a
+// token, the API is served only on a loopback address.
+func serveControl(addr, token string, p *logreplay.Player) {
+	if token == "" && !loopbackAddr(addr) {
+		log.Fatal(errNoControlToken)
+	}
+
+	c := &controller{player: p}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pause", c.pause)
+	mux.HandleFunc("/resume", c.resume)
+	mux.HandleFunc("/stop", c.stop)
+	mux.HandleFunc("/throttle", c.setThrottle)
+	mux.HandleFunc("/concurrency", c.setConcurrency)
+	mux.HandleFunc("/status", c.status)
+	log.Fatal(http.ListenAndServe(addr, requireToken(token, mux)))
+}
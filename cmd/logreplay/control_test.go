@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoopbackAddr(t *testing.T) {
+	for addr, loopback := range map[string]bool{
+		"localhost:9191":  true,
+		"127.0.0.1:9191":  true,
+		"[::1]:9191":      true,
+		":9191":           false,
+		"0.0.0.0:9191":    false,
+		"example.org:443": false,
+		"localhost":       false,
+	} {
+		if loopbackAddr(addr) != loopback {
+			t.Errorf("%s: expected loopback: %t", addr, loopback)
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	h := requireToken("secret", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	for _, test := range []struct {
+		title  string
+		token  string
+		status int
+	}{{
+		title:  "no token",
+		status: http.StatusUnauthorized,
+	}, {
+		title:  "wrong token",
+		token:  "guess",
+		status: http.StatusUnauthorized,
+	}, {
+		title:  "valid token",
+		token:  "secret",
+		status: http.StatusOK,
+	}} {
+		t.Run(test.title, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://localhost:9191/status", nil)
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+
+			rsp := httptest.NewRecorder()
+			h.ServeHTTP(rsp, req)
+			if rsp.Code != test.status {
+				t.Errorf("got: %d, expected: %d", rsp.Code, test.status)
+			}
+		})
+	}
+}
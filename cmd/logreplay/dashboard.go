@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aryszka/logreplay"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// the number of the latest intervals shown in the latency sparkline
+const sparklineLength = 60
+
+// moves the cursor to the top left corner and clears the screen
+const clearScreen = "\033[H\033[2J"
+
+var sparkChars = []rune("▁▂▃▄▅▆▇█")
+
+// dashboard renders the progress reports of the player to a terminal
+type dashboard struct {
+	out       io.Writer
+	latencies []time.Duration
+}
+
+func sparkline(d []time.Duration) string {
+	var max time.Duration
+	for _, di := range d {
+		if di > max {
+			max = di
+		}
+	}
+
+	s := make([]rune, len(d))
+	for i, di := range d {
+		if max == 0 {
+			s[i] = sparkChars[0]
+			continue
+		}
+
+		s[i] = sparkChars[int(di)*(len(sparkChars)-1)/int(max)]
+	}
+
+	return string(s)
+}
+
+func (d *dashboard) update(p logreplay.Progress) {
+	d.latencies = append(d.latencies, p.Latency)
+	if len(d.latencies) > sparklineLength {
+		d.latencies = d.latencies[len(d.latencies)-sparklineLength:]
+	}
+
+	var b bytes.Buffer
+	b.WriteString(clearScreen)
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "rps\t%.1f\n", p.RPS)
+	fmt.Fprintf(w, "in flight\t%d\n", p.InFlight)
+	fmt.Fprintf(w, "requests\t%d\n", p.Requests)
+	fmt.Fprintf(w, "errors\t%d\n", p.Errors)
+	if p.Percent >= 0 {
+		fmt.Fprintf(w, "completed\t%.1f%%\n", p.Percent)
+	}
+
+	var codes []int
+	for code := range p.StatusCodes {
+		codes = append(codes, code)
+	}
+
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "status %d\t%d\n", code, p.StatusCodes[code])
+	}
+
+	var classes []string
+	for class := range p.StatusClasses {
+		classes = append(classes, class)
+	}
+
+	sort.Strings(classes)
+	for _, class := range classes {
+		fmt.Fprintf(w, "status %s\t%d\n", class, p.StatusClasses[class])
+	}
+
+	fmt.Fprintf(w, "latency\t%v\n", p.Latency)
+	w.Flush()
+
+	fmt.Fprintln(&b, sparkline(d.latencies))
+	d.out.Write(b.Bytes())
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aryszka/logreplay"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// the flags handled by the coordinator, that are not forwarded to the workers
+var coordinatorFlags = []string{
+	"workers",
+	"distribute",
+	"config",
+	"once",
+	"throttle",
+	"stats-file",
+	"dashboard",
+	"control-addr",
+	"control-token",
+	"fail-on-error-rate",
+	"worker-token",
+}
+
+// the replay flags accepted by the workers. The flags that read or write local files,
+// load scripts, expose the environment or open listeners are not accepted, because the
+// arguments are received over the network.
+var workerFlags = map[string]bool{
+	"log-format": true, "log-time-format": true, "from": true, "to": true,
+	"methods": true, "exclude-methods": true, "statuses": true, "exclude-statuses": true,
+	"dedup": true, "dedup-weights": true,
+	"server": true, "servers": true, "server-balancing": true, "shadow": true,
+	"compare-headers": true, "compare-bodies": true, "benchmark": true, "benchmark-batches": true,
+	"max-memory": true, "max-response-bytes": true, "default-scheme": true,
+	"header": true, "basic-auth": true, "host-basic-auth": true,
+	"oauth2-token-url": true, "oauth2-client-id": true, "oauth2-client-secret": true, "oauth2-scopes": true,
+	"forward-remote-address": true, "remote-address-header": true,
+	"request-id-header": true, "request-id-format": true,
+	"http2": true, "h2c": true, "http3": true, "proxy": true, "proxy-from-env": true, "resolve": true,
+	"disable-keepalive": true, "preserve-http10": true, "dial-timeout": true, "address-family": true,
+	"tls-handshake-timeout": true, "expect-continue-threshold": true, "expect-continue-timeout": true,
+	"response-header-timeout": true, "request-timeout": true, "server-name": true, "insecure": true,
+	"tls-min-version": true, "tls-max-version": true, "tls-ciphers": true,
+	"concurrent-sessions": true, "redirect-behavior": true, "redirect-allow": true, "max-redirects": true,
+	"post-content-length": true, "post-content-length-deviation": true, "post-set-content-length": true,
+	"post-body-format": true, "post-form-fields": true, "post-form-field-size": true,
+	"post-body-template": true, "post-chunked": true, "chunk-size": true, "chunk-delay": true,
+	"payload": true, "fuzz-query": true, "accept-encoding": true, "decompress": true,
+	"client-cache": true, "conditional": true, "cache-bust": true, "path-rule": true,
+	"label": true, "extract": true, "compress-body": true,
+	"think-time": true, "think-time-deviation": true, "jitter": true,
+	"halt-on-500": true, "halt-rule": true, "halt-threshold": true,
+	"assert-status": true, "assert-header": true, "assert-body": true, "assert-max-latency": true,
+	"assertion-threshold": true, "size-tolerance": true, "size-deviation-threshold": true,
+	"latency-regression-factor": true, "circuit-breaker-threshold": true, "circuit-breaker-timeout": true,
+	"max-concurrency-per-host": true, "latency-slo": true, "latency-slo-percentile": true,
+	"latency-slo-window": true, "throttle": true, "start-at": true,
+	"adaptive-error-rate": true, "adaptive-latency": true, "adaptive-interval": true, "adaptive-min-rate": true,
+	"shuffle": true, "shuffle-seed": true, "random-seed": true, "weighted": true,
+	"preserve-sessions": true, "session-field": true, "session-cookie": true, "session-pattern": true,
+	"open-loop": true, "max-open-requests": true, "verbose": true, "quiet": true,
+	"log-requests": true, "slow-threshold": true, "redact-headers": true, "redact-body": true, "ramp-down": true,
+}
+
+// the environment variable used as the default of the shared worker token
+const workerTokenEnv = "LOGREPLAY_WORKER_TOKEN"
+
+var (
+	errNoWorkers           = errors.New("no workers defined")
+	errInvalidDistribution = errors.New("invalid distribution")
+	errNoWorkerToken       = errors.New("the worker token is required, set it with -token or " + workerTokenEnv)
+	errWorkerFlag          = errors.New("flag not accepted by the workers")
+	errCoordinatedP99      = errors.New("-fail-on-p99 is not supported by the coordinator, the percentiles of the workers cannot be merged")
+)
+
+// workerResult is the response of a worker to the coordinator
+type workerResult struct {
+	Stats logreplay.Stats `json:"stats"`
+	Error string          `json:"error,omitempty"`
+}
+
+// worker runs the replays received from a coordinator, one at a time
+type worker struct {
+	mx    sync.Mutex
+	token string
+
+	// the replay flags, used only to check the received arguments
+	flags *flag.FlagSet
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	if f == nil {
+		return false
+	}
+
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// removeFlags removes the listed flags and their values from the command line flags
+func removeFlags(fs *flag.FlagSet, args []string, names ...string) []string {
+	remove := make(map[string]bool)
+	for _, n := range names {
+		remove[n] = true
+	}
+
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		name, n := flagArgs(fs, args, i)
+		if !remove[name] {
+			kept = append(kept, args[i:i+n]...)
+		}
+
+		i += n - 1
+	}
+
+	return kept
+}
+
+// flagArgs returns the name of the flag at position i of the command line, and the number
+// of the arguments that it takes, including its value
+func flagArgs(fs *flag.FlagSet, args []string, i int) (string, int) {
+	name := strings.TrimLeft(args[i], "-")
+	hasValue := strings.Contains(name, "=")
+	if hasValue {
+		name = name[:strings.Index(name, "=")]
+	}
+
+	n := 1
+	if !hasValue && !isBoolFlag(fs.Lookup(name)) && i+1 < len(args) {
+		n = 2
+	}
+
+	return name, n
+}
+
+// checkWorkerFlags verifies that the command line consists only of the flags accepted by
+// the workers, and contains no positional arguments, e.g. additional input files
+func checkWorkerFlags(fs *flag.FlagSet, args []string) error {
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			return fmt.Errorf("%w: %s", errWorkerFlag, args[i])
+		}
+
+		name, n := flagArgs(fs, args, i)
+		if !workerFlags[name] || fs.Lookup(name) == nil {
+			return fmt.Errorf("%w: %s", errWorkerFlag, args[i])
+		}
+
+		i += n - 1
+	}
+
+	return nil
+}
+
+// partitionInput splits the access log between the workers line by line, preserving the
+// order of the lines within the parts. When the rate is distributed, every worker
+// receives the complete access log.
+func partitionInput(in io.Reader, n int, rate bool) ([][]byte, error) {
+	parts := make([][]byte, n)
+	if rate {
+		b, err := ioutil.ReadAll(in)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range parts {
+			parts[i] = b
+		}
+
+		return parts, nil
+	}
+
+	buffers := make([]bytes.Buffer, n)
+	s := bufio.NewScanner(in)
+	var line int
+	for s.Scan() {
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+
+		buffers[line%n].Write(s.Bytes())
+		buffers[line%n].WriteByte('\n')
+		line++
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range buffers {
+		parts[i] = buffers[i].Bytes()
+	}
+
+	return parts, nil
+}
+
+func workerURL(addr string, args []string) string {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+
+	return strings.TrimSuffix(addr, "/") + "/replay?" + url.Values{"arg": args}.Encode()
+}
+
+// runRemote sends a part of the access log to a worker, and waits until the worker
+// completes the replay
+func runRemote(addr, token string, args []string, part []byte) (workerResult, error) {
+	req, err := http.NewRequest("POST", workerURL(addr, args), bytes.NewReader(part))
+	if err != nil {
+		return workerResult{}, err
+	}
+
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return workerResult{}, err
+	}
+
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(rsp.Body)
+		return workerResult{}, fmt.Errorf("worker %s: %s: %s", addr, rsp.Status, strings.TrimSpace(string(b)))
+	}
+
+	var r workerResult
+	err = json.NewDecoder(rsp.Body).Decode(&r)
+	return r, err
+}
+
+func runCoordinate(args []string) {
+	var (
+		workers      string
+		distribution string
+		token        string
+	)
+
+	fs := flag.NewFlagSet("coordinate", flag.ExitOnError)
+	registerReplayFlags(fs)
+	fs.StringVar(
+		&workers,
+		"workers",
+		"",
+		"comma separated list of the addresses of the worker processes, started with the worker command. The replay flags are forwarded to the workers, except for the config file, from which only the inputs are used",
+	)
+
+	fs.StringVar(
+		&distribution,
+		"distribute",
+		"scenario",
+		"how to distribute the load between the workers: scenario splits the access log, while rate sends the complete log to every worker. In both cases, the throttle is divided between the workers",
+	)
+
+	fs.StringVar(
+		&token,
+		"worker-token",
+		os.Getenv(workerTokenEnv),
+		"the shared token that the workers were started with, defaults to the "+workerTokenEnv+" environment variable",
+	)
+
+	parseReplayFlags(fs, args)
+	if workers == "" {
+		fs.PrintDefaults()
+		log.Fatal(errNoWorkers)
+	}
+
+	if token == "" {
+		fs.PrintDefaults()
+		log.Fatal(errNoWorkerToken)
+	}
+
+	if distribution != "scenario" && distribution != "rate" {
+		fs.PrintDefaults()
+		log.Fatal(errInvalidDistribution)
+	}
+
+	// the workers report only their own percentiles, and the merged values are their
+	// weighted averages, that can be far below the real p99:
+	if failOnP99 > 0 {
+		fs.PrintDefaults()
+		log.Fatal(errCoordinatedP99)
+	}
+
+	in, err := input(fs.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	addrs := strings.Split(workers, ",")
+	parts, err := partitionInput(in, len(addrs), distribution == "rate")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	forward := removeFlags(fs, args[:len(args)-len(fs.Args())], coordinatorFlags...)
+	if options.Throttle > 0 {
+		forward = append(forward, fmt.Sprintf("-throttle=%g", options.Throttle/float64(len(addrs))))
+	}
+
+	if err := checkWorkerFlags(fs, forward); err != nil {
+		fs.PrintDefaults()
+		log.Fatal(err)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		results = make([]workerResult, len(addrs))
+		errs    = make([]error, len(addrs))
+	)
+
+	for i := range addrs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = runRemote(addrs[i], token, forward, parts[i])
+		}(i)
+	}
+
+	wg.Wait()
+
+	var (
+		stats  []logreplay.Stats
+		failed bool
+	)
+
+	for i, r := range results {
+		switch {
+		case errs[i] != nil:
+			log.Println(errs[i])
+			failed = true
+			continue
+		case r.Error != "":
+			log.Printf("worker %s: %s", addrs[i], r.Error)
+			failed = true
+		}
+
+		stats = append(stats, r.Stats)
+	}
+
+	s := logreplay.MergeStats(stats...)
+	writeStats(s)
+	log.Println("the response time percentiles are the averages of the worker percentiles, weighted by the responses")
+	printSummary(s)
+	if failed {
+		os.Exit(1)
+	}
+
+	if !checkThresholds(s) {
+		os.Exit(exitThresholdExceeded)
+	}
+}
+
+// replay runs the replay received from the coordinator in a child process, reading the
+// access log from a temporary file
+func (w *worker) replay(rw http.ResponseWriter, r *http.Request) {
+	if !requirePost(rw, r) {
+		return
+	}
+
+	if !w.authorized(r) {
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	args := r.URL.Query()["arg"]
+	if err := checkWorkerFlags(w.flags, args); err != nil {
+		log.Println(err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	dir, err := ioutil.TempDir("", "logreplay-worker")
+	if err != nil {
+		log.Println(err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
+	logFile := filepath.Join(dir, "access.log")
+	statsFile := filepath.Join(dir, "stats.json")
+	if err := writeBody(logFile, r.Body); err != nil {
+		log.Println(err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		log.Println(err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	args = append([]string{"once", "-stats-file", statsFile}, args...)
+	cmd := exec.CommandContext(r.Context(), self, append(args, logFile)...)
+	cmd.Stderr = os.Stderr
+	log.Println("replay started:", strings.Join(args[3:], " "))
+	runErr := cmd.Run()
+
+	var res workerResult
+	b, err := ioutil.ReadFile(statsFile)
+	if err == nil {
+		err = json.Unmarshal(b, &res.Stats)
+	}
+
+	if err != nil {
+		if runErr != nil {
+			err = runErr
+		}
+
+		log.Println("replay failed:", err)
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if runErr != nil {
+		res.Error = runErr.Error()
+	}
+
+	log.Println("replay completed, requests:", res.Stats.Requests)
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(res); err != nil {
+		log.Println(err)
+	}
+}
+
+// validToken checks the bearer token of a request
+func validToken(r *http.Request, token string) bool {
+	rt := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(rt), []byte(token)) == 1
+}
+
+// authorized checks the shared token of the coordinator
+func (w *worker) authorized(r *http.Request) bool {
+	return validToken(r, w.token)
+}
+
+func writeBody(name string, body io.Reader) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func runWorker(args []string) {
+	var listen, token string
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	fs.StringVar(
+		&listen,
+		"listen",
+		"localhost:9090",
+		"the address to receive the replays from the coordinator on. The workers accept only the replay flags that don't access local files",
+	)
+
+	fs.StringVar(
+		&token,
+		"token",
+		os.Getenv(workerTokenEnv),
+		"the shared token required from the coordinator, defaults to the "+workerTokenEnv+" environment variable",
+	)
+
+	fs.Parse(args)
+	if token == "" {
+		fs.PrintDefaults()
+		log.Fatal(errNoWorkerToken)
+	}
+
+	// the replay flags are registered on a separate flag set, after the own flags of the
+	// worker were parsed:
+	rfs := flag.NewFlagSet("once", flag.ContinueOnError)
+	registerReplayFlags(rfs)
+	w := &worker{token: token, flags: rfs}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replay", w.replay)
+	log.Fatal(http.ListenAndServe(listen, mux))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func replayFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerReplayFlags(fs)
+	return fs
+}
+
+func TestRemoveFlags(t *testing.T) {
+	for _, test := range []struct {
+		title    string
+		args     []string
+		remove   []string
+		expected []string
+	}{{
+		title:    "separate value",
+		args:     []string{"-server", "http://localhost", "-throttle", "10", "-quiet"},
+		remove:   []string{"throttle"},
+		expected: []string{"-server", "http://localhost", "-quiet"},
+	}, {
+		title:    "value with equal sign",
+		args:     []string{"--throttle=10", "-server=http://localhost"},
+		remove:   []string{"throttle"},
+		expected: []string{"-server=http://localhost"},
+	}, {
+		title:    "bool flag",
+		args:     []string{"-once", "-server", "http://localhost"},
+		remove:   []string{"once"},
+		expected: []string{"-server", "http://localhost"},
+	}, {
+		title:    "bool flag followed by a removed flag",
+		args:     []string{"-quiet", "-stats-file", "stats.json"},
+		remove:   []string{"stats-file"},
+		expected: []string{"-quiet"},
+	}, {
+		title:    "missing value at the end",
+		args:     []string{"-server", "http://localhost", "-throttle"},
+		remove:   []string{"throttle"},
+		expected: []string{"-server", "http://localhost"},
+	}} {
+		t.Run(test.title, func(t *testing.T) {
+			kept := removeFlags(replayFlags(), test.args, test.remove...)
+			if !reflect.DeepEqual(kept, test.expected) {
+				t.Errorf("got: %v, expected: %v", kept, test.expected)
+			}
+		})
+	}
+}
+
+func TestPartitionInput(t *testing.T) {
+	const log = "a\nb\n\nc\nd\ne"
+	t.Run("scenario", func(t *testing.T) {
+		parts, err := partitionInput(bytes.NewBufferString(log), 2, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := [][]byte{[]byte("a\nc\ne\n"), []byte("b\nd\n")}
+		if !reflect.DeepEqual(parts, expected) {
+			t.Errorf("got: %q, expected: %q", parts, expected)
+		}
+	})
+
+	t.Run("rate", func(t *testing.T) {
+		parts, err := partitionInput(bytes.NewBufferString(log), 3, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(parts) != 3 {
+			t.Fatal("invalid number of parts", len(parts))
+		}
+
+		for _, p := range parts {
+			if string(p) != log {
+				t.Errorf("got: %q, expected: %q", p, log)
+			}
+		}
+	})
+}
+
+func TestCheckWorkerFlags(t *testing.T) {
+	for _, test := range []struct {
+		args   []string
+		accept bool
+	}{
+		{args: []string{"-server", "http://localhost", "-throttle=10", "-quiet"}, accept: true},
+		{args: []string{"-header", "-result-log"}, accept: true},
+		{args: []string{"-result-log", "/etc/passwd"}},
+		{args: []string{"-diff-log=/tmp/diff"}},
+		{args: []string{"-payload-sample", "/etc/passwd", "-payload", "sample"}},
+		{args: []string{"-script", "script.lua"}},
+		{args: []string{"-expand-env"}},
+		{args: []string{"-quiet", "/etc/passwd"}},
+		{args: []string{"--", "/etc/passwd"}},
+		{args: []string{"-unknown", "foo"}},
+	} {
+		err := checkWorkerFlags(replayFlags(), test.args)
+		if test.accept && err != nil {
+			t.Errorf("failed to accept %v: %v", test.args, err)
+		}
+
+		if !test.accept && !errors.Is(err, errWorkerFlag) {
+			t.Errorf("failed to reject %v: %v", test.args, err)
+		}
+	}
+}
+
+func TestWorkerRejectsRequests(t *testing.T) {
+	w := &worker{token: "secret", flags: replayFlags()}
+	for _, test := range []struct {
+		title  string
+		token  string
+		args   []string
+		status int
+	}{{
+		title:  "no token",
+		status: http.StatusUnauthorized,
+	}, {
+		title:  "wrong token",
+		token:  "guess",
+		status: http.StatusUnauthorized,
+	}, {
+		title:  "not accepted flag",
+		token:  "secret",
+		args:   []string{"-stats-file", "/tmp/overwritten"},
+		status: http.StatusBadRequest,
+	}} {
+		t.Run(test.title, func(t *testing.T) {
+			req := httptest.NewRequest("POST", workerURL("localhost:9090", test.args), nil)
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+
+			rsp := httptest.NewRecorder()
+			w.replay(rsp, req)
+			if rsp.Code != test.status {
+				t.Errorf("got: %d, expected: %d", rsp.Code, test.status)
+			}
+		})
+	}
+}
@@ -1,27 +1,68 @@
 package main
 
 import (
-	"os"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/aryszka/logreplay"
 	"golang.org/x/crypto/ssh/terminal"
 	"io"
-	"flag"
-	"errors"
+	"io/ioutil"
 	"log"
-	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 )
 
+// the factor used to raise or lower the throttle interactively
+const throttleStep = 1.1
+
+// the number of the requests skipped interactively
+const skipStep = 100
+
+// the exit code used when the replay completed, but the results exceeded the failure
+// thresholds
+const exitThresholdExceeded = 2
+
 var (
+	summaryOnce     sync.Once
+	saveOnce        sync.Once
+	finishOnce      sync.Once
+	finished        = make(chan struct{})
 	errTooManyInput = errors.New("too many input")
-	errNoInput = errors.New("no input defined")
+	errNoInput      = errors.New("no input defined")
 )
 
-func input() (io.Reader, error) {
-	args := flag.Args()
-	if len(args) > 1 {
+// inputs opens the access log files listed in the config file, and reads them one
+// after the other
+func inputs(files []string) (io.Reader, error) {
+	var r []io.Reader
+	for _, f := range files {
+		fr, err := os.Open(f)
+		if err != nil {
+			return nil, err
+		}
+
+		// the last line of a file may not be terminated:
+		r = append(r, fr, strings.NewReader("\n"))
+	}
+
+	return io.MultiReader(r...), nil
+}
+
+func input(args []string) (io.Reader, error) {
+	if len(args) > 1 || len(args) == 1 && len(fileConfig.Inputs) > 0 {
 		return nil, errTooManyInput
 	}
 
+	if len(fileConfig.Inputs) > 0 {
+		return inputs(fileConfig.Inputs)
+	}
+
 	if len(args) == 1 {
 		return os.Open(args[0])
 	}
@@ -34,50 +75,398 @@ func input() (io.Reader, error) {
 	return nil, errNoInput
 }
 
-func play(p *logreplay.Player) {
-	playFunc := p.Play
+// checkThresholds returns false when the statistics exceed any of the failure thresholds
+func checkThresholds(s logreplay.Stats) bool {
+	ok := true
+	if failOnErrorRate >= 0 && s.Requests > 0 {
+		rate := float64(s.Errors+s.ServerErrors) / float64(s.Requests)
+		if rate > failOnErrorRate {
+			log.Printf("error rate %.4f exceeds %.4f", rate, failOnErrorRate)
+			ok = false
+		}
+	}
+
+	if failOnP99 > 0 && s.Latency.P99 > failOnP99 {
+		log.Printf("p99 response time %v exceeds %v", s.Latency.P99, failOnP99)
+		ok = false
+	}
+
+	return ok
+}
+
+// the order of the error classes in the summary
+var errorClasses = []logreplay.ErrorClass{
+	logreplay.DNSError,
+	logreplay.ConnectionRefused,
+	logreplay.TLSError,
+	logreplay.Timeout,
+	logreplay.OtherError,
+	logreplay.ClientError,
+	logreplay.ServerError,
+}
+
+func printSummary(s logreplay.Stats) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	defer w.Flush()
+
+	count := func(name string, n int) {
+		fmt.Fprintf(w, "%s\t%d\t\n", name, n)
+	}
+
+	size := func(name string, n int64) {
+		fmt.Fprintf(w, "%s\t%d\t\n", name, n)
+	}
+
+	duration := func(name string, d time.Duration) {
+		fmt.Fprintf(w, "%s\t%v\t\n", name, d)
+	}
+
+	count("requests", s.Requests)
+	count("errors", s.Errors)
+	count("server errors", s.ServerErrors)
+	for _, c := range errorClasses {
+		if n := s.ErrorClasses[c]; n > 0 {
+			count(string(c)+" errors", n)
+		}
+	}
+
+	count("skipped", s.Skipped)
+	count("dropped", s.Dropped)
+	count("cache hits", s.CacheHits)
+	count("differences", s.Differences)
+	count("assertion failures", s.AssertionFailures)
+	count("size deviations", s.SizeDeviations)
+	size("response bytes", s.ResponseBytes)
+	size("uncompressed bytes", s.UncompressedBytes)
+	count("truncated responses", s.TruncatedResponses)
+	duration("min", s.Latency.Min)
+	duration("mean", s.Latency.Mean)
+	duration("p50", s.Latency.P50)
+	duration("p90", s.Latency.P90)
+	duration("p95", s.Latency.P95)
+	duration("p99", s.Latency.P99)
+	duration("max", s.Latency.Max)
+	printStatuses(s)
+	printLabels(s.Labels)
+	printRegressions(s.LatencyRegressions)
+}
+
+// printStatuses prints the distribution of the responses by status code and class
+func printStatuses(s logreplay.Stats) {
+	var total int
+	for _, n := range s.StatusClasses {
+		total += n
+	}
+
+	if total == 0 {
+		return
+	}
+
+	var codes []int
+	for code := range s.StatusCodes {
+		codes = append(codes, code)
+	}
+
+	var classes []string
+	for class := range s.StatusClasses {
+		classes = append(classes, class)
+	}
+
+	sort.Ints(codes)
+	sort.Strings(classes)
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	defer w.Flush()
+	fmt.Fprintf(w, "status\tresponses\tshare\t\n")
+	for _, code := range codes {
+		n := s.StatusCodes[code]
+		fmt.Fprintf(w, "%d\t%d\t%.1f%%\t\n", code, n, 100*float64(n)/float64(total))
+	}
+
+	for _, class := range classes {
+		n := s.StatusClasses[class]
+		fmt.Fprintf(w, "%s\t%d\t%.1f%%\t\n", class, n, 100*float64(n)/float64(total))
+	}
+}
+
+// printLabels prints the main statistics of the label groups
+func printLabels(l map[string]logreplay.Stats) {
+	if len(l) == 0 {
+		return
+	}
+
+	var keys []string
+	for key := range l {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	defer w.Flush()
+	fmt.Fprintf(w, "label\trequests\terrors\tserver errors\tp50\tp99\t\n")
+	for _, key := range keys {
+		s := l[key]
+		fmt.Fprintf(
+			w,
+			"%s\t%d\t%d\t%d\t%v\t%v\t\n",
+			key,
+			s.Requests,
+			s.Errors,
+			s.ServerErrors,
+			s.Latency.P50,
+			s.Latency.P99,
+		)
+	}
+}
+
+// printRegressions prints the endpoints with latency regressions, the most frequent ones
+// first
+func printRegressions(r map[string]logreplay.LatencyRegression) {
+	if len(r) == 0 {
+		return
+	}
+
+	var endpoints []string
+	for endpoint := range r {
+		endpoints = append(endpoints, endpoint)
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool {
+		ri, rj := r[endpoints[i]], r[endpoints[j]]
+		if ri.Requests == rj.Requests {
+			return endpoints[i] < endpoints[j]
+		}
+
+		return ri.Requests > rj.Requests
+	})
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	defer w.Flush()
+	fmt.Fprintf(w, "regressed endpoint\trequests\tlogged\treplayed\t\n")
+	for _, endpoint := range endpoints {
+		ri := r[endpoint]
+		fmt.Fprintf(w, "%s\t%d\t%v\t%v\t\n", endpoint, ri.Requests, ri.Logged, ri.Replayed)
+	}
+}
+
+// playFunc returns the function that starts or resumes the replay
+func playFunc(p *logreplay.Player) func() error {
 	if once {
-		playFunc = p.Once
+		return p.Once
+	}
+
+	return p.Play
+}
+
+// summary prints the summary of the replay only once, even when the replay was
+// stopped by a signal
+func summary(p *logreplay.Player) {
+	summaryOnce.Do(func() { printSummary(p.Stats()) })
+}
+
+// writeStatsFile writes statistics as JSON to a file, that can be printed with the
+// report command
+func writeStatsFile(name string, s logreplay.Stats) {
+	b, err := json.Marshal(s)
+	if err == nil {
+		err = ioutil.WriteFile(name, b, 0644)
+	}
+
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// writeStats writes the final statistics as JSON to the file set by -stats-file
+func writeStats(s logreplay.Stats) {
+	if statsFile == "" {
+		return
+	}
+
+	writeStatsFile(statsFile, s)
+}
+
+// saveStats saves the final statistics of the player only once, even when the replay
+// was stopped by a signal
+func saveStats(p *logreplay.Player) {
+	saveOnce.Do(func() { writeStats(p.Stats()) })
+}
+
+func play(p *logreplay.Player) {
+	err := playFunc(p)()
+	finishOnce.Do(func() { close(finished) })
+	saveStats(p)
+	if once || quiet {
+		summary(p)
 	}
 
-	err := playFunc()
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	if !checkThresholds(p.Stats()) {
+		os.Exit(exitThresholdExceeded)
+	}
+}
+
+func changeThrottle(p *logreplay.Player, factor float64) {
+	t := p.Throttle()
+	if t <= 0 {
+		log.Println("throttle is not set")
+		return
+	}
+
+	p.SetThrottle(t * factor)
+	log.Println("throttle:", p.Throttle())
+}
+
+func changeConcurrency(p *logreplay.Player, delta int) {
+	n := p.Concurrency() + delta
+	if n < 1 {
+		log.Println("concurrency cannot be lower than 1")
+		return
+	}
+
+	p.SetConcurrency(n)
+	log.Println("concurrency:", p.Concurrency())
 }
 
 func playControl(p *logreplay.Player) {
-	log.Println("press Enter to pause or play")
-	var running bool
-	for {
-		if running {
+	log.Println(
+		"press Enter to pause or play, and a key followed by Enter to:",
+		"+/- raise or lower the throttle, ]/[ raise or lower the concurrency,",
+		"s skip ahead, i print the statistics",
+	)
+
+	// the pause state is taken from the player, because the replay can be paused also
+	// by a signal or over the control API:
+	toggle := func() {
+		if p.Paused() {
+			// the outcome of the replay is handled by the initial call to play:
+			go playFunc(p)()
+			log.Println("playing")
+		} else {
 			p.Pause()
 			log.Println("paused")
-			running = false
-		} else {
-			go play(p)
-			log.Println("playing")
-			running = true
 		}
+	}
 
-		fmt.Scanln()
+	go play(p)
+	log.Println("playing")
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		switch s.Text() {
+		case "+":
+			changeThrottle(p, throttleStep)
+		case "-":
+			changeThrottle(p, 1/throttleStep)
+		case "]":
+			changeConcurrency(p, 1)
+		case "[":
+			changeConcurrency(p, -1)
+		case "s":
+			p.Skip(skipStep)
+			log.Println("skipped requests:", skipStep)
+		case "i":
+			printSummary(p.Stats())
+		default:
+			toggle()
+		}
 	}
 }
 
-func main() {
-	input, err := input()
+func printBenchmark(r logreplay.BenchmarkReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	defer w.Flush()
+
+	ratio := func(a, b float64) string {
+		if a == 0 {
+			return "-"
+		}
+
+		return fmt.Sprintf("%.3f", b/a)
+	}
+
+	count := func(name string, a, b int) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t\n", name, a, b, ratio(float64(a), float64(b)))
+	}
+
+	duration := func(name string, a, b time.Duration) {
+		fmt.Fprintf(w, "%s\t%v\t%v\t%s\t\n", name, a, b, ratio(float64(a), float64(b)))
+	}
+
+	fmt.Fprintln(w, "\tA\tB\tB/A\t")
+	count("requests", r.A.Requests, r.B.Requests)
+	count("errors", r.A.Errors, r.B.Errors)
+	count("server errors", r.A.ServerErrors, r.B.ServerErrors)
+	duration("min", r.A.Latency.Min, r.B.Latency.Min)
+	duration("mean", r.A.Latency.Mean, r.B.Latency.Mean)
+	duration("p50", r.A.Latency.P50, r.B.Latency.P50)
+	duration("p90", r.A.Latency.P90, r.B.Latency.P90)
+	duration("p95", r.A.Latency.P95, r.B.Latency.P95)
+	duration("p99", r.A.Latency.P99, r.B.Latency.P99)
+	duration("max", r.A.Latency.Max, r.B.Latency.Max)
+}
+
+func runBenchmark() {
+	r, err := logreplay.Benchmark(logreplay.BenchmarkOptions{
+		Options: options,
+		A:       options.Server,
+		B:       benchmark,
+		Batches: benchmarkBatches,
+	})
+
+	printBenchmark(r)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// replay runs the play and once commands
+func replay(args []string) {
+	input, err := input(args)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	options.AccessLog = input
+	switch {
+	case showDashboard:
+		d := &dashboard{out: os.Stdout}
+		options.OnProgress = d.update
+		options.ProgressInterval = time.Second
+	case !quiet && rpsInterval > 0:
+		d := &rateDisplay{interval: rpsInterval}
+		options.OnProgress = d.update
+		options.ProgressInterval = time.Second
+	}
+
+	if benchmark != "" {
+		runBenchmark()
+		return
+	}
 
 	p, err := logreplay.New(options)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if input == os.Stdin {
+	go handleSignals(p)
+	if len(fileConfig.Stages) > 0 {
+		go runStages(p, fileConfig.Stages)
+	}
+
+	if controlAddr != "" {
+		go serveControl(controlAddr, controlToken, p)
+		play(p)
+		return
+	}
+
+	// the interactive controls are available only when the input is not read from
+	// stdin, and stdin is a terminal, e.g. not when started by a worker:
+	if input == os.Stdin || !terminal.IsTerminal(int(os.Stdin.Fd())) {
 		play(p)
 		return
 	}
@@ -85,3 +474,23 @@ func main() {
 	playControl(p)
 	select {}
 }
+
+func main() {
+	args := os.Args[1:]
+	run := runPlay
+	if len(args) > 0 {
+		switch args[0] {
+		case "help", "-h", "-help", "--help":
+			usage()
+			return
+		}
+
+		// without a command, the arguments are handled by the play command:
+		if c, ok := commands[args[0]]; ok {
+			run = c.run
+			args = args[1:]
+		}
+	}
+
+	run(args)
+}
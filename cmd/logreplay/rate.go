@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aryszka/logreplay"
+	"log"
+	"strings"
+	"time"
+)
+
+// the windows of the moving averages of the request rate
+var rateWindows = []time.Duration{time.Second, 10 * time.Second, time.Minute}
+
+type rateSample struct {
+	time     time.Time
+	requests int
+}
+
+// rateDisplay prints the moving averages of the request rate periodically, based on the
+// progress reports of the player
+type rateDisplay struct {
+	interval  time.Duration
+	samples   []rateSample
+	lastPrint time.Time
+}
+
+// rate returns the request rate over a window, measured from the newest sample at least
+// as old as the window, or from the oldest sample, when the replay is shorter
+func (d *rateDisplay) rate(window time.Duration) float64 {
+	last := d.samples[len(d.samples)-1]
+	from := d.samples[0]
+	for i := len(d.samples) - 2; i >= 0; i-- {
+		if last.time.Sub(d.samples[i].time) >= window {
+			from = d.samples[i]
+			break
+		}
+	}
+
+	elapsed := last.time.Sub(from.time)
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(last.requests-from.requests) / elapsed.Seconds()
+}
+
+func (d *rateDisplay) update(p logreplay.Progress) {
+	now := time.Now()
+	d.samples = append(d.samples, rateSample{time: now, requests: p.Requests})
+
+	// keep one sample older than the longest window:
+	longest := rateWindows[len(rateWindows)-1]
+	for len(d.samples) > 2 && now.Sub(d.samples[1].time) >= longest {
+		d.samples = d.samples[1:]
+	}
+
+	if d.lastPrint.IsZero() {
+		d.lastPrint = now
+		return
+	}
+
+	if now.Sub(d.lastPrint) < d.interval {
+		return
+	}
+
+	d.lastPrint = now
+	rates := make([]string, len(rateWindows))
+	for i, w := range rateWindows {
+		rates[i] = fmt.Sprintf("%.1f (%gs)", d.rate(w), w.Seconds())
+	}
+
+	log.Println("rps:", strings.Join(rates, ", "))
+}
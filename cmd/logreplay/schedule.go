@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aryszka/logreplay"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// the runs are prepared this much before their start time, to read the access log and
+// resolve the hosts in advance
+const scheduleWarmup = time.Minute
+
+// the search for the next run gives up after this period, e.g. in case of February 30
+const scheduleHorizon = 5 * 366 * 24 * time.Hour
+
+// the format of the report file names, without colons, to keep them portable
+const reportTimeFormat = "2006-01-02T15-04-05"
+
+var (
+	errInvalidSchedule = errors.New("invalid schedule, expected: minute hour day-of-month month day-of-week")
+	errScheduleStdin   = errors.New("the scheduled replay requires an access log file")
+)
+
+// the ranges of the schedule fields: minute, hour, day of month, month, day of week
+var scheduleRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// schedule is a cron-like recurring schedule. Every field is a set of the accepted
+// values, stored as a bitmask.
+type schedule struct {
+	fields [5]uint64
+
+	// like in cron, when both the day of month and the day of week are restricted, a
+	// day matches when either of them matches
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+// parseScheduleField parses a field of the schedule: a comma separated list of *, a
+// value or a range of values, each optionally followed by /step
+func parseScheduleField(f string, min, max int) (uint64, error) {
+	var mask uint64
+	for _, item := range strings.Split(f, ",") {
+		r, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step < 1 {
+				return 0, errInvalidSchedule
+			}
+
+			r = item[:i]
+		}
+
+		from, to := min, max
+		if r != "*" {
+			bounds := strings.SplitN(r, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, errInvalidSchedule
+			}
+
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, errInvalidSchedule
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+
+		// Sunday can be set as 7, too:
+		limit := max
+		if max == 6 {
+			limit = 7
+		}
+
+		if from < min || to > limit || from > to {
+			return 0, errInvalidSchedule
+		}
+
+		for v := from; v <= to; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+
+	if max == 6 && mask&(1<<7) != 0 {
+		mask = mask&^(1<<7) | 1
+	}
+
+	return mask, nil
+}
+
+// parseSchedule parses a schedule in the format of the crontab entries, e.g. 0 2 * * *
+// for every night at 02:00
+func parseSchedule(s string) (*schedule, error) {
+	f := strings.Fields(s)
+	if len(f) != len(scheduleRanges) {
+		return nil, errInvalidSchedule
+	}
+
+	sc := &schedule{anyDayOfMonth: f[2] == "*", anyDayOfWeek: f[4] == "*"}
+	for i, fi := range f {
+		var err error
+		if sc.fields[i], err = parseScheduleField(fi, scheduleRanges[i][0], scheduleRanges[i][1]); err != nil {
+			return nil, fmt.Errorf("%w: %s", err, s)
+		}
+	}
+
+	if sc.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("%w: %s", errInvalidSchedule, s)
+	}
+
+	return sc, nil
+}
+
+func (s *schedule) has(field, value int) bool {
+	return s.fields[field]&(1<<uint(value)) != 0
+}
+
+func (s *schedule) matchDay(t time.Time) bool {
+	if !s.has(3, int(t.Month())) {
+		return false
+	}
+
+	dom, dow := s.has(2, t.Day()), s.has(4, int(t.Weekday()))
+	switch {
+	case s.anyDayOfMonth:
+		return dow
+	case s.anyDayOfWeek:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// next returns the first scheduled minute after t, or the zero time, when the schedule
+// never fires
+func (s *schedule) next(t time.Time) time.Time {
+	limit := t.Add(scheduleHorizon)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case !s.matchDay(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+		case !s.has(1, t.Hour()):
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.has(0, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// closeInput closes the access log files of a run
+func closeInput(in io.Reader) {
+	if c, ok := in.(io.Closer); ok && in != os.Stdin {
+		c.Close()
+	}
+}
+
+// scheduledRun replays the access log once, starting at the scheduled time. When the
+// duration is set, the requests are replayed repeatedly for the duration, otherwise they
+// are replayed once. It returns false, when the run was interrupted by a signal.
+func scheduledRun(args []string, start time.Time, duration time.Duration, signals <-chan os.Signal) (logreplay.Stats, bool, error) {
+	in, err := input(args)
+	if err != nil {
+		return logreplay.Stats{}, true, err
+	}
+
+	defer closeInput(in)
+	if in == os.Stdin {
+		return logreplay.Stats{}, true, errScheduleStdin
+	}
+
+	o := options
+	o.AccessLog = in
+	o.StartAt = start
+	p, err := logreplay.New(o)
+	if err != nil {
+		return logreplay.Stats{}, true, err
+	}
+
+	defer p.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- playFunc(p)() }()
+
+	var end <-chan time.Time
+	if duration > 0 {
+		t := time.NewTimer(time.Until(start) + duration)
+		defer t.Stop()
+		end = t.C
+	}
+
+	stop := func() error {
+		go p.Stop()
+		return <-done
+	}
+
+	select {
+	case err = <-done:
+		return p.Stats(), true, err
+	case <-end:
+		if rampDown > 0 {
+			log.Println("ramping down:", rampDown)
+			p.RampDown(rampDown)
+		}
+
+		err = stop()
+		return p.Stats(), true, err
+	case s := <-signals:
+		log.Println("stopping:", s)
+		err = stop()
+		return p.Stats(), false, err
+	}
+}
+
+// runSchedule reruns the replay on a recurring schedule from a long-lived process, and
+// writes the statistics of every run into a separate file named after its start time,
+// which can be printed with the report command. The access log is reopened for every
+// run, so it can be updated between the runs.
+func runSchedule(args []string) {
+	var (
+		cron        string
+		runDuration time.Duration
+		reportDir   string
+	)
+
+	fs := flag.NewFlagSet("schedule", flag.ExitOnError)
+	registerReplayFlags(fs)
+	fs.StringVar(
+		&cron,
+		"cron",
+		"",
+		"the schedule of the runs in the crontab format: minute hour day-of-month month day-of-week, in local time, e.g. '0 2 * * *' for every night at 02:00. The fields accept *, values, ranges, lists and steps, like */15 or 1-5",
+	)
+
+	fs.DurationVar(
+		&runDuration,
+		"run-duration",
+		0,
+		"the duration of a single run, during which the requests are replayed repeatedly. When not set, every run replays the requests once",
+	)
+
+	fs.StringVar(
+		&reportDir,
+		"report-dir",
+		".",
+		"the directory to write the statistics of the runs to, as JSON, named after the start time of the runs",
+	)
+
+	parseReplayFlags(fs, args)
+	if cron == "" {
+		fs.PrintDefaults()
+		log.Fatal(errInvalidSchedule)
+	}
+
+	sc, err := parseSchedule(cron)
+	if err != nil {
+		fs.PrintDefaults()
+		log.Fatal(err)
+	}
+
+	if err := os.MkdirAll(reportDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	once = runDuration <= 0
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	for {
+		start := sc.next(time.Now())
+		log.Println("next run:", start)
+		wait := time.NewTimer(time.Until(start.Add(-scheduleWarmup)))
+		select {
+		case <-wait.C:
+		case s := <-signals:
+			log.Println("stopping:", s)
+			return
+		}
+
+		stats, ok, err := scheduledRun(fs.Args(), start, runDuration, signals)
+		if err != nil {
+			log.Println("run failed:", err)
+		}
+
+		writeStatsFile(filepath.Join(reportDir, start.Format(reportTimeFormat)+".json"), stats)
+		if !quiet {
+			printSummary(stats)
+		}
+
+		if !checkThresholds(stats) {
+			log.Println("run exceeded the failure thresholds:", start)
+		}
+
+		if !ok {
+			return
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// values returns the mask of the listed values
+func values(v ...int) uint64 {
+	var mask uint64
+	for _, vi := range v {
+		mask |= 1 << uint(vi)
+	}
+
+	return mask
+}
+
+func TestParseScheduleField(t *testing.T) {
+	for _, test := range []struct {
+		field    string
+		min, max int
+		expected uint64
+		fail     bool
+	}{
+		{field: "*", min: 0, max: 6, expected: values(0, 1, 2, 3, 4, 5, 6)},
+		{field: "5", min: 0, max: 59, expected: values(5)},
+		{field: "1,3,5", min: 0, max: 59, expected: values(1, 3, 5)},
+		{field: "10-13", min: 0, max: 59, expected: values(10, 11, 12, 13)},
+		{field: "*/15", min: 0, max: 59, expected: values(0, 15, 30, 45)},
+		{field: "5/20", min: 0, max: 59, expected: values(5, 25, 45)},
+		{field: "1-10/3", min: 1, max: 31, expected: values(1, 4, 7, 10)},
+		{field: "*/5", min: 1, max: 12, expected: values(1, 6, 11)},
+		{field: "7", min: 0, max: 6, expected: values(0)},
+		{field: "5-7", min: 0, max: 6, expected: values(0, 5, 6)},
+		{field: "1-7/2", min: 0, max: 6, expected: values(0, 1, 3, 5)},
+		{field: "2-7/2", min: 0, max: 6, expected: values(2, 4, 6)},
+		{field: "0,7", min: 0, max: 6, expected: values(0)},
+		{field: "8", min: 0, max: 6, fail: true},
+		{field: "7", min: 1, max: 12, expected: values(7)},
+		{field: "13", min: 1, max: 12, fail: true},
+		{field: "0", min: 1, max: 31, fail: true},
+		{field: "60", min: 0, max: 59, fail: true},
+		{field: "5-3", min: 0, max: 59, fail: true},
+		{field: "*/0", min: 0, max: 59, fail: true},
+		{field: "a", min: 0, max: 59, fail: true},
+		{field: "1,", min: 0, max: 59, fail: true},
+		{field: "", min: 0, max: 59, fail: true},
+	} {
+		mask, err := parseScheduleField(test.field, test.min, test.max)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: failed to fail", test.field)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.field, err)
+			continue
+		}
+
+		if mask != test.expected {
+			t.Errorf("%s: got: %b, expected: %b", test.field, mask, test.expected)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			panic(err)
+		}
+
+		return t
+	}
+
+	for _, test := range []struct {
+		schedule string
+		from     string
+		expected string
+	}{
+		// 2024-01-01 is a Monday:
+		{schedule: "* * * * *", from: "2024-01-01 10:00", expected: "2024-01-01 10:01"},
+		{schedule: "0 2 * * *", from: "2024-01-01 10:00", expected: "2024-01-02 02:00"},
+		{schedule: "0 2 * * *", from: "2024-01-01 01:59", expected: "2024-01-01 02:00"},
+		{schedule: "*/15 * * * *", from: "2024-01-01 10:07", expected: "2024-01-01 10:15"},
+		{schedule: "30 23 31 12 *", from: "2024-01-01 00:00", expected: "2024-12-31 23:30"},
+		{schedule: "0 0 * * 7", from: "2024-01-01 00:00", expected: "2024-01-07 00:00"},
+		{schedule: "0 0 * * 6-7", from: "2024-01-01 00:00", expected: "2024-01-06 00:00"},
+		{schedule: "0 0 29 2 *", from: "2024-03-01 00:00", expected: "2028-02-29 00:00"},
+
+		// either the day of month or the day of week:
+		{schedule: "0 0 15 * 5", from: "2024-01-01 00:00", expected: "2024-01-05 00:00"},
+		{schedule: "0 0 3 * 5", from: "2024-01-01 00:00", expected: "2024-01-03 00:00"},
+	} {
+		sc, err := parseSchedule(test.schedule)
+		if err != nil {
+			t.Errorf("%s: %v", test.schedule, err)
+			continue
+		}
+
+		if next := sc.next(at(test.from)); !next.Equal(at(test.expected)) {
+			t.Errorf("%s from %s: got: %v, expected: %s", test.schedule, test.from, next, test.expected)
+		}
+	}
+
+	for _, s := range []string{"", "* * * *", "* * * * * *", "0 0 30 2 *"} {
+		if _, err := parseSchedule(s); err == nil {
+			t.Errorf("%q: failed to fail", s)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/aryszka/logreplay"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// the names of the global functions called by the player
+const (
+	scriptRequestFunc  = "request"
+	scriptResponseFunc = "response"
+)
+
+var (
+	errNoScriptHooks   = errors.New("the script defines neither a request nor a response function")
+	errRejectedRequest = errors.New("request rejected by the script")
+)
+
+// script runs the request and response hooks defined in a Lua script. The Lua state is
+// not safe for concurrent use, so the calls are serialized, which also allows the
+// scripts to keep state in global variables.
+type script struct {
+	mx       sync.Mutex
+	state    *lua.LState
+	request  *lua.LFunction
+	response *lua.LFunction
+}
+
+func loadScript(file string) (*script, error) {
+	l := lua.NewState()
+	if err := l.DoFile(file); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	s := &script{state: l}
+	s.request, _ = l.GetGlobal(scriptRequestFunc).(*lua.LFunction)
+	s.response, _ = l.GetGlobal(scriptResponseFunc).(*lua.LFunction)
+	if s.request == nil && s.response == nil {
+		l.Close()
+		return nil, errNoScriptHooks
+	}
+
+	return s, nil
+}
+
+func (s *script) headerTable(h http.Header) *lua.LTable {
+	t := s.state.NewTable()
+	for name, values := range h {
+		t.RawSetString(name, lua.LString(strings.Join(values, ", ")))
+	}
+
+	return t
+}
+
+// readHeaderTable applies the changes made by the script to the headers. The unchanged
+// headers keep their original values, even when they had multiple ones.
+func readHeaderTable(t *lua.LTable, h http.Header) {
+	for name, values := range h {
+		v := t.RawGetString(name)
+		switch {
+		case v == lua.LNil:
+			h.Del(name)
+		case v.String() != strings.Join(values, ", "):
+			h.Set(name, v.String())
+		}
+	}
+
+	t.ForEach(func(k, v lua.LValue) {
+		if _, ok := h[k.String()]; !ok && v != lua.LNil {
+			h.Set(k.String(), v.String())
+		}
+	})
+}
+
+func requestBody(hr *http.Request) (string, bool) {
+	if hr.GetBody == nil {
+		return "", false
+	}
+
+	b, err := hr.GetBody()
+	if err != nil {
+		return "", false
+	}
+
+	defer b.Close()
+	body, err := ioutil.ReadAll(b)
+	return string(body), err == nil
+}
+
+func setRequestBody(hr *http.Request, body string) {
+	if hr.Body != nil {
+		hr.Body.Close()
+	}
+
+	b := []byte(body)
+	hr.Body = ioutil.NopCloser(bytes.NewReader(b))
+	hr.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+
+	hr.ContentLength = int64(len(b))
+	hr.TransferEncoding = nil
+}
+
+func (s *script) call(f *lua.LFunction, t *lua.LTable) (lua.LValue, error) {
+	if err := s.state.CallByParam(lua.P{Fn: f, NRet: 1, Protect: true}, t); err != nil {
+		return lua.LNil, err
+	}
+
+	ret := s.state.Get(-1)
+	s.state.Pop(1)
+	return ret, nil
+}
+
+// onRequest passes the method, the URL, the host, the headers and, when available, the
+// body of the request to the script, and applies the changes made to them. When the
+// script returns false, the request is not sent.
+func (s *script) onRequest(hr *http.Request) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	t := s.state.NewTable()
+	t.RawSetString("method", lua.LString(hr.Method))
+	t.RawSetString("url", lua.LString(hr.URL.String()))
+	t.RawSetString("host", lua.LString(hr.Host))
+	t.RawSetString("headers", s.headerTable(hr.Header))
+	body, hasBody := requestBody(hr)
+	if hasBody {
+		t.RawSetString("body", lua.LString(body))
+	}
+
+	ret, err := s.call(s.request, t)
+	if err != nil {
+		return err
+	}
+
+	if ret == lua.LFalse {
+		return errRejectedRequest
+	}
+
+	hr.Method = t.RawGetString("method").String()
+	hr.Host = t.RawGetString("host").String()
+	if u := t.RawGetString("url").String(); u != hr.URL.String() {
+		pu, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("invalid url set by the script: %w", err)
+		}
+
+		hr.URL = pu
+	}
+
+	if h, ok := t.RawGetString("headers").(*lua.LTable); ok {
+		readHeaderTable(h, hr.Header)
+	}
+
+	if b := t.RawGetString("body"); b != lua.LNil && (!hasBody || b.String() != body) {
+		setRequestBody(hr, b.String())
+	}
+
+	return nil
+}
+
+// onResponse passes the request method and URL, and the status, the headers, the body
+// and the response time in seconds to the script. When the script returns false, the
+// response is counted as an assertion failure.
+func (s *script) onResponse(hr *http.Request, rsp logreplay.Response) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	t := s.state.NewTable()
+	t.RawSetString("method", lua.LString(hr.Method))
+	t.RawSetString("url", lua.LString(hr.URL.String()))
+	t.RawSetString("status", lua.LNumber(rsp.Status))
+	t.RawSetString("headers", s.headerTable(rsp.Header))
+	t.RawSetString("body", lua.LString(rsp.Body))
+	t.RawSetString("latency", lua.LNumber(rsp.Latency.Seconds()))
+
+	ret, err := s.call(s.response, t)
+	if err != nil {
+		log.Println("script error:", err)
+		return false
+	}
+
+	return ret != lua.LFalse
+}
+
+// apply sets the hooks defined by the script in the options
+func (s *script) apply(o *logreplay.Options) {
+	if s.request != nil {
+		o.OnRequest = s.onRequest
+	}
+
+	if s.response != nil {
+		o.OnResponse = s.onResponse
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/aryszka/logreplay"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// the maximum time to wait for the requests in flight when stopping the replay on a signal
+const stopDrainTimeout = 30 * time.Second
+
+// drain waits for the requests in flight to complete, so that their results are counted in
+// the statistics, but not longer than the drain timeout
+func drain(p *logreplay.Player) {
+	drained := make(chan struct{})
+	go func() {
+		p.PauseAndDrain()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(stopDrainTimeout):
+		log.Println("requests in flight not completed in", stopDrainTimeout)
+	}
+}
+
+// stopReplay lets the requests in flight complete, stops the player, prints the summary
+// and exits, with the same exit code as when the replay completes
+func stopReplay(p *logreplay.Player) {
+	stopped := make(chan struct{})
+	go func() {
+		drain(p)
+		p.Stop()
+		close(stopped)
+	}()
+
+	// the replay may have finished already:
+	select {
+	case <-stopped:
+	case <-finished:
+	}
+
+	saveStats(p)
+	summary(p)
+	if !checkThresholds(p.Stats()) {
+		os.Exit(exitThresholdExceeded)
+	}
+
+	os.Exit(0)
+}
+
+// rampDownReplay reduces the load gradually, when ramp-down is set, and stops the replay
+func rampDownReplay(p *logreplay.Player) {
+	if rampDown > 0 {
+		log.Println("ramping down:", rampDown)
+		p.RampDown(rampDown)
+	}
+
+	stopReplay(p)
+}
+
+// handleSignals stops the replay and prints the summary on SIGTERM and SIGINT, toggles
+// pause on SIGUSR1, and prints the current statistics on SIGUSR2. When ramp-down is set,
+// the first SIGTERM or SIGINT starts it, and the second one stops the replay immediately.
+func handleSignals(p *logreplay.Player) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	// the pause state is taken from the player, because the replay can be paused also
+	// from the terminal or over the control API:
+	var rampingDown bool
+	for s := range c {
+		switch s {
+		case syscall.SIGUSR1:
+			if p.Paused() {
+				// the outcome of the replay is handled by the initial call to play:
+				go playFunc(p)()
+				log.Println("playing")
+			} else {
+				p.Pause()
+				log.Println("paused")
+			}
+		case syscall.SIGUSR2:
+			printSummary(p.Stats())
+		default:
+			log.Println("stopping:", s)
+			if rampDown > 0 && !rampingDown && !p.Paused() {
+				rampingDown = true
+				go rampDownReplay(p)
+				continue
+			}
+
+			stopReplay(p)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package logreplay
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// combinedParser parses the Apache2 Combined log format, with the Skipper extensions of
+// the duration and the host, without regular expressions. It sets the same fields of the
+// requests as the regular expression based parser with the equivalent named groups. The
+// quoted fields may contain escaped double quotes, and the fields may be separated by any
+// whitespace.
+type combinedParser struct {
+	timeFormat string
+	log        Logger
+}
+
+// combinedLine holds the position of the parser in a log line
+type combinedLine struct {
+	text string
+	pos  int
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\v' || c == '\f'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isAddressChar accepts the characters of the IPv4 and the IPv6 addresses
+func isAddressChar(c byte) bool {
+	return isDigit(c) || c == '.' || c == ':' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func (l *combinedLine) done() bool {
+	return l.pos >= len(l.text)
+}
+
+func (l *combinedLine) peek() byte {
+	if l.done() {
+		return 0
+	}
+
+	return l.text[l.pos]
+}
+
+func (l *combinedLine) skipSpace() {
+	for !l.done() && isSpace(l.text[l.pos]) {
+		l.pos++
+	}
+}
+
+// token reads the characters accepted by the predicate
+func (l *combinedLine) token(accept func(byte) bool) string {
+	start := l.pos
+	for !l.done() && accept(l.text[l.pos]) {
+		l.pos++
+	}
+
+	return l.text[start:l.pos]
+}
+
+// field reads a field not containing whitespace, and not starting a bracketed or quoted
+// field
+func (l *combinedLine) field() string {
+	return l.token(func(c byte) bool { return !isSpace(c) && c != '[' && c != '"' })
+}
+
+// dash consumes a single dash used in place of a missing field
+func (l *combinedLine) dash() bool {
+	if l.peek() != '-' {
+		return false
+	}
+
+	if l.pos+1 < len(l.text) && !isSpace(l.text[l.pos+1]) {
+		return false
+	}
+
+	l.pos++
+	return true
+}
+
+// remoteAddress reads a comma separated list of addresses, like in the X-Forwarded-For
+// header
+func (l *combinedLine) remoteAddress() (string, bool) {
+	if l.dash() {
+		return "", true
+	}
+
+	start := l.pos
+	for {
+		if l.token(isAddressChar) == "" {
+			return "", false
+		}
+
+		end := l.pos
+		l.skipSpace()
+		if l.peek() != ',' {
+			l.pos = end
+			return l.text[start:end], true
+		}
+
+		l.pos++
+		l.skipSpace()
+	}
+}
+
+// bracketed reads a field enclosed in square brackets, or a dash
+func (l *combinedLine) bracketed() (string, bool) {
+	if l.dash() {
+		return "", true
+	}
+
+	if l.peek() != '[' {
+		return "", false
+	}
+
+	end := strings.IndexByte(l.text[l.pos:], ']')
+	if end < 0 {
+		return "", false
+	}
+
+	v := l.text[l.pos+1 : l.pos+end]
+	l.pos += end + 1
+	return v, true
+}
+
+// quoted reads a field enclosed in double quotes, and unescapes the escaped double quotes
+// and backslashes in it
+func (l *combinedLine) quoted() (string, bool) {
+	if l.peek() != '"' {
+		return "", false
+	}
+
+	var (
+		b       strings.Builder
+		escaped bool
+	)
+
+	start := l.pos + 1
+	for i := start; i < len(l.text); i++ {
+		c := l.text[i]
+		switch {
+		case c == '\\' && i+1 < len(l.text) && (l.text[i+1] == '"' || l.text[i+1] == '\\'):
+			if !escaped {
+				b.WriteString(l.text[start:i])
+				escaped = true
+			}
+
+			i++
+			b.WriteByte(l.text[i])
+		case c == '"':
+			l.pos = i + 1
+			if !escaped {
+				return l.text[start:i], true
+			}
+
+			return b.String(), true
+		case escaped:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", false
+}
+
+// number reads a decimal number, or a dash
+func (l *combinedLine) number() (string, bool) {
+	if l.dash() {
+		return "", true
+	}
+
+	n := l.token(isDigit)
+	return n, n != ""
+}
+
+// message splits the HTTP message into the method, the path and the protocol. The
+// protocol is optional.
+func message(m string) (method, path, protocol string, ok bool) {
+	f := strings.Fields(m)
+	if len(f) < 2 || len(f) > 3 {
+		return "", "", "", false
+	}
+
+	if len(f) == 3 {
+		protocol = f[2]
+	}
+
+	return f[0], f[1], protocol, true
+}
+
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+
+	return s != ""
+}
+
+// parse reads the fields of the line. It returns false when the line doesn't match the
+// format.
+func (l *combinedLine) parse(fields map[string]string) bool {
+	l.skipSpace()
+	remoteAddress, ok := l.remoteAddress()
+	if !ok {
+		return false
+	}
+
+	fields["remoteaddress"] = remoteAddress
+
+	// client identity and user id:
+	for i := 0; i < 2; i++ {
+		l.skipSpace()
+		if l.field() == "" {
+			return false
+		}
+	}
+
+	l.skipSpace()
+	t, ok := l.bracketed()
+	if !ok {
+		return false
+	}
+
+	fields["time"] = t
+
+	l.skipSpace()
+	m, ok := l.quoted()
+	if !ok {
+		return false
+	}
+
+	if fields["method"], fields["path"], fields["protocol"], ok = message(m); !ok {
+		return false
+	}
+
+	l.skipSpace()
+	if fields["status"] = l.token(isDigit); fields["status"] == "" {
+		return false
+	}
+
+	l.skipSpace()
+	if fields["size"], ok = l.number(); !ok {
+		return false
+	}
+
+	// referrer (the comma must be a mistake):
+	l.skipSpace()
+	if _, ok := l.quoted(); ok {
+		if l.peek() == ',' {
+			l.pos++
+		}
+
+		// user agent:
+		l.skipSpace()
+		fields["useragent"], _ = l.quoted()
+	}
+
+	// duration and host, additional fields are ignored:
+	l.skipSpace()
+	if f := l.field(); allDigits(f) {
+		fields["duration"] = f
+		l.skipSpace()
+		fields["host"] = l.field()
+	} else {
+		fields["host"] = f
+	}
+
+	return true
+}
+
+func (p *combinedParser) Parse(line string) *Request {
+	r := &Request{}
+	fields := make(map[string]string)
+	l := &combinedLine{text: line}
+	if !l.parse(fields) {
+		return r
+	}
+
+	for name, value := range fields {
+		if value == "" {
+			delete(fields, name)
+		}
+	}
+
+	if len(fields) > 0 {
+		r.Fields = fields
+	}
+
+	r.RemoteAddress = fields["remoteaddress"]
+	r.Method = fields["method"]
+	r.Path = fields["path"]
+	r.Protocol = fields["protocol"]
+	r.UserAgent = fields["useragent"]
+	r.Host = fields["host"]
+	if s, err := strconv.Atoi(fields["status"]); err == nil {
+		r.LoggedStatus = s
+	}
+
+	if s, err := strconv.ParseInt(fields["size"], 10, 64); err == nil {
+		r.LoggedSize = s
+	}
+
+	if d, err := strconv.ParseInt(fields["duration"], 10, 64); err == nil {
+		r.LoggedDuration = time.Duration(d) * time.Millisecond
+	}
+
+	if t := fields["time"]; t != "" {
+		pt, err := parseTime(p.timeFormat, t)
+		if err != nil {
+			p.log.Debugln("failed to parse the time of the log entry:", err)
+		} else {
+			r.Time = pt
+		}
+	}
+
+	absoluteForm(r)
+	return r
+}
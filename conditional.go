@@ -0,0 +1,113 @@
+package logreplay
+
+import (
+	"net/http"
+	"sync"
+)
+
+// validators are the cache validators received for a resource
+type validators struct {
+	etag         string
+	lastModified string
+}
+
+// validatorCache holds the validators received in a session, like the cache of a browser.
+// The responses may be received on a different goroutine than where the next request is
+// prepared.
+type validatorCache struct {
+	mx     sync.Mutex
+	values map[string]validators
+}
+
+func (vc *validatorCache) get(key string) (validators, bool) {
+	vc.mx.Lock()
+	defer vc.mx.Unlock()
+	v, ok := vc.values[key]
+	return v, ok
+}
+
+func (vc *validatorCache) set(key string, v validators) {
+	vc.mx.Lock()
+	defer vc.mx.Unlock()
+	if vc.values == nil {
+		vc.values = make(map[string]validators)
+	}
+
+	vc.values[key] = v
+}
+
+// validatorKey identifies a resource by the host and the URI of the request. Only the GET
+// and HEAD requests are considered.
+func validatorKey(hr *http.Request) (string, bool) {
+	if hr.Method != "GET" && hr.Method != "HEAD" {
+		return "", false
+	}
+
+	return hr.Host + hr.URL.RequestURI(), true
+}
+
+// conditional sets the conditional headers on a request, when an earlier response of the
+// session contained validators for the same resource. The headers set explicitly, e.g.
+// in the options, are not overridden.
+func (c *client) conditional(hr *http.Request) {
+	if !c.options.ConditionalRequests {
+		return
+	}
+
+	key, ok := validatorKey(hr)
+	if !ok {
+		return
+	}
+
+	v, ok := c.validators.get(key)
+	if !ok {
+		return
+	}
+
+	if v.etag != "" && hr.Header.Get("If-None-Match") == "" {
+		hr.Header.Set("If-None-Match", v.etag)
+	}
+
+	if v.lastModified != "" && hr.Header.Get("If-Modified-Since") == "" {
+		hr.Header.Set("If-Modified-Since", v.lastModified)
+	}
+}
+
+// storeValidators stores the validators received in a response. A 304 Not Modified
+// response updates only the validators that it contains.
+func (c *client) storeValidators(hr *http.Request, rsp response) {
+	if !c.options.ConditionalRequests {
+		return
+	}
+
+	if rsp.status != http.StatusOK && rsp.status != http.StatusNotModified {
+		return
+	}
+
+	key, ok := validatorKey(hr)
+	if !ok {
+		return
+	}
+
+	v := validators{
+		etag:         rsp.header.Get("ETag"),
+		lastModified: rsp.header.Get("Last-Modified"),
+	}
+
+	if rsp.status == http.StatusNotModified {
+		prev, _ := c.validators.get(key)
+		if v.etag == "" {
+			v.etag = prev.etag
+		}
+
+		if v.lastModified == "" {
+			v.lastModified = prev.lastModified
+		}
+	}
+
+	if v.etag == "" && v.lastModified == "" {
+		return
+	}
+
+	c.validators.set(key, v)
+}
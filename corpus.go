@@ -0,0 +1,188 @@
+package logreplay
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Corpus is a set of sample payloads, from which the player picks the body of the POST,
+// PUT and PATCH requests randomly.
+type Corpus struct {
+
+	// PathPattern is a regular expression matched against the request path. When empty,
+	// the corpus is used for all requests.
+	PathPattern string
+
+	// Path is a directory, or a .zip, .tar, .tar.gz or .tgz archive, containing one
+	// sample payload per file.
+	Path string
+}
+
+type corpus struct {
+	path     *regexp.Regexp
+	payloads [][]byte
+}
+
+// ErrEmptyCorpus is returned by New() when a corpus does not contain any payloads.
+var ErrEmptyCorpus = errors.New("empty corpus")
+
+func readCorpusDir(dir string) ([][]byte, error) {
+	var names []string
+	if err := filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			names = append(names, name)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	var p [][]byte
+	for _, n := range names {
+		b, err := ioutil.ReadFile(n)
+		if err != nil {
+			return nil, err
+		}
+
+		p = append(p, b)
+	}
+
+	return p, nil
+}
+
+func readCorpusZip(name string) ([][]byte, error) {
+	z, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer z.Close()
+
+	var p [][]byte
+	for _, f := range z.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		p = append(p, b)
+	}
+
+	return p, nil
+}
+
+func readCorpusTar(name string, compressed bool) ([][]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var r io.Reader = f
+	if compressed {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+
+		defer gr.Close()
+		r = gr
+	}
+
+	var p [][]byte
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return p, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		p = append(p, b)
+	}
+}
+
+func readCorpus(name string) ([][]byte, error) {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return readCorpusZip(name)
+	case strings.HasSuffix(name, ".tar"):
+		return readCorpusTar(name, false)
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return readCorpusTar(name, true)
+	default:
+		return readCorpusDir(name)
+	}
+}
+
+func loadCorpora(c []Corpus) ([]corpus, error) {
+	var l []corpus
+	for _, ci := range c {
+		rx, err := regexp.Compile(ci.PathPattern)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := readCorpus(ci.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(p) == 0 {
+			return nil, ErrEmptyCorpus
+		}
+
+		l = append(l, corpus{path: rx, payloads: p})
+	}
+
+	return l, nil
+}
+
+func pickCorpusPayload(rnd *rand.Rand, c []corpus, path string) ([]byte, bool) {
+	for _, ci := range c {
+		if ci.path.MatchString(path) {
+			return ci.payloads[rnd.Intn(len(ci.payloads))], true
+		}
+	}
+
+	return nil, false
+}
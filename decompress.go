@@ -0,0 +1,73 @@
+package logreplay
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// countingReader counts the bytes read from the response body, before decompression
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// decoder returns a reader decompressing the body of a response, or nil, when the content
+// encoding is not supported. Decoding an empty body, e.g. of a HEAD request, results in
+// an empty reader.
+func decoder(encoding string, body io.Reader) (io.Reader, error) {
+	var (
+		r   io.Reader
+		err error
+	)
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(body)
+	case "deflate":
+		r, err = zlib.NewReader(body)
+	default:
+		return nil, nil
+	}
+
+	if err == io.EOF {
+		return body, nil
+	}
+
+	return r, err
+}
+
+// responseBody returns the reader of the response body, decompressed when it is enabled
+// in the options and the content encoding is supported. When the transport decompressed
+// the body already, it is returned as it is.
+func (c *client) responseBody(rsp *http.Response, body io.Reader) io.Reader {
+	if !c.options.DecompressResponses || rsp.Uncompressed {
+		return body
+	}
+
+	encoding := rsp.Header.Get("Content-Encoding")
+	if encoding == "" {
+		return body
+	}
+
+	r, err := decoder(encoding, body)
+	if err != nil {
+		c.options.Log.Warnln("failed to decompress the response:", err)
+		return body
+	}
+
+	if r == nil {
+		c.options.Log.Debugln("unsupported content encoding:", encoding)
+		return body
+	}
+
+	return r
+}
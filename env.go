@@ -0,0 +1,103 @@
+package logreplay
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+)
+
+// matches the ${NAME} references. The $NAME form is not supported, because the header
+// values and the templates may contain a literal $.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${NAME} references with the value of the environment variables.
+// It fails when a referenced variable is not set, to prevent sending requests with missing
+// credentials.
+func expandEnv(s string) (string, error) {
+	var missing string
+	e := envReference.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok && missing == "" {
+			missing = name
+		}
+
+		return v
+	})
+
+	if missing != "" {
+		return "", fmt.Errorf("%w: %s", ErrUndefinedEnv, missing)
+	}
+
+	return e, nil
+}
+
+func expandEnvMap(m map[string]string) (map[string]string, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	e := make(map[string]string)
+	for k, v := range m {
+		var err error
+		if e[k], err = expandEnv(v); err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+func expandEnvHeader(h http.Header) (http.Header, error) {
+	if h == nil {
+		return nil, nil
+	}
+
+	e := make(http.Header)
+	for k, vs := range h {
+		for _, v := range vs {
+			ev, err := expandEnv(v)
+			if err != nil {
+				return nil, err
+			}
+
+			e[k] = append(e[k], ev)
+		}
+	}
+
+	return e, nil
+}
+
+// expandEnvOptions expands the environment variable references in the options holding
+// the credentials and the addresses. The body templates are expanded when they are
+// parsed.
+func expandEnvOptions(o Options) (Options, error) {
+	var err error
+	for _, s := range []*string{
+		&o.BasicAuth,
+		&o.OAuth2TokenURL,
+		&o.OAuth2ClientID,
+		&o.OAuth2ClientSecret,
+		&o.Server,
+		&o.Shadow,
+	} {
+		if *s, err = expandEnv(*s); err != nil {
+			return Options{}, err
+		}
+	}
+
+	if o.Headers, err = expandEnvHeader(o.Headers); err != nil {
+		return Options{}, err
+	}
+
+	if o.HostBasicAuth, err = expandEnvMap(o.HostBasicAuth); err != nil {
+		return Options{}, err
+	}
+
+	if o.Resolve, err = expandEnvMap(o.Resolve); err != nil {
+		return Options{}, err
+	}
+
+	return o, nil
+}
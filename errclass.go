@@ -0,0 +1,92 @@
+package logreplay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ErrorClass is the category of a failed request, used in the statistics.
+type ErrorClass string
+
+const (
+
+	// DNSError is the class of the requests failed due to a name lookup error.
+	DNSError ErrorClass = "dns"
+
+	// ConnectionRefused is the class of the requests whose connection was refused by the
+	// target.
+	ConnectionRefused ErrorClass = "connection-refused"
+
+	// TLSError is the class of the requests failed during the TLS handshake, e.g. due
+	// to an invalid certificate.
+	TLSError ErrorClass = "tls"
+
+	// Timeout is the class of the requests that timed out.
+	Timeout ErrorClass = "timeout"
+
+	// ClientError is the class of the responses with a 4xx status code.
+	ClientError ErrorClass = "4xx"
+
+	// ServerError is the class of the responses with a 5xx status code.
+	ServerError ErrorClass = "5xx"
+
+	// OtherError is the class of the requests failed for any other reason, e.g. the
+	// connection was reset, or too many redirects.
+	OtherError ErrorClass = "other"
+)
+
+func isTLSError(err error) bool {
+	var (
+		record    tls.RecordHeaderError
+		authority x509.UnknownAuthorityError
+		invalid   x509.CertificateInvalidError
+		hostname  x509.HostnameError
+	)
+
+	return errors.As(err, &record) ||
+		errors.As(err, &authority) ||
+		errors.As(err, &invalid) ||
+		errors.As(err, &hostname) ||
+		strings.Contains(err.Error(), "tls: ")
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// classifyError returns the class of a failed request, or an empty string, when the
+// request succeeded
+func classifyError(err error, status int) ErrorClass {
+	switch {
+	case status >= 500:
+		return ServerError
+	case status >= 400:
+		return ClientError
+	case status > 0 || err == nil:
+		return ""
+	}
+
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return DNSError
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectionRefused
+	case isTimeout(err):
+		return Timeout
+	case isTLSError(err):
+		return TLSError
+	default:
+		return OtherError
+	}
+}
@@ -0,0 +1,145 @@
+package logreplay
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultEventBuffer is the size of the buffer of the event channel when not specified
+// otherwise.
+const DefaultEventBuffer = 1024
+
+// EventType identifies the kind of an Event.
+type EventType int
+
+const (
+
+	// RequestSent is emitted when a request is about to be sent.
+	RequestSent EventType = iota
+
+	// ResponseReceived is emitted when a response was received, including the 5xx
+	// responses.
+	ResponseReceived
+
+	// RequestError is emitted when a request failed without a response, or it could not
+	// be created.
+	RequestError
+
+	// LoopCompleted is emitted when a session reached the end of the requests, either
+	// starting over, or, in case of Once(), finishing.
+	LoopCompleted
+
+	// Halted is emitted when the player stopped due to an error or a halt rule.
+	Halted
+)
+
+// Event is emitted by the player on the channel returned by Events().
+type Event struct {
+
+	// Type is the kind of the event.
+	Type EventType
+
+	// Time is when the event occurred.
+	Time time.Time
+
+	// Request is the replayed request, set for RequestSent, ResponseReceived and
+	// RequestError.
+	Request *Request
+
+	// Method and URL are the method and the URL of the request as sent, set for
+	// RequestSent, ResponseReceived and, when the request was created, RequestError.
+	Method string
+	URL    string
+
+	// Status and Latency are set for ResponseReceived.
+	Status  int
+	Latency time.Duration
+
+	// Err is set for RequestError and Halted.
+	Err error
+}
+
+func (t EventType) String() string {
+	switch t {
+	case RequestSent:
+		return "request sent"
+	case ResponseReceived:
+		return "response received"
+	case RequestError:
+		return "request error"
+	case LoopCompleted:
+		return "loop completed"
+	case Halted:
+		return "halted"
+	default:
+		return "unknown"
+	}
+}
+
+// eventChannel is created on the first call to Events(). Until then, the events are not
+// emitted.
+type eventChannel struct {
+	mx      sync.Mutex
+	size    int
+	channel atomic.Value
+}
+
+func newEventChannel(o Options) *eventChannel {
+	size := o.EventBuffer
+	if size <= 0 {
+		size = DefaultEventBuffer
+	}
+
+	return &eventChannel{size: size}
+}
+
+func (ec *eventChannel) get() chan Event {
+	ec.mx.Lock()
+	defer ec.mx.Unlock()
+	if c, ok := ec.channel.Load().(chan Event); ok {
+		return c
+	}
+
+	c := make(chan Event, ec.size)
+	ec.channel.Store(c)
+	return c
+}
+
+// emit sends an event without blocking. When the buffer is full, the event is dropped.
+func (ec *eventChannel) emit(e Event) {
+	c, ok := ec.channel.Load().(chan Event)
+	if !ok {
+		return
+	}
+
+	e.Time = time.Now()
+	select {
+	case c <- e:
+	default:
+	}
+}
+
+func (c *client) emitRequest(t EventType, o *outgoing, r result) {
+	c.shared.events.emit(Event{
+		Type:    t,
+		Request: o.request,
+		Method:  o.httpRequest.Method,
+		URL:     o.httpRequest.URL.String(),
+		Status:  r.status,
+		Latency: r.latency,
+		Err:     r.err,
+	})
+}
+
+// emitResult emits the event of a completed request
+func (c *client) emitResult(o *outgoing, r result) {
+	if r.status == 0 {
+		c.emitRequest(RequestError, o, r)
+		return
+	}
+
+	// the error of the 5xx responses is not reported:
+	r.err = nil
+	c.emitRequest(ResponseReceived, o, r)
+}
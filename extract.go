@@ -0,0 +1,247 @@
+package logreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Extraction captures a value from the responses into a session variable. The variables
+// are available in the templates of the later requests of the same session, as
+// .Vars.name, e.g. to use the ID of a resource created by an earlier request. Exactly one
+// of JSONPath, Regexp and Header needs to be set.
+type Extraction struct {
+
+	// Name is the name of the session variable.
+	Name string
+
+	// PathPattern, when set, is a regular expression that the path of the request needs
+	// to match for the extraction to be applied.
+	PathPattern string
+
+	// JSONPath selects the value from a JSON response body, e.g. $.items[0].id. Only
+	// object fields and array indexes are supported. When the selected value is not a
+	// string or a number, its JSON representation is stored.
+	JSONPath string
+
+	// Regexp is matched against the response body. The first submatch is stored, or
+	// the whole match, when the expression has no groups.
+	Regexp string
+
+	// Header is the name of the response header whose value is stored.
+	Header string
+}
+
+// sessionVars holds the values extracted from the responses of a session. The responses
+// may be received on a different goroutine than where the next request is prepared.
+type sessionVars struct {
+	mx     sync.Mutex
+	values map[string]string
+}
+
+func (v *sessionVars) set(name, value string) {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+	if v.values == nil {
+		v.values = make(map[string]string)
+	}
+
+	v.values[name] = value
+}
+
+// snapshot returns a copy of the current values
+func (v *sessionVars) snapshot() map[string]string {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+	if len(v.values) == 0 {
+		return nil
+	}
+
+	s := make(map[string]string, len(v.values))
+	for name, value := range v.values {
+		s[name] = value
+	}
+
+	return s
+}
+
+// parseJSONPath splits a path like $.items[0].id into object fields and array indexes
+func parseJSONPath(p string) ([]interface{}, error) {
+	p = strings.TrimPrefix(strings.TrimPrefix(p, "$"), ".")
+	if p == "" {
+		return nil, nil
+	}
+
+	var steps []interface{}
+	for _, part := range strings.Split(p, ".") {
+		field := part
+		var indexes []int
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			field = part[:i]
+			for _, ix := range strings.Split(strings.TrimSuffix(part[i+1:], "]"), "][") {
+				n, err := strconv.Atoi(ix)
+				if err != nil || n < 0 || !strings.HasSuffix(part, "]") {
+					return nil, fmt.Errorf("%w: %s", ErrInvalidExtraction, p)
+				}
+
+				indexes = append(indexes, n)
+			}
+		}
+
+		if field == "" && len(indexes) == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidExtraction, p)
+		}
+
+		if field != "" {
+			steps = append(steps, field)
+		}
+
+		for _, n := range indexes {
+			steps = append(steps, n)
+		}
+	}
+
+	return steps, nil
+}
+
+func selectJSON(body []byte, steps []interface{}) (string, bool) {
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return "", false
+	}
+
+	for _, s := range steps {
+		switch st := s.(type) {
+		case string:
+			o, ok := v.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+
+			if v, ok = o[st]; !ok {
+				return "", false
+			}
+		case int:
+			a, ok := v.([]interface{})
+			if !ok || st >= len(a) {
+				return "", false
+			}
+
+			v = a[st]
+		}
+	}
+
+	switch vt := v.(type) {
+	case string:
+		return vt, true
+	case json.Number:
+		return vt.String(), true
+	default:
+		b, err := json.Marshal(vt)
+		return string(b), err == nil
+	}
+}
+
+// validateExtractions checks the extractions, and compiles their regular expressions
+func validateExtractions(rc *regexpCache, e []Extraction) error {
+	for _, ei := range e {
+		var sources int
+		for _, s := range []string{ei.JSONPath, ei.Regexp, ei.Header} {
+			if s != "" {
+				sources++
+			}
+		}
+
+		if ei.Name == "" || sources != 1 {
+			return fmt.Errorf("%w: %s", ErrInvalidExtraction, ei.Name)
+		}
+
+		if ei.JSONPath != "" {
+			if _, err := parseJSONPath(ei.JSONPath); err != nil {
+				return err
+			}
+		}
+
+		for _, expr := range []string{ei.PathPattern, ei.Regexp} {
+			if expr == "" {
+				continue
+			}
+
+			if _, err := rc.get(expr); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func hasBodyExtraction(e []Extraction) bool {
+	for _, ei := range e {
+		if ei.JSONPath != "" || ei.Regexp != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *client) extractValue(e Extraction, header http.Header, body []byte) (string, bool) {
+	switch {
+	case e.Header != "":
+		v := header.Get(e.Header)
+		return v, v != ""
+	case e.JSONPath != "":
+		steps, err := parseJSONPath(e.JSONPath)
+		if err != nil {
+			return "", false
+		}
+
+		return selectJSON(body, steps)
+	default:
+		rx, err := c.shared.regexps.get(e.Regexp)
+		if err != nil {
+			return "", false
+		}
+
+		m := rx.FindSubmatch(body)
+		switch len(m) {
+		case 0:
+			return "", false
+		case 1:
+			return string(m[0]), true
+		default:
+			return string(m[1]), true
+		}
+	}
+}
+
+// extract stores the values selected by the extractions from a response. When a value is
+// not found, the variable keeps its previous value.
+func (c *client) extract(o *outgoing, rsp response) {
+	if len(c.options.Extractions) == 0 || rsp.status == 0 {
+		return
+	}
+
+	path := o.httpRequest.URL.Path
+	for _, e := range c.options.Extractions {
+		if e.PathPattern != "" && !c.match(e.PathPattern, []byte(path)) {
+			continue
+		}
+
+		v, ok := c.extractValue(e, rsp.header, rsp.body)
+		if !ok {
+			c.options.Log.Debugln("value not found for extraction:", e.Name, o.httpRequest.Method, path)
+			continue
+		}
+
+		c.vars.set(e.Name, v)
+	}
+}
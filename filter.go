@@ -0,0 +1,174 @@
+package logreplay
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTimeFormat is the format of the timestamps in the Apache access logs.
+const DefaultTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// entryFilter selects the log entries to be replayed
+type entryFilter struct {
+	from, to        time.Time
+	methods         map[string]bool
+	excludeMethods  map[string]bool
+	statuses        map[string]bool
+	excludeStatuses map[string]bool
+}
+
+func methodSet(m []string) map[string]bool {
+	if len(m) == 0 {
+		return nil
+	}
+
+	s := make(map[string]bool)
+	for _, mi := range m {
+		s[strings.ToUpper(mi)] = true
+	}
+
+	return s
+}
+
+func statusSet(s []string) (map[string]bool, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	m := make(map[string]bool)
+	for _, si := range s {
+		si = strings.ToLower(strings.TrimSpace(si))
+		if !validStatusKey(si) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidStatusFilter, si)
+		}
+
+		m[si] = true
+	}
+
+	return m, nil
+}
+
+func newEntryFilter(o Options) (*entryFilter, error) {
+	statuses, err := statusSet(o.Statuses)
+	if err != nil {
+		return nil, err
+	}
+
+	excludeStatuses, err := statusSet(o.ExcludeStatuses)
+	if err != nil {
+		return nil, err
+	}
+
+	return &entryFilter{
+		from:            o.From,
+		to:              o.To,
+		methods:         methodSet(o.Methods),
+		excludeMethods:  methodSet(o.ExcludeMethods),
+		statuses:        statuses,
+		excludeStatuses: excludeStatuses,
+	}, nil
+}
+
+func (f *entryFilter) inRange(t time.Time) bool {
+	if f.from.IsZero() && f.to.IsZero() {
+		return true
+	}
+
+	if t.IsZero() {
+		return false
+	}
+
+	return (f.from.IsZero() || !t.Before(f.from)) && (f.to.IsZero() || t.Before(f.to))
+}
+
+func (f *entryFilter) acceptMethod(m string) bool {
+	if m == "" {
+		m = "GET"
+	}
+
+	m = strings.ToUpper(m)
+	return (f.methods == nil || f.methods[m]) && !f.excludeMethods[m]
+}
+
+// matchStatus tells whether the status code or its class is in the set
+func matchStatus(set map[string]bool, status int) bool {
+	if status == 0 {
+		return false
+	}
+
+	code := strconv.Itoa(status)
+	return set[code] || set[code[:1]+"xx"]
+}
+
+func (f *entryFilter) acceptStatus(s int) bool {
+	return (f.statuses == nil || matchStatus(f.statuses, s)) && !matchStatus(f.excludeStatuses, s)
+}
+
+func (f *entryFilter) accept(r *Request) bool {
+	return f.inRange(r.Time) && f.acceptMethod(r.Method) && f.acceptStatus(r.LoggedStatus)
+}
+
+// parseTime parses the time of a log entry, trying RFC3339, when the configured format
+// doesn't match
+func parseTime(format, value string) (time.Time, error) {
+	t, err := time.Parse(format, value)
+	if err == nil {
+		return t, nil
+	}
+
+	if t, errRFC := time.Parse(time.RFC3339Nano, value); errRFC == nil {
+		return t, nil
+	}
+
+	return time.Time{}, err
+}
+
+// deduplicator drops the repeated log entries, identified by their method, host and path,
+// including the query
+type deduplicator struct {
+	weights bool
+	seen    map[string]*Request
+}
+
+func newDeduplicator(o Options) *deduplicator {
+	if !o.Deduplicate {
+		return nil
+	}
+
+	return &deduplicator{
+		weights: o.DeduplicateWeights,
+		seen:    make(map[string]*Request),
+	}
+}
+
+// duplicate returns true when the request was already seen. When counting the weights,
+// the weight of the first occurrence is incremented.
+func (d *deduplicator) duplicate(r *Request) bool {
+	if d == nil {
+		return false
+	}
+
+	m := strings.ToUpper(r.Method)
+	if m == "" {
+		m = "GET"
+	}
+
+	key := m + " " + r.Host + " " + r.Path
+	first, ok := d.seen[key]
+	if !ok {
+		d.seen[key] = r
+		if d.weights && r.Weight <= 0 {
+			r.Weight = 1
+		}
+
+		return false
+	}
+
+	if d.weights {
+		first.Weight++
+	}
+
+	return true
+}
@@ -0,0 +1,79 @@
+package logreplay
+
+import (
+	"net/url"
+	"strings"
+)
+
+// the maximum length of the random query values
+const maxFuzzLength = 64
+
+// printable characters, including the ones with special meaning in URLs
+const fuzzChars = chars + "0123456789" + "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+// the numbers at the edges of the common integer and float ranges
+var boundaryNumbers = []string{
+	"0",
+	"-1",
+	"2147483647",
+	"-2147483648",
+	"2147483648",
+	"4294967296",
+	"9223372036854775807",
+	"-9223372036854775808",
+	"18446744073709551616",
+	"1e309",
+	"NaN",
+}
+
+// splitPath splits the path of a request from its query
+func splitPath(p string) (string, string) {
+	if i := strings.IndexByte(p, '?'); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+
+	return p, ""
+}
+
+func (c *client) fuzzValue() string {
+	kinds := 2
+	if len(c.options.QueryFuzzWords) > 0 {
+		kinds = 3
+	}
+
+	switch c.random.Intn(kinds) {
+	case 0:
+		return string(randomBytes(c.random, fuzzChars, 1+c.random.Intn(maxFuzzLength)))
+	case 1:
+		return boundaryNumbers[c.random.Intn(len(boundaryNumbers))]
+	default:
+		return c.options.QueryFuzzWords[c.random.Intn(len(c.options.QueryFuzzWords))]
+	}
+}
+
+// fuzzQuery replaces the query parameter values with random values, at the rate set in
+// the options. When no value was replaced, the original query is returned unchanged.
+func (c *client) fuzzQuery(q string) string {
+	if c.options.QueryFuzzRate <= 0 || q == "" {
+		return q
+	}
+
+	// the values parsed before a malformed part are still used:
+	v, _ := url.ParseQuery(q)
+
+	var fuzzed bool
+	for _, values := range v {
+		for i := range values {
+			if c.random.Float64() < c.options.QueryFuzzRate {
+				values[i] = c.fuzzValue()
+				fuzzed = true
+			}
+		}
+	}
+
+	if !fuzzed {
+		return q
+	}
+
+	return v.Encode()
+}
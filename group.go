@@ -0,0 +1,186 @@
+package logreplay
+
+import "sync"
+
+// Group runs multiple players together, e.g. to model a mixed workload from different
+// access logs, with different options and targets. The players are started, paused and
+// stopped together, and their statistics can be read merged.
+type Group struct {
+	mx      sync.Mutex
+	members []*groupMember
+}
+
+// groupMember tracks the pending Play() and Once() calls of a player, because the
+// signals can be sent to a player only while it is running
+type groupMember struct {
+	player *Player
+	calls  int
+
+	// closed when the last pending call returned
+	done signalChannel
+}
+
+// NewGroup initializes a group, with a player for each of the options.
+func NewGroup(o ...Options) (*Group, error) {
+	if len(o) == 0 {
+		return nil, ErrEmptyGroup
+	}
+
+	g := &Group{}
+	for _, oi := range o {
+		p, err := New(oi)
+		if err != nil {
+			return nil, err
+		}
+
+		g.members = append(g.members, &groupMember{player: p})
+	}
+
+	return g, nil
+}
+
+// dropSignals discards the signals that were sent to the player after it stopped,
+// before it is started again
+func (p *Player) dropSignals() {
+	for _, s := range []chan signalChannel{p.signalPause, p.signalDrain, p.signalStop} {
+		select {
+		case d := <-s:
+			close(d)
+		default:
+		}
+	}
+}
+
+func (g *Group) start(m *groupMember) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	if m.calls == 0 {
+		m.player.dropSignals()
+		m.done = make(signalChannel)
+	}
+
+	m.calls++
+}
+
+func (g *Group) finish(m *groupMember) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	m.calls--
+	if m.calls == 0 {
+		close(m.done)
+	}
+}
+
+// run starts or resumes every player, and waits until all of them have finished. When
+// a player fails, it stops the rest, and returns the first error.
+func (g *Group) run(f func(*Player) error) error {
+	errs := make(chan error, len(g.members))
+	for _, m := range g.members {
+		g.start(m)
+		go func(m *groupMember) {
+			err := f(m.player)
+			g.finish(m)
+			errs <- err
+		}(m)
+	}
+
+	var first error
+	for range g.members {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+			g.Stop()
+		}
+	}
+
+	return first
+}
+
+// signal sends a signal to the running players at the same time, and waits until all
+// of them have processed it
+func (g *Group) signal(s func(*Player) chan signalChannel) {
+	g.mx.Lock()
+	var running []*groupMember
+	for _, m := range g.members {
+		if m.calls > 0 {
+			running = append(running, &groupMember{player: m.player, done: m.done})
+		}
+	}
+
+	g.mx.Unlock()
+
+	var wg sync.WaitGroup
+	for _, m := range running {
+		wg.Add(1)
+		go func(m *groupMember) {
+			defer wg.Done()
+
+			// the player may stop while signaling it:
+			d := make(signalChannel)
+			select {
+			case s(m.player) <- d:
+			case <-m.done:
+				return
+			}
+
+			select {
+			case <-d:
+			case <-m.done:
+			}
+		}(m)
+	}
+
+	wg.Wait()
+}
+
+// Players returns the players of the group, e.g. to change their throttle or
+// concurrency individually.
+func (g *Group) Players() []*Player {
+	var p []*Player
+	for _, m := range g.members {
+		p = append(p, m.player)
+	}
+
+	return p
+}
+
+// Play starts or resumes the players, replaying their requests infinitely. It blocks until
+// all the players have stopped. When a player fails, e.g. because it reached its halt
+// threshold, the rest of the players are stopped, and the first error is returned.
+func (g *Group) Play() error {
+	return g.run((*Player).Play)
+}
+
+// Once starts or resumes the players, replaying their requests once. It blocks until all
+// the players have finished. When a player fails, the rest of the players are stopped, and
+// the first error is returned.
+func (g *Group) Once() error {
+	return g.run((*Player).Once)
+}
+
+// Pause pauses the running players, without waiting for their requests in flight.
+func (g *Group) Pause() {
+	g.signal(func(p *Player) chan signalChannel { return p.signalPause })
+}
+
+// PauseAndDrain pauses the running players, and blocks until their requests in flight have
+// completed.
+func (g *Group) PauseAndDrain() {
+	g.signal(func(p *Player) chan signalChannel { return p.signalDrain })
+}
+
+// Stop stops the running players. Unlike Player.Stop(), it can be called any number of
+// times, also when the players have already finished.
+func (g *Group) Stop() {
+	g.signal(func(p *Player) chan signalChannel { return p.signalStop })
+}
+
+// Stats returns the statistics of the players merged. Unlike MergeStats(), it merges the
+// latency histograms of the players, so the percentiles are exact.
+func (g *Group) Stats() Stats {
+	s := newStats()
+	for _, m := range g.members {
+		s.merge(m.player.stats.merged())
+	}
+
+	return s.get()
+}
@@ -0,0 +1,185 @@
+package logreplay
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// the histogram stores the durations in microseconds, in buckets with a relative
+// resolution of 1/16: the values below 32 are stored in their own bucket, and every
+// further power of two range is divided into 16 buckets
+const (
+	histogramSubBuckets = 16
+	histogramBuckets    = (64 - 4) * histogramSubBuckets
+)
+
+type histogram struct {
+	counts [histogramBuckets]uint64
+	count  uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+func histogramBucket(us uint64) int {
+	if us < 2*histogramSubBuckets {
+		return int(us)
+	}
+
+	e := bits.Len64(us) - 5
+	return e*histogramSubBuckets + int(us>>uint(e))
+}
+
+// returns the middle of the bucket
+func histogramValue(b int) time.Duration {
+	if b < 2*histogramSubBuckets {
+		return time.Duration(b) * time.Microsecond
+	}
+
+	e := uint(b/histogramSubBuckets - 1)
+	m := uint64(b%histogramSubBuckets + histogramSubBuckets)
+	us := m<<e + (uint64(1)<<e)/2
+	return time.Duration(us) * time.Microsecond
+}
+
+func (h *histogram) add(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	h.counts[histogramBucket(uint64(d/time.Microsecond))]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+
+	if d > h.max {
+		h.max = d
+	}
+
+	h.count++
+	h.sum += d
+}
+
+// atomicHistogram is a histogram that can be updated concurrently without locking
+type atomicHistogram struct {
+	counts [histogramBuckets]uint64
+	sum    int64
+	max    int64
+
+	// the minimum is stored as its distance from the largest duration, so that the zero
+	// value means no measurements both for the minimum and the maximum
+	minDistance int64
+}
+
+// storeMax sets the value at the address when it is greater than the current one
+func storeMax(addr *int64, v int64) {
+	for {
+		current := atomic.LoadInt64(addr)
+		if v <= current || atomic.CompareAndSwapInt64(addr, current, v) {
+			return
+		}
+	}
+}
+
+func (h *atomicHistogram) add(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	atomic.AddUint64(&h.counts[histogramBucket(uint64(d/time.Microsecond))], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	storeMax(&h.max, int64(d))
+	storeMax(&h.minDistance, math.MaxInt64-int64(d))
+}
+
+// load returns a copy of the histogram. The count is taken from the buckets, so that the
+// percentiles are consistent even when the histogram is updated during the copy.
+func (h *atomicHistogram) load() histogram {
+	var c histogram
+	for i := range h.counts {
+		c.counts[i] = atomic.LoadUint64(&h.counts[i])
+		c.count += c.counts[i]
+	}
+
+	if c.count == 0 {
+		return histogram{}
+	}
+
+	c.sum = time.Duration(atomic.LoadInt64(&h.sum))
+	c.max = time.Duration(atomic.LoadInt64(&h.max))
+	c.min = time.Duration(math.MaxInt64 - atomic.LoadInt64(&h.minDistance))
+	return c
+}
+
+func (h *histogram) merge(from *histogram) {
+	if from.count == 0 {
+		return
+	}
+
+	for i, c := range from.counts {
+		h.counts[i] += c
+	}
+
+	if h.count == 0 || from.min < h.min {
+		h.min = from.min
+	}
+
+	if from.max > h.max {
+		h.max = from.max
+	}
+
+	h.count += from.count
+	h.sum += from.sum
+}
+
+// percentile returns the approximate value below which the p fraction of the values
+// fall, where p is between 0 and 1
+func (h *histogram) percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := uint64(p*float64(h.count) + .5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	var n uint64
+	for b, c := range h.counts {
+		n += c
+		if n < rank {
+			continue
+		}
+
+		v := histogramValue(b)
+		if v < h.min {
+			return h.min
+		}
+
+		if v > h.max {
+			return h.max
+		}
+
+		return v
+	}
+
+	return h.max
+}
+
+func (h *histogram) latency() Latency {
+	if h.count == 0 {
+		return Latency{}
+	}
+
+	return Latency{
+		Min:  h.min,
+		Mean: h.sum / time.Duration(h.count),
+		Max:  h.max,
+		P50:  h.percentile(.5),
+		P90:  h.percentile(.9),
+		P95:  h.percentile(.95),
+		P99:  h.percentile(.99),
+	}
+}
@@ -0,0 +1,56 @@
+package logreplay
+
+import (
+	"net/http"
+	"time"
+)
+
+// Response is passed to the OnResponse hook.
+type Response struct {
+
+	// Status is the status code of the response.
+	Status int
+
+	// Header contains the response headers.
+	Header http.Header
+
+	// Body is the complete response body.
+	Body []byte
+
+	// Latency is the response time.
+	Latency time.Duration
+}
+
+// onRequest calls the request hook, when set
+func (c *client) onRequest(hr *http.Request) error {
+	if c.options.OnRequest == nil {
+		return nil
+	}
+
+	if err := c.options.OnRequest(hr); err != nil {
+		c.options.Log.Warnln("request hook failed:", hr.Method, hr.URL.Path, err)
+		return err
+	}
+
+	return nil
+}
+
+// onResponse calls the response hook, when set, and returns false, when the hook rejected
+// the response
+func (c *client) onResponse(hr *http.Request, rsp response) bool {
+	if c.options.OnResponse == nil {
+		return true
+	}
+
+	if !c.options.OnResponse(hr, Response{
+		Status:  rsp.status,
+		Header:  rsp.header,
+		Body:    rsp.body,
+		Latency: rsp.latency,
+	}) {
+		c.options.Log.Warnln("response rejected by hook:", hr.Method, hr.URL.Path)
+		return false
+	}
+
+	return true
+}
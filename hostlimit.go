@@ -0,0 +1,84 @@
+package logreplay
+
+// the number of the requests that a session can defer due to the host limit, before it
+// waits for the hosts to complete their requests in flight
+const maxDeferredRequests = 1 << 8
+
+// hostLimit tracks the requests in flight per host, when MaxConcurrencyPerHost is set.
+// It is used only from the goroutine of the Player.
+type hostLimit struct {
+	max      int
+	inFlight map[string]int
+}
+
+func newHostLimit(o Options) *hostLimit {
+	if o.MaxConcurrencyPerHost <= 0 {
+		return nil
+	}
+
+	return &hostLimit{
+		max:      o.MaxConcurrencyPerHost,
+		inFlight: make(map[string]int),
+	}
+}
+
+func (l *hostLimit) allow(host string) bool {
+	return l == nil || l.inFlight[host] < l.max
+}
+
+func (l *hostLimit) start(host string) {
+	if l != nil {
+		l.inFlight[host]++
+	}
+}
+
+func (l *hostLimit) done(host string) {
+	if l == nil {
+		return
+	}
+
+	if l.inFlight[host]--; l.inFlight[host] <= 0 {
+		delete(l.inFlight, host)
+	}
+}
+
+// takeDeferred returns the first request deferred by the session, whose host is below
+// the limit
+func (p *Player) takeDeferred(s *player) *Request {
+	for i, r := range s.deferred {
+		if p.hostLimit.allow(r.Host) {
+			s.deferred = append(s.deferred[:i], s.deferred[i+1:]...)
+			return r
+		}
+	}
+
+	return nil
+}
+
+// park tells the session to wait until one of its deferred requests can be sent. The
+// session is not offering itself for the next request until then.
+func (p *Player) park(s *player) {
+	s.feed <- nil
+	p.parked = append(p.parked, s)
+}
+
+// unpark feeds the waiting sessions with their deferred requests, whose hosts are below
+// the limit again
+func (p *Player) unpark() {
+	var parked []*player
+	for _, s := range p.parked {
+		if !p.isActive(s) {
+			continue
+		}
+
+		r := p.takeDeferred(s)
+		if r == nil {
+			parked = append(parked, s)
+			continue
+		}
+
+		p.send(s, r)
+	}
+
+	p.parked = parked
+}
@@ -0,0 +1,55 @@
+package logreplay
+
+import (
+	"sort"
+)
+
+// LabelRule sets a label on the requests whose path matches, e.g. to group the traffic
+// by route in the statistics.
+type LabelRule struct {
+
+	// PathPattern is a regular expression matched against the request path.
+	PathPattern string
+
+	// Name and Value define the label.
+	Name, Value string
+}
+
+// validateLabelRules compiles, and this way caches, the path patterns of the label rules
+func validateLabelRules(rc *regexpCache, rules []LabelRule) error {
+	for _, r := range rules {
+		if _, err := rc.get(r.PathPattern); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// labels returns the keys of the statistics groups of a request, in the form of
+// name=value. The labels of the request take precedence over the rules.
+func (c *client) labels(r *Request) []string {
+	if len(r.Labels) == 0 && len(c.options.LabelRules) == 0 {
+		return nil
+	}
+
+	l := make(map[string]string)
+	path, _ := splitPath(r.Path)
+	for _, lr := range c.options.LabelRules {
+		if _, set := l[lr.Name]; !set && c.match(lr.PathPattern, []byte(path)) {
+			l[lr.Name] = lr.Value
+		}
+	}
+
+	for name, value := range r.Labels {
+		l[name] = value
+	}
+
+	var keys []string
+	for name, value := range l {
+		keys = append(keys, name+"="+value)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -2,9 +2,9 @@ package logreplay
 
 import "github.com/sirupsen/logrus"
 
-// TODO: fill up the interface with the complete set of standard log functions
-
-// Logger objects are used for logging events from the player.
+// Logger objects are used for logging events from the player. It contains only the
+// methods that the player uses, so that other loggers are easy to adapt. The structured
+// fields are optional, see FieldLogger.
 type Logger interface {
 	Errorln(...interface{})
 	Warnln(...interface{})
@@ -13,10 +13,172 @@ type Logger interface {
 	Debugf(string, ...interface{})
 }
 
+// FieldLogger is an optional extension of Logger. When the logger set in the options
+// implements it, the player attaches structured fields to the log messages, e.g. the
+// name of the component that logged the message. The default logger implements it.
+type FieldLogger interface {
+	Logger
+	WithField(key string, value interface{}) Logger
+	WithFields(fields map[string]interface{}) Logger
+}
+
+// LogLevel defines the verbosity of a component of the player.
+type LogLevel int
+
+const (
+
+	// LogDefault leaves the filtering of the messages to the logger. With the default
+	// logger, it means the global level of logrus.
+	LogDefault LogLevel = iota
+
+	// LogError allows only the error messages.
+	LogError
+
+	// LogWarn allows the warnings and the error messages.
+	LogWarn
+
+	// LogInfo allows the info, the warning and the error messages.
+	LogInfo
+
+	// LogDebug allows all messages.
+	LogDebug
+)
+
+// The components of the player that log messages. They can be used as the keys in
+// Options.LogLevels, and they are set as the "component" field of the log messages.
+const (
+	PlayerComponent = "player"
+	ParserComponent = "parser"
+	ClientComponent = "client"
+)
+
+// logrusLogger is the default logger. Its level is raised to the most verbose component
+// level, and the components at LogDefault are filtered to the global level of logrus.
+type logrusLogger struct {
+	logrus.FieldLogger
+	defaultLevel LogLevel
+}
+
+var logrusLevels = [...]logrus.Level{
+	LogError: logrus.ErrorLevel,
+	LogWarn:  logrus.WarnLevel,
+	LogInfo:  logrus.InfoLevel,
+	LogDebug: logrus.DebugLevel,
+}
+
+// componentLogger filters the messages of a component by level, and attaches the name
+// of the component, when the underlying logger supports fields
+type componentLogger struct {
+	base  Logger
+	log   Logger
+	level LogLevel
+}
+
 func enableDebugLog() { logrus.SetLevel(logrus.DebugLevel) }
 
-func newDefaultLog() Logger {
+func logLevel(l logrus.Level) LogLevel {
+	switch {
+	case l <= logrus.ErrorLevel:
+		return LogError
+	case l == logrus.WarnLevel:
+		return LogWarn
+	case l == logrus.InfoLevel:
+		return LogInfo
+	default:
+		return LogDebug
+	}
+}
+
+func newDefaultLog(levels map[string]LogLevel) Logger {
 	l := logrus.New()
 	l.Level = logrus.GetLevel()
-	return l
+	defaultLevel := logLevel(l.Level)
+	for _, li := range levels {
+		if li > logLevel(l.Level) && int(li) < len(logrusLevels) {
+			l.Level = logrusLevels[li]
+		}
+	}
+
+	return logrusLogger{FieldLogger: l, defaultLevel: defaultLevel}
+}
+
+func (l logrusLogger) WithField(key string, value interface{}) Logger {
+	return logrusLogger{FieldLogger: l.FieldLogger.WithField(key, value), defaultLevel: l.defaultLevel}
+}
+
+func (l logrusLogger) WithFields(fields map[string]interface{}) Logger {
+	return logrusLogger{
+		FieldLogger:  l.FieldLogger.WithFields(logrus.Fields(fields)),
+		defaultLevel: l.defaultLevel,
+	}
+}
+
+func newComponentLog(l Logger, component string, levels map[string]LogLevel) Logger {
+	if cl, ok := l.(*componentLogger); ok {
+		l = cl.base
+	}
+
+	level := levels[component]
+	if dl, ok := l.(logrusLogger); ok && level == LogDefault {
+		level = dl.defaultLevel
+	}
+
+	cl := &componentLogger{base: l, log: l, level: level}
+	if fl, ok := l.(FieldLogger); ok {
+		cl.log = fl.WithField("component", component)
+	}
+
+	return cl
+}
+
+func (l *componentLogger) enabled(level LogLevel) bool {
+	return l.level == LogDefault || level <= l.level
+}
+
+func (l *componentLogger) Errorln(a ...interface{}) {
+	if l.enabled(LogError) {
+		l.log.Errorln(a...)
+	}
+}
+
+func (l *componentLogger) Warnln(a ...interface{}) {
+	if l.enabled(LogWarn) {
+		l.log.Warnln(a...)
+	}
+}
+
+func (l *componentLogger) Infoln(a ...interface{}) {
+	if l.enabled(LogInfo) {
+		l.log.Infoln(a...)
+	}
+}
+
+func (l *componentLogger) Debugln(a ...interface{}) {
+	if l.enabled(LogDebug) {
+		l.log.Debugln(a...)
+	}
+}
+
+func (l *componentLogger) Debugf(f string, a ...interface{}) {
+	if l.enabled(LogDebug) {
+		l.log.Debugf(f, a...)
+	}
+}
+
+func (l *componentLogger) WithField(key string, value interface{}) Logger {
+	fl, ok := l.log.(FieldLogger)
+	if !ok {
+		return l
+	}
+
+	return &componentLogger{base: l.base, log: fl.WithField(key, value), level: l.level}
+}
+
+func (l *componentLogger) WithFields(fields map[string]interface{}) Logger {
+	fl, ok := l.log.(FieldLogger)
+	if !ok {
+		return l
+	}
+
+	return &componentLogger{base: l.base, log: fl.WithFields(fields), level: l.level}
 }
@@ -15,8 +15,17 @@
 package logreplay
 
 import (
+	"crypto/x509"
 	"errors"
 	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 // RedirectBehavior defines how to handle redirect responses.
@@ -34,12 +43,81 @@ const (
 	// FollowRedirect tells the player to follow all redirects. (Not recommended
 	// during load tests.)
 	FollowRedirect
+
+	// FollowAllowedDomains tells the player to follow redirects only to the domains
+	// listed in RedirectAllowedDomains, or to their subdomains.
+	FollowAllowedDomains
+)
+
+// ServerBalancing defines how the requests are distributed between multiple servers.
+type ServerBalancing int
+
+const (
+
+	// RoundRobin tells the player to send the requests to the servers in turns.
+	RoundRobin ServerBalancing = iota
+
+	// RandomServer tells the player to send each request to a randomly selected server.
+	RandomServer
+)
+
+// AddressFamily defines which IP versions are used when connecting to the servers.
+type AddressFamily int
+
+const (
+
+	// DualStack tells the player to connect over IPv4 or IPv6, whichever succeeds
+	// first, as the Go standard library does by default.
+	DualStack AddressFamily = iota
+
+	// IPv4Only tells the player to connect only over IPv4.
+	IPv4Only
+
+	// IPv6Only tells the player to connect only over IPv6.
+	IPv6Only
+)
+
+// RequestIDFormat defines how the IDs of the requests are generated.
+type RequestIDFormat int
+
+const (
+
+	// UUIDRequestID tells the player to send random, version 4 UUIDs as request IDs.
+	UUIDRequestID RequestIDFormat = iota
+
+	// SequenceRequestID tells the player to send the sequence numbers of the requests
+	// as request IDs.
+	SequenceRequestID
 )
 
 // DefaultHaltThreshold is the limit that continuous failures need to reach to make the
 // player halt.
 const DefaultHaltThreshold = 1 << 7
 
+// DefaultMaxRedirects is the number of the redirects followed for a request, when the
+// player follows redirects, and MaxRedirects is not set.
+const DefaultMaxRedirects = 10
+
+// DefaultExpectContinueTimeout is the time of waiting for the 100 Continue response
+// before sending the request body anyway, when ExpectContinueThreshold is set, and
+// ExpectContinueTimeout is not.
+const DefaultExpectContinueTimeout = time.Second
+
+// DefaultMaxOpenRequests is the number of the requests that a session can have in flight
+// in open loop mode, when MaxOpenRequests is not set.
+const DefaultMaxOpenRequests = 1 << 8
+
+// DefaultRemoteAddressHeader is the header used to forward the address of the original
+// client, when ForwardRemoteAddress is set, and RemoteAddressHeader is not.
+const DefaultRemoteAddressHeader = "X-Forwarded-For"
+
+// the load is reduced every second during ramp-down, or, when ramp-down is shorter, in
+// ten steps
+const (
+	rampDownStep     = time.Second
+	rampDownMinSteps = 10
+)
+
 // Request describes an individual request made by the player.
 type Request struct {
 
@@ -51,12 +129,81 @@ type Request struct {
 	// address of the request.
 	Host string
 
-	// Path is set as the HTTP path of the request.
+	// Scheme is the scheme of the original request, http or https, when it was logged
+	// with an absolute URL, e.g. by a forward proxy. When the network address is taken
+	// from the Host field, it overrides DefaultScheme. Otherwise it is ignored.
+	Scheme string
+
+	// Path is set as the HTTP path of the request. It can contain a query. The paths of
+	// the requests passed in the options can be templates, executed with TemplateData,
+	// e.g. /items/{{rand 1 100}}?id={{uuid}}.
 	Path string
 
 	// UserAgent is set as the HTTP User-Agent header of the request.
 	UserAgent string
 
+	// Protocol is the HTTP version of the original request, e.g. HTTP/1.0, as captured
+	// from the log entry. The requests are sent with the protocol negotiated by the
+	// client, but see PreserveHTTP10.
+	Protocol string
+
+	// RemoteAddress is the address of the client that made the original request, as
+	// captured from the log entry. It may contain a comma separated list of addresses.
+	RemoteAddress string
+
+	// Time is the time of the original request, as captured from the log entry.
+	Time time.Time
+
+	// LoggedStatus is the status code of the original response, as captured from the
+	// log entry.
+	LoggedStatus int
+
+	// LoggedSize is the size of the original response body, as captured from the log
+	// entry. Zero means that the size was not logged.
+	LoggedSize int64
+
+	// LoggedDuration is the duration of the original request, as captured from the log
+	// entry, in milliseconds. Zero means that the duration was not logged.
+	LoggedDuration time.Duration
+
+	// Session identifies the user session that the request belongs to. When
+	// PreserveSessions is set, and Session is empty, RemoteAddress is used instead.
+	Session string
+
+	// Body is sent as the request payload when set. In this case, the random content
+	// settings of the request are ignored.
+	Body []byte
+
+	// BodyFile is the path of a file whose content is sent as the request payload. It is
+	// read every time the request is made. When Body is set, BodyFile is ignored.
+	BodyFile string
+
+	// BodyTemplate is a text/template, whose result is sent as the request payload. The
+	// template is executed with TemplateData, e.g. {"id": "{{.UUID}}", "seq": {{.Seq}}}.
+	// When Body or BodyFile is set, BodyTemplate is ignored.
+	BodyTemplate string
+
+	// Fields contain the named values captured from the log entry by the parser.
+	Fields map[string]string
+
+	// Labels are used to group the statistics, e.g. by customer tier or route. Every
+	// label forms a separate group, in the form of name=value. The default parser
+	// captures the labels from the groups of the access log format named label_name,
+	// e.g. (?P<label_tier>[a-z]+).
+	Labels map[string]string
+
+	// BodyFormat defines the format of the randomly generated request payload. When it
+	// is FormBody or MultipartBody, the ContentLength settings are ignored, and the
+	// payload contains FormFields number of fields, with random values of FormFieldSize
+	// length.
+	BodyFormat BodyFormat
+
+	// FormFields defines the number of fields in a form payload. Defaults to 1.
+	FormFields int
+
+	// FormFieldSize defines the length of the random field values in a form payload.
+	FormFieldSize int
+
 	// ContentLength defines the size of the randomly generated request payload.
 	//
 	// When ContentLengthDeviation is defined, the actual size will be randomly
@@ -72,6 +219,44 @@ type Request struct {
 	// SetContentLength defines if the request content should be sent with defined
 	// Content-Length header.
 	SetContentLength bool
+
+	// Chunked tells the player to send the request payload with chunked transfer
+	// encoding, streaming it without the Content-Length header, even when the size of
+	// the payload is known. The size of the chunks and the delay between them can be
+	// controlled with the ChunkSize and ChunkDelay options.
+	Chunked bool
+
+	// Delay defines how long the session should wait before making the request, simulating
+	// the pacing of real users.
+	//
+	// When DelayDeviation is defined, the actual delay will be randomly decided by Delay
+	// +/- rand(DelayDeviation).
+	Delay time.Duration
+
+	// DelayDeviation defines how much the actual delay of the request can differ from
+	// Delay.
+	DelayDeviation float64
+
+	// Weight defines how likely the request is picked, relative to the other requests,
+	// when the player is in Weighted mode. Requests without weight count with the
+	// weight of 1.
+	Weight float64
+
+	// Assertions contains the expectations against the response of this request,
+	// additionally to the global assertions defined in the options.
+	Assertions []Assertion
+
+	// Timeout, when set, overrides the RequestTimeout of the options for this request,
+	// e.g. for known slow endpoints.
+	Timeout time.Duration
+
+	// RedirectBehavior, when set, overrides the RedirectBehavior of the options for this
+	// request, e.g. to follow the redirects only after a login.
+	RedirectBehavior *RedirectBehavior
+
+	// set for the requests read by LogSource(), to replay them like the entries of the
+	// access log
+	logEntry bool
 }
 
 // Parser can parse a log entry.
@@ -88,7 +273,9 @@ type Options struct {
 	// Requests to be executed by the player in the specified order.
 	//
 	// When used together with AccessLog, requests defined in this field are
-	// executed after the requests read from the AccessLog.
+	// executed after the requests read from the AccessLog. To combine the requests of
+	// multiple access logs, request slices and generated requests in a different order,
+	// or to repeat them, see Compose().
 	Requests []*Request
 
 	// AccessLog is a source of scenario to be executed by the player. By default, it
@@ -98,26 +285,66 @@ type Options struct {
 	// In addition to the Combined log format, the default parser accepts two additional
 	// fields based on the Skipper (https://github.com/zalando/skipper) access logs,
 	// where the request host is taken from the last field (following an integer for
-	// duration.)
+	// duration.) The quoted fields may contain escaped double quotes, and the fields may
+	// be separated by any whitespace. Additional fields following the host are ignored.
 	//
-	// On continuous play, the log is read only once, and stored in memory for subsequent
-	// plays. For this reason, the parsed access log must fit in memory.
-	//
-	// Known bugs in the default parser:
-	//
-	// 	- escaped double quotes in the HTTP message not handled
-	// 	- whitespace handling in the HTTP message: only whitespace
+	// When the path in the %r field is an absolute URL, like in the logs of the forward
+	// proxies, the scheme and the host of the request are taken from the URL. This
+	// applies to the path captured with AccessLogFormat, too.
 	//
+	// On continuous play, the log is read only once, and stored in memory for subsequent
+	// plays. For this reason, the parsed access log must fit in memory, unless MaxMemory
+	// is set.
 	AccessLog io.Reader
 
 	// AccessLogFormat is a regular expression and can be used to override the default
-	// parser expression. The expression can define the following named groups:
-	// method, host, path. The captured submatches with these names will be used to
-	// set the according field in the parsed request.
+	// parser. The expression can define the following named groups:
+	// method, host, path, protocol, useragent, body, remoteaddress, session, time,
+	// status. The captured submatches with these names will be used to set the according
+	// field in the parsed request. All the named groups, including the ones with other
+	// names, are stored in the Fields of the request.
 	//
 	// If Parser is set, this field is ignored.
 	AccessLogFormat string
 
+	// AccessLogTimeFormat is the layout of the time captured from the log entries by
+	// the default parser, as expected by time.Parse. Defaults to DefaultTimeFormat.
+	// When the time doesn't match it, RFC3339 is tried.
+	AccessLogTimeFormat string
+
+	// From and To, when set, limit the replayed log entries to the ones whose time is
+	// within the range, e.g. to reproduce an incident. From is inclusive, To is
+	// exclusive. When either of them is set, the entries without a time are skipped.
+	From, To time.Time
+
+	// Methods, when set, limits the replayed log entries to the ones with these HTTP
+	// methods, e.g. GET and HEAD, when replaying production logs against a shared
+	// environment.
+	Methods []string
+
+	// ExcludeMethods contains the HTTP methods of the log entries that are not
+	// replayed, e.g. DELETE.
+	ExcludeMethods []string
+
+	// Statuses, when set, limits the replayed log entries to the ones whose original
+	// response had one of these status codes or classes, e.g. 500 or 5xx, to reproduce
+	// failures. The entries without a logged status are skipped.
+	Statuses []string
+
+	// ExcludeStatuses contains the status codes or classes of the original responses,
+	// whose log entries are not replayed, e.g. 4xx.
+	ExcludeStatuses []string
+
+	// Deduplicate tells the player to replay only the first one of the log entries with
+	// the same method, host, path and query, e.g. when warming up a cache. The entries
+	// seen are kept in memory.
+	Deduplicate bool
+
+	// DeduplicateWeights tells the player to count the duplicates of the log entries in
+	// their Weight, when Deduplicate is set. It can be used together with Weighted, to
+	// keep the distribution of the original traffic.
+	DeduplicateWeights bool
+
 	// Parser is a custom parser for log entries (lines). It can be used e.g. to define
 	// a JSON log parser.
 	Parser Parser
@@ -125,6 +352,130 @@ type Options struct {
 	// Server is a network address to send the requests to.
 	Server string
 
+	// Servers is a list of network addresses to distribute the requests between. When
+	// set, Server is ignored.
+	Servers []string
+
+	// ServerBalancing tells the player how to distribute the requests between the
+	// Servers. Defaults to RoundRobin.
+	ServerBalancing ServerBalancing
+
+	// Shadow is the network address of a second server. When set, every request is
+	// sent both to the primary and to the shadow server concurrently, and the responses
+	// are compared. The request body is read completely before the requests are made.
+	// Halting and the statistics, except for the number of differences, are based on
+	// the responses of the primary server.
+	Shadow string
+
+	// CompareHeaders contains the names of the response headers that are compared in
+	// shadow mode, additionally to the status code.
+	CompareHeaders []string
+
+	// CompareBodies tells the player to compare the SHA-256 hashes of the response
+	// bodies in shadow mode.
+	CompareBodies bool
+
+	// DiffLog, when set, receives the differences found in shadow mode, in JSON, one
+	// per line.
+	DiffLog io.Writer
+
+	// ResultLog, when set, receives a log line for every replayed request, with the
+	// status, the size and the duration of the replayed response, e.g. to analyze the
+	// replay with the existing log tools, or to replay it again.
+	ResultLog io.Writer
+
+	// ResultLogFormat defines the format of the ResultLog. Defaults to
+	// CombinedResultLog.
+	ResultLogFormat ResultLogFormat
+
+	// CaptureDir, when set, tells the player to save the response bodies in this
+	// directory. The files are named after the sequence number of the request, e.g.
+	// 42.body, or 42.shadow.body for the response of the shadow server. The directory
+	// is created when it doesn't exist.
+	CaptureDir string
+
+	// CaptureMode tells the player which response bodies to save. Defaults to
+	// CaptureAll.
+	CaptureMode CaptureMode
+
+	// CaptureSizeLimit, when set, limits the saved size of the response bodies, the
+	// rest of the bodies is discarded.
+	CaptureSizeLimit int64
+
+	// MaxResponseBytes, when set, limits how many bytes of the response bodies are
+	// read. The response bodies are not buffered, unless required by the assertions,
+	// the extractions, the hooks, the comparison or the capture, and longer bodies are
+	// counted in TruncatedResponses. The connections of the truncated responses are not
+	// reused. The limit applies to the bodies as received, before decompression.
+	MaxResponseBytes int64
+
+	// BasicAuth, when set, is sent with every request as basic authentication
+	// credentials, in the form of user:password.
+	BasicAuth string
+
+	// HostBasicAuth contains basic authentication credentials per host, in the form of
+	// user:password. The keys are in the form of host:port or host, and they are matched
+	// against the host of the requests. It takes precedence over BasicAuth. An
+	// Authorization header set in Headers takes precedence over both.
+	HostBasicAuth map[string]string
+
+	// TokenSource, when set, provides the bearer tokens sent with every request in the
+	// Authorization header. It takes precedence over the basic authentication.
+	TokenSource TokenSource
+
+	// OAuth2TokenURL, when set, tells the player to acquire bearer tokens with the OAuth2
+	// client credentials flow from this endpoint, using OAuth2ClientID, OAuth2ClientSecret
+	// and OAuth2Scopes. The tokens are cached until they expire, or the target rejects
+	// them with 401 Unauthorized. It is ignored when TokenSource is set.
+	OAuth2TokenURL     string
+	OAuth2ClientID     string
+	OAuth2ClientSecret string
+	OAuth2Scopes       []string
+
+	// Headers are set on every request, overriding the headers set by the player, e.g.
+	// the User-Agent taken from the access log. When Host is set, it overrides the host
+	// of the requests. The values can be templates, executed with TemplateData, e.g.
+	// X-Correlation-Id: {{uuid}}.
+	Headers http.Header
+
+	// ExpandEnv tells the player to replace the ${NAME} references with the value of
+	// the environment variables in Server, Shadow, Headers, BasicAuth, HostBasicAuth,
+	// Resolve, in the OAuth2 settings and in the body templates, so that the secrets can
+	// be supplied at runtime. When a referenced variable is not set, New() fails with
+	// ErrUndefinedEnv.
+	ExpandEnv bool
+
+	// AcceptEncoding, when set, is sent as the Accept-Encoding header of every request,
+	// e.g. gzip, br. In this case, the responses are not decompressed by the transport,
+	// and they are counted with their compressed size in the statistics.
+	AcceptEncoding string
+
+	// DecompressResponses tells the player to decompress the gzip and deflate encoded
+	// responses, before checking the assertions, extracting the values, comparing them
+	// with the responses of the shadow server, or saving them. The decompressed size is
+	// reported in the UncompressedBytes of the statistics.
+	DecompressResponses bool
+
+	// ForwardRemoteAddress tells the player to send the RemoteAddress of the requests,
+	// the address of the original client, in the header set by RemoteAddressHeader, e.g.
+	// to make the geolocation or the rate limiting of the target behave like with the
+	// original traffic.
+	ForwardRemoteAddress bool
+
+	// RemoteAddressHeader is the name of the header used to forward the address of the
+	// original client. Defaults to X-Forwarded-For.
+	RemoteAddressHeader string
+
+	// RequestIDHeader, when set, tells the player to send a unique ID with every request
+	// in this header, e.g. X-Request-Id, so that the replayed requests can be found in
+	// the logs of the target. The ID is included in the request logs and in the
+	// differences found in shadow mode.
+	RequestIDHeader string
+
+	// RequestIDFormat defines how the request IDs are generated. Defaults to
+	// UUIDRequestID.
+	RequestIDFormat RequestIDFormat
+
 	// DefaultScheme tells whether http or https should be used when the network address
 	// is taken from the host specified in the request, and the scheme is not specified.
 	DefaultScheme string
@@ -135,9 +486,129 @@ type Options struct {
 	// Defaults to 1.
 	ConcurrentSessions int
 
+	// HTTP2 enables HTTP/2 for the requests made over TLS. The negotiated protocols are
+	// reported in the Stats. Without it, only HTTP/1.1 is used.
+	HTTP2 bool
+
+	// H2C tells the player to use cleartext HTTP/2 with prior knowledge, when the
+	// requests are not made over TLS. When set, HTTP/1.1 is not used, and the requests
+	// made over TLS use HTTP/2, too.
+	H2C bool
+
+	// HTTP3 tells the player to make the requests over HTTP/3 (QUIC). It is experimental,
+	// and it works only with servers accessed over TLS. When set, HTTP2 and H2C are
+	// ignored. The HTTP/3 transport doesn't support proxies, DisableKeepAlives,
+	// TLSHandshakeTimeout and ResponseHeaderTimeout, and when any of them is set, or
+	// Server, Servers or Shadow is not accessed over TLS, New() returns ErrHTTP3Option.
+	// The QUIC handshake, including TLS, is limited by DialTimeout.
+	HTTP3 bool
+
+	// ProxyURL, when set, tells the player to send the requests through the specified
+	// forward proxy, e.g. http://proxy.example.org:3128. Requests over TLS are tunneled
+	// with CONNECT.
+	ProxyURL string
+
+	// ProxyFromEnvironment tells the player to use the proxy set in the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables. It is ignored when ProxyURL is set.
+	ProxyFromEnvironment bool
+
+	// Resolve overrides the network address of hosts, similar to the --resolve option of
+	// curl. The keys are in the form of host:port or host, while the values are in the
+	// form of address:port or address. When the value doesn't contain a port, the port
+	// of the request is used. The Host header of the requests is not changed.
+	Resolve map[string]string
+
+	// DisableKeepAlives tells the player to open a new connection for every request,
+	// e.g. to measure the cost of the connection setup. It is ignored with HTTP/3.
+	DisableKeepAlives bool
+
+	// PreserveHTTP10 tells the player to send the requests logged with HTTP/1.0 without
+	// keep-alive, closing the connection after the response, to reproduce the behavior of
+	// the legacy clients. The requests themselves are sent as HTTP/1.1, with the
+	// Connection: close header. It is ignored with HTTP/2 and HTTP/3.
+	PreserveHTTP10 bool
+
+	// DialTimeout limits the time of establishing a connection. With HTTP/3, it limits
+	// the QUIC handshake. Zero means no timeout.
+	DialTimeout time.Duration
+
+	// AddressFamily tells the player to connect only over IPv4 or only over IPv6, e.g.
+	// when the IPv6 connectivity of the replay environment is broken, and the timeouts
+	// of the failing attempts would distort the response times. The hosts are resolved
+	// only to the addresses of the selected family. It applies to the proxy connections,
+	// too. Defaults to DualStack.
+	AddressFamily AddressFamily
+
+	// TLSHandshakeTimeout limits the time of the TLS handshake. Zero means no timeout.
+	TLSHandshakeTimeout time.Duration
+
+	// ExpectContinueThreshold, when set, tells the player to send the Expect:
+	// 100-continue header with the request bodies of at least this size, in bytes, and
+	// with the chunked bodies of unknown size, and to send the body only after the
+	// server responded with 100 Continue, the way the clients upload large payloads.
+	// The time of waiting for the 100 Continue response is measured in the statistics.
+	// It is ignored with HTTP/3.
+	ExpectContinueThreshold int64
+
+	// ExpectContinueTimeout limits the time of waiting for the 100 Continue response,
+	// after which the body is sent anyway. Default: 1 second.
+	ExpectContinueTimeout time.Duration
+
+	// ResponseHeaderTimeout limits the time of waiting for the response headers after
+	// the request was sent. Zero means no timeout.
+	ResponseHeaderTimeout time.Duration
+
+	// RequestTimeout limits the overall time of a request, including the connection,
+	// the redirects and reading the response body. Zero means no timeout.
+	RequestTimeout time.Duration
+
+	// ClientCertFile and ClientKeyFile set the PEM encoded client certificate and key,
+	// used when the server requests a client certificate during the TLS handshake
+	// (mutual TLS). They need to be set together.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// ServerName, when set, is sent in the TLS handshake as the server name (SNI), and
+	// used to verify the server certificate, instead of the host of the request URL.
+	ServerName string
+
+	// RootCAs, when set, is used to verify the server certificates instead of the
+	// system certificate pool.
+	RootCAs *x509.CertPool
+
+	// CAFile is a file with PEM encoded CA certificates used to verify the server
+	// certificates. When RootCAs is set, the certificates are added to RootCAs,
+	// otherwise they are used instead of the system certificate pool.
+	CAFile string
+
+	// InsecureSkipVerify tells the player not to verify the server certificates. It is
+	// meant only for testing environments with private or self-signed certificates.
+	InsecureSkipVerify bool
+
+	// MinTLSVersion and MaxTLSVersion limit the TLS versions offered in the handshake,
+	// e.g. tls.VersionTLS13 for both to accept only TLS 1.3. Zero means the defaults of
+	// the Go standard library.
+	MinTLSVersion uint16
+	MaxTLSVersion uint16
+
+	// CipherSuites, when set, limits the cipher suites offered in the TLS handshake, as
+	// the IDs defined in the crypto/tls package. It applies only up to TLS 1.2, the
+	// cipher suites of TLS 1.3 are not configurable.
+	CipherSuites []uint16
+
 	// RedirectBehavior tells the player how to act on redirect responses.
 	RedirectBehavior RedirectBehavior
 
+	// RedirectAllowedDomains contains the domains that the player follows the redirects
+	// to, when the RedirectBehavior is FollowAllowedDomains. The subdomains of the
+	// listed domains are allowed, too.
+	RedirectAllowedDomains []string
+
+	// MaxRedirects limits the number of the redirects followed for a single request,
+	// when the player follows redirects. When a request exceeds it, it fails with
+	// ErrTooManyRedirects. Default: 10.
+	MaxRedirects int
+
 	// PostContentLength tells the player the average request content size to send in
 	// case of POST, PUT and PATCH requests ware taken from the access log.
 	PostContentLength int
@@ -150,18 +621,364 @@ type Options struct {
 	// Content-Length header.
 	PostSetContentLength bool
 
-	// Log defines a custom logger for the player.
+	// PostChunked tells the player to send the payload of the POST, PUT and PATCH
+	// requests taken from the access log with chunked transfer encoding.
+	PostChunked bool
+
+	// ChunkSize limits the size of the chunks, when sending a request payload with
+	// chunked transfer encoding.
+	ChunkSize int
+
+	// ChunkDelay defines how long the player should wait between sending the chunks,
+	// when sending a request payload with chunked transfer encoding. It can be used to
+	// simulate slow clients.
+	ChunkDelay time.Duration
+
+	// PostBodyFormat defines the format of the random payload of the POST, PUT and
+	// PATCH requests taken from the access log.
+	PostBodyFormat BodyFormat
+
+	// PostFormFields defines the number of fields in the form payload of the POST, PUT
+	// and PATCH requests taken from the access log.
+	PostFormFields int
+
+	// PostFormFieldSize defines the length of the random field values in the form
+	// payload of the POST, PUT and PATCH requests taken from the access log.
+	PostFormFieldSize int
+
+	// PostBodyTemplate is used as the body template for the POST, PUT and PATCH requests
+	// taken from the access log. When set, PostContentLength and
+	// PostContentLengthDeviation are ignored.
+	PostBodyTemplate string
+
+	// Payload defines the kind of the randomly generated request payloads. Defaults to
+	// TextPayload. The payloads are assembled from random chunks of a pre-generated
+	// block of random bytes, to keep the large payloads cheap.
+	Payload Payload
+
+	// PayloadSample is used as the source of the random payload bytes, when Payload is
+	// set to SamplePayload.
+	PayloadSample []byte
+
+	// QueryFuzzRate, when set, tells the player to replace the query parameter values
+	// of the requests with random strings, boundary numbers or values picked from
+	// QueryFuzzWords, e.g. to test the input validation of the real routes. It is the
+	// probability of replacing a value, between 0 and 1.
+	QueryFuzzRate float64
+
+	// QueryFuzzWords contains values used as replacements when fuzzing the query
+	// parameters, e.g. typical injection strings.
+	QueryFuzzWords []string
+
+	// CacheBustParam, when set, tells the player to append a query parameter with this
+	// name and a unique value to every request, to bypass the caches, e.g. of a CDN, and
+	// load the origin servers instead. The values are made of a random UUID and the
+	// sequence number of the request, so when RandomSeed is set, they repeat between the
+	// runs.
+	CacheBustParam string
+
+	// LabelRules set labels on the requests whose path matches, when the request doesn't
+	// have a label with the same name. When multiple rules set the same label, the
+	// first one is used.
+	LabelRules []LabelRule
+
+	// PathRules rewrite the paths of the requests, applied in order, e.g. to randomize
+	// the IDs in the logged paths.
+	PathRules []PathRule
+
+	// Corpora define sets of sample payloads, from which the player picks the body of
+	// the POST, PUT and PATCH requests randomly, when the request doesn't have an
+	// explicit Body, BodyFile or BodyTemplate. When the path of a request matches
+	// multiple corpora, the first one is used. The corpora are loaded into memory when
+	// the player is created.
+	Corpora []Corpus
+
+	// CompressBody tells the player to compress the request payloads with gzip, and set
+	// the Content-Encoding header. Compressed payloads are always sent with the
+	// Content-Length header.
+	CompressBody bool
+
+	// BodyFiles define files to be sent as the payload of the requests taken from the
+	// access log, selected by the request path. When a path matches multiple patterns,
+	// the first one is used. When the request body was captured from the log, these
+	// files are ignored.
+	BodyFiles []BodyFile
+
+	// ThinkTime defines how long the sessions should wait before making the requests
+	// taken from the access log. It is ignored in OpenLoop mode.
+	ThinkTime time.Duration
+
+	// ThinkTimeDeviation defines how much the actual wait time before a request taken
+	// from the access log can differ from ThinkTime.
+	ThinkTimeDeviation float64
+
+	// Jitter defines the upper limit of a random wait time that the sessions apply before
+	// each request, in addition to the request delay. It helps to avoid artificial bursts
+	// of requests, when many sessions replay the same short scenario in lockstep. It is
+	// ignored in OpenLoop mode.
+	Jitter time.Duration
+
+	// Log defines a custom logger for the player. When it implements FieldLogger, the
+	// messages are logged with structured fields.
 	Log Logger
 
+	// LogLevels defines the verbosity of the components of the player, e.g. the
+	// messages of the client, that makes the requests, can be limited to errors with
+	// ClientComponent: LogError. Components not listed here use LogDefault. With the
+	// default logger, the levels can also raise the verbosity, e.g. ClientComponent:
+	// LogDebug logs the debug messages of the client even when the global level of
+	// logrus is higher. A custom logger can filter the messages further by its own
+	// level, so that the component levels only lower its verbosity.
+	LogLevels map[string]LogLevel
+
+	// LogRequests tells the client to log every replayed request on the info level,
+	// with the method, the URL, the status code and the response time. When the logger
+	// implements FieldLogger, these are set as structured fields.
+	LogRequests bool
+
+	// SlowThreshold, when set, tells the client to log the requests, whose response time
+	// exceeded it, on the warning level, immediately when the response was received,
+	// with the same details as LogRequests.
+	SlowThreshold time.Duration
+
+	// LogRequestDetails tells the client to log the headers and the beginning of the body
+	// of every replayed request on the debug level. The values of the RedactHeaders and
+	// the matches of the RedactBodyPatterns are replaced in the logs. The bodies are
+	// logged only when they are available in memory.
+	LogRequestDetails bool
+
+	// RedactHeaders contains the headers whose values are not logged. Defaults to
+	// DefaultRedactHeaders.
+	RedactHeaders []string
+
+	// RedactBodyPatterns contains regular expressions, whose matches in the request
+	// bodies are not logged, e.g. password=[^&]*.
+	RedactBodyPatterns []string
+
 	// HaltOn500 tells the player to stop not only on errors but on server errors, too.
 	HaltOn500 bool
 
+	// HaltRules defines halting rules per status code or status class. The keys are
+	// either status codes, e.g. "503", or status classes, e.g. "5xx", while the values
+	// tell after how many consecutive responses with a matching status the player
+	// should stop. A threshold of 0 or less means that the matching responses are not
+	// considered errors, e.g. "503": 0 excludes 503 responses from HaltOn500. The rules
+	// for status codes take precedence over the rules for status classes, and both
+	// take precedence over HaltOn500.
+	HaltRules map[string]int
+
 	// HaltThreshold tells the player after how many errors or 500s it should stop.
 	// Default: 128.
 	HaltThreshold int
 
-	// Throttle maximizes the outgoing overall request per second rate.
+	// Assertions contains the expectations against the responses, applied to every
+	// request, or only to the requests whose path matches the PathPattern of the
+	// assertion.
+	Assertions []Assertion
+
+	// AssertionThreshold, when set, tells the player to stop after this many responses
+	// failed to meet the assertions.
+	AssertionThreshold int
+
+	// SizeTolerance, when set, tells the player to compare the size of the response
+	// bodies with the LoggedSize of the requests, and count the responses deviating
+	// more than this ratio, e.g. 0.1 for 10%, as size deviations. The size is compared
+	// as received, so AcceptEncoding should match the original clients, when the logged
+	// responses were compressed.
+	SizeTolerance float64
+
+	// SizeDeviationThreshold, when set, tells the player to stop after this many
+	// responses deviated from the logged size.
+	SizeDeviationThreshold int
+
+	// ClientCache tells the player to simulate the private cache of a browser in every
+	// session. The GET and HEAD requests are not made, when an earlier response to the
+	// same URL in the same session is still fresh, according to its Cache-Control
+	// max-age, or its Expires header. The requests served from the cache are counted
+	// as CacheHits in the statistics.
+	ClientCache bool
+
+	// Extractions capture values from the responses into session variables, used in
+	// the templates of the later requests of the same session.
+	Extractions []Extraction
+
+	// ConditionalRequests tells the player to remember the ETag and Last-Modified
+	// headers of the responses to the GET and HEAD requests, and send If-None-Match and
+	// If-Modified-Since when the same URL is requested again in the same session, like
+	// the browsers do, e.g. to exercise the 304 Not Modified responses of the target in
+	// looped replays.
+	ConditionalRequests bool
+
+	// CircuitBreakerThreshold, when set, enables the per host circuit breaker. When the
+	// requests to the same host (as defined in the request or the log entry) fail this
+	// many times consecutively, with an error or a 5xx response, the further requests
+	// to the host are skipped for the duration of CircuitBreakerTimeout. After the
+	// timeout, the requests are made again, but the first failure opens the circuit
+	// again. To make the circuit breaker effective, it should be lower than the
+	// HaltThreshold.
+	CircuitBreakerThreshold int
+
+	// CircuitBreakerTimeout tells the player how long to skip the requests to a host
+	// with an open circuit. Default: 30 seconds.
+	CircuitBreakerTimeout time.Duration
+
+	// MaxConcurrencyPerHost, when set, limits the number of the requests in flight to
+	// the same host (as defined in the request or the log entry). When the next request
+	// of a session would exceed the limit, it is deferred, and the session continues
+	// with the following requests, so that a slow host doesn't occupy all the sessions.
+	// The deferred requests are sent in their original order, as soon as the host
+	// completes a request. When a session has deferred too many requests, or it reached
+	// the end of the requests, it waits for its deferred requests.
+	MaxConcurrencyPerHost int
+
+	// LatencySLO, when set, tells the player to stop when the LatencySLOPercentile of the
+	// response times over the last LatencySLOWindow exceeds it. The objective is checked
+	// every tenth of the window.
+	LatencySLO time.Duration
+
+	// LatencySLOPercentile is the percentile of the response times, between 0 and 1,
+	// checked against LatencySLO. Default: 0.99.
+	LatencySLOPercentile float64
+
+	// LatencySLOWindow is the duration over which the response times are checked
+	// against LatencySLO. Default: 1 minute.
+	LatencySLOWindow time.Duration
+
+	// LatencyRegressionFactor, when set, tells the player to compare the response times
+	// with the LoggedDuration of the requests, and report the endpoints, where the
+	// response time exceeded the logged duration multiplied by this factor, e.g. 2 for
+	// twice as slow as the original request.
+	LatencyRegressionFactor float64
+
+	// Throttle maximizes the outgoing overall request per second rate. It can be
+	// changed during the replay with SetThrottle().
 	Throttle float64
+
+	// AdaptiveErrorRate, when set, enables the adaptive throttling, and tells the player
+	// to halve the rate when the ratio of the failed requests and the 5xx responses
+	// exceeds it, e.g. 0.05 for 5%. When the target recovers, the rate is increased in
+	// every healthy interval by a tenth of the rate set by Throttle or SetThrottle(), or,
+	// when throttling is disabled, of the rate observed before the first reduction, until
+	// it is restored.
+	AdaptiveErrorRate float64
+
+	// AdaptiveLatency, when set, enables the adaptive throttling, and tells the player to
+	// halve the rate when the 95th percentile of the response times exceeds it.
+	AdaptiveLatency time.Duration
+
+	// AdaptiveInterval is the period of checking the health of the target by the
+	// adaptive throttling. Default: 10 seconds.
+	AdaptiveInterval time.Duration
+
+	// AdaptiveMinRate is the request per second rate below which the adaptive
+	// throttling doesn't reduce the rate. Default: 1.
+	AdaptiveMinRate float64
+
+	// Shuffle tells the player to replay the requests in a random order. The order is
+	// different in every iteration of a session. When shuffling, the access log is read
+	// completely before the first request is made.
+	Shuffle bool
+
+	// ShuffleSeed is used to seed the random order of the requests when Shuffle is set.
+	// When not set, RandomSeed is used.
+	ShuffleSeed int64
+
+	// RandomSeed is used to seed all the random decisions of the player, e.g. the
+	// content length deviation, the payload bytes, the order of the requests or the
+	// delays. Two replays with the same seed and options make every session send the
+	// same requests in the same order, with the same random content. The sequence
+	// numbers are shared by the sessions, so with multiple sessions, the values derived
+	// from them, like Seq in the templates, SequenceRequestID or the round-robin server
+	// selection, depend on the timing of the sessions. When not set, a time based seed
+	// is used.
+	RandomSeed int64
+
+	// MaxMemory, when set, limits the approximate memory, in bytes, used by the log
+	// entries kept for replaying them repeatedly. The entries read after the limit was
+	// reached are spilled to a temporary file, and read back from the disk when they
+	// are replayed. The file is released by Close().
+	MaxMemory int64
+
+	// Weighted tells the player to pick the requests randomly, according to their
+	// Weight, instead of replaying them in order. When used with Once(), every session
+	// makes as many requests as many are defined in the scenario. When picking by
+	// weight, the access log is read completely before the first request is made. It
+	// takes precedence over Shuffle.
+	Weighted bool
+
+	// PreserveSessions tells the player to split the requests into user sessions, and
+	// distribute the user sessions between the concurrent sessions of the player, such
+	// that every user session is replayed by a single player session, in its original
+	// order. The user sessions are identified by the Session of the requests, or when
+	// it is not set, by their RemoteAddress. Without PreserveSessions, every player
+	// session replays all the requests. When preserving sessions, the access log is read
+	// completely before the first request is made, and the user sessions are
+	// redistributed when the concurrency is changed, as the player sessions start over.
+	// It takes precedence over Weighted and Shuffle.
+	PreserveSessions bool
+
+	// SessionField names the field of the requests captured by the parser, e.g. a named
+	// group in AccessLogFormat, whose value identifies the user session of the requests
+	// read from the access log.
+	SessionField string
+
+	// SessionCookie names the cookie that identifies the user session of the requests
+	// read from the access log. The cookies are taken from the field captured by the
+	// parser with the name "cookie", or, when set, with the name SessionField.
+	SessionCookie string
+
+	// SessionPattern is a regular expression applied to the log entries. Its first
+	// submatch, or when it has none, the complete match identifies the user session of
+	// the request. It takes precedence over SessionField and SessionCookie.
+	SessionPattern string
+
+	// OpenLoop tells the player to issue the requests at the rate defined by Throttle,
+	// independent of how long it takes to receive the responses. The time between the
+	// requests follows an exponential distribution, as with Poisson arrivals. Without
+	// OpenLoop, the sessions make the next request only after the previous one has
+	// completed, and when the server slows down, so does the replay.
+	//
+	// In open loop mode, Throttle must be set, and Once() returns when the last
+	// request was issued, without waiting for the pending responses.
+	OpenLoop bool
+
+	// MaxOpenRequests limits the number of the requests that a session can have in
+	// flight in open loop mode. The requests arriving while a session is at the limit
+	// are not made, and they are counted in Stats.Dropped. Defaults to
+	// DefaultMaxOpenRequests.
+	MaxOpenRequests int
+
+	// StartAt, when set to a time in the future, tells the player to prepare the replay
+	// immediately when Play() or Once() is called, but to start sending the requests only
+	// at this time, e.g. to synchronize multiple players. The preparation includes
+	// reading the complete access log, and resolving the host names of the target
+	// servers, or, without a server, of the requests. After stop, the replay is started
+	// immediately.
+	StartAt time.Time
+
+	// OnRequest, when set, is called before every request is sent, and it can modify
+	// the request, e.g. its URL or headers. When it returns an error, the request is
+	// not sent, and it is counted as failed. It is called from the goroutines of the
+	// sessions.
+	OnRequest func(*http.Request) error
+
+	// OnResponse, when set, is called with every received response. When it returns
+	// false, the response is counted as an assertion failure. Setting it requires the
+	// response bodies to be kept in memory while the hook is called.
+	OnResponse func(*http.Request, Response) bool
+
+	// OnProgress, when set, is called periodically while the player is playing
+	// requests, and once more when the replay stopped. It is called from the goroutine
+	// of the player, and it should return quickly.
+	OnProgress func(Progress)
+
+	// ProgressInterval sets how often OnProgress is called. Defaults to
+	// DefaultProgressInterval.
+	ProgressInterval time.Duration
+
+	// EventBuffer sets the size of the buffer of the channel returned by Events().
+	// Defaults to DefaultEventBuffer.
+	EventBuffer int
 }
 
 type (
@@ -174,19 +991,49 @@ type (
 // Player replays HTTP requests explicitly specified and/or read from an Apache access log.
 type Player struct {
 	options        Options
+	shared         *shared
 	accessLog      *reader
-	logEntries     []*Request
+	logEntries     *entryStore
 	customRequests []*Request
 	errors         int
 	serverErrors   int
+	assertFailures int
+	sizeDeviations int
+	breaker        *breaker
+	hostLimit      *hostLimit
+	statusCounts   map[string]int
+	slo            *sloWindow
+	adaptive       *adaptiveThrottle
+	progress       *progress
+	fed            int
+	skip           int64
+	paused         int32
+	started        int
+	inFlight       int
 	players        []*player
+	parked         []*player
+	bodyFiles      []bodyFile
+	seed           int64
+	random         *rand.Rand
+	weights        []float64
+	sessionIndexes []int
 	once           bool
+	stats          *shardedStats
 	waitingError   []errorChannel
+	waitingDrain   []signalChannel
 	notRunning     signalChannel
 	signalPlay     chan errorChannel
 	signalOnce     chan errorChannel
 	signalPause    chan signalChannel
+	signalDrain    chan signalChannel
 	signalStop     chan signalChannel
+	sessionsSet    signalChannel
+	requestFeed    chan *player
+	results        resultChannel
+
+	// closed when the run stops, to release the sessions that report their last
+	// results, since nothing receives them anymore
+	quit signalChannel
 }
 
 var (
@@ -199,90 +1046,313 @@ var (
 
 	// ErrNoRequests is returned when the there are no requests to be executed by Play().
 	ErrNoRequests = errors.New("no requests to play")
+
+	// ErrNoRate is returned by New() when OpenLoop is set without a Throttle.
+	ErrNoRate = errors.New("open loop replay requires a rate")
+
+	// ErrNoPayloadSample is returned by New() when Payload is set to SamplePayload
+	// without a PayloadSample.
+	ErrNoPayloadSample = errors.New("sample payload requires a sample")
+
+	// ErrIncompleteClientCert is returned when only one of the client certificate and
+	// the client key is set.
+	ErrIncompleteClientCert = errors.New("client certificate and key need to be set together")
+
+	// ErrInvalidTLSVersion is returned by New() when MinTLSVersion is higher than
+	// MaxTLSVersion.
+	ErrInvalidTLSVersion = errors.New("minimum TLS version is higher than the maximum")
+
+	// ErrInvalidCAFile is returned when the CA file doesn't contain any PEM encoded
+	// certificates.
+	ErrInvalidCAFile = errors.New("no certificates found in the CA file")
+
+	// ErrAssertionFailed is returned when the number of the responses failing to meet
+	// the assertions reached the AssertionThreshold.
+	ErrAssertionFailed = errors.New("assertion failed")
+
+	// ErrInvalidHaltRule is returned when a key in HaltRules is neither a status code nor
+	// a status class.
+	ErrInvalidHaltRule = errors.New("invalid halt rule")
+
+	// ErrInvalidStatusFilter is returned when an item in Statuses or ExcludeStatuses is
+	// neither a status code nor a status class.
+	ErrInvalidStatusFilter = errors.New("invalid status filter")
+
+	// ErrTooManyRedirects is the error of the requests that exceeded MaxRedirects.
+	ErrTooManyRedirects = errors.New("too many redirects")
+
+	// ErrHaltStatus is returned when the player stopped due to a rule in HaltRules.
+	ErrHaltStatus = errors.New("halt rule threshold reached")
+
+	// ErrSizeDeviation is returned when the number of the responses deviating from the
+	// logged size reached the SizeDeviationThreshold.
+	ErrSizeDeviation = errors.New("response size deviated")
+
+	// ErrLatencySLO is returned when the player stopped, because the response times
+	// exceeded the LatencySLO.
+	ErrLatencySLO = errors.New("latency objective violated")
+
+	// ErrUndefinedEnv is returned by New() when ExpandEnv is set, and a referenced
+	// environment variable is not set.
+	ErrUndefinedEnv = errors.New("undefined environment variable")
+
+	// ErrInvalidPathRule is returned by New() when a random range in the replacement of
+	// a path rule is invalid.
+	ErrInvalidPathRule = errors.New("invalid path rule")
+
+	// ErrInvalidExtraction is returned by New() when an extraction doesn't have a name,
+	// or it doesn't have exactly one source, or its JSON path is invalid.
+	ErrInvalidExtraction = errors.New("invalid extraction")
+
+	// ErrHTTP3Option is returned by New() when HTTP3 is set together with an option
+	// that the HTTP/3 transport doesn't support, or with a server not accessed over TLS.
+	ErrHTTP3Option = errors.New("option not supported over HTTP/3")
+
+	// ErrEmptyGroup is returned by NewGroup() when no options are passed in.
+	ErrEmptyGroup = errors.New("empty group")
 )
 
 // New initialzies a player.
 func New(o Options) (*Player, error) {
 	if o.Log == nil {
-		o.Log = newDefaultLog()
+		o.Log = newDefaultLog(o.LogLevels)
+	}
+
+	parserLog := newComponentLog(o.Log, ParserComponent, o.LogLevels)
+	o.Log = newComponentLog(o.Log, PlayerComponent, o.LogLevels)
+
+	if o.ExpandEnv {
+		var err error
+		if o, err = expandEnvOptions(o); err != nil {
+			return nil, err
+		}
+	}
+
+	for key := range o.HaltRules {
+		if !validStatusKey(key) {
+			return nil, ErrInvalidHaltRule
+		}
+	}
+
+	if o.OpenLoop && o.Throttle <= 0 {
+		return nil, ErrNoRate
+	}
+
+	if err := checkHTTP3(o); err != nil {
+		return nil, err
+	}
+
+	if o.Payload == SamplePayload && len(o.PayloadSample) == 0 {
+		return nil, ErrNoPayloadSample
 	}
 
 	var r *reader
 	if o.AccessLog != nil {
 		var err error
-		r, err = newReader(o.AccessLog, o.AccessLogFormat, o.Parser, o.Log)
+		r, err = newReader(o, parserLog)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if o.DefaultScheme == "" {
-		o.DefaultScheme = "http"
+	bf, err := compileBodyFiles(o.BodyFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, err := compilePathRules(o.PathRules)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := loadCorpora(o.Corpora)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.CaptureDir != "" {
+		if err := os.MkdirAll(o.CaptureDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	tc, err := newTransportConfig(o)
+	if err != nil {
+		return nil, err
 	}
 
 	if o.ConcurrentSessions <= 0 {
 		o.ConcurrentSessions = 1
 	}
 
+	sh := newShared(o, c, tc)
+	sh.pathRules = pr
+	if sh.tokens == nil && o.OAuth2TokenURL != "" {
+		sh.tokens = newClientCredentials(o, tc)
+	}
+
+	if o.PostBodyTemplate != "" {
+		if _, err := sh.templates.get(o.PostBodyTemplate); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := registerTemplates(sh.templates, o); err != nil {
+		return nil, err
+	}
+
+	if err := validateRedactPatterns(sh.regexps, o.RedactBodyPatterns); err != nil {
+		return nil, err
+	}
+
+	if err := validateAssertions(sh.regexps, o.Assertions); err != nil {
+		return nil, err
+	}
+
+	if err := validateExtractions(sh.regexps, o.Extractions); err != nil {
+		return nil, err
+	}
+
+	if err := validateLabelRules(sh.regexps, o.LabelRules); err != nil {
+		return nil, err
+	}
+
+	for _, ri := range o.Requests {
+		if err := validateAssertions(sh.regexps, ri.Assertions); err != nil {
+			return nil, err
+		}
+
+		if ri.BodyTemplate == "" {
+			continue
+		}
+
+		if _, err := sh.templates.get(ri.BodyTemplate); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.DefaultScheme == "" {
+		o.DefaultScheme = "http"
+	}
+
+	seed := o.RandomSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	shuffleSeed := o.ShuffleSeed
+	if shuffleSeed == 0 {
+		shuffleSeed = seed
+	}
+
 	// enable starting the player:
 	notRunning := make(signalChannel, 1)
 	notRunning <- signalToken{}
 
 	return &Player{
 		options:        o,
+		shared:         sh,
+		bodyFiles:      bf,
+		seed:           seed,
+		random:         newRandom(shuffleSeed),
 		accessLog:      r,
+		logEntries:     newEntryStore(o, o.Log),
 		customRequests: o.Requests,
 		notRunning:     notRunning,
+		stats:          newShardedStats(),
+		breaker:        newBreaker(o),
+		hostLimit:      newHostLimit(o),
+		statusCounts:   make(map[string]int),
+		slo:            newSLOWindow(o),
+		adaptive:       newAdaptiveThrottle(o),
+		progress:       newProgress(o),
 		signalPlay:     make(chan errorChannel, 1),
 		signalOnce:     make(chan errorChannel, 1),
 		signalPause:    make(chan signalChannel, 1),
+		signalDrain:    make(chan signalChannel, 1),
 		signalStop:     make(chan signalChannel, 1),
+		sessionsSet:    make(signalChannel, 1),
 	}, nil
 }
 
 func (p *Player) contentSettings(r *Request) {
-	switch r.Method {
-	case "POST", "PUT", "PATCH":
-	default:
+	if !isPost(r.Method) {
 		return
 	}
 
+	r.BodyTemplate = p.options.PostBodyTemplate
+	r.BodyFormat = p.options.PostBodyFormat
+	r.FormFields = p.options.PostFormFields
+	r.FormFieldSize = p.options.PostFormFieldSize
 	r.ContentLength = p.options.PostContentLength
 	r.ContentLengthDeviation = p.options.PostContentLengthDeviation
 	r.SetContentLength = p.options.PostSetContentLength
+	r.Chunked = p.options.PostChunked
 }
 
-func (p *Player) nextRequest(position int) (*Request, error) {
-	if position < len(p.logEntries) {
-		r := p.logEntries[position]
-		p.contentSettings(r)
-		return r, nil
-	}
-
-	if p.accessLog == nil {
-		position -= len(p.logEntries)
-		if position >= len(p.customRequests) {
-			return nil, io.EOF
-		}
-
-		return p.customRequests[position], nil
+func (p *Player) logEntrySettings(r *Request) {
+	p.contentSettings(r)
+	r.Delay = p.options.ThinkTime
+	r.DelayDeviation = p.options.ThinkTimeDeviation
+	if len(r.Body) == 0 {
+		r.BodyFile = matchBodyFile(p.bodyFiles, r.Path)
 	}
+}
 
-	var err error
+func (p *Player) readLogEntry() error {
 	r, err := p.accessLog.ReadRequest()
 	if err != nil && err != io.EOF {
 		p.options.Log.Warnln("error while reading access log:", err)
-		return nil, err
+		return err
 	}
 
 	if err == io.EOF {
 		p.accessLog = nil
-		return p.nextRequest(position)
+		return nil
 	}
 
-	p.logEntries = append(p.logEntries, r)
-	p.contentSettings(r)
-	return r, nil
+	if err := p.logEntries.add(r); err != nil {
+		p.options.Log.Errorln("failed to store log entry:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (p *Player) nextRequest(position int) (*Request, error) {
+	// when requests were skipped, the access log may need to be read further than the
+	// next entry:
+	for position >= p.logEntries.count() && p.accessLog != nil {
+		if err := p.readLogEntry(); err != nil {
+			return nil, err
+		}
+	}
+
+	if position < p.logEntries.count() {
+		r, err := p.logEntries.get(position)
+		if err != nil {
+			p.options.Log.Errorln("failed to load log entry:", err)
+			return nil, err
+		}
+
+		p.logEntrySettings(r)
+		return r, nil
+	}
+
+	position -= p.logEntries.count()
+	if position >= len(p.customRequests) {
+		return nil, io.EOF
+	}
+
+	r := p.customRequests[position]
+	if !r.logEntry {
+		return r, nil
+	}
+
+	// the requests in the options are not modified:
+	rc := *r
+	p.logEntrySettings(&rc)
+	return &rc, nil
 }
 
 func (p *Player) checkHaltError() bool {
@@ -294,6 +1364,72 @@ func (p *Player) checkHaltError() bool {
 	return true
 }
 
+// validStatusKey checks a status code or a status class, e.g. 503 or 5xx
+func validStatusKey(key string) bool {
+	if len(key) != 3 || key[0] < '1' || key[0] > '5' {
+		return false
+	}
+
+	if key[1:] == "xx" {
+		return true
+	}
+
+	_, err := strconv.Atoi(key)
+	return err == nil
+}
+
+// haltRule returns the key and the threshold of the halt rule matching the status
+func (p *Player) haltRule(status int) (string, int, bool) {
+	code := strconv.Itoa(status)
+	if t, ok := p.options.HaltRules[code]; ok {
+		return code, t, true
+	}
+
+	class := code[:1] + "xx"
+	if t, ok := p.options.HaltRules[class]; ok {
+		return class, t, true
+	}
+
+	return "", 0, false
+}
+
+// checkHaltRules applies the halt rules to the result, and returns the error that
+// needs to be checked by the default rules
+func (p *Player) checkHaltRules(r result) (bool, error) {
+	if len(p.options.HaltRules) == 0 || r.status == 0 {
+		return false, r.err
+	}
+
+	key, threshold, ok := p.haltRule(r.status)
+	for k := range p.statusCounts {
+		if k != key {
+			delete(p.statusCounts, k)
+		}
+	}
+
+	if !ok {
+		return false, r.err
+	}
+
+	err := r.err
+	if err == ErrServerError {
+		err = nil
+	}
+
+	if threshold <= 0 {
+		return false, err
+	}
+
+	p.statusCounts[key]++
+	if p.statusCounts[key] < threshold {
+		return false, err
+	}
+
+	p.options.Log.Errorln("halt rule threshold reached:", key)
+	p.stop(ErrHaltStatus)
+	return true, nil
+}
+
 func (p *Player) checkHaltStatus() bool {
 	if !p.options.HaltOn500 || p.serverErrors < p.options.HaltThreshold {
 		return false
@@ -303,6 +1439,36 @@ func (p *Player) checkHaltStatus() bool {
 	return true
 }
 
+func (p *Player) checkHaltAssertion(r result) bool {
+	if !r.assertionFailed {
+		return false
+	}
+
+	p.assertFailures++
+	if p.options.AssertionThreshold <= 0 || p.assertFailures < p.options.AssertionThreshold {
+		return false
+	}
+
+	p.options.Log.Errorln("assertion failures exceeded threshold")
+	p.stop(ErrAssertionFailed)
+	return true
+}
+
+func (p *Player) checkHaltSize(r result) bool {
+	if !r.sizeDeviated {
+		return false
+	}
+
+	p.sizeDeviations++
+	if p.options.SizeDeviationThreshold <= 0 || p.sizeDeviations < p.options.SizeDeviationThreshold {
+		return false
+	}
+
+	p.options.Log.Errorln("response size deviations exceeded threshold")
+	p.stop(ErrSizeDeviation)
+	return true
+}
+
 func (p *Player) checkHalt(err error) bool {
 	err = p.checkError(err)
 	if err == nil {
@@ -318,8 +1484,8 @@ func (p *Player) checkError(err error) error {
 	case nil:
 		p.errors = 0
 		p.serverErrors = 0
-	case ErrNoRequests:
-		return ErrNoRequests
+	case ErrNoRequests, ErrAssertionFailed, ErrSizeDeviation, ErrHaltStatus, ErrLatencySLO:
+		return err
 	case ErrServerError:
 		p.serverErrors++
 		if p.checkHaltStatus() {
@@ -335,58 +1501,261 @@ func (p *Player) checkError(err error) error {
 	return nil
 }
 
-func (p *Player) stopPlayer(i int, feed requestChannel) {
-	if i < 0 {
-		for i = 0; i < len(p.players); i++ {
-			if p.players[i].feed == feed {
-				break
-			}
+func (p *Player) stopPlayer(s *player) {
+	for i := range p.players {
+		if p.players[i] == s {
+			close(s.feed)
+			p.players = append(p.players[:i], p.players[i+1:]...)
+			return
 		}
 	}
+}
 
-	if i >= len(p.players) {
-		return
+// adjustSessions starts or stops sessions to match the concurrency set
+func (p *Player) adjustSessions() {
+	n := p.shared.getSessions()
+	for len(p.players) < n {
+		sh := p.stats.shard()
+		s := newPlayer(
+			p.options,
+			p.shared,
+			p.seed+int64(p.started)+1,
+			p.requestFeed,
+			p.results,
+			p.quit,
+			sh,
+		)
+
+		// the order of the requests is drawn separately for every session, so that it
+		// doesn't depend on the timing of the other sessions:
+		s.orderRandom = newRandom(p.random.Int63())
+		p.started++
+		p.players = append(p.players, s)
+		run := s.run
+		if p.options.OpenLoop {
+			run = s.runOpenLoop
+		}
+
+		go func() {
+			run()
+
+			// the exited session doesn't count more results:
+			p.stats.retire(sh)
+		}()
 	}
 
-	close(p.players[i].feed)
-	p.players = append(p.players[:i], p.players[i+1:]...)
+	for len(p.players) > n {
+		p.stopPlayer(p.players[len(p.players)-1])
+	}
+}
+
+// a stopped session can still ask for a request, before it notices that its feed was
+// closed
+func (p *Player) isActive(s *player) bool {
+	for _, si := range p.players {
+		if si == s {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (p *Player) stop(err error) {
-	for i := range p.players {
-		p.stopPlayer(i, nil)
+	for _, s := range p.players {
+		close(s.feed)
 	}
 
+	p.players = nil
+	close(p.quit)
+	atomic.StoreInt32(&p.paused, 0)
+	p.reportProgress()
+
 	err = p.checkError(err)
+	if err != nil {
+		p.shared.events.emit(Event{Type: Halted, Err: err})
+	}
+
 	for _, w := range p.waitingError {
 		w <- err
 	}
 
+	p.releaseDrain()
+
 	p.notRunning <- signalToken{}
 }
 
-func (p *Player) feedRequest(f feedRequest) bool {
-	r, err := p.nextRequest(f.position)
-	if err == io.EOF {
-		if p.once {
-			p.stopPlayer(-1, f.response)
-			if len(p.players) == 0 {
-				p.stop(nil)
-				return false
+func (p *Player) readAll() error {
+	for p.accessLog != nil {
+		if _, err := p.nextRequest(p.logEntries.count()); err != nil && err != io.EOF {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// eachRequest calls f with the log entries and the custom requests, in order. When a
+// spilled log entry cannot be loaded, f receives an empty request in its place.
+func (p *Player) eachRequest(f func(int, *Request)) {
+	n := p.logEntries.count()
+	for i := 0; i < n; i++ {
+		r, err := p.logEntries.get(i)
+		if err != nil {
+			p.options.Log.Errorln("failed to load log entry:", err)
+			r = &Request{}
+		}
+
+		f(i, r)
+	}
+
+	for i, r := range p.customRequests {
+		f(n+i, r)
+	}
+}
+
+func (p *Player) requestWeights() []float64 {
+	weights := make([]float64, p.logEntries.count()+len(p.customRequests))
+	var sum float64
+	p.eachRequest(func(i int, r *Request) {
+		w := r.Weight
+		if w <= 0 {
+			w = 1
+		}
+
+		sum += w
+		weights[i] = sum
+	})
+
+	return weights
+}
+
+func (p *Player) pickWeighted(s *player) int {
+	return sort.SearchFloat64s(p.weights, s.orderRandom.Float64()*p.weights[len(p.weights)-1])
+}
+
+func (p *Player) sessionRequest(s *player) (*Request, error) {
+	position := s.position
+	switch {
+	case p.options.PreserveSessions:
+		if position == 0 {
+			if err := p.readAll(); err != nil {
+				return nil, err
 			}
 
-			return true
+			s.order = p.sessionOrder(s)
 		}
 
-		if f.position == 0 {
-			p.stop(ErrNoRequests)
-			return false
+		if position >= len(s.order) {
+			return nil, io.EOF
+		}
+
+		position = s.order[position]
+	case p.options.Weighted:
+		if position == 0 && p.weights == nil {
+			if err := p.readAll(); err != nil {
+				return nil, err
+			}
+
+			p.weights = p.requestWeights()
+		}
+
+		if position >= len(p.weights) {
+			return nil, io.EOF
+		}
+
+		position = p.pickWeighted(s)
+	case p.options.Shuffle:
+		if position == 0 {
+			if err := p.readAll(); err != nil {
+				return nil, err
+			}
+
+			s.order = s.orderRandom.Perm(p.logEntries.count() + len(p.customRequests))
+		}
+
+		if position >= len(s.order) {
+			return nil, io.EOF
 		}
 
-		f.response <- nil
+		position = s.order[position]
+	}
+
+	return p.nextRequest(position)
+}
+
+// applySkip moves every session forward by the number of the requests skipped since
+// the last request was fed
+func (p *Player) applySkip() {
+	n := int(atomic.SwapInt64(&p.skip, 0))
+	if n <= 0 {
+		return
+	}
+
+	for _, s := range p.players {
+		s.position += n
+	}
+}
+
+// send feeds a request to a session
+func (p *Player) send(s *player, r *Request) {
+	var rc Request
+	rc = *r
+	s.feed <- &rc
+	p.inFlight++
+	p.hostLimit.start(r.Host)
+}
+
+func (p *Player) feedRequest(s *player) bool {
+	// the requests deferred due to the host limit are sent first:
+	if r := p.takeDeferred(s); r != nil {
+		p.send(s, r)
 		return true
 	}
 
+	if len(s.deferred) >= maxDeferredRequests {
+		p.park(s)
+		return true
+	}
+
+	p.applySkip()
+	r, err := p.sessionRequest(s)
+	if err == io.EOF && len(s.deferred) > 0 {
+		p.park(s)
+		return true
+	}
+
+	if err == io.EOF && s.position > 0 {
+		p.shared.events.emit(Event{Type: LoopCompleted})
+	}
+
+	if err == io.EOF && !p.once && s.position > 0 {
+		s.position = 0
+		r, err = p.sessionRequest(s)
+	}
+
+	if err == io.EOF {
+		// when preserving sessions, a player session may not have any user sessions
+		// assigned:
+		if p.once || p.options.PreserveSessions {
+			p.stopPlayer(s)
+			if len(p.players) > 0 {
+				return true
+			}
+
+			if p.once {
+				p.stop(nil)
+			} else {
+				p.stop(ErrNoRequests)
+			}
+
+			return false
+		}
+
+		p.stop(ErrNoRequests)
+		return false
+	}
+
 	if err != nil {
 		if p.checkHalt(err) {
 			return false
@@ -395,55 +1764,157 @@ func (p *Player) feedRequest(f feedRequest) bool {
 		return true
 	}
 
-	var rc Request
-	rc = *r
-	f.response <- &rc
+	s.position++
+	p.fed++
+
+	// when the circuit is open for the host, the request is skipped, and the session
+	// asks for the next one:
+	if !p.breaker.allow(r.Host) {
+		p.stats.skip()
+		return true
+	}
+
+	// when the host reached the limit, the request is deferred, and the session asks for
+	// the next one:
+	if !p.hostLimit.allow(r.Host) {
+		s.deferred = append(s.deferred, r)
+		return true
+	}
+
+	p.send(s, r)
 	return true
 }
 
 func (p *Player) run() {
-	requestFeed := make(chan feedRequest)
-	results := make(errorChannel)
+	p.requestFeed = make(chan *player)
+	p.results = make(resultChannel)
+	p.quit = make(signalChannel)
 	p.waitingError = nil
-
-	o := p.options
-	o.Throttle = p.options.Throttle / float64(p.options.ConcurrentSessions)
-	p.players = make([]*player, p.options.ConcurrentSessions)
-	for i := 0; i < p.options.ConcurrentSessions; i++ {
-		p.players[i] = newPlayer(o, requestFeed, results)
-		go p.players[i].run()
+	p.waitingDrain = nil
+	p.fed = 0
+	p.inFlight = 0
+	p.hostLimit = newHostLimit(p.options)
+	p.parked = nil
+
+	var tick <-chan time.Time
+	if p.progress != nil {
+		ticker := time.NewTicker(p.progress.interval)
+		defer ticker.Stop()
+		tick = ticker.C
 	}
 
-	var feed chan feedRequest
+	p.players = nil
+	p.started = 0
+	p.adjustSessions()
+
+	// before the scheduled start, the requests are not fed, even when playing:
+	var (
+		feed, pending chan *player
+		start         = p.startTimer()
+	)
+
 	for {
 		select {
 		case d := <-p.signalPlay:
+			atomic.StoreInt32(&p.paused, 0)
 			p.waitingError = append(p.waitingError, d)
 			p.once = false
-			feed = requestFeed
+			pending = p.requestFeed
+			if start == nil {
+				feed = pending
+				p.unpark()
+			}
 		case d := <-p.signalOnce:
+			atomic.StoreInt32(&p.paused, 0)
 			p.waitingError = append(p.waitingError, d)
 			p.once = true
-			feed = requestFeed
+			pending = p.requestFeed
+			if start == nil {
+				feed = pending
+				p.unpark()
+			}
+		case <-start:
+			start = nil
+			feed = pending
+			if feed != nil {
+				p.unpark()
+			}
 		case d := <-p.signalPause:
-			feed = nil
+			atomic.StoreInt32(&p.paused, 1)
+			feed, pending = nil, nil
 			close(d)
+		case d := <-p.signalDrain:
+			atomic.StoreInt32(&p.paused, 1)
+			feed, pending = nil, nil
+			p.waitingDrain = append(p.waitingDrain, d)
+			if p.inFlight == 0 {
+				p.releaseDrain()
+			}
 		case d := <-p.signalStop:
 			p.stop(nil)
 			close(d)
 			return
-		case err := <-results:
-			if p.checkHalt(err) {
+		case <-p.sessionsSet:
+			p.adjustSessions()
+		case r := <-p.results:
+			p.inFlight--
+			p.hostLimit.done(r.host)
+			if p.inFlight == 0 {
+				p.releaseDrain()
+			}
+
+			if feed != nil {
+				p.unpark()
+			}
+
+			if r.cacheHit || r.dropped {
+				continue
+			}
+
+			p.report(r)
+			p.adaptThrottle(r)
+			if p.checkHaltAssertion(r) || p.checkHaltSize(r) || p.checkHaltSLO(r) {
+				return
+			}
+
+			halt, err := p.checkHaltRules(r)
+			if halt || p.checkHalt(err) {
 				return
 			}
-		case f := <-feed:
-			if !p.feedRequest(f) {
+		case s := <-feed:
+			if !p.isActive(s) {
+				continue
+			}
+
+			if !p.feedRequest(s) {
 				return
 			}
+		case <-tick:
+			p.reportProgress()
 		}
 	}
 }
 
+// releaseDrain unblocks the calls to PauseAndDrain()
+func (p *Player) releaseDrain() {
+	for _, d := range p.waitingDrain {
+		close(d)
+	}
+
+	p.waitingDrain = nil
+}
+
+func (p *Player) report(r result) {
+	p.breaker.report(r.host, r.status == 0 || r.status >= 500)
+	if r.diff != nil && p.options.DiffLog != nil {
+		p.writeDifference(r.diff)
+	}
+
+	if r.logEntry != nil {
+		p.writeResult(r.logEntry)
+	}
+}
+
 // this is enough to avoid starting more than one goroutine
 func (p *Player) isRunning() bool {
 	select {
@@ -499,13 +1970,137 @@ func (p *Player) Once() error {
 // replay is resumed at the next request in order. It should not be called after Stop(). Play(),
 // Once() and Pause() can be called any number of times during a session started by Play() or
 // Once().
+//
+// Pause returns as soon as no more requests are started, and it doesn't wait for the requests
+// in flight. They complete in the background, and their results are still counted in the
+// statistics and checked by the halt conditions. To wait for them, use PauseAndDrain().
 func (p *Player) Pause() {
 	p.signal(p.signalPause)
 }
 
+// PauseAndDrain pauses the replay of the requests, like Pause(), and blocks until all the
+// requests in flight have completed and their results were processed, so that the sessions
+// are idle. After it returns, the statistics don't change until the replay is resumed, and the
+// player can be safely inspected or reconfigured. When the replay stops or halts while
+// draining, it returns, too. It should not be called after Stop().
+func (p *Player) PauseAndDrain() {
+	p.signal(p.signalDrain)
+}
+
+// Paused tells whether the replay was paused with Pause() or PauseAndDrain(), and it was
+// not resumed or stopped since. It can be called from any goroutine.
+func (p *Player) Paused() bool {
+	return atomic.LoadInt32(&p.paused) == 1
+}
+
 // Stop stops the replay of the requests. When Play() or Once() are called after stop, the
 // replay starts from the first request. It can be called only once after Play() or Once() was
 // called.
 func (p *Player) Stop() {
 	p.signal(p.signalStop)
 }
+
+// Close releases the resources of the player, e.g. the temporary file of the log entries
+// spilled to disk when MaxMemory is set. It can be called only when the player is not
+// running, and the player cannot be used afterwards.
+func (p *Player) Close() error {
+	return p.logEntries.close()
+}
+
+// SetThrottle changes the maximum outgoing overall request per second rate. It takes
+// effect immediately, also when the player is currently playing requests. Zero or a
+// negative value disables throttling. In open loop mode, where the rate is required,
+// values of zero or below are ignored. With adaptive throttling, it also sets the rate
+// to recover to.
+func (p *Player) SetThrottle(rps float64) {
+	if rps <= 0 && p.options.OpenLoop {
+		return
+	}
+
+	p.shared.rate.set(rps)
+	if p.adaptive != nil {
+		p.adaptive.target.set(rps)
+	}
+}
+
+// Throttle returns the current maximum outgoing overall request per second rate. Zero
+// means that throttling is disabled. With adaptive throttling, it returns the rate
+// currently applied.
+func (p *Player) Throttle() float64 {
+	return p.shared.rate.get()
+}
+
+// SetConcurrency changes the number of the concurrent sessions. It takes effect
+// immediately, also when the player is currently playing requests. The new sessions
+// start from the first request, and in case of Once(), they replay all the requests.
+// Values below 1 are ignored.
+func (p *Player) SetConcurrency(n int) {
+	if n < 1 {
+		return
+	}
+
+	p.shared.setSessions(n)
+	select {
+	case p.sessionsSet <- signalToken{}:
+	default:
+	}
+}
+
+// Concurrency returns the current number of the concurrent sessions.
+func (p *Player) Concurrency() int {
+	return p.shared.getSessions()
+}
+
+// RampDown reduces the load gradually over the given duration, e.g. to let the
+// connections drain, and to observe the behavior of the target at decreasing load. The
+// concurrency and, when throttling is enabled, the throttle are reduced linearly from
+// their current values towards zero, every second, or in ten steps when the duration is
+// shorter than ten seconds. The concurrency is kept at least at one session. RampDown
+// blocks until the duration passes, and it doesn't stop the player: Stop() needs to be
+// called afterwards to end the replay.
+func (p *Player) RampDown(d time.Duration) {
+	step := d / rampDownMinSteps
+	if step > rampDownStep {
+		step = rampDownStep
+	}
+
+	if step <= 0 {
+		return
+	}
+
+	n := int(d / step)
+	concurrency, throttle := p.Concurrency(), p.Throttle()
+	for i := 1; i <= n; i++ {
+		if f := float64(n-i) / float64(n); f > 0 {
+			p.SetConcurrency(int(math.Ceil(float64(concurrency) * f)))
+			if throttle > 0 {
+				p.SetThrottle(throttle * f)
+			}
+		}
+
+		time.Sleep(step)
+	}
+}
+
+// Skip skips the next n requests in every session. It can be called also when the player
+// is currently playing requests. When a session skips past the last request, it
+// continues with the first one, or, in case of Once(), it completes.
+func (p *Player) Skip(n int) {
+	if n > 0 {
+		atomic.AddInt64(&p.skip, int64(n))
+	}
+}
+
+// Stats returns the statistics of the replay, collected since the player was created. It
+// can be called while the player is playing requests.
+func (p *Player) Stats() Stats {
+	return p.stats.get()
+}
+
+// Events returns the channel of the events of the replay, e.g. to implement custom
+// reporting. The events are emitted only after the first call to Events(). The channel is
+// buffered, see EventBuffer, and when the buffer is full, the events are dropped instead
+// of slowing down the replay. The channel is never closed.
+func (p *Player) Events() <-chan Event {
+	return p.shared.events.get()
+}
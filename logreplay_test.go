@@ -1,16 +1,37 @@
 package logreplay
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -37,6 +58,8 @@ type slowMotionHandler struct {
 	signal signalChannel
 }
 
+type delayHandler time.Duration
+
 type redirectHandler struct {
 	location   string
 	unlessPath string
@@ -47,6 +70,16 @@ type contentLengthHandler struct {
 	length int
 }
 
+type bodyRecorderHandler struct {
+	mx     sync.Mutex
+	bodies []string
+}
+
+type formHandler struct {
+	mx    sync.Mutex
+	forms []url.Values
+}
+
 type headerCaptureHandler struct {
 	mx     sync.Mutex
 	header http.Header
@@ -122,6 +155,10 @@ func (s *slowMotionHandler) ServeHTTP(http.ResponseWriter, *http.Request) {
 	<-s.signal
 }
 
+func (d delayHandler) ServeHTTP(http.ResponseWriter, *http.Request) {
+	time.Sleep(time.Duration(d))
+}
+
 func (rh *redirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if rh.unlessPath != "" && r.URL.Path == rh.unlessPath {
 		return
@@ -144,6 +181,38 @@ func (c *contentLengthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	c.length += len(b)
 }
 
+func (b *bodyRecorderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	b.bodies = append(b.bodies, string(body))
+}
+
+func (f *formHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		err = r.ParseMultipartForm(1 << 20)
+	} else {
+		err = r.ParseForm()
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.forms = append(f.forms, r.PostForm)
+}
+
 func (hc *headerCaptureHandler) ServeHTTP(_ http.ResponseWriter, r *http.Request) {
 	hc.mx.Lock()
 	defer hc.mx.Unlock()
@@ -180,11 +249,17 @@ func (p *testJSONParser) Parse(line string) *Request {
 		return nil
 	}
 
-	return &Request{
+	r := &Request{
 		Method: m["method"],
 		Host:   m["host"],
 		Path:   m["path"],
 	}
+
+	if m["body"] != "" {
+		r.Body = []byte(m["body"])
+	}
+
+	return r
 }
 
 func (r *recorder) log(a ...interface{}) {
@@ -696,6 +771,329 @@ func test(t *testing.T, concurrency int) {
 		}
 	})
 
+	t.Run("Stats", func(t *testing.T) {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/fail" {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+		defer s.Close()
+
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests:           []*Request{{}, {Path: "/fail"}, {}},
+			Server:             s.URL,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		once(t, p)
+
+		st := p.Stats()
+		if st.Requests != 3*concurrency ||
+			st.Errors != 0 ||
+			st.ServerErrors != concurrency ||
+			st.Protocols["HTTP/1.1"] != 3*concurrency {
+			t.Error("unexpected stats", st)
+		}
+	})
+
+	t.Run("H2C", func(t *testing.T) {
+		s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ProtoMajor != 2 {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}))
+
+		s.Config.Protocols = new(http.Protocols)
+		s.Config.Protocols.SetUnencryptedHTTP2(true)
+		s.Start()
+		defer s.Close()
+
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests:           []*Request{{}, {}},
+			Server:             s.URL,
+			H2C:                true,
+			HaltOn500:          true,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		once(t, p)
+
+		if st := p.Stats(); st.Protocols["HTTP/2.0"] != 2*concurrency {
+			t.Error("failed to use h2c", st)
+		}
+	})
+
+	t.Run("Proxy", func(t *testing.T) {
+		var (
+			mx    sync.Mutex
+			hosts []string
+		)
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mx.Lock()
+			defer mx.Unlock()
+			hosts = append(hosts, r.URL.Host)
+		}))
+		defer s.Close()
+
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests:           []*Request{{}, {}},
+			Server:             "www.example.org",
+			ProxyURL:           s.URL,
+			HaltOn500:          true,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		once(t, p)
+
+		mx.Lock()
+		defer mx.Unlock()
+		if len(hosts) != 2*concurrency {
+			t.Error("failed to make the requests through the proxy", len(hosts))
+			return
+		}
+
+		for _, h := range hosts {
+			if h != "www.example.org" {
+				t.Error("invalid target host", h)
+			}
+		}
+	})
+
+	t.Run("Resolve", func(t *testing.T) {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Host != "www.example.org" {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+		defer s.Close()
+
+		for _, resolve := range []map[string]string{
+			{"www.example.org": s.Listener.Addr().String()},
+			{"www.example.org:80": s.Listener.Addr().String()},
+		} {
+			p, err := New(Options{
+				ConcurrentSessions: concurrency,
+				Requests:           []*Request{{Host: "www.example.org"}, {Host: "www.example.org"}},
+				Resolve:            resolve,
+			})
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			once(t, p)
+
+			if st := p.Stats(); st.Requests != 2*concurrency || st.Errors != 0 || st.ServerErrors != 0 {
+				t.Error("failed to resolve the address", resolve, st)
+			}
+		}
+	})
+
+	t.Run("Servers", func(t *testing.T) {
+		for _, balancing := range []ServerBalancing{RoundRobin, RandomServer} {
+			var (
+				counters []*counterHandler
+				servers  []string
+			)
+
+			for i := 0; i < 3; i++ {
+				c := &counterHandler{}
+				s := httptest.NewServer(c)
+				defer s.Close()
+				counters = append(counters, c)
+				servers = append(servers, s.URL)
+			}
+
+			p, err := New(Options{
+				ConcurrentSessions: concurrency,
+				Requests:           []*Request{{}, {}, {}, {}, {}, {}, {}, {}, {}},
+				Servers:            servers,
+				ServerBalancing:    balancing,
+				HaltOn500:          true,
+			})
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			once(t, p)
+
+			var total int
+			for _, c := range counters {
+				n := c.counter
+				if balancing == RoundRobin && n != 3*concurrency {
+					t.Error("failed to distribute the requests evenly", n)
+				}
+
+				total += n
+			}
+
+			if total != 9*concurrency {
+				t.Error("failed to make all the requests", total)
+			}
+		}
+	})
+
+	t.Run("Shadow", func(t *testing.T) {
+		primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Version", "1")
+			w.Write([]byte("foo"))
+		}))
+		defer primary.Close()
+
+		shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/status":
+				w.WriteHeader(http.StatusNotFound)
+			case "/header":
+				w.Header().Set("X-Version", "2")
+			case "/body":
+				w.Header().Set("X-Version", "1")
+				w.Write([]byte("bar"))
+			default:
+				w.Header().Set("X-Version", "1")
+				w.Write([]byte("foo"))
+			}
+		}))
+		defer shadow.Close()
+
+		diffLog := &bytes.Buffer{}
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests: []*Request{
+				{Path: "/match"},
+				{Path: "/status"},
+				{Path: "/header"},
+				{Path: "/body"},
+				{Method: "POST", Path: "/match", Body: []byte("baz")},
+			},
+			Server:         primary.URL,
+			Shadow:         shadow.URL,
+			CompareHeaders: []string{"X-Version"},
+			CompareBodies:  true,
+			DiffLog:        diffLog,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		once(t, p)
+
+		if st := p.Stats(); st.Requests != 5*concurrency || st.Differences != 3*concurrency {
+			t.Error("failed to compare the responses", st)
+		}
+
+		diffs := make(map[string]Difference)
+		d := json.NewDecoder(diffLog)
+		for {
+			var diff Difference
+			if err := d.Decode(&diff); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Error(err)
+				return
+			}
+
+			diffs[diff.Path] = diff
+		}
+
+		if len(diffs) != 3 ||
+			diffs["/status"].ShadowStatus != http.StatusNotFound ||
+			len(diffs["/header"].Headers) != 1 ||
+			diffs["/body"].BodyHash == diffs["/body"].ShadowBodyHash {
+			t.Error("failed to report the differences", diffs)
+		}
+	})
+
+	t.Run("Assertions", func(t *testing.T) {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/missing":
+				w.WriteHeader(http.StatusNotFound)
+			case "/slow":
+				time.Sleep(30 * time.Millisecond)
+			case "/json":
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"foo": 42}`))
+			default:
+				w.Write([]byte("Hello, world!"))
+			}
+		}))
+		defer s.Close()
+
+		requests := []*Request{
+			{Path: "/hello"},
+			{Path: "/missing"},
+			{Path: "/slow", Assertions: []Assertion{{MaxLatency: 15 * time.Millisecond}}},
+			{Path: "/json", Assertions: []Assertion{{Body: `"foo":\s*42`}}},
+			{Path: "/hello", Assertions: []Assertion{{Body: "^Hi"}}},
+		}
+
+		assertions := []Assertion{
+			{Status: []int{http.StatusOK}},
+			{PathPattern: "^/json$", Headers: map[string]string{"Content-Type": "application/json"}},
+		}
+
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests:           requests,
+			Server:             s.URL,
+			Assertions:         assertions,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		once(t, p)
+
+		if st := p.Stats(); st.AssertionFailures != 3*concurrency {
+			t.Error("failed to check the assertions", st.AssertionFailures)
+		}
+
+		p, err = New(Options{
+			ConcurrentSessions: concurrency,
+			Requests:           requests,
+			Server:             s.URL,
+			Assertions:         assertions,
+			AssertionThreshold: 1,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err := p.Once(); err != ErrAssertionFailed {
+			t.Error("failed to halt on assertion failure", err)
+		}
+
+		if _, err := New(Options{Assertions: []Assertion{{Body: "("}}}); err == nil {
+			t.Error("failed to fail on invalid assertion")
+		}
+	})
+
 	t.Run("RequestWithContent", func(t *testing.T) {
 		cl := &contentLengthHandler{}
 		s := httptest.NewServer(cl)
@@ -759,19 +1157,26 @@ func test(t *testing.T, concurrency int) {
 		}
 	})
 
-	t.Run("Throttle", func(t *testing.T) {
-		if testing.Short() {
-			t.Skip()
-		}
+	t.Run("AccessLogWithBody", func(t *testing.T) {
+		const (
+			log = `
+				POST /foo {"foo":42}
+				PUT /bar {"bar":36}
+			`
 
-		s := httptest.NewServer(statusHandler(http.StatusOK))
+			format = `^(?P<method>\S+)\s+(?P<path>\S+)\s+(?P<body>\S+)$`
+		)
+
+		b := &bodyRecorderHandler{}
+		s := httptest.NewServer(b)
 		defer s.Close()
 
-		requests := []*Request{{}, {}, {}}
 		p, err := New(Options{
-			Requests: requests,
-			Server:   s.URL,
-			Throttle: 5,
+			ConcurrentSessions: concurrency,
+			AccessLog:          &logReader{log},
+			AccessLogFormat:    format,
+			PostContentLength:  500,
+			Server:             s.URL,
 		})
 
 		if err != nil {
@@ -779,23 +1184,30 @@ func test(t *testing.T, concurrency int) {
 			return
 		}
 
-		start := time.Now()
-		p.Once()
-		duration := time.Now().Sub(start)
-		if duration < 600*time.Millisecond {
-			t.Error("too fast, throttle failed")
+		once(t, p)
+
+		if len(b.bodies) != 2*concurrency {
+			t.Error("failed to send the requests", len(b.bodies))
+			return
+		}
+
+		if concurrency == 1 && (b.bodies[0] != `{"foo":42}` || b.bodies[1] != `{"bar":36}`) {
+			t.Error("failed to send the right body", b.bodies)
 		}
 	})
 
-	t.Run("OncePausePlayStop", func(t *testing.T) {
-		signal := make(signalChannel)
-		s := httptest.NewServer(&slowMotionHandler{signal})
+	t.Run("CustomParserWithBody", func(t *testing.T) {
+		const log = `{"method": "POST", "path": "/foo", "body": "foo=bar"}`
+
+		b := &bodyRecorderHandler{}
+		s := httptest.NewServer(b)
 		defer s.Close()
 
-		requests := []*Request{{}, {}, {}}
 		p, err := New(Options{
-			Requests: requests,
-			Server:   s.URL,
+			ConcurrentSessions: concurrency,
+			AccessLog:          &logReader{log},
+			Parser:             &testJSONParser{t},
+			Server:             s.URL,
 		})
 
 		if err != nil {
@@ -803,40 +1215,47 @@ func test(t *testing.T, concurrency int) {
 			return
 		}
 
-		done := make(signalChannel)
-		go func() {
-			go p.Once()
-			signal <- signalToken{}
-			p.Pause()
-			go p.Play()
-			signal <- signalToken{}
-			signal <- signalToken{}
-			signal <- signalToken{}
-			p.Stop()
-			close(done)
-		}()
+		once(t, p)
 
-		select {
-		case <-done:
-		case <-time.After(120 * time.Millisecond):
-			t.Error("timeout")
+		if len(b.bodies) != concurrency || b.bodies[0] != "foo=bar" {
+			t.Error("failed to send the right body", b.bodies)
 		}
 	})
 
-	t.Run("InvalidFormat", func(t *testing.T) {
-		_, err := New(Options{
-			AccessLog:       &logReader{},
-			AccessLogFormat: "\\",
-		})
+	t.Run("BodyFile", func(t *testing.T) {
+		const (
+			log = `
+				POST /foo
+				POST /bar
+			`
 
-		if err == nil {
-			t.Error("failed to fail")
+			format = `^(?P<method>\S+)\s+(?P<path>\S+)$`
+		)
+
+		f, err := ioutil.TempFile("", "logreplay-body")
+		if err != nil {
+			t.Error(err)
+			return
 		}
-	})
 
-	t.Run("ReadFailed", func(t *testing.T) {
+		defer os.Remove(f.Name())
+		if _, err := f.Write([]byte("foo body")); err != nil {
+			t.Error(err)
+			return
+		}
+
+		f.Close()
+
+		b := &bodyRecorderHandler{}
+		s := httptest.NewServer(b)
+		defer s.Close()
+
 		p, err := New(Options{
-			AccessLog: &failingReader{},
+			AccessLog:       &logReader{log},
+			AccessLogFormat: format,
+			Requests:        []*Request{{Method: "PUT", BodyFile: f.Name()}},
+			BodyFiles:       []BodyFile{{PathPattern: "^/foo$", File: f.Name()}},
+			Server:          s.URL,
 		})
 
 		if err != nil {
@@ -844,11 +1263,5009 @@ func test(t *testing.T, concurrency int) {
 			return
 		}
 
-		err = p.Play()
-		if err != ErrRequestError {
+		once(t, p)
+
+		if len(b.bodies) != 3 || b.bodies[0] != "foo body" || b.bodies[1] != "" || b.bodies[2] != "foo body" {
+			t.Error("failed to send the right body", b.bodies)
+		}
+	})
+
+	t.Run("BodyTemplate", func(t *testing.T) {
+		const (
+			log = `
+				POST /foo foo
+				POST /bar bar
+			`
+
+			format   = `^(?P<method>\S+)\s+(?P<path>\S+)\s+(?P<user>\S+)$`
+			template = `{"user": "{{.Fields.user}}", "path": "{{.Path}}", "seq": {{.Seq}}, "id": "{{.UUID}}"}`
+		)
+
+		b := &bodyRecorderHandler{}
+		s := httptest.NewServer(b)
+		defer s.Close()
+
+		p, err := New(Options{
+			AccessLog:        &logReader{log},
+			AccessLogFormat:  format,
+			PostBodyTemplate: template,
+			Server:           s.URL,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		once(t, p)
+
+		if len(b.bodies) != 2 {
+			t.Error("failed to send the requests", len(b.bodies))
+			return
+		}
+
+		for i, user := range []string{"foo", "bar"} {
+			var body struct {
+				User string
+				Path string
+				Seq  int
+				ID   string
+			}
+
+			if err := json.Unmarshal([]byte(b.bodies[i]), &body); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if body.User != user || body.Path != "/"+user || body.Seq != i+1 || len(body.ID) != 36 {
+				t.Error("failed to execute the template", b.bodies[i])
+			}
+		}
+	})
+
+	t.Run("InvalidBodyTemplate", func(t *testing.T) {
+		_, err := New(Options{
+			Requests: []*Request{{BodyTemplate: "{{.Seq"}},
+		})
+
+		if err == nil {
+			t.Error("failed to fail")
+		}
+	})
+
+	t.Run("FormBody", func(t *testing.T) {
+		for _, format := range []BodyFormat{FormBody, MultipartBody} {
+			f := &formHandler{}
+			s := httptest.NewServer(f)
+			defer s.Close()
+
+			p, err := New(Options{
+				ConcurrentSessions: concurrency,
+				AccessLog:          &logReader{`POST /foo www.example.org`},
+				AccessLogFormat:    `^(?P<method>\S+)\s+(?P<path>\S+)\s+(?P<host>\S+)$`,
+				PostBodyFormat:     format,
+				PostFormFields:     3,
+				PostFormFieldSize:  12,
+				Server:             s.URL,
+			})
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			once(t, p)
+
+			if len(f.forms) != concurrency {
+				t.Error("failed to send the form", format, len(f.forms))
+				return
+			}
+
+			form := f.forms[0]
+			if len(form) != 3 || len(form.Get("field1")) != 12 || len(form.Get("field3")) != 12 {
+				t.Error("failed to send the right form", format, form)
+			}
+		}
+	})
+
+	t.Run("CompressBody", func(t *testing.T) {
+		var (
+			mx     sync.Mutex
+			bodies []string
+		)
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Content-Encoding") != "gzip" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			gr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			b, err := ioutil.ReadAll(gr)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			mx.Lock()
+			defer mx.Unlock()
+			bodies = append(bodies, string(b))
+		}))
+		defer s.Close()
+
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests:           []*Request{{Method: "POST", Body: []byte("foo bar baz")}},
+			Server:             s.URL,
+			CompressBody:       true,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		once(t, p)
+
+		if len(bodies) != concurrency || bodies[0] != "foo bar baz" {
+			t.Error("failed to send compressed body", bodies)
+		}
+	})
+
+	t.Run("Chunked", func(t *testing.T) {
+		var (
+			mx     sync.Mutex
+			bodies []string
+		)
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength != -1 || len(r.TransferEncoding) != 1 || r.TransferEncoding[0] != "chunked" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			mx.Lock()
+			defer mx.Unlock()
+			bodies = append(bodies, string(b))
+			w.Write(b)
+		}))
+		defer s.Close()
+
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests: []*Request{{
+				Method:  "POST",
+				Body:    []byte("foo bar baz qux quux"),
+				Chunked: true,
+			}},
+			Server:     s.URL,
+			ChunkSize:  4,
+			ChunkDelay: 15 * time.Millisecond,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		start := time.Now()
+		once(t, p)
+		if time.Now().Sub(start) < 60*time.Millisecond {
+			t.Error("too fast, chunk delay failed")
+		}
+
+		if len(bodies) != concurrency || bodies[0] != "foo bar baz qux quux" {
+			t.Error("failed to send chunked body", bodies)
+		}
+	})
+
+	t.Run("Payload", func(t *testing.T) {
+		for _, test := range []struct {
+			payload Payload
+			sample  []byte
+			check   func(string) bool
+		}{{
+			payload: TextPayload,
+			check: func(b string) bool {
+				return strings.Trim(b, chars) == ""
+			},
+		}, {
+			payload: JSONPayload,
+			check: func(b string) bool {
+				return strings.Trim(b, jsonChars) == "" && strings.Trim(b, chars) != ""
+			},
+		}, {
+			payload: BinaryPayload,
+			check: func(b string) bool {
+				return strings.Trim(b, jsonChars) != ""
+			},
+		}, {
+			payload: SamplePayload,
+			sample:  []byte("ab"),
+			check: func(b string) bool {
+				return strings.Trim(b, "ab") == "" && strings.Contains(b, "a") && strings.Contains(b, "b")
+			},
+		}} {
+			b := &bodyRecorderHandler{}
+			s := httptest.NewServer(b)
+			defer s.Close()
+
+			p, err := New(Options{
+				ConcurrentSessions: concurrency,
+				Requests:           []*Request{{Method: "POST", ContentLength: 600}},
+				Server:             s.URL,
+				Payload:            test.payload,
+				PayloadSample:      test.sample,
+			})
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			once(t, p)
+
+			if len(b.bodies) != concurrency || len(b.bodies[0]) != 600 || !test.check(b.bodies[0]) {
+				t.Error("failed to send the right payload", test.payload)
+			}
+		}
+	})
+
+	t.Run("MissingPayloadSample", func(t *testing.T) {
+		_, err := New(Options{Payload: SamplePayload})
+		if err != ErrNoPayloadSample {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+
+	t.Run("Throttle", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip()
+		}
+
+		s := httptest.NewServer(statusHandler(http.StatusOK))
+		defer s.Close()
+
+		requests := []*Request{{}, {}, {}}
+		p, err := New(Options{
+			Requests: requests,
+			Server:   s.URL,
+			Throttle: 5,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		start := time.Now()
+		p.Once()
+		duration := time.Now().Sub(start)
+		if duration < 600*time.Millisecond {
+			t.Error("too fast, throttle failed")
+		}
+	})
+
+	t.Run("SetThrottle", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip()
+		}
+
+		notify := make(signalChannel)
+		s := httptest.NewServer(&limitHandler{notify: notify, limit: 30})
+		defer s.Close()
+
+		p, err := New(Options{
+			Requests: []*Request{{}},
+			Server:   s.URL,
+			Throttle: 10,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		go play(t, p)
+		defer p.Stop()
+
+		time.Sleep(120 * time.Millisecond)
+		p.SetThrottle(0)
+		if p.Throttle() != 0 {
+			t.Error("failed to set throttle")
+		}
+
+		select {
+		case <-notify:
+		case <-time.After(600 * time.Millisecond):
+			t.Error("timeout, failed to change throttle")
+		}
+	})
+
+	t.Run("Delay", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip()
+		}
+
+		s := httptest.NewServer(statusHandler(http.StatusOK))
+		defer s.Close()
+
+		requests := []*Request{{
+			Delay: 100 * time.Millisecond,
+		}, {
+			Delay:          100 * time.Millisecond,
+			DelayDeviation: 0.1,
+		}, {}}
+
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests:           requests,
+			Server:             s.URL,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		start := time.Now()
+		once(t, p)
+		if time.Now().Sub(start) < 190*time.Millisecond {
+			t.Error("too fast, delay failed")
+		}
+	})
+
+	t.Run("ThinkTime", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip()
+		}
+
+		const (
+			log = `
+				GET /foo www.example.org
+				GET /bar www.example.org
+			`
+
+			format = `^(?P<method>\S+)\s+(?P<path>\S+)\s+(?P<host>\S+)$`
+		)
+
+		s := httptest.NewServer(statusHandler(http.StatusOK))
+		defer s.Close()
+
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			AccessLog:          &logReader{log},
+			AccessLogFormat:    format,
+			Server:             s.URL,
+			ThinkTime:          100 * time.Millisecond,
+			ThinkTimeDeviation: 0.1,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		start := time.Now()
+		once(t, p)
+		if time.Now().Sub(start) < 180*time.Millisecond {
+			t.Error("too fast, think time failed")
+		}
+	})
+
+	t.Run("Jitter", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip()
+		}
+
+		s := httptest.NewServer(statusHandler(http.StatusOK))
+		defer s.Close()
+
+		requests := make([]*Request, 12)
+		for i := range requests {
+			requests[i] = &Request{}
+		}
+
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests:           requests,
+			Server:             s.URL,
+			Jitter:             60 * time.Millisecond,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		start := time.Now()
+		once(t, p)
+		if time.Now().Sub(start) < 60*time.Millisecond {
+			t.Error("too fast, jitter failed")
+		}
+	})
+
+	t.Run("Shuffle", func(t *testing.T) {
+		const logs = `
+			GET /foo www.example.org
+			GET /bar www.example.org
+			GET /baz www.example.org
+			GET /qux www.example.org
+		`
+
+		const format = `^(?P<method>\S+)\s+(?P<path>\S+)\s+(?P<host>\S+)$`
+
+		rh := &recorderHandler{}
+		s := httptest.NewServer(rh)
+		defer s.Close()
+
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			AccessLog:          &logReader{logs},
+			AccessLogFormat:    format,
+			Requests:           []*Request{{Path: "/quux"}, {Path: "/corge"}},
+			Server:             s.URL,
+			Shuffle:            true,
+			ShuffleSeed:        42,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		once(t, p)
+
+		rh.checkLength(t, 6*concurrency)
+		if concurrency > 1 {
+			return
+		}
+
+		original := []string{"/foo", "/bar", "/baz", "/qux", "/quux", "/corge"}
+		paths := make(map[string]bool)
+		ordered := true
+		for i, l := range rh.logs {
+			paths[l[3].(string)] = true
+			if l[3] != original[i] {
+				ordered = false
+			}
+		}
+
+		if len(paths) != 6 {
+			t.Error("failed to replay all requests", len(paths))
+		}
+
+		if ordered {
+			t.Error("failed to shuffle requests")
+		}
+	})
+
+	t.Run("Weighted", func(t *testing.T) {
+		rh := &recorderHandler{}
+		notify := make(signalChannel)
+		s := httptest.NewServer(chainHandlers(rh, &limitHandler{notify: notify, limit: 300}))
+		defer s.Close()
+
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests:           []*Request{{Path: "/foo", Weight: 9}, {Path: "/bar"}},
+			Server:             s.URL,
+			Weighted:           true,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		go play(t, p)
+		<-notify
+		p.Stop()
+
+		rh.mx.Lock()
+		defer rh.mx.Unlock()
+		var foo, bar int
+		for _, l := range rh.logs {
+			switch l[3] {
+			case "/foo":
+				foo++
+			case "/bar":
+				bar++
+			}
+		}
+
+		if bar == 0 || foo < 3*bar {
+			t.Error("failed to pick the requests by weight", foo, bar)
+		}
+	})
+
+	t.Run("WeightedOnce", func(t *testing.T) {
+		c := &counterHandler{}
+		s := httptest.NewServer(c)
+		defer s.Close()
+
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests:           []*Request{{Weight: 3}, {}, {Weight: 0.5}},
+			Server:             s.URL,
+			Weighted:           true,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		once(t, p)
+		if c.counter != 3*concurrency {
+			t.Error("failed to replay the right number of requests", c.counter, 3*concurrency)
+		}
+	})
+
+	t.Run("OpenLoop", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip()
+		}
+
+		c := &counterHandler{}
+		s := httptest.NewServer(chainHandlers(c, delayHandler(300*time.Millisecond)))
+		defer s.Close()
+
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests:           []*Request{{}},
+			Server:             s.URL,
+			Throttle:           60,
+			OpenLoop:           true,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		go play(t, p)
+		time.Sleep(240 * time.Millisecond)
+		p.Stop()
+
+		c.mx.Lock()
+		defer c.mx.Unlock()
+		if c.counter < 4 {
+			t.Error("failed to issue requests independent of the responses", c.counter)
+		}
+	})
+
+	t.Run("OpenLoopDropsOverLimit", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip()
+		}
+
+		c := &counterHandler{}
+		s := httptest.NewServer(chainHandlers(c, delayHandler(300*time.Millisecond)))
+		defer s.Close()
+
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests:           []*Request{{}},
+			Server:             s.URL,
+			Throttle:           float64(120 * concurrency),
+			OpenLoop:           true,
+			MaxOpenRequests:    2,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		go play(t, p)
+		time.Sleep(240 * time.Millisecond)
+		p.Stop()
+
+		c.mx.Lock()
+		defer c.mx.Unlock()
+		if c.counter > 2*concurrency {
+			t.Error("failed to limit the requests in flight", c.counter)
+		}
+
+		if p.Stats().Dropped == 0 {
+			t.Error("failed to count the dropped requests")
+		}
+	})
+
+	t.Run("OpenLoopRequiresRate", func(t *testing.T) {
+		_, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests:           []*Request{{}},
+			OpenLoop:           true,
+		})
+
+		if err != ErrNoRate {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+
+	t.Run("OpenLoopKeepsRate", func(t *testing.T) {
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests:           []*Request{{}},
+			Throttle:           60,
+			OpenLoop:           true,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		p.SetThrottle(0)
+		if p.Throttle() != 60 {
+			t.Error("failed to keep the rate", p.Throttle())
+		}
+	})
+
+	t.Run("OncePausePlayStop", func(t *testing.T) {
+		signal := make(signalChannel)
+		s := httptest.NewServer(&slowMotionHandler{signal})
+		defer s.Close()
+
+		requests := []*Request{{}, {}, {}}
+		p, err := New(Options{
+			Requests: requests,
+			Server:   s.URL,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		done := make(signalChannel)
+		go func() {
+			go p.Once()
+			signal <- signalToken{}
+			p.Pause()
+			go p.Play()
+			signal <- signalToken{}
+			signal <- signalToken{}
+			signal <- signalToken{}
+			p.Stop()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(120 * time.Millisecond):
+			t.Error("timeout")
+		}
+	})
+
+	t.Run("Paused", func(t *testing.T) {
+		var started sync.Once
+		requested := make(signalChannel)
+		s := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			started.Do(func() { close(requested) })
+		}))
+
+		defer s.Close()
+
+		p, err := New(Options{
+			ConcurrentSessions: concurrency,
+			Requests:           []*Request{{}},
+			Server:             s.URL,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		go p.Play()
+		<-requested
+		if p.Paused() {
+			t.Error("unexpected pause")
+		}
+
+		p.Pause()
+		if !p.Paused() {
+			t.Error("failed to report the pause")
+		}
+
+		p.Stop()
+		if p.Paused() {
+			t.Error("failed to reset the pause on stop")
+		}
+	})
+
+	t.Run("InvalidFormat", func(t *testing.T) {
+		_, err := New(Options{
+			AccessLog:       &logReader{},
+			AccessLogFormat: "\\",
+		})
+
+		if err == nil {
+			t.Error("failed to fail")
+		}
+	})
+
+	t.Run("ReadFailed", func(t *testing.T) {
+		p, err := New(Options{
+			AccessLog: &failingReader{},
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = p.Play()
+		if err != ErrRequestError {
+			t.Error("failed to fail")
+		}
+	})
+}
+
+func TestRandomSeed(t *testing.T) {
+	replay := func(seed int64) []string {
+		b := &bodyRecorderHandler{}
+		s := httptest.NewServer(b)
+		defer s.Close()
+
+		p, err := New(Options{
+			Requests: []*Request{{
+				Method:                 "POST",
+				ContentLength:          300,
+				ContentLengthDeviation: 0.5,
+			}, {
+				Method:       "POST",
+				BodyTemplate: "{{.UUID}}",
+			}, {
+				Method:        "POST",
+				BodyFormat:    MultipartBody,
+				FormFields:    2,
+				FormFieldSize: 12,
+			}},
+			Server:     s.URL,
+			Shuffle:    true,
+			RandomSeed: seed,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		return b.bodies
+	}
+
+	b1, b2, b3 := replay(42), replay(42), replay(36)
+	if len(b1) != 3 || len(b2) != 3 || len(b3) != 3 {
+		t.Fatal("failed to replay the requests")
+	}
+
+	for i := range b1 {
+		if b1[i] != b2[i] {
+			t.Error("failed to replay the same traffic", i)
+		}
+
+		if b1[i] == b3[i] {
+			t.Error("failed to replay different traffic", i)
+		}
+	}
+}
+
+func TestRandomSeedConcurrentSessions(t *testing.T) {
+	replay := func(o Options) []string {
+		var (
+			mx       sync.Mutex
+			requests []string
+		)
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// vary the timing of the sessions:
+			time.Sleep(time.Duration(time.Now().UnixNano()%3) * time.Millisecond)
+			b, _ := ioutil.ReadAll(r.Body)
+			mx.Lock()
+			defer mx.Unlock()
+			requests = append(requests, r.URL.Path+" "+string(b))
+		}))
+
+		defer s.Close()
+
+		for i := 0; i < 6; i++ {
+			o.Requests = append(o.Requests, &Request{
+				Method:       "POST",
+				Path:         fmt.Sprintf("/%d", i),
+				BodyTemplate: "{{.UUID}}",
+				Weight:       float64(i + 1),
+			})
+		}
+
+		o.Server = s.URL
+		o.ConcurrentSessions = 4
+		o.RandomSeed = 42
+		p, err := New(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		sort.Strings(requests)
+		return requests
+	}
+
+	for _, o := range []Options{{Shuffle: true}, {Weighted: true}} {
+		r1, r2 := replay(o), replay(o)
+		if len(r1) != 24 || !reflect.DeepEqual(r1, r2) {
+			t.Error("failed to replay the same requests in the sessions", o.Shuffle, o.Weighted)
+		}
+	}
+}
+
+func TestCorpus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logreplay-corpus")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	payloads := map[string]bool{`{"foo": 42}`: true, `{"bar": 36}`: true}
+	var i int
+	for p := range payloads {
+		if err := ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(i)), []byte(p), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		i++
+	}
+
+	zf, err := ioutil.TempFile("", "logreplay-corpus-*.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(zf.Name())
+
+	zw := zip.NewWriter(zf)
+	w, err := zw.Create("baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Write([]byte("baz=qux")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zf.Close()
+
+	b := &bodyRecorderHandler{}
+	s := httptest.NewServer(b)
+	defer s.Close()
+
+	p, err := New(Options{
+		Requests: []*Request{
+			{Method: "POST", Path: "/form"},
+			{Method: "PUT", Path: "/api/foo"},
+			{Method: "PATCH", Path: "/api/bar"},
+			{Method: "POST", Path: "/other", ContentLength: 3},
+			{Method: "GET", Path: "/api/baz"},
+		},
+		Corpora: []Corpus{
+			{PathPattern: "^/form$", Path: zf.Name()},
+			{PathPattern: "^/api/", Path: dir},
+		},
+		Server: s.URL,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+
+	if len(b.bodies) != 5 {
+		t.Fatal("failed to replay the requests", len(b.bodies))
+	}
+
+	if b.bodies[0] != "baz=qux" || !payloads[b.bodies[1]] || !payloads[b.bodies[2]] ||
+		len(b.bodies[3]) != 3 || b.bodies[4] != "" {
+		t.Error("failed to pick the payloads from the corpus", b.bodies)
+	}
+
+	empty, err := ioutil.TempDir("", "logreplay-corpus")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(empty)
+	if _, err := New(Options{Corpora: []Corpus{{Path: empty}}}); err != ErrEmptyCorpus {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+// writeCertificate creates a self-signed certificate for localhost, and saves it
+// together with its key in the provided directory
+func writeCertificate(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{"localhost", name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logreplay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(t, dir, "client")
+
+	if _, err := New(Options{ClientCertFile: certFile}); err != ErrIncompleteClientCert {
+		t.Error("failed to fail with the right error", err)
+	}
+
+	if _, err := New(Options{ClientCertFile: certFile, ClientKeyFile: certFile}); err == nil {
+		t.Error("failed to fail with invalid key")
+	}
+
+	if _, err := New(Options{ClientCertFile: certFile, ClientKeyFile: keyFile}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logreplay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	serverCert, serverKey := writeCertificate(t, dir, "server")
+	clientCert, clientKey := writeCertificate(t, dir, "client")
+
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientPEM, err := ioutil.ReadFile(clientCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientPEM)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	s.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+
+	s.StartTLS()
+	defer s.Close()
+
+	for _, test := range []struct {
+		title string
+		o     Options
+		fail  bool
+	}{{
+		title: "unknown authority",
+		o:     Options{ClientCertFile: clientCert, ClientKeyFile: clientKey},
+		fail:  true,
+	}, {
+		title: "no client certificate",
+		o:     Options{CAFile: serverCert},
+		fail:  true,
+	}, {
+		title: "ca file",
+		o:     Options{CAFile: serverCert, ClientCertFile: clientCert, ClientKeyFile: clientKey},
+	}, {
+		title: "insecure",
+		o:     Options{InsecureSkipVerify: true, ClientCertFile: clientCert, ClientKeyFile: clientKey},
+	}} {
+		t.Run(test.title, func(t *testing.T) {
+			o := test.o
+			o.Server = s.URL
+			o.Requests = []*Request{{}}
+			p, err := New(o)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = p.Once()
+			if test.fail && err != ErrRequestError || !test.fail && err != nil {
+				t.Error("unexpected result", err)
+			}
+		})
+	}
+
+	if _, err := New(Options{CAFile: serverKey}); err != ErrInvalidCAFile {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+func TestServerName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logreplay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(t, dir, "www.example.org")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mx          sync.Mutex
+		serverNames []string
+	)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	s.TLS = &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			mx.Lock()
+			defer mx.Unlock()
+			serverNames = append(serverNames, hello.ServerName)
+			return &cert, nil
+		},
+	}
+
+	s.StartTLS()
+	defer s.Close()
+
+	p, err := New(Options{
+		Server:     s.URL,
+		Requests:   []*Request{{}},
+		CAFile:     certFile,
+		ServerName: "www.example.org",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+
+	mx.Lock()
+	defer mx.Unlock()
+	if len(serverNames) != 1 || serverNames[0] != "www.example.org" {
+		t.Error("failed to set the server name", serverNames)
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	const accessLog = `
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /foo HTTP/1.1" 200 566 "-" "-" 1 www.example.org
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "POST /bar HTTP/1.1" 200 566 "-" "-" 1 www.example.org
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /baz HTTP/1.1" 200 566 "-" "-" 1 www.example.org`
+
+	for _, batches := range []int{0, 2, 5} {
+		var payloads [2][]string
+		servers := make([]*httptest.Server, 2)
+		for i := range servers {
+			i := i
+			servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if i == 1 {
+					time.Sleep(3 * time.Millisecond)
+				}
+
+				if r.Method != "POST" {
+					return
+				}
+
+				b, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+
+				payloads[i] = append(payloads[i], string(b))
+			}))
+			defer servers[i].Close()
+		}
+
+		r, err := Benchmark(BenchmarkOptions{
+			Options: Options{
+				AccessLog:         &logReader{accessLog},
+				Requests:          []*Request{{Path: "/qux"}},
+				PostContentLength: 64,
+			},
+			A:       servers[0].URL,
+			B:       servers[1].URL,
+			Batches: batches,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.A.Requests != 4 || r.B.Requests != 4 || r.A.Errors != 0 || r.B.Errors != 0 {
+			t.Error("failed to replay the requests", batches, r)
+		}
+
+		if r.A.Latency.P50 >= r.B.Latency.P50 || r.B.Latency.Min < 3*time.Millisecond {
+			t.Error("failed to measure latency", batches, r.A.Latency, r.B.Latency)
+		}
+
+		if len(payloads[0]) != 1 || len(payloads[1]) != 1 || payloads[0][0] != payloads[1][0] {
+			t.Error("failed to replay the same payloads", batches)
+		}
+	}
+}
+
+func TestCapture(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer s.Close()
+
+	for _, test := range []struct {
+		title string
+		mode  CaptureMode
+		limit int64
+		files map[string]string
+	}{{
+		title: "all",
+		mode:  CaptureAll,
+		files: map[string]string{"1.body": "/foo", "2.body": "/missing"},
+	}, {
+		title: "errors",
+		mode:  CaptureErrors,
+		files: map[string]string{"2.body": "/missing"},
+	}, {
+		title: "size limit",
+		mode:  CaptureAll,
+		limit: 3,
+		files: map[string]string{"1.body": "/fo", "2.body": "/mi"},
+	}} {
+		t.Run(test.title, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "logreplay-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer os.RemoveAll(dir)
+			p, err := New(Options{
+				Server:           s.URL,
+				Requests:         []*Request{{Path: "/foo"}, {Path: "/missing"}},
+				CaptureDir:       filepath.Join(dir, "capture"),
+				CaptureMode:      test.mode,
+				CaptureSizeLimit: test.limit,
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			once(t, p)
+
+			fi, err := ioutil.ReadDir(filepath.Join(dir, "capture"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(fi) != len(test.files) {
+				t.Error("invalid number of captured bodies", len(fi))
+			}
+
+			for name, expected := range test.files {
+				b, err := ioutil.ReadFile(filepath.Join(dir, "capture", name))
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+
+				if string(b) != expected {
+					t.Error("invalid captured body", name, string(b))
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	dead := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	dead.Close()
+
+	live := &counterHandler{}
+	s := httptest.NewServer(live)
+	defer s.Close()
+
+	var requests []*Request
+	for i := 0; i < 10; i++ {
+		requests = append(requests, &Request{Host: dead.URL})
+	}
+
+	requests = append(requests, &Request{Host: s.URL})
+
+	p, err := New(Options{
+		Requests:      requests,
+		HaltThreshold: 4,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Once(); err != ErrRequestError {
+		t.Error("failed to halt without circuit breaker", err)
+	}
+
+	p, err = New(Options{
+		Requests:                requests,
+		HaltThreshold:           4,
+		CircuitBreakerThreshold: 2,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+
+	if st := p.Stats(); st.Errors != 2 || st.Skipped != 8 || live.counter != 1 {
+		t.Error("failed to apply the circuit breaker", st, live.counter)
+	}
+}
+
+func TestHaltRules(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/limited":
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer s.Close()
+
+	requests := func(path string) []*Request {
+		var r []*Request
+		for i := 0; i < 5; i++ {
+			r = append(r, &Request{Path: path})
+		}
+
+		return append(r, &Request{Path: "/ok"})
+	}
+
+	for _, test := range []struct {
+		title string
+		o     Options
+		err   error
+	}{{
+		title: "no rules",
+		o:     Options{Requests: requests("/unavailable"), HaltOn500: true, HaltThreshold: 3},
+		err:   ErrServerError,
+	}, {
+		title: "status code",
+		o:     Options{Requests: requests("/unavailable"), HaltRules: map[string]int{"503": 3}},
+		err:   ErrHaltStatus,
+	}, {
+		title: "status code below threshold",
+		o:     Options{Requests: requests("/unavailable"), HaltRules: map[string]int{"503": 6}},
+	}, {
+		title: "status class",
+		o:     Options{Requests: requests("/limited"), HaltRules: map[string]int{"4xx": 2}},
+		err:   ErrHaltStatus,
+	}, {
+		title: "not an error",
+		o: Options{
+			Requests:      requests("/unavailable"),
+			HaltOn500:     true,
+			HaltThreshold: 3,
+			HaltRules:     map[string]int{"503": 0},
+		},
+	}, {
+		title: "code overrides class",
+		o: Options{
+			Requests:  requests("/unavailable"),
+			HaltRules: map[string]int{"503": 0, "5xx": 2},
+		},
+	}} {
+		t.Run(test.title, func(t *testing.T) {
+			test.o.Server = s.URL
+			p, err := New(test.o)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := p.Once(); err != test.err {
+				t.Error("unexpected result", err)
+			}
+		})
+	}
+
+	for _, key := range []string{"", "42", "600", "5x", "5xxx", "abc"} {
+		if _, err := New(Options{HaltRules: map[string]int{key: 1}}); err != ErrInvalidHaltRule {
+			t.Error("failed to fail with the right error", key, err)
+		}
+	}
+}
+
+func TestLatencySLO(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	var (
+		mx   sync.Mutex
+		slow bool
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		mx.Lock()
+		s := slow
+		mx.Unlock()
+		if s {
+			time.Sleep(40 * time.Millisecond)
+		}
+	}))
+	defer s.Close()
+
+	p, err := New(Options{
+		Requests:         []*Request{{}},
+		Server:           s.URL,
+		LatencySLO:       20 * time.Millisecond,
+		LatencySLOWindow: 100 * time.Millisecond,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- p.Play() }()
+
+	select {
+	case err := <-done:
+		t.Fatal("unexpected halt", err)
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	mx.Lock()
+	slow = true
+	mx.Unlock()
+
+	select {
+	case err := <-done:
+		if err != ErrLatencySLO {
+			t.Error("failed to fail with the right error", err)
+		}
+	case <-time.After(2 * time.Second):
+		p.Stop()
+		t.Error("failed to halt on latency objective violation")
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow-header":
+			time.Sleep(120 * time.Millisecond)
+		case "/slow-body":
+			w.Write([]byte("foo"))
+			w.(http.Flusher).Flush()
+			time.Sleep(120 * time.Millisecond)
+			w.Write([]byte("bar"))
+		}
+	}))
+	defer s.Close()
+
+	for _, test := range []struct {
+		path string
+		o    Options
+		fail bool
+	}{{
+		path: "/slow-header",
+		o:    Options{ResponseHeaderTimeout: 30 * time.Millisecond},
+		fail: true,
+	}, {
+		path: "/slow-body",
+		o:    Options{ResponseHeaderTimeout: 30 * time.Millisecond},
+	}, {
+		path: "/slow-body",
+		o:    Options{RequestTimeout: 60 * time.Millisecond},
+		fail: true,
+	}, {
+		path: "/fast",
+		o: Options{
+			DialTimeout:           30 * time.Millisecond,
+			ResponseHeaderTimeout: 30 * time.Millisecond,
+			RequestTimeout:        60 * time.Millisecond,
+		},
+	}} {
+		o := test.o
+		o.Server = s.URL
+		o.Requests = []*Request{{Path: test.path}}
+		o.HaltThreshold = 1
+		p, err := New(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = p.Once()
+		if test.fail && err != ErrRequestError || !test.fail && err != nil {
+			t.Error("unexpected result", test.path, err)
+		}
+	}
+}
+
+func TestConnections(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer s.Close()
+
+	for _, disable := range []bool{false, true} {
+		p, err := New(Options{
+			Server:            s.URL,
+			Requests:          []*Request{{}, {}, {}},
+			DisableKeepAlives: disable,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+
+		st := p.Stats()
+		if disable && (st.NewConnections != 3 || st.ReusedConnections != 0) ||
+			!disable && (st.NewConnections != 1 || st.ReusedConnections != 2) {
+			t.Error("unexpected connection stats", disable, st.NewConnections, st.ReusedConnections)
+		}
+
+		if st.Connect.Min <= 0 || st.TimeToFirstByte.Min <= 0 || st.TimeToFirstByte.Max > st.Latency.Max {
+			t.Error("unexpected connection timings", st.Connect, st.TimeToFirstByte)
+		}
+	}
+}
+
+func TestMaxRedirects(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil || n == 0 {
+			return
+		}
+
+		w.Header().Set("Location", fmt.Sprintf("/%d", n-1))
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer s.Close()
+
+	p, err := New(Options{
+		Server:           s.URL,
+		Requests:         []*Request{{Path: "/0"}, {Path: "/1"}, {Path: "/2"}, {Path: "/2"}, {Path: "/3"}},
+		RedirectBehavior: FollowRedirect,
+		MaxRedirects:     2,
+		HaltThreshold:    2,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+
+	st := p.Stats()
+	if st.Errors != 1 || len(st.RedirectChains) != 2 || st.RedirectChains[1] != 1 || st.RedirectChains[2] != 2 {
+		t.Error("unexpected redirect stats", st.Errors, st.RedirectChains)
+	}
+}
+
+func TestRedirectAllowedDomains(t *testing.T) {
+	allowed := &counterHandler{}
+	sa := httptest.NewServer(allowed)
+	defer sa.Close()
+
+	denied := &counterHandler{}
+	sd := httptest.NewServer(denied)
+	defer sd.Close()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "http://"+strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer s.Close()
+
+	p, err := New(Options{
+		Server: s.URL,
+		Requests: []*Request{
+			{Path: "/www.example.org"},
+			{Path: "/example.org"},
+			{Path: "/www.example.com"},
+			{Path: "/notexample.org"},
+		},
+		Resolve: map[string]string{
+			"www.example.org": sa.Listener.Addr().String(),
+			"example.org":     sa.Listener.Addr().String(),
+			"www.example.com": sd.Listener.Addr().String(),
+			"notexample.org":  sd.Listener.Addr().String(),
+		},
+		RedirectBehavior:       FollowAllowedDomains,
+		RedirectAllowedDomains: []string{"example.org"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+
+	if allowed.counter != 2 || denied.counter != 0 {
+		t.Error("failed to apply the allowed domains", allowed.counter, denied.counter)
+	}
+}
+
+type fieldRecorder struct {
+	mx      *sync.Mutex
+	fields  map[string]interface{}
+	entries *[]map[string]interface{}
+}
+
+func (r fieldRecorder) log(level string, a ...interface{}) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	e := map[string]interface{}{"level": level, "msg": fmt.Sprint(a...)}
+	for k, v := range r.fields {
+		e[k] = v
+	}
+
+	*r.entries = append(*r.entries, e)
+}
+
+func (r fieldRecorder) Errorln(a ...interface{})          { r.log("error", a...) }
+func (r fieldRecorder) Warnln(a ...interface{})           { r.log("warning", a...) }
+func (r fieldRecorder) Infoln(a ...interface{})           { r.log("info", a...) }
+func (r fieldRecorder) Debugln(a ...interface{})          { r.log("debug", a...) }
+func (r fieldRecorder) Debugf(f string, a ...interface{}) { r.log("debug", fmt.Sprintf(f, a...)) }
+
+func (r fieldRecorder) WithField(key string, value interface{}) Logger {
+	return r.WithFields(map[string]interface{}{key: value})
+}
+
+func (r fieldRecorder) WithFields(fields map[string]interface{}) Logger {
+	f := make(map[string]interface{})
+	for k, v := range r.fields {
+		f[k] = v
+	}
+
+	for k, v := range fields {
+		f[k] = v
+	}
+
+	return fieldRecorder{mx: r.mx, fields: f, entries: r.entries}
+}
+
+func TestLogLevels(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	s.Close()
+
+	for _, test := range []struct {
+		levels   map[string]LogLevel
+		expected []string
+	}{{
+		expected: []string{"client", "player"},
+	}, {
+		levels:   map[string]LogLevel{ClientComponent: LogError},
+		expected: []string{"player"},
+	}, {
+		levels:   map[string]LogLevel{ClientComponent: LogWarn, PlayerComponent: LogWarn},
+		expected: []string{"client", "player"},
+	}} {
+		var entries []map[string]interface{}
+		log := fieldRecorder{mx: &sync.Mutex{}, entries: &entries}
+		p, err := New(Options{
+			Server:    s.URL,
+			Requests:  []*Request{{}},
+			Log:       log,
+			LogLevels: test.levels,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.Once(); err != ErrRequestError {
+			t.Error("failed to fail with the right error", err)
+		}
+
+		var components []string
+		for _, e := range entries {
+			c := fmt.Sprint(e["component"])
+			if len(components) == 0 || components[len(components)-1] != c {
+				components = append(components, c)
+			}
+		}
+
+		if strings.Join(components, ",") != strings.Join(test.expected, ",") {
+			t.Error("unexpected log entries", test.levels, entries)
+		}
+	}
+}
+
+func TestDefaultLogLevels(t *testing.T) {
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.InfoLevel)
+	levels := map[string]LogLevel{ClientComponent: LogDebug}
+	l := newDefaultLog(levels)
+	if l.(logrusLogger).FieldLogger.(*logrus.Logger).Level != logrus.DebugLevel {
+		t.Error("failed to raise the level of the logger")
+	}
+
+	client := newComponentLog(l, ClientComponent, levels).(*componentLogger)
+	if !client.enabled(LogDebug) {
+		t.Error("failed to enable the debug messages of the client")
+	}
+
+	player := newComponentLog(l, PlayerComponent, levels).(*componentLogger)
+	if player.enabled(LogDebug) || !player.enabled(LogInfo) {
+		t.Error("failed to keep the global level for the player")
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer s.Close()
+
+	var entries []map[string]interface{}
+	log := fieldRecorder{mx: &sync.Mutex{}, entries: &entries}
+	p, err := New(Options{
+		Server:      s.URL,
+		Requests:    []*Request{{Method: "POST", Path: "/foo"}},
+		Log:         log,
+		LogRequests: true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+
+	if len(entries) != 1 {
+		t.Fatal("unexpected log entries", entries)
+	}
+
+	e := entries[0]
+	if e["level"] != "info" ||
+		e["component"] != ClientComponent ||
+		e["method"] != "POST" ||
+		e["url"] != s.URL+"/foo" ||
+		e["status"] != http.StatusTeapot {
+		t.Error("unexpected log entry", e)
+	}
+
+	if _, ok := e["latency"].(time.Duration); !ok {
+		t.Error("missing response time", e)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer s.Close()
+
+	var reports []Progress
+	p, err := New(Options{
+		Server:             s.URL,
+		Requests:           []*Request{{Path: "/foo"}, {Path: "/bar"}},
+		ConcurrentSessions: 3,
+		Throttle:           600,
+		OnProgress:         func(pr Progress) { reports = append(reports, pr) },
+		ProgressInterval:   2 * time.Millisecond,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+
+	if len(reports) < 2 {
+		t.Fatal("not enough progress reports", reports)
+	}
+
+	for i := 1; i < len(reports); i++ {
+		if reports[i].Requests < reports[i-1].Requests || reports[i].Percent < reports[i-1].Percent {
+			t.Error("inconsistent progress", reports[i-1], reports[i])
+		}
+	}
+
+	last := reports[len(reports)-1]
+	if last.Requests != 6 || last.Errors != 0 || last.Percent != 100 ||
+		last.InFlight != 0 || last.StatusCodes[http.StatusOK] != 6 {
+		t.Error("unexpected final progress", last)
+	}
+}
+
+func TestSetConcurrency(t *testing.T) {
+	var current, max int64
+	s := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		c := atomic.AddInt64(&current, 1)
+		defer atomic.AddInt64(&current, -1)
+		for {
+			m := atomic.LoadInt64(&max)
+			if c <= m || atomic.CompareAndSwapInt64(&max, m, c) {
+				break
+			}
+		}
+
+		time.Sleep(3 * time.Millisecond)
+	}))
+	defer s.Close()
+
+	p, err := New(Options{
+		Server:   s.URL,
+		Requests: []*Request{{}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go play(t, p)
+	defer p.Stop()
+
+	for _, n := range []int{1, 4, 2} {
+		p.SetConcurrency(n)
+		if p.Concurrency() != n {
+			t.Error("failed to set concurrency", n, p.Concurrency())
+		}
+
+		// let the stopped sessions complete their pending requests:
+		time.Sleep(15 * time.Millisecond)
+		atomic.StoreInt64(&max, 0)
+		time.Sleep(60 * time.Millisecond)
+		if m := atomic.LoadInt64(&max); m != int64(n) {
+			t.Error("unexpected concurrency", n, m)
+		}
+	}
+}
+
+func TestSkip(t *testing.T) {
+	rh := &recorderHandler{}
+	s := httptest.NewServer(rh)
+	defer s.Close()
+
+	var requests []*Request
+	for i := 0; i < 6; i++ {
+		requests = append(requests, &Request{Path: fmt.Sprintf("/%d", i)})
+	}
+
+	p, err := New(Options{
+		Server:    s.URL,
+		AccessLog: &logReader{text: "\"GET /log0 HTTP/1.1\" 200 0\n\"GET /log1 HTTP/1.1\" 200 0"},
+		Requests:  requests,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Skip(3)
+	once(t, p)
+
+	rh.check(t, [][]string{
+		{"GET", s.Listener.Addr().String(), "/1"},
+		{"GET", s.Listener.Addr().String(), "/2"},
+		{"GET", s.Listener.Addr().String(), "/3"},
+		{"GET", s.Listener.Addr().String(), "/4"},
+		{"GET", s.Listener.Addr().String(), "/5"},
+	})
+}
+
+func TestMergeStats(t *testing.T) {
+	s := MergeStats(Stats{
+		Requests:    3,
+		Errors:      1,
+		StatusCodes: map[int]int{200: 2},
+		Latency: Latency{
+			Min:  time.Millisecond,
+			Mean: 2 * time.Millisecond,
+			Max:  3 * time.Millisecond,
+			P99:  3 * time.Millisecond,
+		},
+	}, Stats{
+		Requests:     2,
+		ServerErrors: 1,
+		StatusCodes:  map[int]int{200: 1, 500: 1},
+		Latency: Latency{
+			Min:  500 * time.Microsecond,
+			Mean: 5 * time.Millisecond,
+			Max:  9 * time.Millisecond,
+			P99:  9 * time.Millisecond,
+		},
+	}, Stats{})
+
+	if s.Requests != 5 || s.Errors != 1 || s.ServerErrors != 1 ||
+		s.StatusCodes[200] != 3 || s.StatusCodes[500] != 1 {
+		t.Error("unexpected counters", s)
+	}
+
+	if s.Latency.Min != 500*time.Microsecond ||
+		s.Latency.Max != 9*time.Millisecond ||
+		s.Latency.Mean != 3500*time.Microsecond ||
+		s.Latency.P99 != 6*time.Millisecond {
+		t.Error("unexpected latency", s.Latency)
+	}
+}
+
+func TestPreserveSessions(t *testing.T) {
+	var (
+		mx    sync.Mutex
+		paths []string
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/a1" {
+			time.Sleep(15 * time.Millisecond)
+		}
+
+		mx.Lock()
+		defer mx.Unlock()
+		paths = append(paths, r.URL.Path)
+	}))
+	defer s.Close()
+
+	var log string
+	for _, e := range []struct{ address, path string }{
+		{"10.0.0.1", "/a1"},
+		{"10.0.0.2", "/b1"},
+		{"10.0.0.1", "/a2"},
+		{"10.0.0.3", "/c1"},
+		{"10.0.0.2", "/b2"},
+		{"10.0.0.1", "/a3"},
+	} {
+		log += fmt.Sprintf("%s - - [-] \"GET %s HTTP/1.1\" 200 0\n", e.address, e.path)
+	}
+
+	p, err := New(Options{
+		Server:             s.URL,
+		AccessLog:          &logReader{text: log},
+		ConcurrentSessions: 2,
+		PreserveSessions:   true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+
+	if len(paths) != 6 {
+		t.Fatal("unexpected number of requests", paths)
+	}
+
+	positions := make(map[string]int)
+	for i, pi := range paths {
+		positions[pi] = i
+	}
+
+	if positions["/a1"] > positions["/a2"] || positions["/a2"] > positions["/a3"] ||
+		positions["/b1"] > positions["/b2"] {
+		t.Error("failed to preserve the order of the sessions", paths)
+	}
+
+	// the slow first request of the first session doesn't block the other sessions:
+	if positions["/a1"] < positions["/b2"] {
+		t.Error("failed to replay the sessions concurrently", paths)
+	}
+}
+
+func TestSessionExtraction(t *testing.T) {
+	const (
+		format = `^"(?P<method>\S+) (?P<path>\S+)" "(?P<cookie>[^"]*)" "(?P<user>[^"]*)"`
+		log    = `"GET /foo" "theme=dark; sid=abc" "alice" user=1` + "\n" +
+			`"GET /bar" "sid=def" "bob" user=2` + "\n" +
+			`"GET /baz" "" "" -`
+	)
+
+	for _, test := range []struct {
+		options  Options
+		expected []string
+	}{{
+		options:  Options{SessionCookie: "sid"},
+		expected: []string{"abc", "def", ""},
+	}, {
+		options:  Options{SessionField: "user"},
+		expected: []string{"alice", "bob", ""},
+	}, {
+		options:  Options{SessionPattern: `user=(\d+)`},
+		expected: []string{"1", "2", ""},
+	}, {
+		options:  Options{SessionPattern: `sid=\w+`, SessionField: "user"},
+		expected: []string{"sid=abc", "sid=def", ""},
+	}} {
+		o := test.options
+		o.AccessLog = &logReader{text: log}
+		o.AccessLogFormat = format
+		requests, err := ReadRequests(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(requests) != len(test.expected) {
+			t.Fatal("unexpected number of requests", len(requests))
+		}
+
+		for i, r := range requests {
+			if r.Session != test.expected[i] {
+				t.Error("unexpected session", i, r.Session, test.expected[i])
+			}
+		}
+	}
+}
+
+func TestForwardRemoteAddress(t *testing.T) {
+	hc := &headerCaptureHandler{}
+	s := httptest.NewServer(hc)
+	defer s.Close()
+
+	for _, test := range []struct {
+		forward  bool
+		header   string
+		expected string
+	}{{
+		expected: "",
+	}, {
+		forward:  true,
+		header:   DefaultRemoteAddressHeader,
+		expected: "10.0.0.1, 10.0.0.2",
+	}, {
+		forward:  true,
+		header:   "X-Real-Ip",
+		expected: "10.0.0.1, 10.0.0.2",
+	}} {
+		o := Options{
+			Server:               s.URL,
+			AccessLog:            &logReader{text: `10.0.0.1, 10.0.0.2 - - [-] "GET / HTTP/1.1" 200 0`},
+			ForwardRemoteAddress: test.forward,
+		}
+
+		if test.header != DefaultRemoteAddressHeader {
+			o.RemoteAddressHeader = test.header
+		}
+
+		p, err := New(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+
+		header := test.header
+		if header == "" {
+			header = DefaultRemoteAddressHeader
+		}
+
+		if v := hc.header.Get(header); v != test.expected {
+			t.Error("unexpected remote address", header, v, test.expected)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var (
+		mx  sync.Mutex
+		ids []string
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		ids = append(ids, r.Header.Get("X-Request-Id"))
+	}))
+	defer s.Close()
+
+	for _, format := range []RequestIDFormat{UUIDRequestID, SequenceRequestID} {
+		ids = nil
+		var entries []map[string]interface{}
+		p, err := New(Options{
+			Server:          s.URL,
+			Requests:        []*Request{{}, {}},
+			RequestIDHeader: "X-Request-Id",
+			RequestIDFormat: format,
+			Log:             fieldRecorder{mx: &sync.Mutex{}, entries: &entries},
+			LogRequests:     true,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+
+		if len(ids) != 2 || ids[0] == ids[1] {
+			t.Fatal("unexpected request IDs", ids)
+		}
+
+		switch format {
+		case UUIDRequestID:
+			if len(ids[0]) != 36 || len(ids[1]) != 36 {
+				t.Error("invalid UUIDs", ids)
+			}
+		case SequenceRequestID:
+			if ids[0] != "1" || ids[1] != "2" {
+				t.Error("invalid sequence IDs", ids)
+			}
+		}
+
+		for i, e := range entries {
+			if e["requestId"] != ids[i] {
+				t.Error("request ID not logged", e, ids[i])
+			}
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	var (
+		host   string
+		header http.Header
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		host, header = r.Host, r.Header
+	}))
+	defer s.Close()
+
+	p, err := New(Options{
+		Server:   s.URL,
+		Requests: []*Request{{UserAgent: "logged"}},
+		Headers: http.Header{
+			"X-Feature":  []string{"foo", "bar"},
+			"User-Agent": []string{"static"},
+			"Host":       []string{"www.example.org"},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+
+	if host != "www.example.org" {
+		t.Error("failed to set the host", host)
+	}
+
+	if strings.Join(header["X-Feature"], ",") != "foo,bar" || header.Get("User-Agent") != "static" {
+		t.Error("failed to set the headers", header)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	var (
+		mx          sync.Mutex
+		credentials []string
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		user, password, _ := r.BasicAuth()
+		credentials = append(credentials, user+":"+password)
+	}))
+	defer s.Close()
+
+	p, err := New(Options{
+		Server: s.URL,
+		Requests: []*Request{
+			{Host: "www.example.org"},
+			{Host: "api.example.org:8080"},
+			{Host: "api.example.org:9090"},
+		},
+		BasicAuth: "foo:bar",
+		HostBasicAuth: map[string]string{
+			"api.example.org":      "baz:qux",
+			"api.example.org:9090": "quux:a:b",
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+
+	if strings.Join(credentials, ",") != "foo:bar,baz:qux,quux:a:b" {
+		t.Error("unexpected credentials", credentials)
+	}
+}
+
+type staticToken string
+
+func (t staticToken) Token() (string, error) { return string(t), nil }
+
+func TestTokenSource(t *testing.T) {
+	hc := &headerCaptureHandler{}
+	s := httptest.NewServer(hc)
+	defer s.Close()
+
+	p, err := New(Options{
+		Server:      s.URL,
+		Requests:    []*Request{{}},
+		BasicAuth:   "foo:bar",
+		TokenSource: staticToken("baz"),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+
+	if a := hc.header.Get("Authorization"); a != "Bearer baz" {
+		t.Error("unexpected authorization", a)
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	var issued int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if r.Method != "POST" ||
+			r.FormValue("grant_type") != "client_credentials" ||
+			r.FormValue("scope") != "read write" ||
+			id != "foo" || secret != "bar" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		issued++
+		fmt.Fprintf(w, `{"access_token": "token%d", "token_type": "bearer", "expires_in": 3600}`, issued)
+	}))
+	defer ts.Close()
+
+	var tokens []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := r.Header.Get("Authorization")
+		tokens = append(tokens, a)
+		if a == "Bearer token1" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer s.Close()
+
+	p, err := New(Options{
+		Server:             s.URL,
+		Requests:           []*Request{{}, {}, {}},
+		OAuth2TokenURL:     ts.URL,
+		OAuth2ClientID:     "foo",
+		OAuth2ClientSecret: "bar",
+		OAuth2Scopes:       []string{"read", "write"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+
+	if issued != 2 || strings.Join(tokens, ",") != "Bearer token1,Bearer token2,Bearer token2" {
+		t.Error("unexpected tokens", issued, tokens)
+	}
+}
+
+func TestLogRequestDetails(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer s.Close()
+
+	var entries []map[string]interface{}
+	p, err := New(Options{
+		Server: s.URL,
+		Requests: []*Request{{
+			Method: "POST",
+			Body:   []byte("user=foo&password=bar&remember=true"),
+		}},
+		Headers: http.Header{
+			"Authorization": []string{"Bearer baz"},
+			"X-Api-Key":     []string{"qux"},
+			"X-Feature":     []string{"quux"},
+		},
+		Log:                fieldRecorder{mx: &sync.Mutex{}, entries: &entries},
+		LogRequestDetails:  true,
+		RedactHeaders:      append(DefaultRedactHeaders, "x-api-key"),
+		RedactBodyPatterns: []string{"password=[^&]*"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+
+	if len(entries) != 1 || entries[0]["level"] != "debug" {
+		t.Fatal("unexpected log entries", entries)
+	}
+
+	h, ok := entries[0]["headers"].(http.Header)
+	if !ok || h.Get("Authorization") != redacted || h.Get("X-Api-Key") != redacted || h.Get("X-Feature") != "quux" {
+		t.Error("failed to redact the headers", entries[0]["headers"])
+	}
+
+	if b := entries[0]["body"]; b != "user=foo&[redacted]&remember=true" {
+		t.Error("failed to redact the body", b)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("LOGREPLAY_TEST_TOKEN", "foo")
+	os.Setenv("LOGREPLAY_TEST_USER", "bar")
+	defer os.Unsetenv("LOGREPLAY_TEST_TOKEN")
+	defer os.Unsetenv("LOGREPLAY_TEST_USER")
+
+	t.Run("Expand", func(t *testing.T) {
+		var (
+			header http.Header
+			body   []byte
+		)
+
+		s := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			header = r.Header
+			body, _ = ioutil.ReadAll(r.Body)
+		}))
+
+		defer s.Close()
+
+		p, err := New(Options{
+			Server: s.URL,
+			Requests: []*Request{{
+				Method:       "POST",
+				BodyTemplate: `{"user": "${LOGREPLAY_TEST_USER}", "seq": {{.Seq}}}`,
+			}},
+			Headers:   http.Header{"X-Api-Key": []string{"${LOGREPLAY_TEST_TOKEN}", "$baz"}},
+			BasicAuth: "${LOGREPLAY_TEST_USER}:${LOGREPLAY_TEST_TOKEN}",
+			ExpandEnv: true,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+
+		if keys := header["X-Api-Key"]; len(keys) != 2 || keys[0] != "foo" || keys[1] != "$baz" {
+			t.Error("failed to expand the header", keys)
+		}
+
+		if user, pass, ok := (&http.Request{Header: header}).BasicAuth(); !ok || user != "bar" || pass != "foo" {
+			t.Error("failed to expand the basic auth", user, pass)
+		}
+
+		if string(body) != `{"user": "bar", "seq": 1}` {
+			t.Error("failed to expand the body template", string(body))
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		var header http.Header
+		s := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			header = r.Header
+		}))
+
+		defer s.Close()
+
+		p, err := New(Options{
+			Server:   s.URL,
+			Requests: []*Request{{}},
+			Headers:  http.Header{"X-Api-Key": []string{"${LOGREPLAY_TEST_TOKEN}"}},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		if key := header.Get("X-Api-Key"); key != "${LOGREPLAY_TEST_TOKEN}" {
+			t.Error("unexpected expansion", key)
+		}
+	})
+
+	t.Run("Undefined", func(t *testing.T) {
+		for _, o := range []Options{{
+			Headers:   http.Header{"X-Api-Key": []string{"${LOGREPLAY_TEST_UNDEFINED}"}},
+			ExpandEnv: true,
+		}, {
+			Requests:  []*Request{{BodyTemplate: "${LOGREPLAY_TEST_UNDEFINED}"}},
+			ExpandEnv: true,
+		}} {
+			if _, err := New(o); !errors.Is(err, ErrUndefinedEnv) {
+				t.Error("failed to fail", err)
+			}
+		}
+	})
+}
+
+func TestQueryFuzzing(t *testing.T) {
+	var (
+		mx      sync.Mutex
+		queries []url.Values
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		if r.URL.Path != "/foo" {
+			t.Error("unexpected path", r.URL.Path)
+		}
+
+		queries = append(queries, r.URL.Query())
+	}))
+
+	defer s.Close()
+
+	t.Run("Preserve", func(t *testing.T) {
+		queries = nil
+		p, err := New(Options{
+			Server:   s.URL,
+			Requests: []*Request{{Path: "/foo?bar=1&baz=qux"}},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		if len(queries) != 1 || queries[0].Get("bar") != "1" || queries[0].Get("baz") != "qux" {
+			t.Error("failed to preserve the query", queries)
+		}
+	})
+
+	t.Run("Fuzz", func(t *testing.T) {
+		queries = nil
+		words := []string{"' OR 1=1 --", "<script>"}
+		p, err := New(Options{
+			Server:         s.URL,
+			Requests:       []*Request{{Path: "/foo?bar=1&baz=qux"}},
+			QueryFuzzRate:  1,
+			QueryFuzzWords: words,
+			RandomSeed:     42,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 30; i++ {
+			once(t, p)
+		}
+
+		var fromWords bool
+		for _, q := range queries {
+			if q.Get("bar") == "1" && q.Get("baz") == "qux" {
+				t.Error("failed to fuzz the query", q)
+			}
+
+			for _, w := range words {
+				fromWords = fromWords || q.Get("bar") == w || q.Get("baz") == w
+			}
+		}
+
+		if !fromWords {
+			t.Error("failed to use the wordlist")
+		}
+	})
+}
+
+func TestPathRules(t *testing.T) {
+	t.Run("Randomize", func(t *testing.T) {
+		var (
+			mx    sync.Mutex
+			paths []string
+		)
+
+		s := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			mx.Lock()
+			defer mx.Unlock()
+			paths = append(paths, r.URL.RequestURI())
+		}))
+
+		defer s.Close()
+
+		var requests []*Request
+		for i := 0; i < 30; i++ {
+			requests = append(requests, &Request{Path: "/users/42/orders/7?expand=true"})
+		}
+
+		p, err := New(Options{
+			Server:   s.URL,
+			Requests: requests,
+			PathRules: []PathRule{{
+				Pattern:     `^/users/\d+`,
+				Replacement: "/users/{rand:1..3}",
+			}, {
+				Pattern:     `/(orders)/\d+`,
+				Replacement: "/$1/{rand:-5..-3}",
+			}},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		users := make(map[string]bool)
+		rx := regexp.MustCompile(`^/users/([1-3])/orders/-[3-5]\?expand=true$`)
+		for _, pi := range paths {
+			m := rx.FindStringSubmatch(pi)
+			if len(m) == 0 {
+				t.Fatal("unexpected path", pi)
+			}
+
+			users[m[1]] = true
+		}
+
+		if len(users) != 3 {
+			t.Error("failed to randomize the path", users)
+		}
+	})
+
+	t.Run("InvalidRange", func(t *testing.T) {
+		if _, err := New(Options{
+			PathRules: []PathRule{{Pattern: "/users/\\d+", Replacement: "/users/{rand:9..1}"}},
+		}); !errors.Is(err, ErrInvalidPathRule) {
+			t.Error("failed to fail", err)
+		}
+	})
+}
+
+func TestTemplateFunctions(t *testing.T) {
+	type received struct {
+		uri, header, body string
+	}
+
+	var (
+		mx sync.Mutex
+		r  []received
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		b, _ := ioutil.ReadAll(req.Body)
+		r = append(r, received{
+			uri:    req.URL.RequestURI(),
+			header: req.Header.Get("X-Correlation-Id"),
+			body:   string(b),
+		})
+	}))
+
+	defer s.Close()
+
+	p, err := New(Options{
+		Server: s.URL,
+		Requests: []*Request{{
+			Method:       "POST",
+			Path:         "/items/{{rand 1 3}}?seq={{seq}}",
+			BodyTemplate: `{"id": "{{uuid}}", "time": "{{now}}"}`,
+		}, {
+			Path: "/users/42",
+		}},
+		Headers:   http.Header{"X-Correlation-Id": []string{"{{uuid}}"}},
+		PathRules: []PathRule{{Pattern: `^/users/\d+$`, Replacement: "/users/{{seq}}"}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+	if len(r) != 2 {
+		t.Fatal("unexpected number of requests", len(r))
+	}
+
+	if !regexp.MustCompile(`^/items/[1-3]\?seq=1$`).MatchString(r[0].uri) {
+		t.Error("failed to expand the path", r[0].uri)
+	}
+
+	var body struct{ ID, Time string }
+	if err := json.Unmarshal([]byte(r[0].body), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	if body.ID == "" || body.ID != r[0].header {
+		t.Error("failed to use the same UUID in the header and the body", body.ID, r[0].header)
+	}
+
+	if _, err := time.Parse(time.RFC3339, body.Time); err != nil {
+		t.Error("failed to expand the time", err)
+	}
+
+	if r[1].uri != "/users/2" || r[1].header == "" || r[1].header == r[0].header {
+		t.Error("failed to expand the path rule or the header", r[1])
+	}
+
+	if _, err := New(Options{Requests: []*Request{{Path: "/items/{{rand 1"}}}); err == nil {
+		t.Error("failed to fail")
+	}
+}
+
+func TestExtraction(t *testing.T) {
+	var (
+		mx    sync.Mutex
+		paths []string
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		paths = append(paths, r.URL.RequestURI()+" "+r.Header.Get("X-Token"))
+		if r.Method == "POST" {
+			w.Header().Set("X-Token", "foo")
+			w.Write([]byte(`{"items": [{"id": 42, "name": "bar"}], "status": "created"}`))
+		}
+	}))
+
+	defer s.Close()
+
+	p, err := New(Options{
+		Server: s.URL,
+		Requests: []*Request{
+			{Method: "GET", Path: "/items/{{.Vars.id}}"},
+			{Method: "POST", Path: "/items"},
+			{Method: "GET", Path: "/items/{{.Vars.id}}?name={{.Vars.name}}&status={{.Vars.status}}"},
+		},
+		Headers: http.Header{"X-Token": []string{"{{.Vars.token}}"}},
+		Extractions: []Extraction{
+			{Name: "id", PathPattern: "^/items$", JSONPath: "$.items[0].id"},
+			{Name: "name", JSONPath: "items[0].name"},
+			{Name: "status", Regexp: `"status": "([a-z]+)"`},
+			{Name: "token", Header: "X-Token"},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+	expect := []string{"/items/ ", "/items ", "/items/42?name=bar&status=created foo"}
+	if len(paths) != len(expect) {
+		t.Fatal("unexpected number of requests", paths)
+	}
+
+	for i := range expect {
+		if paths[i] != expect[i] {
+			t.Error("unexpected request", paths[i], expect[i])
+		}
+	}
+
+	for _, e := range []Extraction{
+		{JSONPath: "$.id"},
+		{Name: "id"},
+		{Name: "id", JSONPath: "$.id", Header: "X-Id"},
+		{Name: "id", JSONPath: "$.items[x]"},
+	} {
+		if _, err := New(Options{Extractions: []Extraction{e}}); !errors.Is(err, ErrInvalidExtraction) {
+			t.Error("failed to fail", e, err)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var (
+		mx    sync.Mutex
+		paths []string
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		paths = append(paths, r.URL.Path+" "+r.Header.Get("X-Hook"))
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+		w.Write([]byte("foo"))
+	}))
+
+	defer s.Close()
+
+	var bodies []string
+	p, err := New(Options{
+		Server: s.URL,
+		Requests: []*Request{
+			{Path: "/foo"},
+			{Path: "/rejected"},
+			{Path: "/missing"},
+		},
+		HaltThreshold: 2,
+		OnRequest: func(hr *http.Request) error {
+			if hr.URL.Path == "/rejected" {
+				return errors.New("rejected")
+			}
+
+			hr.Header.Set("X-Hook", "bar")
+			return nil
+		},
+		OnResponse: func(hr *http.Request, rsp Response) bool {
+			bodies = append(bodies, string(rsp.Body))
+			return rsp.Status == http.StatusOK
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+	if len(paths) != 2 || paths[0] != "/foo bar" || paths[1] != "/missing bar" {
+		t.Error("failed to apply the request hook", paths)
+	}
+
+	if len(bodies) != 2 || bodies[0] != "foo" {
+		t.Error("failed to pass the response body to the hook", bodies)
+	}
+
+	if st := p.Stats(); st.AssertionFailures != 1 || st.Errors != 1 {
+		t.Error("unexpected stats", st.AssertionFailures, st.Errors)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	defer s.Close()
+
+	const accessLog = `
+		GET /api/foo gold
+		GET /api/bar silver
+		GET /admin/baz gold
+		GET /static/qux -
+	`
+
+	p, err := New(Options{
+		Server:          s.URL,
+		AccessLog:       bytes.NewBufferString(accessLog),
+		AccessLogFormat: `(?P<method>[A-Z]+) (?P<path>\S+) ((?P<label_tier>[a-z]+)|-)`,
+		LabelRules: []LabelRule{
+			{PathPattern: "^/api/", Name: "route", Value: "api"},
+			{PathPattern: "^/admin/", Name: "route", Value: "admin"},
+			{PathPattern: "^/", Name: "route", Value: "other"},
+		},
+		HaltThreshold: 9,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+	expect := map[string]struct{ requests, serverErrors int }{
+		"tier=gold":   {2, 1},
+		"tier=silver": {1, 0},
+		"route=api":   {2, 0},
+		"route=admin": {1, 1},
+		"route=other": {1, 0},
+	}
+
+	st := p.Stats()
+	if len(st.Labels) != len(expect) {
+		t.Fatal("unexpected label groups", st.Labels)
+	}
+
+	for key, e := range expect {
+		l := st.Labels[key]
+		if l.Requests != e.requests || l.ServerErrors != e.serverErrors {
+			t.Error("unexpected label stats", key, l.Requests, l.ServerErrors)
+		}
+	}
+
+	m := MergeStats(st, st)
+	if l := m.Labels["tier=gold"]; l.Requests != 4 || l.ServerErrors != 2 {
+		t.Error("failed to merge the label stats", l.Requests, l.ServerErrors)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		time.Sleep(60 * time.Millisecond)
+	}))
+
+	defer s.Close()
+
+	p, err := New(Options{
+		Server: s.URL,
+		Requests: []*Request{
+			{Path: "/slow", Timeout: 360 * time.Millisecond},
+			{Path: "/default"},
+		},
+		RequestTimeout: 30 * time.Millisecond,
+		HaltThreshold:  2,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+	if st := p.Stats(); st.Requests != 2 || st.Errors != 1 || st.StatusCodes[http.StatusOK] != 1 {
+		t.Error("failed to apply the request timeout", st.Requests, st.Errors, st.StatusCodes)
+	}
+}
+
+func TestRequestRedirectBehavior(t *testing.T) {
+	var (
+		mx    sync.Mutex
+		paths []string
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		paths = append(paths, r.URL.Path)
+		mx.Unlock()
+		if r.URL.Path != "/home" {
+			http.Redirect(w, r, "/home", http.StatusFound)
+		}
+	}))
+
+	defer s.Close()
+
+	follow := FollowSameHost
+	p, err := New(Options{
+		Server: s.URL,
+		Requests: []*Request{
+			{Path: "/login", RedirectBehavior: &follow},
+			{Path: "/bulk"},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+	if len(paths) != 3 || paths[0] != "/login" || paths[1] != "/home" || paths[2] != "/bulk" {
+		t.Error("failed to override the redirect behavior", paths)
+	}
+
+	if st := p.Stats(); st.RedirectChains[1] != 1 || st.StatusCodes[http.StatusFound] != 1 {
+		t.Error("unexpected stats", st.RedirectChains, st.StatusCodes)
+	}
+}
+
+func TestTimeRange(t *testing.T) {
+	const accessLog = `
+		1.2.3.4 - - [02/Mar/2017:13:59:59 +0000] "GET /before HTTP/1.1" 200 566
+		1.2.3.4 - - [02/Mar/2017:14:00:00 +0000] "GET /from HTTP/1.1" 200 566
+		1.2.3.4 - - [02/Mar/2017:16:10:00 +0200] "GET /within HTTP/1.1" 200 566
+		1.2.3.4 - - - "GET /missing-time HTTP/1.1" 200 566
+		1.2.3.4 - - [02/Mar/2017:14:15:00 +0000] "GET /to HTTP/1.1" 200 566
+	`
+
+	requests, err := ReadRequests(Options{
+		AccessLog: bytes.NewBufferString(accessLog),
+		From:      time.Date(2017, 3, 2, 14, 0, 0, 0, time.UTC),
+		To:        time.Date(2017, 3, 2, 14, 15, 0, 0, time.UTC),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 2 || requests[0].Path != "/from" || requests[1].Path != "/within" {
+		t.Fatal("failed to filter by time", requests)
+	}
+
+	if !requests[1].Time.Equal(time.Date(2017, 3, 2, 14, 10, 0, 0, time.UTC)) {
+		t.Error("failed to parse the time", requests[1].Time)
+	}
+
+	requests, err = ReadRequests(Options{
+		AccessLog:           bytes.NewBufferString("GET /foo 2017-03-02 14:00\nGET /bar 2017-03-02 15:00"),
+		AccessLogFormat:     `(?P<method>[A-Z]+) (?P<path>\S+) (?P<time>.+)`,
+		AccessLogTimeFormat: "2006-01-02 15:04",
+		From:                time.Date(2017, 3, 2, 14, 30, 0, 0, time.UTC),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 1 || requests[0].Path != "/bar" {
+		t.Error("failed to filter by custom time format", requests)
+	}
+}
+
+func TestMethodFilter(t *testing.T) {
+	const accessLog = `
+		GET /foo
+		POST /bar
+		DELETE /baz
+		head /qux
+		/quux
+	`
+
+	for _, test := range []struct {
+		title            string
+		methods, exclude []string
+		expect           string
+	}{{
+		title:  "All",
+		expect: "/foo /bar /baz /qux /quux",
+	}, {
+		title:   "Include",
+		methods: []string{"get", "HEAD"},
+		expect:  "/foo /qux /quux",
+	}, {
+		title:   "Exclude",
+		exclude: []string{"DELETE", "POST"},
+		expect:  "/foo /qux /quux",
+	}, {
+		title:   "IncludeAndExclude",
+		methods: []string{"GET", "POST"},
+		exclude: []string{"GET"},
+		expect:  "/bar",
+	}} {
+		t.Run(test.title, func(t *testing.T) {
+			requests, err := ReadRequests(Options{
+				AccessLog:       bytes.NewBufferString(accessLog),
+				AccessLogFormat: `((?P<method>[a-zA-Z]+) )?(?P<path>\S+)`,
+				Methods:         test.methods,
+				ExcludeMethods:  test.exclude,
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var paths []string
+			for _, r := range requests {
+				paths = append(paths, r.Path)
+			}
+
+			if p := strings.Join(paths, " "); p != test.expect {
+				t.Error("unexpected requests", p)
+			}
+		})
+	}
+}
+
+func TestStatusFilter(t *testing.T) {
+	const accessLog = `
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /ok HTTP/1.1" 200 566
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /missing HTTP/1.1" 404 566
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /failed HTTP/1.1" 500 566
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /unavailable HTTP/1.1" 503 566
+	`
+
+	for _, test := range []struct {
+		title             string
+		statuses, exclude []string
+		expect            string
+	}{{
+		title:  "All",
+		expect: "/ok /missing /failed /unavailable",
+	}, {
+		title:    "Include",
+		statuses: []string{"5XX", "404"},
+		expect:   "/missing /failed /unavailable",
+	}, {
+		title:   "Exclude",
+		exclude: []string{"4xx", "503"},
+		expect:  "/ok /failed",
+	}} {
+		t.Run(test.title, func(t *testing.T) {
+			requests, err := ReadRequests(Options{
+				AccessLog:       bytes.NewBufferString(accessLog),
+				Statuses:        test.statuses,
+				ExcludeStatuses: test.exclude,
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var paths []string
+			for _, r := range requests {
+				paths = append(paths, r.Path)
+			}
+
+			if p := strings.Join(paths, " "); p != test.expect {
+				t.Error("unexpected requests", p)
+			}
+		})
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		if _, err := New(Options{
+			AccessLog: bytes.NewBufferString(accessLog),
+			Statuses:  []string{"6xx"},
+		}); !errors.Is(err, ErrInvalidStatusFilter) {
+			t.Error("failed to fail", err)
+		}
+	})
+}
+
+func TestDeduplicate(t *testing.T) {
+	const accessLog = `
+		GET foo.example.org /foo?bar=1
+		GET foo.example.org /foo?bar=1
+		get foo.example.org /foo?bar=1
+		GET foo.example.org /foo?bar=2
+		HEAD foo.example.org /foo?bar=1
+		GET baz.example.org /foo?bar=1
+		GET foo.example.org /foo?bar=2
+	`
+
+	read := func(weights bool) []*Request {
+		requests, err := ReadRequests(Options{
+			AccessLog:          bytes.NewBufferString(accessLog),
+			AccessLogFormat:    `(?P<method>[a-zA-Z]+) (?P<host>\S+) (?P<path>\S+)`,
+			Deduplicate:        true,
+			DeduplicateWeights: weights,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return requests
+	}
+
+	requests := read(false)
+	if len(requests) != 4 || requests[0].Weight != 0 {
+		t.Fatal("failed to deduplicate", len(requests))
+	}
+
+	requests = read(true)
+	expect := []float64{3, 2, 1, 1}
+	if len(requests) != len(expect) {
+		t.Fatal("failed to deduplicate", len(requests))
+	}
+
+	for i, w := range expect {
+		if requests[i].Weight != w {
+			t.Error("unexpected weight", i, requests[i].Weight, w)
+		}
+	}
+}
+
+func TestCacheBust(t *testing.T) {
+	var (
+		mx     sync.Mutex
+		values = make(map[string]bool)
+		count  int
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		q := r.URL.Query()
+		if q.Get("bar") != "baz" {
+			t.Error("failed to preserve the query", r.URL.RawQuery)
+		}
+
+		values[q.Get("_cb")] = true
+		count++
+	}))
+
+	defer s.Close()
+
+	p, err := New(Options{
+		Server:         s.URL,
+		Requests:       []*Request{{Path: "/foo?bar=baz"}, {Path: "/foo?bar=baz"}},
+		CacheBustParam: "_cb",
+		RandomSeed:     42,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		once(t, p)
+	}
+
+	if count != 6 || len(values) != count || values[""] {
+		t.Error("failed to bust the cache", count, values)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	var (
+		mx          sync.Mutex
+		notModified int
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		switch r.URL.Path {
+		case "/etag":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			w.Header().Set("ETag", `"v1"`)
+		case "/modified":
+			if r.Header.Get("If-Modified-Since") == "Mon, 02 Jan 2006 15:04:05 GMT" {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		case "/post":
+			if r.Header.Get("If-None-Match") != "" {
+				t.Error("unexpected conditional header on POST")
+			}
+
+			w.Header().Set("ETag", `"v1"`)
+		}
+	}))
+
+	defer s.Close()
+
+	requests := []*Request{
+		{Path: "/etag"},
+		{Path: "/modified"},
+		{Method: "POST", Path: "/post"},
+		{Path: "/etag"},
+		{Path: "/modified"},
+		{Method: "POST", Path: "/post"},
+		{Path: "/etag"},
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		notModified = 0
+		p, err := New(Options{Server: s.URL, Requests: requests})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		if notModified != 0 {
+			t.Error("unexpected conditional requests", notModified)
+		}
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		notModified = 0
+		p, err := New(Options{Server: s.URL, Requests: requests, ConditionalRequests: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		if notModified != 3 {
+			t.Error("failed to make conditional requests", notModified)
+		}
+	})
+}
+
+func TestDecompression(t *testing.T) {
+	body := strings.Repeat("foo bar baz ", 100)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write([]byte(body))
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		gw.Write([]byte(body))
+		gw.Close()
+	}))
+
+	defer s.Close()
+
+	replay := func(t *testing.T, o Options) Stats {
+		o.Server = s.URL
+		o.Requests = []*Request{{Path: "/foo", Assertions: []Assertion{{Body: "^foo bar baz"}}}}
+		p, err := New(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		return p.Stats()
+	}
+
+	t.Run("Plain", func(t *testing.T) {
+		st := replay(t, Options{})
+		if st.AssertionFailures != 0 {
+			t.Error("unexpected assertion failure")
+		}
+
+		if st.ResponseBytes != int64(len(body)) || st.UncompressedBytes != int64(len(body)) {
+			t.Error("unexpected response size", st.ResponseBytes, st.UncompressedBytes)
+		}
+	})
+
+	t.Run("Compressed", func(t *testing.T) {
+		st := replay(t, Options{AcceptEncoding: "gzip"})
+		if st.AssertionFailures != 1 {
+			t.Error("unexpected assertion success")
+		}
+
+		if st.ResponseBytes >= int64(len(body)) || st.UncompressedBytes != st.ResponseBytes {
+			t.Error("unexpected response size", st.ResponseBytes, st.UncompressedBytes)
+		}
+	})
+
+	t.Run("Decompressed", func(t *testing.T) {
+		st := replay(t, Options{AcceptEncoding: "gzip", DecompressResponses: true})
+		if st.AssertionFailures != 0 {
+			t.Error("failed to decompress the response")
+		}
+
+		if st.ResponseBytes >= int64(len(body)) || st.UncompressedBytes != int64(len(body)) {
+			t.Error("unexpected response size", st.ResponseBytes, st.UncompressedBytes)
+		}
+	})
+}
+
+func TestSizeDeviation(t *testing.T) {
+	const accessLog = `
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /100 HTTP/1.1" 200 100
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /105 HTTP/1.1" 200 100
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /50 HTTP/1.1" 200 100
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /150 HTTP/1.1" 200 100
+	`
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		w.Write(bytes.Repeat([]byte{'x'}, n))
+	}))
+
+	defer s.Close()
+
+	t.Run("Parse", func(t *testing.T) {
+		requests, err := ReadRequests(Options{AccessLog: bytes.NewBufferString(accessLog)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(requests) != 4 || requests[0].LoggedSize != 100 {
+			t.Error("failed to parse the logged size")
+		}
+	})
+
+	t.Run("Count", func(t *testing.T) {
+		p, err := New(Options{
+			Server:        s.URL,
+			AccessLog:     bytes.NewBufferString(accessLog),
+			SizeTolerance: 0.1,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		if st := p.Stats(); st.Requests != 4 || st.SizeDeviations != 2 {
+			t.Error("unexpected size deviations", st.Requests, st.SizeDeviations)
+		}
+	})
+
+	t.Run("Halt", func(t *testing.T) {
+		p, err := New(Options{
+			Server:                 s.URL,
+			AccessLog:              bytes.NewBufferString(accessLog),
+			SizeTolerance:          0.1,
+			SizeDeviationThreshold: 1,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.Once(); err != ErrSizeDeviation {
+			t.Error("failed to halt on size deviation", err)
+		}
+	})
+}
+
+func TestLatencyRegression(t *testing.T) {
+	const accessLog = `
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /slow?foo=bar HTTP/1.1" 200 566 "-" "curl" 5 foo.example.org
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /slow?foo=baz HTTP/1.1" 200 566 "-" "curl" 5 foo.example.org
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /fast HTTP/1.1" 200 566 "-" "curl" 3000 foo.example.org
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /unknown HTTP/1.1" 200 566
+	`
+
+	s := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/fast" {
+			time.Sleep(30 * time.Millisecond)
+		}
+	}))
+
+	defer s.Close()
+
+	t.Run("Parse", func(t *testing.T) {
+		requests, err := ReadRequests(Options{AccessLog: bytes.NewBufferString(accessLog)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(requests) != 4 || requests[0].LoggedDuration != 5*time.Millisecond || requests[3].LoggedDuration != 0 {
+			t.Error("failed to parse the logged duration")
+		}
+	})
+
+	t.Run("Report", func(t *testing.T) {
+		p, err := New(Options{
+			Server:                  s.URL,
+			AccessLog:               bytes.NewBufferString(accessLog),
+			LatencyRegressionFactor: 2,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		r := p.Stats().LatencyRegressions
+		if len(r) != 1 {
+			t.Fatal("unexpected regressions", r)
+		}
+
+		slow := r["GET /slow"]
+		if slow.Requests != 2 || slow.Logged != 5*time.Millisecond || slow.Replayed < 30*time.Millisecond {
+			t.Error("unexpected regression", slow)
+		}
+
+		m := MergeStats(p.Stats(), p.Stats()).LatencyRegressions["GET /slow"]
+		if m.Requests != 4 || m.Logged != slow.Logged || m.Replayed != slow.Replayed {
+			t.Error("failed to merge the regressions", m)
+		}
+	})
+}
+
+func TestSlowThreshold(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(30 * time.Millisecond)
+		}
+	}))
+
+	defer s.Close()
+
+	var entries []map[string]interface{}
+	p, err := New(Options{
+		Server:        s.URL,
+		Requests:      []*Request{{Path: "/fast"}, {Path: "/slow"}},
+		Log:           fieldRecorder{mx: &sync.Mutex{}, entries: &entries},
+		SlowThreshold: 15 * time.Millisecond,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+	if len(entries) != 1 {
+		t.Fatal("unexpected log entries", entries)
+	}
+
+	e := entries[0]
+	if e["level"] != "warning" || e["msg"] != "slow request" || e["url"] != s.URL+"/slow" {
+		t.Error("unexpected log entry", e)
+	}
+
+	if d, ok := e["latency"].(time.Duration); !ok || d < 30*time.Millisecond {
+		t.Error("invalid response time", e)
+	}
+}
+
+func TestErrorClasses(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/failed":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/slow":
+			time.Sleep(60 * time.Millisecond)
+		}
+	}))
+
+	defer s.Close()
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer tlsServer.Close()
+
+	closed := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	closed.Close()
+
+	for _, test := range []struct {
+		title  string
+		server string
+		path   string
+		class  ErrorClass
+	}{{
+		title:  "ClientError",
+		server: s.URL,
+		path:   "/missing",
+		class:  ClientError,
+	}, {
+		title:  "ServerError",
+		server: s.URL,
+		path:   "/failed",
+		class:  ServerError,
+	}, {
+		title:  "Timeout",
+		server: s.URL,
+		path:   "/slow",
+		class:  Timeout,
+	}, {
+		title:  "ConnectionRefused",
+		server: closed.URL,
+		class:  ConnectionRefused,
+	}, {
+		title:  "TLS",
+		server: tlsServer.URL,
+		class:  TLSError,
+	}} {
+		t.Run(test.title, func(t *testing.T) {
+			p, err := New(Options{
+				Server:         test.server,
+				Requests:       []*Request{{Path: test.path}, {Path: "/ok"}},
+				RequestTimeout: 30 * time.Millisecond,
+				HaltThreshold:  2,
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p.Once()
+			c := p.Stats().ErrorClasses
+			if len(c) != 1 || c[test.class] == 0 {
+				t.Error("unexpected error classes", c)
+			}
+		})
+	}
+
+	t.Run("DNS", func(t *testing.T) {
+		if c := classifyError(&url.Error{Err: &net.DNSError{IsNotFound: true}}, 0); c != DNSError {
+			t.Error("unexpected error class", c)
+		}
+	})
+}
+
+func TestStatusClasses(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		w.WriteHeader(code)
+	}))
+
+	defer s.Close()
+
+	var (
+		mx       sync.Mutex
+		progress []Progress
+	)
+
+	p, err := New(Options{
+		Server: s.URL,
+		Requests: []*Request{
+			{Path: "/200"},
+			{Path: "/204"},
+			{Path: "/404"},
+			{Path: "/410"},
+			{Path: "/404"},
+		},
+		OnProgress: func(p Progress) {
+			mx.Lock()
+			defer mx.Unlock()
+			progress = append(progress, p)
+		},
+		ProgressInterval: time.Millisecond,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+	st := p.Stats()
+	if len(st.StatusClasses) != 2 || st.StatusClasses["2xx"] != 2 || st.StatusClasses["4xx"] != 3 {
+		t.Error("unexpected status classes", st.StatusClasses)
+	}
+
+	if m := MergeStats(st, st); m.StatusClasses["4xx"] != 6 {
+		t.Error("failed to merge the status classes", m.StatusClasses)
+	}
+
+	mx.Lock()
+	defer mx.Unlock()
+	if len(progress) == 0 {
+		t.Fatal("no progress reported")
+	}
+
+	for _, pr := range progress {
+		if pr.StatusClasses["2xx"]+pr.StatusClasses["4xx"] != pr.Requests {
+			t.Error("inconsistent progress", pr)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/failed" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	defer s.Close()
+
+	collect := func(events <-chan Event) []Event {
+		var e []Event
+		for {
+			select {
+			case ei := <-events:
+				e = append(e, ei)
+			default:
+				return e
+			}
+		}
+	}
+
+	t.Run("Once", func(t *testing.T) {
+		p, err := New(Options{
+			Server:        s.URL,
+			Requests:      []*Request{{Path: "/foo"}, {Path: "/failed"}},
+			HaltThreshold: 2,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		if e := collect(p.Events()); len(e) != 0 {
+			t.Fatal("unexpected events before subscribing", e)
+		}
+
+		once(t, p)
+		var types []string
+		for _, e := range collect(p.Events()) {
+			types = append(types, e.Type.String())
+			if e.Type == ResponseReceived && e.URL == s.URL+"/failed" && e.Status != http.StatusInternalServerError {
+				t.Error("unexpected status", e.Status)
+			}
+		}
+
+		expect := "request sent, response received, request sent, response received, loop completed"
+		if strings.Join(types, ", ") != expect {
+			t.Error("unexpected events", types)
+		}
+	})
+
+	t.Run("Halted", func(t *testing.T) {
+		closed := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		closed.Close()
+		p, err := New(Options{Server: closed.URL, Requests: []*Request{{Path: "/foo"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events := p.Events()
+		if err := p.Once(); err != ErrRequestError {
+			t.Fatal("unexpected error", err)
+		}
+
+		e := collect(events)
+		if len(e) != 3 ||
+			e[1].Type != RequestError || e[1].Err == nil ||
+			e[2].Type != Halted || e[2].Err != ErrRequestError {
+			t.Error("unexpected events", e)
+		}
+	})
+
+	t.Run("Dropped", func(t *testing.T) {
+		p, err := New(Options{
+			Server:      s.URL,
+			Requests:    []*Request{{Path: "/foo"}, {Path: "/bar"}},
+			EventBuffer: 2,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events := p.Events()
+		once(t, p)
+		if e := collect(events); len(e) != 2 {
+			t.Error("unexpected events", e)
+		}
+	})
+}
+
+func TestResultLog(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+		w.Write([]byte("foo"))
+	}))
+
+	defer s.Close()
+
+	replay := func(t *testing.T, f ResultLogFormat) *bytes.Buffer {
+		var buf bytes.Buffer
+		p, err := New(Options{
+			Server: s.URL,
+			Requests: []*Request{
+				{Path: "/foo?bar=baz", Host: "foo.example.org", UserAgent: "test-agent", RemoteAddress: "1.2.3.4"},
+				{Path: "/missing"},
+			},
+			ResultLog:       &buf,
+			ResultLogFormat: f,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		return &buf
+	}
+
+	t.Run("Combined", func(t *testing.T) {
+		buf := replay(t, CombinedResultLog)
+		requests, err := ReadRequests(Options{AccessLog: buf})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(requests) != 2 {
+			t.Fatal("unexpected number of log lines", len(requests))
+		}
+
+		r := requests[0]
+		if r.Method != "GET" ||
+			r.Path != "/foo?bar=baz" ||
+			r.Host != "foo.example.org" ||
+			r.UserAgent != "test-agent" ||
+			r.RemoteAddress != "1.2.3.4" ||
+			r.LoggedStatus != http.StatusOK ||
+			r.LoggedSize != 3 ||
+			r.Time.IsZero() {
+			t.Error("unexpected result log entry", r)
+		}
+
+		if requests[1].LoggedStatus != http.StatusNotFound {
+			t.Error("unexpected status", requests[1].LoggedStatus)
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		dec := json.NewDecoder(replay(t, JSONResultLog))
+		var entries []map[string]interface{}
+		for dec.More() {
+			var e map[string]interface{}
+			if err := dec.Decode(&e); err != nil {
+				t.Fatal(err)
+			}
+
+			entries = append(entries, e)
+		}
+
+		if len(entries) != 2 ||
+			entries[0]["uri"] != "/foo?bar=baz" ||
+			entries[0]["status"] != float64(http.StatusOK) ||
+			entries[0]["size"] != float64(3) ||
+			entries[1]["status"] != float64(http.StatusNotFound) {
+			t.Error("unexpected result log entries", entries)
+		}
+	})
+}
+
+func TestClientCache(t *testing.T) {
+	var (
+		mx       sync.Mutex
+		received = make(map[string]int)
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		received[r.URL.Path]++
+		switch r.URL.Path {
+		case "/max-age":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/expires":
+			w.Header().Set("Expires", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+		case "/expired":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Age", "120")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store, max-age=60")
+		case "/failed":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	defer s.Close()
+
+	var requests []*Request
+	for i := 0; i < 3; i++ {
+		for _, p := range []string{"/max-age", "/expires", "/expired", "/no-store", "/failed", "/none"} {
+			requests = append(requests, &Request{Path: p})
+		}
+
+		requests = append(requests, &Request{Method: "POST", Path: "/max-age"})
+	}
+
+	p, err := New(Options{
+		Server:        s.URL,
+		Requests:      requests,
+		ClientCache:   true,
+		HaltThreshold: 10,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+	expect := map[string]int{
+		"/max-age":  4,
+		"/expires":  1,
+		"/expired":  3,
+		"/no-store": 3,
+		"/failed":   3,
+		"/none":     3,
+	}
+
+	for path, n := range expect {
+		if received[path] != n {
+			t.Error("unexpected number of requests", path, received[path], n)
+		}
+	}
+
+	if st := p.Stats(); st.CacheHits != 4 || st.Requests != len(requests)-4 {
+		t.Error("unexpected statistics", st.CacheHits, st.Requests)
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		w.Write(bytes.Repeat([]byte{'x'}, n))
+	}))
+
+	defer s.Close()
+
+	p, err := New(Options{
+		Server:           s.URL,
+		Requests:         []*Request{{Path: "/10"}, {Path: "/100"}, {Path: "/1000000"}},
+		MaxResponseBytes: 100,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+	st := p.Stats()
+	if st.Errors != 0 || st.TruncatedResponses != 1 || st.ResponseBytes != 210 {
+		t.Error("unexpected statistics", st.Errors, st.TruncatedResponses, st.ResponseBytes)
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	var (
+		mx       sync.Mutex
+		received map[string]int
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		received[r.URL.RequestURI()]++
+	}))
+
+	defer s.Close()
+
+	var accessLog bytes.Buffer
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(&accessLog, "1.2.3.%d - - [02/Mar/2017:11:43:00 +0000] \"GET /foo/%d HTTP/1.1\" 200 566\n", i%3, i)
+	}
+
+	for _, test := range []struct {
+		title   string
+		options Options
+	}{{
+		title: "InOrder",
+	}, {
+		title:   "Shuffle",
+		options: Options{Shuffle: true},
+	}, {
+		title:   "PreserveSessions",
+		options: Options{PreserveSessions: true},
+	}} {
+		t.Run(test.title, func(t *testing.T) {
+			received = make(map[string]int)
+			var entries []map[string]interface{}
+			o := test.options
+			o.Server = s.URL
+			o.AccessLog = bytes.NewBuffer(accessLog.Bytes())
+			o.MaxMemory = 10 * requestSize(&Request{Method: "GET", Path: "/foo/10", RemoteAddress: "1.2.3.0"})
+			o.ConcurrentSessions = 2
+			o.Log = fieldRecorder{mx: &sync.Mutex{}, entries: &entries}
+			p, err := New(o)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			once(t, p)
+			if p.logEntries.count() != 30 || len(p.logEntries.memory) >= 30 {
+				t.Error("failed to spill the log entries", len(p.logEntries.memory))
+			}
+
+			expect := 2
+			if o.PreserveSessions {
+				expect = 1
+			}
+
+			if len(received) != 30 {
+				t.Fatal("unexpected requests", received)
+			}
+
+			for path, n := range received {
+				if n != expect {
+					t.Error("unexpected number of requests", path, n)
+				}
+			}
+
+			var warned bool
+			for _, e := range entries {
+				warned = warned || e["level"] == "warning" && strings.Contains(e["msg"].(string), "spilling")
+			}
+
+			if !warned {
+				t.Error("missing warning")
+			}
+
+			spill := p.logEntries.spill
+			if err := p.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := spill.Stat(); err == nil {
+				t.Error("failed to close the spill file")
+			}
+		})
+	}
+}
+
+func TestCombinedParser(t *testing.T) {
+	for _, test := range []struct {
+		title    string
+		line     string
+		expected Request
+	}{{
+		title: "EscapedQuotes",
+		line:  `1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /foo HTTP/1.1" 200 566 "-" "Foo \"Bar\" \\ Baz" 42 www.example.org`,
+		expected: Request{
+			RemoteAddress:  "1.2.3.4",
+			Method:         "GET",
+			Path:           "/foo",
+			Protocol:       "HTTP/1.1",
+			UserAgent:      `Foo "Bar" \ Baz`,
+			Host:           "www.example.org",
+			LoggedStatus:   200,
+			LoggedSize:     566,
+			LoggedDuration: 42 * time.Millisecond,
+		},
+	}, {
+		title: "Whitespace",
+		line:  "1.2.3.4 ,\t5.6.7.8\t-\t-  [02/Mar/2017:11:43:00 +0000]\t\"POST\t /foo  HTTP/1.1\"  201\t12",
+		expected: Request{
+			RemoteAddress: "1.2.3.4 ,\t5.6.7.8",
+			Method:        "POST",
+			Path:          "/foo",
+			Protocol:      "HTTP/1.1",
+			LoggedStatus:  201,
+			LoggedSize:    12,
+		},
+	}, {
+		title: "MissingProtocolAndSize",
+		line:  `- - - - "GET /foo" 304 - "https://www.example.org" "Mozilla/5.0"`,
+		expected: Request{
+			Method:       "GET",
+			Path:         "/foo",
+			UserAgent:    "Mozilla/5.0",
+			LoggedStatus: 304,
+		},
+	}, {
+		title: "IPv6",
+		line:  `2001:db8::1, 10.0.0.1 - - - "GET /foo HTTP/1.1" 200 0 "-" "curl" 3 api.example.org extra fields`,
+		expected: Request{
+			RemoteAddress:  "2001:db8::1, 10.0.0.1",
+			Method:         "GET",
+			Path:           "/foo",
+			Protocol:       "HTTP/1.1",
+			UserAgent:      "curl",
+			Host:           "api.example.org",
+			LoggedStatus:   200,
+			LoggedDuration: 3 * time.Millisecond,
+		},
+	}, {
+		title: "AbsoluteURL",
+		line:  `1.2.3.4 - - - "GET https://user@www.example.org:8443?foo=bar HTTP/1.1" 200 0 "-" "curl" 3 proxy.example.org`,
+		expected: Request{
+			RemoteAddress:  "1.2.3.4",
+			Method:         "GET",
+			Scheme:         "https",
+			Host:           "www.example.org:8443",
+			Path:           "/?foo=bar",
+			Protocol:       "HTTP/1.1",
+			UserAgent:      "curl",
+			LoggedStatus:   200,
+			LoggedDuration: 3 * time.Millisecond,
+		},
+	}, {
+		title: "Invalid",
+		line:  `1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /foo HTTP/1.1 200 566`,
+	}} {
+		t.Run(test.title, func(t *testing.T) {
+			requests, err := ReadRequests(Options{AccessLog: bytes.NewBufferString(test.line)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(requests) != 1 {
+				t.Fatal("failed to parse the log entry", len(requests))
+			}
+
+			r := requests[0]
+			r.Fields = nil
+			r.Time = time.Time{}
+			if !reflect.DeepEqual(*r, test.expected) {
+				t.Errorf("invalid request, got: %+v, expected: %+v", *r, test.expected)
+			}
+		})
+	}
+}
+
+func TestPayloadSeed(t *testing.T) {
+	body := func(seed int64) string {
+		b := &bodyRecorderHandler{}
+		s := httptest.NewServer(b)
+		defer s.Close()
+
+		p, err := New(Options{
+			Requests:   []*Request{{Method: "POST", ContentLength: 1 << 20}},
+			Server:     s.URL,
+			RandomSeed: seed,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		if len(b.bodies) != 1 || len(b.bodies[0]) != 1<<20 || strings.Trim(b.bodies[0], chars) != "" {
+			t.Fatal("failed to send the right payload")
+		}
+
+		return b.bodies[0]
+	}
+
+	b1, b2, b3 := body(42), body(42), body(43)
+	if b1 != b2 {
+		t.Error("failed to repeat the payload with the same seed")
+	}
+
+	if b1 == b3 {
+		t.Error("failed to generate different payloads with different seeds")
+	}
+}
+
+func TestResolvedEntries(t *testing.T) {
+	var (
+		mx       sync.Mutex
+		received []string
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		received = append(
+			received,
+			strings.Join([]string{r.URL.RequestURI(), r.UserAgent(), r.Header.Get("X-Foo"), r.Host}, " "),
+		)
+	}))
+
+	defer s.Close()
+
+	p, err := New(Options{
+		Server: s.URL,
+		Requests: []*Request{
+			{Path: "/foo?bar=baz", UserAgent: "qux", Host: "www.example.org"},
+			{Path: "/seq/{{.Seq}}"},
+		},
+		Headers: map[string][]string{"X-Foo": {"quux"}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		once(t, p)
+	}
+
+	expected := []string{
+		"/foo?bar=baz qux quux www.example.org",
+		"/seq/2 Go-http-client/1.1 quux " + strings.TrimPrefix(s.URL, "http://"),
+		"/foo?bar=baz qux quux www.example.org",
+		"/seq/4 Go-http-client/1.1 quux " + strings.TrimPrefix(s.URL, "http://"),
+		"/foo?bar=baz qux quux www.example.org",
+		"/seq/6 Go-http-client/1.1 quux " + strings.TrimPrefix(s.URL, "http://"),
+	}
+
+	if !reflect.DeepEqual(received, expected) {
+		t.Error("failed to send the right requests", received)
+	}
+
+	if len(p.shared.resolved.entries) != 1 {
+		t.Error("failed to store the resolved entry", len(p.shared.resolved.entries))
+	}
+}
+
+func TestAdaptiveThrottle(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	var (
+		failing int32 = 1
+		entries []map[string]interface{}
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	defer s.Close()
+
+	p, err := New(Options{
+		Server:            s.URL,
+		Requests:          []*Request{{Path: "/foo"}},
+		Throttle:          200,
+		AdaptiveErrorRate: .1,
+		AdaptiveInterval:  30 * time.Millisecond,
+		AdaptiveMinRate:   20,
+		HaltThreshold:     1 << 20,
+		Log:               fieldRecorder{mx: &sync.Mutex{}, entries: &entries},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go play(t, p)
+	defer p.Stop()
+
+	time.Sleep(300 * time.Millisecond)
+	if r := p.Throttle(); r != 20 {
+		t.Error("failed to reduce the rate", r)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(900 * time.Millisecond)
+	if r := p.Throttle(); r != 200 {
+		t.Error("failed to restore the rate", r)
+	}
+}
+
+func TestRampDown(t *testing.T) {
+	s := httptest.NewServer(ok)
+	defer s.Close()
+
+	p, err := New(Options{
+		Server:             s.URL,
+		Requests:           []*Request{{Path: "/foo"}},
+		ConcurrentSessions: 10,
+		Throttle:           1000,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go play(t, p)
+	defer p.Stop()
+
+	var (
+		mx           sync.Mutex
+		concurrency  []int
+		throttle     []float64
+		done         = make(chan struct{})
+		sampleTicker = time.NewTicker(3 * time.Millisecond)
+	)
+
+	defer sampleTicker.Stop()
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-sampleTicker.C:
+				mx.Lock()
+				concurrency = append(concurrency, p.Concurrency())
+				throttle = append(throttle, p.Throttle())
+				mx.Unlock()
+			}
+		}
+	}()
+
+	p.RampDown(150 * time.Millisecond)
+	close(done)
+	mx.Lock()
+	defer mx.Unlock()
+
+	if p.Concurrency() != 1 || p.Throttle() != 100 {
+		t.Error("failed to ramp down", p.Concurrency(), p.Throttle())
+	}
+
+	for i := 1; i < len(concurrency); i++ {
+		if concurrency[i] > concurrency[i-1] || throttle[i] > throttle[i-1] {
+			t.Error("failed to reduce the load monotonically", concurrency, throttle)
+			break
+		}
+	}
+
+	if len(concurrency) < 10 || concurrency[len(concurrency)/2] <= 1 || concurrency[len(concurrency)/2] >= 10 {
+		t.Error("failed to reduce the load gradually", concurrency)
+	}
+}
+
+func TestStartAt(t *testing.T) {
+	t.Run("DelayedStart", func(t *testing.T) {
+		var (
+			mx    sync.Mutex
+			first time.Time
+		)
+
+		s := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			mx.Lock()
+			defer mx.Unlock()
+			if first.IsZero() {
+				first = time.Now()
+			}
+		}))
+
+		defer s.Close()
+
+		startAt := time.Now().Add(120 * time.Millisecond)
+		p, err := New(Options{
+			Server:    s.URL,
+			AccessLog: bytes.NewBufferString(`- - - - "GET /foo HTTP/1.1" 200 0` + "\n" + `- - - - "GET /bar HTTP/1.1" 200 0`),
+			StartAt:   startAt,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		if first.Before(startAt) {
+			t.Error("failed to wait for the start", startAt.Sub(first))
+		}
+
+		if p.Stats().Requests != 2 {
+			t.Error("failed to replay the requests", p.Stats().Requests)
+		}
+	})
+
+	t.Run("StopBeforeStart", func(t *testing.T) {
+		var count int32
+		s := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			atomic.AddInt32(&count, 1)
+		}))
+
+		defer s.Close()
+
+		p, err := New(Options{
+			Server:   s.URL,
+			Requests: []*Request{{Path: "/foo"}},
+			StartAt:  time.Now().Add(time.Hour),
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go play(t, p)
+		time.Sleep(30 * time.Millisecond)
+		p.Stop()
+		if atomic.LoadInt32(&count) != 0 {
+			t.Error("failed to wait for the start")
+		}
+	})
+
+	t.Run("WarmupHosts", func(t *testing.T) {
+		p, err := New(Options{
+			Server:  "https://www.example.org:8443",
+			Servers: []string{"api.example.org", "10.0.0.1:9090"},
+			Shadow:  "shadow.example.org",
+			Resolve: map[string]string{"api.example.org": "10.0.0.2"},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h := p.warmupHosts(); !reflect.DeepEqual(h, []string{"www.example.org", "shadow.example.org"}) {
+			t.Error("failed to collect the hosts to resolve", h)
+		}
+	})
+}
+
+func TestPauseAndDrain(t *testing.T) {
+	var active int64
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&active, 1)
+		defer atomic.AddInt64(&active, -1)
+		time.Sleep(30 * time.Millisecond)
+	}))
+
+	defer s.Close()
+
+	p, err := New(Options{
+		Server:             s.URL,
+		Requests:           []*Request{{Path: "/foo"}},
+		ConcurrentSessions: 8,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go play(t, p)
+	defer p.Stop()
+
+	time.Sleep(45 * time.Millisecond)
+	p.PauseAndDrain()
+	if n := atomic.LoadInt64(&active); n != 0 {
+		t.Error("failed to wait for the requests in flight", n)
+	}
+
+	st := p.Stats()
+	if st.Requests == 0 {
+		t.Error("failed to count the drained requests", st.Requests)
+	}
+
+	time.Sleep(45 * time.Millisecond)
+	if p.Stats().Requests != st.Requests {
+		t.Error("failed to keep the statistics while paused", st.Requests, p.Stats().Requests)
+	}
+
+	// draining an idle player returns immediately:
+	done := make(chan struct{})
+	go func() {
+		p.PauseAndDrain()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Millisecond):
+		t.Error("timeout")
+	}
+}
+
+func TestGroup(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		if _, err := NewGroup(); err != ErrEmptyGroup {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+
+	t.Run("Once", func(t *testing.T) {
+		var countA, countB int64
+		sa := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			atomic.AddInt64(&countA, 1)
+		}))
+
+		defer sa.Close()
+		sb := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			atomic.AddInt64(&countB, 1)
+		}))
+
+		defer sb.Close()
+
+		g, err := NewGroup(
+			Options{Server: sa.URL, Requests: []*Request{{Path: "/a"}, {Path: "/a"}}},
+			Options{Server: sb.URL, Requests: []*Request{{Path: "/b"}, {Path: "/b"}, {Path: "/b"}}},
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := g.Once(); err != nil {
+			t.Fatal(err)
+		}
+
+		if countA != 2 || countB != 3 {
+			t.Error("failed to replay the scenarios", countA, countB)
+		}
+
+		if s := g.Stats(); s.Requests != 5 || s.StatusCodes[200] != 5 {
+			t.Error("failed to merge the statistics", s.Requests, s.StatusCodes)
+		}
+
+		if len(g.Players()) != 2 || g.Players()[1].Stats().Requests != 3 {
+			t.Error("failed to return the players")
+		}
+
+		// stopping finished players doesn't block:
+		g.Stop()
+	})
+
+	t.Run("PauseAndStop", func(t *testing.T) {
+		s := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			time.Sleep(3 * time.Millisecond)
+		}))
+
+		defer s.Close()
+
+		g, err := NewGroup(
+			Options{Server: s.URL, Requests: []*Request{{Path: "/a"}}},
+			Options{Server: s.URL, Requests: []*Request{{Path: "/b"}}, ConcurrentSessions: 2},
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error)
+		go func() { done <- g.Play() }()
+
+		time.Sleep(30 * time.Millisecond)
+		g.PauseAndDrain()
+		st := g.Stats()
+		if st.Requests == 0 {
+			t.Error("failed to replay the requests")
+		}
+
+		time.Sleep(15 * time.Millisecond)
+		if g.Stats().Requests != st.Requests {
+			t.Error("failed to pause all the players")
+		}
+
+		go g.Play()
+		time.Sleep(15 * time.Millisecond)
+		if g.Stats().Requests <= st.Requests {
+			t.Error("failed to resume all the players")
+		}
+
+		g.Stop()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(120 * time.Millisecond):
+			t.Error("timeout")
+		}
+	})
+
+	t.Run("FailureStopsAll", func(t *testing.T) {
+		s := httptest.NewServer(ok)
+		defer s.Close()
+
+		failing := httptest.NewServer(statusHandler(http.StatusInternalServerError))
+		defer failing.Close()
+
+		g, err := NewGroup(
+			Options{Server: s.URL, Requests: []*Request{{Path: "/a"}}},
+			Options{
+				Server:        failing.URL,
+				Requests:      []*Request{{Path: "/b"}},
+				HaltThreshold: 3,
+				HaltOn500:     true,
+			},
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error)
+		go func() { done <- g.Play() }()
+		select {
+		case err := <-done:
+			if err != ErrServerError {
+				t.Error("failed to fail with the right error", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Error("timeout")
+		}
+	})
+}
+
+func TestCompose(t *testing.T) {
+	const accessLog = `
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /log1 HTTP/1.1" 200 566 "-" "-" 1 www.example.org
+		1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "POST /log2 HTTP/1.1" 200 138 "-" "-" 1 www.example.org`
+
+	generate := func(i int) *Request {
+		if i == 1 {
+			return nil
+		}
+
+		return &Request{Path: fmt.Sprintf("/gen%d", i)}
+	}
+
+	t.Run("Order", func(t *testing.T) {
+		r, err := Compose(
+			RequestSource(&Request{Path: "/login"}),
+			Repeat(LogSource(Options{AccessLog: bytes.NewBufferString(accessLog)}), 2),
+			Interleave(
+				RequestSource(&Request{Path: "/a"}, &Request{Path: "/b"}),
+				GeneratedSource(4, generate),
+			),
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var paths []string
+		for _, ri := range r {
+			paths = append(paths, ri.Path)
+		}
+
+		expected := []string{
+			"/login",
+			"/log1", "/log2", "/log1", "/log2",
+			"/a", "/gen0", "/b", "/gen2", "/gen3",
+		}
+
+		if !reflect.DeepEqual(paths, expected) {
+			t.Error("failed to compose the scenario", paths)
+		}
+
+		if r[1] == r[3] || !r[1].logEntry || r[0].logEntry {
+			t.Error("failed to copy and mark the log entries")
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		_, err := Compose(
+			RequestSource(&Request{Path: "/login"}),
+			Repeat(LogSource(Options{AccessLog: &failingReader{}}), 2),
+		)
+
+		if err == nil {
 			t.Error("failed to fail")
 		}
 	})
+
+	t.Run("Replay", func(t *testing.T) {
+		var (
+			mx    sync.Mutex
+			paths []string
+			body  []byte
+		)
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mx.Lock()
+			defer mx.Unlock()
+			paths = append(paths, r.URL.Path)
+			if r.URL.Path == "/log2" {
+				body, _ = ioutil.ReadAll(r.Body)
+			}
+		}))
+
+		defer s.Close()
+
+		requests, err := Compose(
+			LogSource(Options{AccessLog: bytes.NewBufferString(accessLog)}),
+			RequestSource(&Request{Path: "/custom"}),
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := ioutil.TempFile("", "logreplay-body")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer os.Remove(f.Name())
+		if _, err := f.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+
+		f.Close()
+
+		p, err := New(Options{
+			Server:    s.URL,
+			Requests:  requests,
+			BodyFiles: []BodyFile{{PathPattern: "^/log2$", File: f.Name()}},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		if !reflect.DeepEqual(paths, []string{"/log1", "/log2", "/custom"}) {
+			t.Error("failed to replay the composed scenario", paths)
+		}
+
+		if string(body) != "foo" {
+			t.Error("failed to apply the log entry settings", string(body))
+		}
+
+		if requests[1].BodyFile != "" {
+			t.Error("failed to keep the requests in the options unchanged")
+		}
+	})
+}
+
+func TestMaxConcurrencyPerHost(t *testing.T) {
+	var (
+		mx                  sync.Mutex
+		active              = make(map[string]int)
+		max                 = make(map[string]int)
+		requests            int
+		fastWhileSlowActive bool
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		requests++
+		active[r.Host]++
+		if active[r.Host] > max[r.Host] {
+			max[r.Host] = active[r.Host]
+		}
+
+		if r.Host == "fast.example.org" && active["slow.example.org"] > 0 {
+			fastWhileSlowActive = true
+		}
+
+		mx.Unlock()
+
+		if r.Host == "slow.example.org" {
+			time.Sleep(15 * time.Millisecond)
+		}
+
+		mx.Lock()
+		active[r.Host]--
+		mx.Unlock()
+	}))
+
+	defer s.Close()
+
+	scenario := []*Request{{Host: "slow.example.org"}}
+	for i := 0; i < 5; i++ {
+		scenario = append(scenario, &Request{Host: "fast.example.org"})
+	}
+
+	p, err := New(Options{
+		Server:                s.URL,
+		Requests:              scenario,
+		ConcurrentSessions:    4,
+		MaxConcurrencyPerHost: 1,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+	mx.Lock()
+	defer mx.Unlock()
+	if requests != 24 || p.Stats().Requests != 24 {
+		t.Error("failed to replay all the requests", requests, p.Stats().Requests)
+	}
+
+	if max["slow.example.org"] != 1 || max["fast.example.org"] != 1 {
+		t.Error("failed to limit the concurrency per host", max)
+	}
+
+	if !fastWhileSlowActive {
+		t.Error("failed to continue with the other hosts")
+	}
+}
+
+func TestAddressFamily(t *testing.T) {
+	// the test server listens on 127.0.0.1:
+	s := httptest.NewServer(ok)
+	defer s.Close()
+
+	for _, test := range []struct {
+		family AddressFamily
+		err    error
+		errors int
+	}{
+		{DualStack, nil, 0},
+		{IPv4Only, nil, 0},
+		{IPv6Only, ErrRequestError, 1},
+	} {
+		p, err := New(Options{
+			Server:        s.URL,
+			Requests:      []*Request{{Path: "/foo"}},
+			AddressFamily: test.family,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.Once(); err != test.err {
+			t.Error("failed to fail with the right error", test.family, err)
+		}
+
+		if st := p.Stats(); st.Requests != 1 || st.Errors != test.errors {
+			t.Error("failed to apply the address family", test.family, st.Requests, st.Errors)
+		}
+	}
+}
+
+func TestHTTP3(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logreplay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(t, dir, "www.example.org")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+	s := &http3.Server{
+		Handler:   ok,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	}
+
+	go s.Serve(conn)
+	defer s.Close()
+
+	port := strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port)
+	for _, test := range []struct {
+		title   string
+		options Options
+		err     error
+	}{{
+		title:   "direct",
+		options: Options{Server: "https://localhost:" + port},
+	}, {
+		title: "resolve",
+		options: Options{
+			Server:  "https://www.example.org:" + port,
+			Resolve: map[string]string{"www.example.org": "127.0.0.1"},
+		},
+	}, {
+		title: "resolve with port",
+		options: Options{
+			Server:  "https://www.example.org",
+			Resolve: map[string]string{"www.example.org:443": "127.0.0.1:" + port},
+		},
+	}, {
+		title:   "IPv4",
+		options: Options{Server: "https://localhost:" + port, AddressFamily: IPv4Only},
+	}, {
+		title: "IPv4 with resolve",
+		options: Options{
+			Server:        "https://www.example.org:" + port,
+			Resolve:       map[string]string{"www.example.org": "localhost"},
+			AddressFamily: IPv4Only,
+		},
+	}, {
+		title:   "IPv6",
+		options: Options{Server: "https://localhost:" + port, AddressFamily: IPv6Only},
+		err:     ErrRequestError,
+	}} {
+		t.Run(test.title, func(t *testing.T) {
+			o := test.options
+			o.Requests = []*Request{{Path: "/foo"}}
+			o.HTTP3 = true
+			o.CAFile = certFile
+			o.DialTimeout = time.Second
+			p, err := New(o)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := p.Once(); err != test.err {
+				t.Fatal("failed to fail with the right error", err)
+			}
+
+			if test.err != nil {
+				return
+			}
+
+			if st := p.Stats(); st.Requests != 1 || st.Protocols["HTTP/3.0"] != 1 {
+				t.Error("failed to replay the request over HTTP/3", st.Requests, st.Errors, st.Protocols)
+			}
+		})
+	}
+}
+
+func TestHTTP3Options(t *testing.T) {
+	for _, test := range []struct {
+		title   string
+		options Options
+		fail    bool
+	}{{
+		title:   "TLS server",
+		options: Options{Server: "https://www.example.org"},
+	}, {
+		title:   "default scheme",
+		options: Options{Server: "www.example.org", DefaultScheme: "https"},
+	}, {
+		title:   "no server",
+		options: Options{DialTimeout: time.Second},
+	}, {
+		title:   "cleartext server",
+		options: Options{Server: "http://www.example.org"},
+		fail:    true,
+	}, {
+		title:   "cleartext by default",
+		options: Options{Server: "www.example.org"},
+		fail:    true,
+	}, {
+		title:   "cleartext shadow",
+		options: Options{Server: "https://www.example.org", Shadow: "http://shadow.example.org"},
+		fail:    true,
+	}, {
+		title:   "cleartext in servers",
+		options: Options{Servers: []string{"https://a.example.org", "http://b.example.org"}},
+		fail:    true,
+	}, {
+		title:   "proxy",
+		options: Options{ProxyURL: "http://proxy.example.org:3128"},
+		fail:    true,
+	}, {
+		title:   "proxy from environment",
+		options: Options{ProxyFromEnvironment: true},
+		fail:    true,
+	}, {
+		title:   "disable keep-alive",
+		options: Options{DisableKeepAlives: true},
+		fail:    true,
+	}, {
+		title:   "TLS handshake timeout",
+		options: Options{TLSHandshakeTimeout: time.Second},
+		fail:    true,
+	}, {
+		title:   "response header timeout",
+		options: Options{ResponseHeaderTimeout: time.Second},
+		fail:    true,
+	}} {
+		t.Run(test.title, func(t *testing.T) {
+			o := test.options
+			o.Requests = []*Request{{}}
+			o.HTTP3 = true
+			_, err := New(o)
+			if test.fail && !errors.Is(err, ErrHTTP3Option) {
+				t.Error("failed to fail with the right error", err)
+			}
+
+			if !test.fail && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestTLSVersionAndCipherSuites(t *testing.T) {
+	var (
+		mx     sync.Mutex
+		suites []uint16
+	)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		suites = append(suites, r.TLS.CipherSuite)
+	}))
+
+	s.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	s.StartTLS()
+	defer s.Close()
+
+	t.Run("InvalidVersions", func(t *testing.T) {
+		_, err := New(Options{
+			Server:        s.URL,
+			MinTLSVersion: tls.VersionTLS13,
+			MaxTLSVersion: tls.VersionTLS12,
+		})
+
+		if err != ErrInvalidTLSVersion {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+
+	t.Run("UnsupportedVersion", func(t *testing.T) {
+		p, err := New(Options{
+			Server:             s.URL,
+			Requests:           []*Request{{}},
+			InsecureSkipVerify: true,
+			MinTLSVersion:      tls.VersionTLS13,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p.Once()
+		if st := p.Stats(); st.Errors != 1 || st.ErrorClasses[TLSError] != 1 {
+			t.Error("failed to enforce the minimum TLS version", st.Errors, st.ErrorClasses)
+		}
+	})
+
+	t.Run("CipherSuite", func(t *testing.T) {
+		p, err := New(Options{
+			Server:             s.URL,
+			Requests:           []*Request{{}},
+			InsecureSkipVerify: true,
+			MaxTLSVersion:      tls.VersionTLS12,
+			CipherSuites:       []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		once(t, p)
+		mx.Lock()
+		defer mx.Unlock()
+		if len(suites) != 1 || suites[0] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+			t.Error("failed to apply the cipher suites", suites)
+		}
+	})
+}
+
+func TestExpectContinue(t *testing.T) {
+	var (
+		mx     sync.Mutex
+		expect []string
+		sizes  []int
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server sends 100 Continue when the handler starts reading the body:
+		time.Sleep(3 * time.Millisecond)
+		b, _ := ioutil.ReadAll(r.Body)
+		mx.Lock()
+		defer mx.Unlock()
+		expect = append(expect, r.Header.Get("Expect"))
+		sizes = append(sizes, len(b))
+	}))
+
+	defer s.Close()
+
+	p, err := New(Options{
+		Server: s.URL,
+		Requests: []*Request{
+			{Method: "POST", Body: make([]byte, 64)},
+			{Method: "POST", Body: make([]byte, 2048)},
+		},
+		ExpectContinueThreshold: 1024,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+	mx.Lock()
+	defer mx.Unlock()
+	if !reflect.DeepEqual(expect, []string{"", "100-continue"}) || !reflect.DeepEqual(sizes, []int{64, 2048}) {
+		t.Error("failed to send Expect: 100-continue with the large bodies", expect, sizes)
+	}
+
+	if c := p.Stats().ExpectContinue; c.Min < 3*time.Millisecond || c.Max != c.Min {
+		t.Error("failed to measure the time of waiting for 100 Continue", c)
+	}
+}
+
+func TestPreserveHTTP10(t *testing.T) {
+	const log = `1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /legacy HTTP/1.0" 200 0
+1.2.3.4 - - [02/Mar/2017:11:43:00 +0000] "GET /current HTTP/1.1" 200 0`
+
+	for _, preserve := range []bool{false, true} {
+		t.Run(fmt.Sprint(preserve), func(t *testing.T) {
+			var (
+				mx     sync.Mutex
+				closed = make(map[string]bool)
+			)
+
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mx.Lock()
+				defer mx.Unlock()
+				closed[r.URL.Path] = r.Close
+			}))
+
+			defer s.Close()
+
+			p, err := New(Options{
+				Server:         s.URL,
+				AccessLog:      bytes.NewBufferString(log),
+				PreserveHTTP10: preserve,
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			once(t, p)
+			mx.Lock()
+			defer mx.Unlock()
+			if closed["/legacy"] != preserve || closed["/current"] {
+				t.Error("invalid keep-alive behavior", closed)
+			}
+		})
+	}
+
+	t.Run("regexp", func(t *testing.T) {
+		requests, err := ReadRequests(Options{
+			AccessLog:       bytes.NewBufferString("GET /foo HTTP/1.0"),
+			AccessLogFormat: `^(?P<method>\S+)\s+(?P<path>\S+)\s+(?P<protocol>\S+)$`,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(requests) != 1 || requests[0].Protocol != "HTTP/1.0" {
+			t.Error("failed to capture the protocol")
+		}
+	})
+}
+
+func TestAbsoluteURL(t *testing.T) {
+	var (
+		mx    sync.Mutex
+		paths []string
+	)
+
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		paths = append(paths, r.Host+r.URL.RequestURI())
+	}))
+
+	defer s.Close()
+
+	host := strings.TrimPrefix(s.URL, "https://")
+	p, err := New(Options{
+		AccessLog: bytes.NewBufferString(fmt.Sprintf(
+			"GET %s/foo?bar=baz\nPOST HTTPS://%s\n",
+			s.URL,
+			host,
+		)),
+		AccessLogFormat:    `^(?P<method>\S+)\s+(?P<path>\S+)$`,
+		InsecureSkipVerify: true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once(t, p)
+	mx.Lock()
+	defer mx.Unlock()
+	if !reflect.DeepEqual(paths, []string{host + "/foo?bar=baz", host + "/"}) {
+		t.Error("failed to replay the absolute URLs", paths)
+	}
+}
+
+func TestReportAfterStop(t *testing.T) {
+	quit := make(signalChannel)
+	s := &player{results: make(resultChannel), quit: quit, stats: newShardedStats().shard()}
+	close(quit)
+
+	done := make(signalChannel)
+	go func() {
+		s.report(result{status: 200})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("failed to release the session after the player stopped")
+	}
 }
 
 func TestConcurrency1(t *testing.T) { test(t, 1) }
@@ -870,3 +6287,164 @@ func TestConcurrency243(t *testing.T) {
 
 	test(t, 243)
 }
+
+func benchmarkClient(b *testing.B, o Options) *client {
+	o.DefaultScheme = "http"
+	o.Log = newDefaultLog(nil)
+	tc, err := newTransportConfig(o)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return newClient(o, newShared(o, nil, tc), newRandom(42))
+}
+
+func BenchmarkCreateHTTPRequest(b *testing.B) {
+	c := benchmarkClient(b, Options{Server: "localhost:9090", CacheBustParam: "_cb"})
+	r := &Request{Method: "GET", Host: "www.example.org", Path: "/foo/bar?baz=qux"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hr, err := c.createHTTPRequest(r, uint64(i+1))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if hr.Body != nil {
+			hr.Body.Close()
+		}
+	}
+}
+
+func BenchmarkPayloadBody(b *testing.B) {
+	c := benchmarkClient(b, Options{Server: "localhost:9090"})
+	r := &Request{Method: "POST", Path: "/foo", ContentLength: 1 << 14}
+	b.ReportAllocs()
+	b.SetBytes(1 << 14)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		body, err := c.createGeneratedBody(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err := io.Copy(ioutil.Discard, body.reader); err != nil {
+			b.Fatal(err)
+		}
+
+		body.reader.(io.Closer).Close()
+	}
+}
+
+func BenchmarkOnce(b *testing.B) {
+	s := httptest.NewServer(statusHandler(http.StatusOK))
+	defer s.Close()
+
+	requests := make([]*Request, 100)
+	for i := range requests {
+		requests[i] = &Request{Method: "GET", Path: fmt.Sprintf("/foo/%d", i)}
+		if i%10 == 0 {
+			requests[i].Method = "POST"
+			requests[i].ContentLength = 1 << 10
+		}
+	}
+
+	p, err := New(Options{
+		Server:             s.URL,
+		Requests:           requests,
+		ConcurrentSessions: 4,
+	})
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := p.Once(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	const line = `1.2.3.4, 5.6.7.8, 9.0.1.2 - - [02/Mar/2017:11:43:00 +0000] "GET /foo HTTP/1.1" 200 566 "https://www.example.org/bar.html", "Mozilla/5.0 (iPhone; CPU iPHone OS 10_2_1 like Mac OS X) AppleWebKit/600.1.4 (KHTML, like Gecko) GSA/23.0.1234 Mobile/14D27 Safari/600.1.4" 1 www.example.org`
+	p := &combinedParser{timeFormat: DefaultTimeFormat, log: newDefaultLog(nil)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.Parse(line)
+	}
+}
+
+func TestShardedStats(t *testing.T) {
+	s := newShardedStats()
+	results := []result{
+		{status: 200, protocol: "HTTP/1.1", latency: 3 * time.Millisecond, size: 10, labels: []string{"tier=gold"}},
+		{status: 503, protocol: "HTTP/2.0", latency: 0, redirects: 2, regression: "GET /foo", loggedDuration: time.Millisecond},
+		{err: errors.New("failed"), labels: []string{"tier=gold"}},
+		{cacheHit: true},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		sh := s.shard()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				for _, r := range results {
+					sh.add(r)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	s.shard().add(result{status: 200, latency: 1500 * time.Microsecond, timings: timings{dns: time.Millisecond}, labels: []string{"tier=gold"}})
+	for _, sh := range s.shards[:4] {
+		s.retire(sh)
+	}
+
+	if len(s.shards) != 5 {
+		t.Error("failed to remove the retired shards", len(s.shards))
+	}
+
+	st := s.get()
+	if st.Requests != 2401 || st.Errors != 800 || st.ServerErrors != 800 || st.CacheHits != 800 {
+		t.Error("invalid counts", st.Requests, st.Errors, st.ServerErrors, st.CacheHits)
+	}
+
+	if st.StatusCodes[200] != 801 || st.StatusClasses["5xx"] != 800 || st.Protocols["HTTP/2.0"] != 800 ||
+		st.RedirectChains[2] != 800 || st.ResponseBytes != 8000 || st.DNS.Max != time.Millisecond {
+		t.Error("invalid groups", st.StatusCodes, st.StatusClasses, st.Protocols, st.RedirectChains)
+	}
+
+	if st.Latency.Min != 0 || st.Latency.Max != 3*time.Millisecond || st.Latency.Mean != 1500*time.Microsecond {
+		t.Error("invalid latency", st.Latency)
+	}
+
+	if r := st.LatencyRegressions["GET /foo"]; r.Requests != 800 || r.Logged != time.Millisecond {
+		t.Error("invalid regressions", st.LatencyRegressions)
+	}
+
+	if l := st.Labels["tier=gold"]; l.Requests != 1601 || l.Errors != 800 || l.StatusCodes[200] != 801 || l.DNS.Max != time.Millisecond {
+		t.Error("invalid label group", l.Requests, l.Errors, l.StatusCodes)
+	}
+}
+
+func BenchmarkStats(b *testing.B) {
+	s := newShardedStats()
+	r := result{status: http.StatusOK, protocol: "HTTP/1.1", latency: 3 * time.Millisecond, size: 1 << 10}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		sh := s.shard()
+		for pb.Next() {
+			sh.add(r)
+		}
+	})
+
+	if st := s.get(); st.Requests != b.N {
+		b.Error("failed to count the requests", st.Requests, b.N)
+	}
+}
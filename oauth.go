@@ -0,0 +1,137 @@
+package logreplay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource provides the bearer tokens sent with the requests. A TokenSource from
+// golang.org/x/oauth2 can be used with a simple adapter, returning the AccessToken of the
+// token.
+type TokenSource interface {
+
+	// Token returns a valid bearer token. It is called for every request, possibly from
+	// multiple goroutines, so it should cache the token until it expires.
+	Token() (string, error)
+}
+
+// ErrTokenRequest is returned when the token endpoint didn't respond with a valid token.
+var ErrTokenRequest = errors.New("token request failed")
+
+// clientCredentials acquires the tokens with the OAuth2 client credentials flow, and
+// caches them until they expire, or the target responds with 401 Unauthorized
+type clientCredentials struct {
+	mx           sync.Mutex
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	httpClient   *http.Client
+	token        string
+	expiry       time.Time
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func newClientCredentials(o Options, tc *transportConfig) *clientCredentials {
+	return &clientCredentials{
+		tokenURL:     o.OAuth2TokenURL,
+		clientID:     o.OAuth2ClientID,
+		clientSecret: o.OAuth2ClientSecret,
+		scopes:       o.OAuth2Scopes,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           tc.proxy,
+				DialContext:     tc.dial,
+				TLSClientConfig: tc.tls.Clone(),
+			},
+			Timeout: o.RequestTimeout,
+		},
+	}
+}
+
+func (cc *clientCredentials) fetch() error {
+	v := url.Values{"grant_type": {"client_credentials"}}
+	if len(cc.scopes) > 0 {
+		v.Set("scope", strings.Join(cc.scopes, " "))
+	}
+
+	req, err := http.NewRequest("POST", cc.tokenURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(cc.clientID), url.QueryEscape(cc.clientSecret))
+	rsp, err := cc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", ErrTokenRequest, rsp.Status)
+	}
+
+	var tr tokenResponse
+	if err := json.NewDecoder(rsp.Body).Decode(&tr); err != nil {
+		return fmt.Errorf("%w: %v", ErrTokenRequest, err)
+	}
+
+	if tr.AccessToken == "" {
+		return fmt.Errorf("%w: missing access token", ErrTokenRequest)
+	}
+
+	cc.token = tr.AccessToken
+	cc.expiry = time.Time{}
+	if tr.ExpiresIn > 0 {
+		cc.expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+
+	return nil
+}
+
+func (cc *clientCredentials) Token() (string, error) {
+	cc.mx.Lock()
+	defer cc.mx.Unlock()
+
+	if cc.token != "" && (cc.expiry.IsZero() || time.Now().Before(cc.expiry)) {
+		return cc.token, nil
+	}
+
+	if err := cc.fetch(); err != nil {
+		return "", err
+	}
+
+	return cc.token, nil
+}
+
+// invalidate drops the cached token when it was rejected by the target
+func (cc *clientCredentials) invalidate(token string) {
+	cc.mx.Lock()
+	defer cc.mx.Unlock()
+	if cc.token == token {
+		cc.token = ""
+	}
+}
+
+// checkToken invalidates the token of the request, when the target rejected it, and the
+// token source supports it
+func (c *client) checkToken(hr *http.Request, status int) {
+	cc, ok := c.shared.tokens.(*clientCredentials)
+	if !ok || status != http.StatusUnauthorized {
+		return
+	}
+
+	cc.invalidate(strings.TrimPrefix(hr.Header.Get("Authorization"), "Bearer "))
+}
@@ -0,0 +1,108 @@
+package logreplay
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+)
+
+// PathRule rewrites the paths of the requests, e.g. to re-roll the IDs of the logged
+// paths, instead of requesting the same resources in every loop.
+type PathRule struct {
+
+	// Pattern is a regular expression matched against the request path, without the
+	// query, e.g. ^/users/\d+.
+	Pattern string
+
+	// Replacement replaces the matches of Pattern. It can reference the submatches as
+	// $1 or ${name}, and it can contain {rand:min..max} placeholders, replaced with a
+	// random integer from the closed range, different for every match, e.g.
+	// /users/{rand:1..100000}. It can be a template, executed with TemplateData.
+	Replacement string
+}
+
+type pathRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+var randomPlaceholder = regexp.MustCompile(`\{rand:(-?\d+)\.\.(-?\d+)\}`)
+
+func compilePathRules(rules []PathRule) ([]pathRule, error) {
+	var c []pathRule
+	for _, r := range rules {
+		rx, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range randomPlaceholder.FindAllStringSubmatch(r.Replacement, -1) {
+			if _, _, ok := parseRandomRange(m); !ok {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidPathRule, m[0])
+			}
+		}
+
+		c = append(c, pathRule{pattern: rx, replacement: r.Replacement})
+	}
+
+	return c, nil
+}
+
+func parseRandomRange(m []string) (int64, int64, bool) {
+	min, errMin := strconv.ParseInt(m[1], 10, 64)
+	max, errMax := strconv.ParseInt(m[2], 10, 64)
+	return min, max, errMin == nil && errMax == nil && max-min+1 > 0
+}
+
+// resolveRandom replaces the random placeholders, with a different value for every
+// placeholder
+func resolveRandom(rnd *rand.Rand, replacement string) string {
+	return randomPlaceholder.ReplaceAllStringFunc(replacement, func(p string) string {
+		min, max, ok := parseRandomRange(randomPlaceholder.FindStringSubmatch(p))
+		if !ok {
+			return p
+		}
+
+		return strconv.FormatInt(min+rnd.Int63n(max-min+1), 10)
+	})
+}
+
+func (r pathRule) apply(rnd *rand.Rand, replacement, path string) string {
+	matches := r.pattern.FindAllStringSubmatchIndex(path, -1)
+	if len(matches) == 0 {
+		return path
+	}
+
+	var (
+		b    []byte
+		last int
+	)
+
+	for _, m := range matches {
+		b = append(b, path[last:m[0]]...)
+		b = r.pattern.ExpandString(b, resolveRandom(rnd, replacement), path, m)
+		last = m[1]
+	}
+
+	return string(append(b, path[last:]...))
+}
+
+// rewritePath applies the path rules in order. The templates in the replacements are
+// executed before the random placeholders are resolved.
+func (c *client) rewritePath(path string, ts *templateScope) (string, error) {
+	for _, r := range c.shared.pathRules {
+		if !r.pattern.MatchString(path) {
+			continue
+		}
+
+		replacement, err := c.expandTemplate(r.replacement, ts)
+		if err != nil {
+			return "", err
+		}
+
+		path = r.apply(c.random, replacement, path)
+	}
+
+	return path, nil
+}
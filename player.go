@@ -1,41 +1,186 @@
 package logreplay
 
-import "time"
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
-type feedRequest struct {
-	position int
-	response requestChannel
+// rate holds the overall request per second limit shared by the sessions. It can be
+// changed while the sessions are running.
+type rate struct {
+	bits uint64
+}
+
+// shared holds the state shared between the player and the sessions.
+type shared struct {
+	rate      *rate
+	sessions  int64
+	sequence  uint64
+	templates *templateCache
+	regexps   *regexpCache
+	corpora   []corpus
+	transport *transportConfig
+	tokens    TokenSource
+	pathRules []pathRule
+	events    *eventChannel
+	payloads  *payloadBlocks
+	resolved  *resolvedCache
+
+	// the canonical names of the headers set in the options, and whether they are free
+	// of templates
+	optionHeaders map[string]bool
+	staticHeaders bool
 }
 
 type player struct {
-	options            Options
-	requestFeed        chan feedRequest
-	results            errorChannel
-	feed               requestChannel
-	position           int
-	client             *client
-	maxRequestDuration time.Duration
-	throttleLag        time.Duration
+	options     Options
+	requestFeed chan *player
+	results     resultChannel
+	quit        signalChannel
+	feed        requestChannel
+	client      *client
+	shared      *shared
+	random      *rand.Rand
+	stats       *statsShard
+	throttleLag time.Duration
+
+	// the requests sent in open loop mode, that the session waits for before exiting,
+	// and their number, accessed atomically:
+	openRequests sync.WaitGroup
+	openCount    int64
+
+	// position, order, orderRandom and deferred are accessed only by the Player, when
+	// feeding the next request:
+	position    int
+	order       []int
+	orderRandom *rand.Rand
+	deferred    []*Request
+}
+
+func newRate(rps float64) *rate {
+	r := &rate{}
+	r.set(rps)
+	return r
+}
+
+func (r *rate) set(rps float64) {
+	if rps < 0 {
+		rps = 0
+	}
+
+	atomic.StoreUint64(&r.bits, math.Float64bits(rps))
+}
+
+func (r *rate) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&r.bits))
 }
 
-func newPlayer(o Options, requestFeed chan feedRequest, results errorChannel) *player {
-	var maxReqDur time.Duration
-	if o.Throttle > 0 {
-		maxReqDur = time.Second / time.Duration(o.Throttle)
+func newShared(o Options, c []corpus, tc *transportConfig) *shared {
+	s := &shared{
+		rate:      newRate(o.Throttle),
+		sessions:  int64(o.ConcurrentSessions),
+		templates: newTemplateCache(o.ExpandEnv),
+		regexps:   newRegexpCache(),
+		corpora:   c,
+		transport: tc,
+		tokens:    o.TokenSource,
+		events:    newEventChannel(o),
+		payloads:  newPayloadBlocks(o.RandomSeed),
+		resolved:  newResolvedCache(),
 	}
 
+	s.optionHeaders, s.staticHeaders = optionHeaders(o.Headers)
+	return s
+}
+
+func (s *shared) setSessions(n int) {
+	atomic.StoreInt64(&s.sessions, int64(n))
+}
+
+func (s *shared) getSessions() int {
+	return int(atomic.LoadInt64(&s.sessions))
+}
+
+// returns the next sequence number, starting from 1
+func (s *shared) next() uint64 {
+	return atomic.AddUint64(&s.sequence, 1)
+}
+
+func newPlayer(
+	o Options,
+	s *shared,
+	seed int64,
+	requestFeed chan *player,
+	results resultChannel,
+	quit signalChannel,
+	st *statsShard,
+) *player {
+	rnd := newRandom(seed)
 	return &player{
-		options:            o,
-		requestFeed:        requestFeed,
-		results:            results,
-		feed:               make(requestChannel),
-		client:             newClient(o),
-		maxRequestDuration: maxReqDur,
+		options:     o,
+		requestFeed: requestFeed,
+		results:     results,
+		quit:        quit,
+		feed:        make(requestChannel),
+		client:      newClient(o, s, rnd),
+		shared:      s,
+		random:      rnd,
+		stats:       st,
+	}
+}
+
+// report counts the result in the statistics shard of the session, before passing it
+// to the player. The requests in flight when the player stops are only counted.
+func (p *player) report(r result) {
+	p.stats.add(r)
+	select {
+	case p.results <- r:
+	case <-p.quit:
 	}
 }
 
-func (p *player) throttle(f func() error) error {
-	if p.maxRequestDuration <= 0 {
+// the overall rate is distributed evenly between the sessions
+func (p *player) maxRequestDuration() time.Duration {
+	rps := p.shared.rate.get() / float64(p.shared.getSessions())
+	if rps <= 0 {
+		return 0
+	}
+
+	return time.Duration(float64(time.Second) / rps)
+}
+
+// in open loop mode, the time between the requests is exponentially distributed
+func (p *player) arrivalGap() time.Duration {
+	rps := p.shared.rate.get() / float64(p.shared.getSessions())
+	if rps <= 0 {
+		return 0
+	}
+
+	return time.Duration(p.random.ExpFloat64() / rps * float64(time.Second))
+}
+
+func (p *player) delay(r *Request) {
+	var d time.Duration
+	if r.Delay > 0 {
+		d = time.Duration(deviateMin(p.random, int(r.Delay), r.DelayDeviation))
+	}
+
+	if p.options.Jitter > 0 {
+		d += time.Duration(p.random.Int63n(int64(p.options.Jitter)))
+	}
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (p *player) throttle(f func() result) result {
+	maxRequestDuration := p.maxRequestDuration()
+	if maxRequestDuration <= 0 {
+		p.throttleLag = 0
 		return f()
 	}
 
@@ -43,7 +188,7 @@ func (p *player) throttle(f func() error) error {
 	err := f()
 	duration := time.Now().Sub(start)
 
-	throttle := p.maxRequestDuration - duration
+	throttle := maxRequestDuration - duration
 	negativeLag := p.throttleLag < 0
 	p.throttleLag += throttle
 	if negativeLag && throttle < 0 {
@@ -58,28 +203,72 @@ func (p *player) throttle(f func() error) error {
 	return err
 }
 
+// wait receives the next request, when the session was parked by the player with a nil
+// request, because of the host limit
+func (p *player) wait(r *Request, open bool) (*Request, bool) {
+	if r != nil || !open {
+		return r, open
+	}
+
+	r, open = <-p.feed
+	return r, open
+}
+
 func (p *player) run() {
 	for {
 		select {
-		case p.requestFeed <- feedRequest{
-			position: p.position,
-			response: p.feed,
-		}:
+		case p.requestFeed <- p:
+		case r, open := <-p.feed:
+			if r, open = p.wait(r, open); !open {
+				return
+			}
+
+			p.delay(r)
+			p.report(p.throttle(func() result {
+				return p.client.do(r)
+			}))
+		}
+	}
+}
+
+func (p *player) runOpenLoop() {
+	defer p.openRequests.Wait()
+	max := int64(p.options.MaxOpenRequests)
+	if max <= 0 {
+		max = DefaultMaxOpenRequests
+	}
+
+	for {
+		select {
+		case p.requestFeed <- p:
 		case r, open := <-p.feed:
-			if !open {
+			if r, open = p.wait(r, open); !open {
 				return
 			}
 
-			if r == nil {
-				p.position = 0
+			// the arrivals over the limit are dropped, but they keep the rate:
+			if atomic.LoadInt64(&p.openCount) >= max {
+				p.report(result{dropped: true, host: r.Host})
+				time.Sleep(p.arrivalGap())
 				continue
 			}
 
-			p.position++
+			o, err := p.client.prepare(r)
+			if err != nil {
+				p.report(result{err: err, host: r.Host, labels: p.client.labels(r)})
+				continue
+			}
 
-			p.results <- p.throttle(func() error {
-				return p.client.do(r)
-			})
+			p.openRequests.Add(1)
+			atomic.AddInt64(&p.openCount, 1)
+			go func() {
+				defer p.openRequests.Done()
+				r := p.client.send(o)
+				atomic.AddInt64(&p.openCount, -1)
+				p.report(r)
+			}()
+
+			time.Sleep(p.arrivalGap())
 		}
 	}
 }
@@ -0,0 +1,127 @@
+package logreplay
+
+import "time"
+
+// DefaultProgressInterval is the interval of the progress reports when not specified
+// otherwise.
+const DefaultProgressInterval = time.Second
+
+// Progress is reported periodically to Options.OnProgress while the player is playing
+// requests.
+type Progress struct {
+
+	// Requests is the number of the completed requests since the player was created.
+	Requests int
+
+	// Errors is the number of the failed requests since the player was created.
+	Errors int
+
+	// ServerErrors is the number of the 5xx responses since the player was created.
+	ServerErrors int
+
+	// InFlight is the number of the requests passed to the sessions, whose results
+	// were not yet received.
+	InFlight int
+
+	// StatusCodes contains the number of the responses by status code since the player
+	// was created.
+	StatusCodes map[int]int
+
+	// StatusClasses contains the number of the responses by status class, e.g. 2xx,
+	// since the player was created.
+	StatusClasses map[string]int
+
+	// Percent is the completed part of the replay started by Once(), between 0 and
+	// 100. It is negative, when the total number of requests is not known, e.g. when
+	// the replay was started by Play(), or when the access log was not yet read to the
+	// end.
+	Percent float64
+
+	// RPS is the rate of the completed requests since the previous report.
+	RPS float64
+
+	// Latency is the mean response time of the responses received since the previous
+	// report.
+	Latency time.Duration
+}
+
+// intervalLatency returns the mean response time between two snapshots of the
+// statistics
+func intervalLatency(from, to Stats) time.Duration {
+	n0, n1 := from.Requests-from.Errors, to.Requests-to.Errors
+	if n1 <= n0 {
+		return 0
+	}
+
+	sum := int64(to.Latency.Mean)*int64(n1) - int64(from.Latency.Mean)*int64(n0)
+	if sum < 0 {
+		return 0
+	}
+
+	return time.Duration(sum / int64(n1-n0))
+}
+
+// progress tracks the state of the progress reports. It is used only from the
+// goroutine of the Player.
+type progress struct {
+	interval  time.Duration
+	lastTime  time.Time
+	lastStats Stats
+}
+
+func newProgress(o Options) *progress {
+	if o.OnProgress == nil {
+		return nil
+	}
+
+	interval := o.ProgressInterval
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+
+	return &progress{interval: interval}
+}
+
+func (p *Player) percent() float64 {
+	if !p.once || p.accessLog != nil {
+		return -1
+	}
+
+	total := p.logEntries.count() + len(p.customRequests)
+	if !p.options.PreserveSessions {
+		total *= p.started
+	}
+
+	if total == 0 {
+		return 100
+	}
+
+	return 100 * float64(p.fed) / float64(total)
+}
+
+func (p *Player) reportProgress() {
+	if p.progress == nil {
+		return
+	}
+
+	now := time.Now()
+	s := p.stats.get()
+	pr := Progress{
+		Requests:      s.Requests,
+		Errors:        s.Errors,
+		ServerErrors:  s.ServerErrors,
+		InFlight:      p.inFlight,
+		StatusCodes:   s.StatusCodes,
+		StatusClasses: s.StatusClasses,
+		Percent:       p.percent(),
+		Latency:       intervalLatency(p.progress.lastStats, s),
+	}
+
+	if elapsed := now.Sub(p.progress.lastTime); !p.progress.lastTime.IsZero() && elapsed > 0 {
+		pr.RPS = float64(s.Requests-p.progress.lastStats.Requests) / elapsed.Seconds()
+	}
+
+	p.progress.lastTime = now
+	p.progress.lastStats = s
+	p.options.OnProgress(pr)
+}
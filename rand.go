@@ -1,33 +1,90 @@
 package logreplay
 
 import (
-	"io"
+	"bytes"
+	"errors"
 	"math/rand"
+	"strings"
+	"sync"
+	"time"
 )
 
-const chars = "      abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+// Payload defines the kind of the randomly generated request payloads.
+type Payload int
 
-type randomReader struct{}
+const (
+
+	// TextPayload tells the player to generate random payloads from lowercase and
+	// uppercase letters and spaces.
+	TextPayload Payload = iota
+
+	// JSONPayload tells the player to generate random payloads from printable
+	// characters typical in JSON documents.
+	JSONPayload
+
+	// BinaryPayload tells the player to generate random payloads from the full byte
+	// range.
+	BinaryPayload
+
+	// SamplePayload tells the player to generate random payloads from the bytes of a
+	// user provided sample, following the byte distribution of the sample.
+	SamplePayload
+)
+
+const (
+
+	// the payload buffers bigger than this are not returned to the pool, to avoid
+	// holding on to the memory of occasional large bodies
+	maxPooledPayload = 1 << 20
+
+	// the random payloads are assembled from chunks of a pre-generated block, starting
+	// at random offsets
+	payloadBlockSize = 1 << 18
+	payloadChunkSize = 1 << 9
+)
+
+const (
+	chars     = "      abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	jsonChars = chars + `0123456789{}[]{}[]"""":::,,,.-_`
+)
+
+// when the alphabet is empty, the full byte range is used
+type randomReader struct {
+	random   *rand.Rand
+	alphabet string
+}
 
 func (r randomReader) Read(p []byte) (int, error) {
 	for i := 0; i < len(p); i++ {
-		p[i] = randomByte()
+		p[i] = r.randomByte()
 	}
 
 	return len(p), nil
 }
 
-func randomByte() byte {
-	return chars[rand.Intn(len(chars))]
+func (r randomReader) randomByte() byte {
+	if len(r.alphabet) == 0 {
+		return byte(r.random.Intn(256))
+	}
+
+	return r.alphabet[r.random.Intn(len(r.alphabet))]
 }
 
-func deviate(i int, d float64) int {
+func newRandom(seed int64) *rand.Rand {
+	return rand.New(rand.NewSource(seed))
+}
+
+func deviate(rnd *rand.Rand, i int, d float64) int {
 	di := int(float64(i) * d)
-	return i + rand.Intn(2*di) - di
+	if di <= 0 {
+		return i
+	}
+
+	return i + rnd.Intn(2*di) - di
 }
 
-func deviateMin(i int, d float64) int {
-	i = deviate(i, d)
+func deviateMin(rnd *rand.Rand, i int, d float64) int {
+	i = deviate(rnd, i, d)
 	if i < 0 {
 		i = 0
 	}
@@ -35,6 +92,133 @@ func deviateMin(i int, d float64) int {
 	return i
 }
 
-func randomText(n int) io.Reader {
-	return io.LimitReader(randomReader{}, int64(n))
+func randomBytes(rnd *rand.Rand, alphabet string, n int) []byte {
+	b := make([]byte, n)
+	randomReader{random: rnd, alphabet: alphabet}.Read(b)
+	return b
+}
+
+func randomText(rnd *rand.Rand, n int) string {
+	var b strings.Builder
+	b.Grow(n)
+	r := randomReader{random: rnd, alphabet: chars}
+	for i := 0; i < n; i++ {
+		b.WriteByte(r.randomByte())
+	}
+
+	return b.String()
+}
+
+// payloadBlocks holds the pre-generated random blocks of the payloads, one for every
+// kind of payload. Generating the bytes one by one would make the large payloads dominate
+// the CPU usage. The blocks are generated from the random seed of the player, so with a
+// fixed seed, the payloads repeat between the runs.
+type payloadBlocks struct {
+	mx     sync.Mutex
+	seed   int64
+	blocks map[Payload][]byte
+}
+
+func newPayloadBlocks(seed int64) *payloadBlocks {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	return &payloadBlocks{seed: seed, blocks: make(map[Payload][]byte)}
+}
+
+// get returns the block of a payload kind, generating it on the first use. The sample
+// is the same for every call of a player. The returned blocks are not modified.
+func (pb *payloadBlocks) get(p Payload, sample []byte) []byte {
+	pb.mx.Lock()
+	defer pb.mx.Unlock()
+	b, ok := pb.blocks[p]
+	if !ok {
+		b = randomBytes(newRandom(pb.seed), payloadAlphabet(p, sample), payloadBlockSize)
+		pb.blocks[p] = b
+	}
+
+	return b
+}
+
+// fill copies random chunks of the block of the payload kind into b
+func (pb *payloadBlocks) fill(rnd *rand.Rand, p Payload, sample []byte, b []byte) {
+	block := pb.get(p, sample)
+	for len(b) > 0 {
+		offset := rnd.Intn(len(block) - payloadChunkSize)
+		b = b[copy(b, block[offset:offset+payloadChunkSize]):]
+	}
+}
+
+var (
+	payloadBuffers   sync.Pool
+	errPayloadClosed = errors.New("payload closed")
+)
+
+// payloadBody is a request body with a pooled buffer. The buffer is returned to the pool
+// when the body is closed. The transport may close the body on a different goroutine than
+// where it is read, this is why the reads and the close are synchronized.
+type payloadBody struct {
+	mx     sync.Mutex
+	buffer *[]byte
+	reader bytes.Reader
+	closed bool
+}
+
+// the payload is generated in advance, because the body of the requests may be read
+// from a different goroutine
+func newPayloadBody(rnd *rand.Rand, blocks *payloadBlocks, p Payload, sample []byte, n int) *payloadBody {
+	b, _ := payloadBuffers.Get().(*[]byte)
+	if b == nil || cap(*b) < n {
+		bb := make([]byte, n)
+		b = &bb
+	}
+
+	*b = (*b)[:n]
+	blocks.fill(rnd, p, sample, *b)
+	pb := &payloadBody{buffer: b}
+	pb.reader.Reset(*b)
+	return pb
+}
+
+func (pb *payloadBody) Read(p []byte) (int, error) {
+	pb.mx.Lock()
+	defer pb.mx.Unlock()
+	if pb.closed {
+		return 0, errPayloadClosed
+	}
+
+	return pb.reader.Read(p)
+}
+
+func (pb *payloadBody) Close() error {
+	pb.mx.Lock()
+	defer pb.mx.Unlock()
+	if pb.closed {
+		return nil
+	}
+
+	pb.closed = true
+	pb.reader.Reset(nil)
+	if cap(*pb.buffer) <= maxPooledPayload {
+		payloadBuffers.Put(pb.buffer)
+	}
+
+	pb.buffer = nil
+	return nil
+}
+
+func payloadAlphabet(p Payload, sample []byte) string {
+	var alphabet string
+	switch p {
+	case JSONPayload:
+		alphabet = jsonChars
+	case BinaryPayload:
+	case SamplePayload:
+		alphabet = string(sample)
+	default:
+		alphabet = chars
+	}
+
+	return alphabet
 }
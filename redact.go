@@ -0,0 +1,95 @@
+package logreplay
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// the replacement of the redacted values in the logs
+const redacted = "[redacted]"
+
+// the maximum number of the request body bytes logged
+const maxLoggedBody = 1 << 12
+
+// DefaultRedactHeaders contains the headers whose values are redacted in the request
+// logs, when RedactHeaders is not set.
+var DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+func (c *client) redactHeader(h http.Header) http.Header {
+	names := c.options.RedactHeaders
+	if names == nil {
+		names = DefaultRedactHeaders
+	}
+
+	rh := h.Clone()
+	for _, n := range names {
+		if _, ok := rh[http.CanonicalHeaderKey(n)]; ok {
+			rh.Set(n, redacted)
+		}
+	}
+
+	return rh
+}
+
+// loggedBody returns the beginning of the request body, when it can be read without
+// consuming the body of the request
+func (c *client) loggedBody(hr *http.Request) string {
+	if hr.GetBody == nil {
+		return ""
+	}
+
+	b, err := hr.GetBody()
+	if err != nil {
+		return ""
+	}
+
+	defer b.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(b, maxLoggedBody))
+	if err != nil {
+		return ""
+	}
+
+	for _, expr := range c.options.RedactBodyPatterns {
+		rx, err := c.shared.regexps.get(expr)
+		if err != nil {
+			continue
+		}
+
+		body = rx.ReplaceAll(body, []byte(redacted))
+	}
+
+	return string(body)
+}
+
+// logRequestDetails logs the headers and the body of the request on the debug level,
+// with the sensitive values redacted
+func (c *client) logRequestDetails(hr *http.Request) {
+	if !c.options.LogRequestDetails {
+		return
+	}
+
+	header, body := c.redactHeader(hr.Header), c.loggedBody(hr)
+	if fl, ok := c.options.Log.(FieldLogger); ok {
+		fl.WithFields(map[string]interface{}{
+			"method":  hr.Method,
+			"url":     hr.URL.String(),
+			"headers": header,
+			"body":    body,
+		}).Debugln("request details")
+		return
+	}
+
+	c.options.Log.Debugln("request details:", hr.Method, hr.URL.String(), header, body)
+}
+
+// validateRedactPatterns compiles, and this way caches, the body redaction patterns
+func validateRedactPatterns(rc *regexpCache, patterns []string) error {
+	for _, expr := range patterns {
+		if _, err := rc.get(expr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
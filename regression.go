@@ -0,0 +1,95 @@
+package logreplay
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// regression returns the endpoint of the request, in the form of METHOD /path, when the
+// response was slower than the logged duration multiplied by LatencyRegressionFactor.
+// The requests without a logged duration, and the failed requests are not checked.
+func (c *client) regression(o *outgoing, rsp response) string {
+	logged := o.request.LoggedDuration
+	if c.options.LatencyRegressionFactor <= 0 || logged <= 0 || rsp.status == 0 {
+		return ""
+	}
+
+	if float64(rsp.latency) <= float64(logged)*c.options.LatencyRegressionFactor {
+		return ""
+	}
+
+	path, _ := splitPath(o.request.Path)
+	endpoint := o.httpRequest.Method + " " + path
+	c.options.Log.Debugln("latency regression:", endpoint, logged, rsp.latency)
+	return endpoint
+}
+
+// regressionCounter sums the durations of the regressed requests of an endpoint
+type regressionCounter struct {
+	requests int
+	logged   time.Duration
+	replayed time.Duration
+}
+
+func (rc *regressionCounter) add(logged, replayed time.Duration) {
+	rc.requests++
+	rc.logged += logged
+	rc.replayed += replayed
+}
+
+// atomicRegressionCounter is a regressionCounter that can be updated concurrently
+// without locking
+type atomicRegressionCounter struct {
+	requests int64
+	logged   int64
+	replayed int64
+}
+
+func (rc *atomicRegressionCounter) add(logged, replayed time.Duration) {
+	atomic.AddInt64(&rc.requests, 1)
+	atomic.AddInt64(&rc.logged, int64(logged))
+	atomic.AddInt64(&rc.replayed, int64(replayed))
+}
+
+func (rc *atomicRegressionCounter) load() regressionCounter {
+	return regressionCounter{
+		requests: int(atomic.LoadInt64(&rc.requests)),
+		logged:   time.Duration(atomic.LoadInt64(&rc.logged)),
+		replayed: time.Duration(atomic.LoadInt64(&rc.replayed)),
+	}
+}
+
+func (rc *regressionCounter) merge(from *regressionCounter) {
+	rc.requests += from.requests
+	rc.logged += from.logged
+	rc.replayed += from.replayed
+}
+
+func (rc *regressionCounter) regression() LatencyRegression {
+	if rc.requests == 0 {
+		return LatencyRegression{}
+	}
+
+	return LatencyRegression{
+		Requests: rc.requests,
+		Logged:   rc.logged / time.Duration(rc.requests),
+		Replayed: rc.replayed / time.Duration(rc.requests),
+	}
+}
+
+// mergeRegressions combines the latency regressions, weighting the means by the number of
+// the requests
+func mergeRegressions(m map[string]LatencyRegression, from map[string]LatencyRegression) {
+	for endpoint, r := range from {
+		rc := regressionCounter{requests: m[endpoint].Requests}
+		rc.logged = m[endpoint].Logged * time.Duration(rc.requests)
+		rc.replayed = m[endpoint].Replayed * time.Duration(rc.requests)
+		rc.merge(&regressionCounter{
+			requests: r.Requests,
+			logged:   r.Logged * time.Duration(r.Requests),
+			replayed: r.Replayed * time.Duration(r.Requests),
+		})
+
+		m[endpoint] = rc.regression()
+	}
+}
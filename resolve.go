@@ -0,0 +1,196 @@
+package logreplay
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// the entries are not cached above this number, to limit the memory used by the cache
+const maxResolvedEntries = 1 << 16
+
+// resolvedKey identifies the entries by the fields that the resolution depends on. The
+// entries are identified by their content rather than their instance, because the
+// requests are copied when fed to the sessions, and because the entries spilled to disk
+// are decoded on every read.
+type resolvedKey struct {
+	path          string
+	userAgent     string
+	host          string
+	remoteAddress string
+}
+
+// resolvedEntry holds the parts of a request that don't change between the loops: the
+// path after the path rules, the query before the fuzzing and the cache busting, and the
+// headers prepared from the entry and the options
+type resolvedEntry struct {
+	path   string
+	query  string
+	header http.Header
+	host   string
+}
+
+// resolvedCache stores the resolved entries, shared between the sessions, because looped
+// play replays the same entries repeatedly
+type resolvedCache struct {
+	mx      sync.RWMutex
+	entries map[resolvedKey]*resolvedEntry
+}
+
+func newResolvedCache() *resolvedCache {
+	return &resolvedCache{entries: make(map[resolvedKey]*resolvedEntry)}
+}
+
+func keyOf(r *Request) resolvedKey {
+	return resolvedKey{
+		path:          r.Path,
+		userAgent:     r.UserAgent,
+		host:          r.Host,
+		remoteAddress: r.RemoteAddress,
+	}
+}
+
+func (rc *resolvedCache) get(r *Request) (*resolvedEntry, bool) {
+	rc.mx.RLock()
+	defer rc.mx.RUnlock()
+	e, ok := rc.entries[keyOf(r)]
+	return e, ok
+}
+
+func (rc *resolvedCache) set(r *Request, e *resolvedEntry) {
+	rc.mx.Lock()
+	defer rc.mx.Unlock()
+	if len(rc.entries) < maxResolvedEntries {
+		rc.entries[keyOf(r)] = e
+	}
+}
+
+// optionHeaders returns the canonical names of the headers set in the options, and
+// whether their values are free of templates
+func optionHeaders(h map[string][]string) (map[string]bool, bool) {
+	names := make(map[string]bool)
+	static := true
+	for name, values := range h {
+		names[http.CanonicalHeaderKey(name)] = true
+		for _, v := range values {
+			if hasTemplate(v) {
+				static = false
+			}
+		}
+	}
+
+	return names, static
+}
+
+// resolve resolves the path, the query and the headers of a request. When the path
+// contains no template, none of the path rules match it, and the headers in the options
+// contain no templates either, a copy of the result is stored for the next loops.
+func (c *client) resolve(r *Request, ts *templateScope) (*resolvedEntry, error) {
+	p, err := c.expandTemplate(r.Path, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &resolvedEntry{}
+	path, query := splitPath(p)
+	static := !hasTemplate(r.Path) && !c.matchPathRules(path) && c.shared.staticHeaders
+	if e.path, err = c.rewritePath(path, ts); err != nil {
+		return nil, err
+	}
+
+	e.query = query
+	if e.header, e.host, err = c.requestHeader(r, ts); err != nil {
+		return nil, err
+	}
+
+	if static {
+		c.shared.resolved.set(r, &resolvedEntry{
+			path:   e.path,
+			query:  e.query,
+			header: e.header.Clone(),
+			host:   e.host,
+		})
+	}
+
+	return e, nil
+}
+
+func (c *client) matchPathRules(path string) bool {
+	for _, r := range c.shared.pathRules {
+		if r.pattern.MatchString(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestHeader creates the headers of a request from the entry and from the options.
+// The headers set in the options override the ones taken from the entry.
+func (c *client) requestHeader(r *Request, ts *templateScope) (http.Header, string, error) {
+	h := make(http.Header)
+	host := r.Host
+	if r.UserAgent != "" {
+		h.Set("User-Agent", r.UserAgent)
+	}
+
+	if c.options.AcceptEncoding != "" {
+		h.Set("Accept-Encoding", c.options.AcceptEncoding)
+	}
+
+	if c.options.ForwardRemoteAddress && r.RemoteAddress != "" {
+		name := c.options.RemoteAddressHeader
+		if name == "" {
+			name = DefaultRemoteAddressHeader
+		}
+
+		h.Set(name, r.RemoteAddress)
+	}
+
+	for name, values := range c.options.Headers {
+		if http.CanonicalHeaderKey(name) == "Host" {
+			if len(values) > 0 {
+				host = values[0]
+			}
+
+			continue
+		}
+
+		h.Del(name)
+		for _, v := range values {
+			ev, err := c.expandTemplate(v, ts)
+			if err != nil {
+				return nil, "", err
+			}
+
+			h.Add(name, ev)
+		}
+	}
+
+	return h, host, nil
+}
+
+// setHeader sets a header of the request, unless the options override it
+func (c *client) setHeader(hr *http.Request, name, value string) {
+	if value == "" || c.shared.optionHeaders[name] {
+		return
+	}
+
+	hr.Header.Set(name, value)
+}
+
+// newRequest creates a request from an already parsed URL, avoiding to format and parse
+// it again
+func newRequest(method string, u *url.URL, body io.Reader) (*http.Request, error) {
+	hr, err := http.NewRequest(method, "", body)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Host = strings.TrimSuffix(u.Host, ":")
+	hr.URL = u
+	hr.Host = u.Host
+	return hr, nil
+}
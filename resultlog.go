@@ -0,0 +1,111 @@
+package logreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ResultLogFormat defines the format of the lines written to the ResultLog.
+type ResultLogFormat int
+
+const (
+
+	// CombinedResultLog writes the results in the Combined Log Format, extended with the
+	// duration in milliseconds and the host, that can be read by the default parser,
+	// e.g. to replay the results again.
+	CombinedResultLog ResultLogFormat = iota
+
+	// JSONResultLog writes the results as JSON objects, one per line.
+	JSONResultLog
+)
+
+// resultEntry contains the details of a replayed request written to the result log
+type resultEntry struct {
+	Time          time.Time `json:"time"`
+	RemoteAddress string    `json:"remoteAddress,omitempty"`
+	Method        string    `json:"method"`
+	URI           string    `json:"uri"`
+	Protocol      string    `json:"protocol,omitempty"`
+	Status        int       `json:"status"`
+	Size          int64     `json:"size"`
+	UserAgent     string    `json:"userAgent,omitempty"`
+	Duration      float64   `json:"durationMs"`
+	Host          string    `json:"host"`
+	Error         string    `json:"error,omitempty"`
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+func (e *resultEntry) combined() []byte {
+	protocol := e.Protocol
+	if protocol == "" {
+		protocol = "HTTP/1.1"
+	}
+
+	return []byte(fmt.Sprintf(
+		"%s - - [%s] \"%s %s %s\" %d %d \"-\" \"%s\" %d %s\n",
+		dashIfEmpty(e.RemoteAddress),
+		e.Time.Format(DefaultTimeFormat),
+		e.Method,
+		e.URI,
+		protocol,
+		e.Status,
+		e.Size,
+		dashIfEmpty(strings.ReplaceAll(e.UserAgent, "\"", "'")),
+		int64(e.Duration),
+		e.Host,
+	))
+}
+
+// resultEntry returns the entry of the result log, when it is enabled
+func (c *client) resultEntry(o *outgoing, start time.Time, r result) *resultEntry {
+	if c.options.ResultLog == nil {
+		return nil
+	}
+
+	e := &resultEntry{
+		Time:          start,
+		RemoteAddress: o.request.RemoteAddress,
+		Method:        o.httpRequest.Method,
+		URI:           o.httpRequest.URL.RequestURI(),
+		Protocol:      r.protocol,
+		Status:        r.status,
+		Size:          r.size,
+		UserAgent:     o.httpRequest.Header.Get("User-Agent"),
+		Duration:      float64(r.latency) / float64(time.Millisecond),
+		Host:          o.httpRequest.Host,
+	}
+
+	if r.err != nil && r.status == 0 {
+		e.Error = r.err.Error()
+	}
+
+	return e
+}
+
+func (p *Player) writeResult(e *resultEntry) {
+	var b []byte
+	if p.options.ResultLogFormat == JSONResultLog {
+		var err error
+		if b, err = json.Marshal(e); err != nil {
+			p.options.Log.Errorln("failed to encode result", err)
+			return
+		}
+
+		b = append(b, '\n')
+	} else {
+		b = e.combined()
+	}
+
+	if _, err := p.options.ResultLog.Write(b); err != nil {
+		p.options.Log.Errorln("failed to write result", err)
+	}
+}
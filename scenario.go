@@ -0,0 +1,127 @@
+package logreplay
+
+// Source provides the requests of a part of a composed scenario. The sources can be
+// combined with Concat(), Interleave() and Repeat(), and the resulting requests can be
+// passed to the player as Options.Requests, using Compose().
+type Source func() ([]*Request, error)
+
+// LogSource reads the requests from the access log set in the options, like
+// ReadRequests(). The requests read this way are replayed like the entries of
+// Options.AccessLog, e.g. ThinkTime and BodyFiles are applied to them.
+func LogSource(o Options) Source {
+	return func() ([]*Request, error) {
+		r, err := ReadRequests(o)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ri := range r {
+			ri.logEntry = true
+		}
+
+		return r, nil
+	}
+}
+
+// RequestSource provides the requests as they are.
+func RequestSource(r ...*Request) Source {
+	return func() ([]*Request, error) {
+		return r, nil
+	}
+}
+
+// GeneratedSource provides n requests created by a factory function, that receives the
+// index of the request. When the factory returns nil, the request is skipped.
+func GeneratedSource(n int, f func(i int) *Request) Source {
+	return func() ([]*Request, error) {
+		var r []*Request
+		for i := 0; i < n; i++ {
+			if ri := f(i); ri != nil {
+				r = append(r, ri)
+			}
+		}
+
+		return r, nil
+	}
+}
+
+// Repeat provides the requests of a source n times after each other. The source is read
+// only once, and the repeated requests are copies of the original ones.
+func Repeat(s Source, n int) Source {
+	return func() ([]*Request, error) {
+		r, err := s()
+		if err != nil {
+			return nil, err
+		}
+
+		var rr []*Request
+		for i := 0; i < n; i++ {
+			for _, ri := range r {
+				rc := *ri
+				rr = append(rr, &rc)
+			}
+		}
+
+		return rr, nil
+	}
+}
+
+// Concat provides the requests of the sources after each other.
+func Concat(s ...Source) Source {
+	return func() ([]*Request, error) {
+		var r []*Request
+		for _, si := range s {
+			ri, err := si()
+			if err != nil {
+				return nil, err
+			}
+
+			r = append(r, ri...)
+		}
+
+		return r, nil
+	}
+}
+
+// Interleave merges the sources by taking the next request from each of them in turn.
+// When a source runs out of requests, the rest are continued.
+func Interleave(s ...Source) Source {
+	return func() ([]*Request, error) {
+		var (
+			parts [][]*Request
+			total int
+		)
+
+		for _, si := range s {
+			ri, err := si()
+			if err != nil {
+				return nil, err
+			}
+
+			parts = append(parts, ri)
+			total += len(ri)
+		}
+
+		r := make([]*Request, 0, total)
+		for i := 0; len(r) < total; i++ {
+			for _, p := range parts {
+				if i < len(p) {
+					r = append(r, p[i])
+				}
+			}
+		}
+
+		return r, nil
+	}
+}
+
+// Compose reads the sources, and returns their requests after each other, to be used as
+// Options.Requests, e.g.:
+//
+//	o.Requests, err = Compose(
+//		Repeat(LogSource(Options{AccessLog: f}), 3),
+//		Interleave(RequestSource(login), GeneratedSource(100, search)),
+//	)
+func Compose(s ...Source) ([]*Request, error) {
+	return Concat(s...)()
+}
@@ -0,0 +1,120 @@
+package logreplay
+
+import (
+	"net/http"
+	"regexp"
+)
+
+func sessionKey(r *Request) string {
+	if r.Session != "" {
+		return r.Session
+	}
+
+	return r.RemoteAddress
+}
+
+// indexSessions numbers the user sessions in the order of their first request, and
+// stores the number of the session for every request
+func (p *Player) indexSessions() {
+	sessions := make(map[string]int)
+	p.sessionIndexes = make([]int, p.logEntries.count()+len(p.customRequests))
+	p.eachRequest(func(i int, r *Request) {
+		key := sessionKey(r)
+		index, ok := sessions[key]
+		if !ok {
+			index = len(sessions)
+			sessions[key] = index
+		}
+
+		p.sessionIndexes[i] = index
+	})
+}
+
+// sessionOrder returns the positions of the requests that belong to the user sessions
+// assigned to a player session. The user sessions are assigned in turns, based on the
+// current position of the player session among the running ones.
+func (p *Player) sessionOrder(s *player) []int {
+	if p.sessionIndexes == nil {
+		p.indexSessions()
+	}
+
+	slot := 0
+	for i, si := range p.players {
+		if si == s {
+			slot = i
+			break
+		}
+	}
+
+	var order []int
+	for position, session := range p.sessionIndexes {
+		if session%len(p.players) == slot {
+			order = append(order, position)
+		}
+	}
+
+	return order
+}
+
+// sessionExtractor sets the session of the requests read from the access log
+type sessionExtractor struct {
+	pattern *regexp.Regexp
+	field   string
+	cookie  string
+}
+
+func newSessionExtractor(o Options) (*sessionExtractor, error) {
+	if o.SessionPattern == "" && o.SessionField == "" && o.SessionCookie == "" {
+		return nil, nil
+	}
+
+	se := &sessionExtractor{field: o.SessionField, cookie: o.SessionCookie}
+	if o.SessionPattern != "" {
+		var err error
+		if se.pattern, err = regexp.Compile(o.SessionPattern); err != nil {
+			return nil, err
+		}
+	}
+
+	if se.cookie != "" && se.field == "" {
+		se.field = "cookie"
+	}
+
+	return se, nil
+}
+
+func (se *sessionExtractor) extract(line string, r *Request) string {
+	if se == nil {
+		return ""
+	}
+
+	if se.pattern != nil {
+		m := se.pattern.FindStringSubmatch(line)
+		switch len(m) {
+		case 0:
+			return ""
+		case 1:
+			return m[0]
+		default:
+			return m[1]
+		}
+	}
+
+	v := r.Fields[se.field]
+	if se.cookie == "" || v == "" {
+		return v
+	}
+
+	cookies, err := http.ParseCookie(v)
+	if err != nil {
+		return ""
+	}
+
+	for _, c := range cookies {
+		if c.Name == se.cookie {
+			return c.Value
+		}
+	}
+
+	return ""
+}
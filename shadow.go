@@ -0,0 +1,178 @@
+package logreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Difference describes a mismatch between the responses of the primary and the shadow
+// server, to the same request.
+type Difference struct {
+
+	// Method and Path identify the request.
+	Method string `json:"method"`
+	Path   string `json:"path"`
+
+	// RequestID is the ID sent with the request, when RequestIDHeader is set.
+	RequestID string `json:"requestId,omitempty"`
+
+	// Status and ShadowStatus are the status codes of the responses. A status code of 0
+	// means that the request failed without a response.
+	Status       int `json:"status"`
+	ShadowStatus int `json:"shadowStatus"`
+
+	// Headers contains the names of the compared headers whose values didn't match.
+	Headers []string `json:"headers,omitempty"`
+
+	// BodyHash and ShadowBodyHash are the SHA-256 hashes of the response bodies, set
+	// only when the bodies are compared and they didn't match.
+	BodyHash       string `json:"bodyHash,omitempty"`
+	ShadowBodyHash string `json:"shadowBodyHash,omitempty"`
+}
+
+// response holds the parts of a response that are used by the statistics and the
+// comparison
+type response struct {
+	status   int
+	protocol string
+	header   http.Header
+	bodyHash string
+	latency  time.Duration
+	body     []byte
+
+	// the size of the body as received, and after decompression
+	size             int64
+	uncompressedSize int64
+	truncated        bool
+
+	newConns    int
+	reusedConns int
+	timings     timings
+	redirects   int
+}
+
+// shadowRequest buffers the body of the request, and creates a copy of it for the shadow
+// server
+func (c *client) shadowRequest(hr *http.Request) (*http.Request, error) {
+	u, err := c.serverURL(c.options.Shadow)
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	if hr.Body != nil {
+		body, err = ioutil.ReadAll(hr.Body)
+		hr.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		hr.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	sr := hr.Clone(hr.Context())
+	sr.URL.Scheme = u.Scheme
+	sr.URL.Host = u.Host
+	if hr.Body != nil {
+		sr.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	return sr, nil
+}
+
+// sendShadow sends the request to the primary and the shadow server concurrently. The
+// result is based on the response from the primary server.
+func (c *client) sendShadow(o *outgoing) result {
+	hr := o.httpRequest
+	sr, err := c.shadowRequest(hr)
+	if err != nil {
+		c.options.Log.Errorln("failed to create shadow request", err)
+		return result{err: err, host: o.request.Host}
+	}
+
+	var (
+		shadowRsp response
+		shadowErr error
+		wg        sync.WaitGroup
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		shadowRsp, shadowErr = c.receive(o.httpClient, sr, false)
+	}()
+
+	rsp, err := c.receive(o.httpClient, hr, o.keepBody)
+	wg.Wait()
+
+	c.checkToken(hr, rsp.status)
+
+	res := c.result(rsp, err)
+	res.host = o.request.Host
+	res.assertionFailed = !c.assert(o, rsp)
+	res.sizeDeviated = !c.checkSize(o, rsp)
+	res.regression = c.regression(o, rsp)
+	res.loggedDuration = o.request.LoggedDuration
+	c.extract(o, rsp)
+	c.storeValidators(hr, rsp)
+	c.storeCache(hr, rsp)
+	if shadowErr != nil && shadowErr != ErrServerError {
+		c.options.Log.Warnln("error while making shadow request:", shadowErr)
+	}
+
+	res.diff = c.compare(hr, rsp, shadowRsp)
+	if res.diff != nil {
+		res.diff.RequestID = o.id
+	}
+
+	c.capture(o, res, rsp, &shadowRsp)
+	return res
+}
+
+// compare returns the difference between the responses, or nil if they match
+func (c *client) compare(hr *http.Request, rsp, shadowRsp response) *Difference {
+	d := &Difference{
+		Method:       hr.Method,
+		Path:         hr.URL.Path,
+		Status:       rsp.status,
+		ShadowStatus: shadowRsp.status,
+	}
+
+	match := rsp.status == shadowRsp.status
+	if rsp.status != 0 && shadowRsp.status != 0 {
+		for _, h := range c.options.CompareHeaders {
+			if rsp.header.Get(h) != shadowRsp.header.Get(h) {
+				d.Headers = append(d.Headers, h)
+				match = false
+			}
+		}
+
+		if c.options.CompareBodies && rsp.bodyHash != shadowRsp.bodyHash {
+			d.BodyHash = rsp.bodyHash
+			d.ShadowBodyHash = shadowRsp.bodyHash
+			match = false
+		}
+	}
+
+	if match {
+		return nil
+	}
+
+	return d
+}
+
+func (p *Player) writeDifference(d *Difference) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		p.options.Log.Errorln("failed to encode difference", err)
+		return
+	}
+
+	if _, err := p.options.DiffLog.Write(append(b, '\n')); err != nil {
+		p.options.Log.Errorln("failed to write difference", err)
+	}
+}
@@ -0,0 +1,28 @@
+package logreplay
+
+import "math"
+
+// checkSize compares the size of the response body with the size captured from the log
+// entry, and returns false, when it deviates more than the SizeTolerance. The requests
+// without a logged size, and the failed requests are not checked.
+func (c *client) checkSize(o *outgoing, rsp response) bool {
+	logged := o.request.LoggedSize
+	if c.options.SizeTolerance <= 0 || logged <= 0 || rsp.status == 0 {
+		return true
+	}
+
+	d := math.Abs(float64(rsp.size-logged)) / float64(logged)
+	if d <= c.options.SizeTolerance {
+		return true
+	}
+
+	c.options.Log.Warnln(
+		"response size deviates from the logged size:",
+		o.httpRequest.Method,
+		o.httpRequest.URL.Path,
+		logged,
+		rsp.size,
+	)
+
+	return false
+}
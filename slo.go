@@ -0,0 +1,95 @@
+package logreplay
+
+import "time"
+
+// DefaultLatencySLOPercentile is the percentile checked against LatencySLO when not
+// specified otherwise.
+const DefaultLatencySLOPercentile = .99
+
+// DefaultLatencySLOWindow is the duration over which the latency is checked against
+// LatencySLO when not specified otherwise.
+const DefaultLatencySLOWindow = time.Minute
+
+// the window of the latency objective is divided into slots, and the objective is
+// checked whenever a slot is closed
+const sloSlots = 10
+
+// sloWindow collects the response times of the recent requests. It is used only from
+// the goroutine of the Player.
+type sloWindow struct {
+	objective  time.Duration
+	percentile float64
+	slot       time.Duration
+	slots      [sloSlots]histogram
+	current    int
+	slotStart  time.Time
+}
+
+func newSLOWindow(o Options) *sloWindow {
+	if o.LatencySLO <= 0 {
+		return nil
+	}
+
+	p := o.LatencySLOPercentile
+	if p <= 0 || p > 1 {
+		p = DefaultLatencySLOPercentile
+	}
+
+	w := o.LatencySLOWindow
+	if w <= 0 {
+		w = DefaultLatencySLOWindow
+	}
+
+	return &sloWindow{
+		objective:  o.LatencySLO,
+		percentile: p,
+		slot:       w / sloSlots,
+		slotStart:  time.Now(),
+	}
+}
+
+// add stores a response time, and returns true when a slot was closed
+func (w *sloWindow) add(d time.Duration, now time.Time) bool {
+	elapsed := int(now.Sub(w.slotStart) / w.slot)
+	if elapsed > sloSlots {
+		elapsed = sloSlots
+	}
+
+	for i := 0; i < elapsed; i++ {
+		w.current = (w.current + 1) % sloSlots
+		w.slots[w.current] = histogram{}
+	}
+
+	if elapsed > 0 {
+		w.slotStart = now
+	}
+
+	w.slots[w.current].add(d)
+	return elapsed > 0
+}
+
+// violated merges the slots, and checks the percentile against the objective
+func (w *sloWindow) violated() (time.Duration, bool) {
+	var h histogram
+	for i := range w.slots {
+		h.merge(&w.slots[i])
+	}
+
+	p := h.percentile(w.percentile)
+	return p, p > w.objective
+}
+
+func (p *Player) checkHaltSLO(r result) bool {
+	if p.slo == nil || r.status == 0 || !p.slo.add(r.latency, time.Now()) {
+		return false
+	}
+
+	latency, violated := p.slo.violated()
+	if !violated {
+		return false
+	}
+
+	p.options.Log.Errorln("latency objective violated:", latency)
+	p.stop(ErrLatencySLO)
+	return true
+}
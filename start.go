@@ -0,0 +1,113 @@
+package logreplay
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the number of the concurrent name lookups when warming up before a scheduled start
+const warmupLookups = 16
+
+// hostName returns the host name of a network address, with or without a scheme and a
+// port
+func hostName(a string) string {
+	if !strings.Contains(a, "://") {
+		a = "http://" + a
+	}
+
+	u, err := url.Parse(a)
+	if err != nil {
+		return ""
+	}
+
+	return u.Hostname()
+}
+
+// warmupHosts returns the host names that the requests will be sent to, excluding the
+// IP addresses and the hosts with an overridden address
+func (p *Player) warmupHosts() []string {
+	var addresses []string
+	switch {
+	case p.options.ProxyURL != "":
+		addresses = []string{p.options.ProxyURL}
+	case p.options.ProxyFromEnvironment:
+	case p.options.Server != "" || len(p.options.Servers) > 0:
+		addresses = append([]string{p.options.Server}, p.options.Servers...)
+	default:
+		p.eachRequest(func(_ int, r *Request) {
+			addresses = append(addresses, r.Host)
+		})
+	}
+
+	if p.options.Shadow != "" {
+		addresses = append(addresses, p.options.Shadow)
+	}
+
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, a := range addresses {
+		h := hostName(a)
+		if h == "" || seen[h] || net.ParseIP(h) != nil || p.options.Resolve[h] != "" {
+			continue
+		}
+
+		seen[h] = true
+		hosts = append(hosts, h)
+	}
+
+	return hosts
+}
+
+// warmup prepares a scheduled start: it reads the access log, and resolves the host
+// names in advance, to fill the caches of the resolvers and to report the failures
+// early. The failures are only logged, the same errors are handled again once the
+// replay starts.
+func (p *Player) warmup() {
+	if err := p.readAll(); err != nil {
+		p.options.Log.Warnln("failed to read the access log before the start:", err)
+	}
+
+	timeout := p.options.DialTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	var wg sync.WaitGroup
+	lookups := make(chan struct{}, warmupLookups)
+	for _, h := range p.warmupHosts() {
+		wg.Add(1)
+		lookups <- struct{}{}
+		go func(h string) {
+			defer func() {
+				<-lookups
+				wg.Done()
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			network := p.shared.transport.network("ip")
+			if _, err := net.DefaultResolver.LookupIP(ctx, network, h); err != nil {
+				p.options.Log.Warnln("failed to resolve host before the start:", err)
+			}
+		}(h)
+	}
+
+	wg.Wait()
+}
+
+// startTimer returns a channel that receives when the scheduled start time is reached.
+// When no start time is set, or it has passed, it returns nil, and no warmup is made.
+func (p *Player) startTimer() <-chan time.Time {
+	d := time.Until(p.options.StartAt)
+	if p.options.StartAt.IsZero() || d <= 0 {
+		return nil
+	}
+
+	p.warmup()
+	p.options.Log.Infoln("waiting for the start at:", p.options.StartAt)
+	return time.After(time.Until(p.options.StartAt))
+}
@@ -0,0 +1,779 @@
+package logreplay
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Latency contains the response time statistics of the requests that received a
+// response. The response time is measured until the response body was read. The
+// percentiles are approximate, with a relative error below 7%.
+type Latency struct {
+	Min  time.Duration
+	Mean time.Duration
+	Max  time.Duration
+	P50  time.Duration
+	P90  time.Duration
+	P95  time.Duration
+	P99  time.Duration
+}
+
+// LatencyRegression contains the requests to an endpoint, whose response time exceeded
+// the logged duration multiplied by the LatencyRegressionFactor.
+type LatencyRegression struct {
+
+	// Requests is the number of the regressed requests.
+	Requests int
+
+	// Logged and Replayed are the mean of the logged durations and the replayed
+	// response times of the regressed requests.
+	Logged   time.Duration
+	Replayed time.Duration
+}
+
+// Stats contains the statistics of the replay, collected since the player was created.
+type Stats struct {
+
+	// Requests is the number of the completed requests, including the failed ones.
+	Requests int
+
+	// Errors is the number of the requests that failed without a response.
+	Errors int
+
+	// ServerErrors is the number of the responses with a 5xx status code.
+	ServerErrors int
+
+	// StatusCodes contains the number of the responses by status code.
+	StatusCodes map[int]int
+
+	// StatusClasses contains the number of the responses by status class, e.g. 2xx.
+	StatusClasses map[string]int
+
+	// ErrorClasses contains the number of the failed requests and the 4xx and 5xx
+	// responses by the class of the failure.
+	ErrorClasses map[ErrorClass]int
+
+	// Protocols contains the number of the responses by the negotiated protocol, e.g.
+	// HTTP/1.1 or HTTP/2.0.
+	Protocols map[string]int
+
+	// Differences is the number of the requests where the responses of the primary and
+	// the shadow server didn't match.
+	Differences int
+
+	// AssertionFailures is the number of the responses that failed to meet the
+	// assertions.
+	AssertionFailures int
+
+	// SizeDeviations is the number of the responses whose size deviated from the
+	// logged size more than the SizeTolerance.
+	SizeDeviations int
+
+	// CacheHits is the number of the requests that were not made, because a fresh
+	// response was available in the client cache. They are not counted in Requests.
+	CacheHits int
+
+	// Skipped is the number of the requests that were not made, because the circuit
+	// breaker was open for their host.
+	Skipped int
+
+	// Dropped is the number of the requests that were not made in open loop mode,
+	// because the session had MaxOpenRequests in flight.
+	Dropped int
+
+	// NewConnections and ReusedConnections are the number of the connections opened
+	// for the requests, and the number of the times an idle connection was reused.
+	NewConnections    int
+	ReusedConnections int
+
+	// RedirectChains contains the number of the requests by the number of the redirects
+	// followed before the final response. The requests without redirects are not
+	// counted.
+	RedirectChains map[int]int
+
+	// ResponseBytes is the total size of the response bodies, as received. When the
+	// transport decompressed the responses transparently, because AcceptEncoding was
+	// not set, it counts the decompressed size.
+	ResponseBytes int64
+
+	// TruncatedResponses is the number of the responses whose body was longer than
+	// MaxResponseBytes.
+	TruncatedResponses int
+
+	// UncompressedBytes is the total size of the response bodies after decompression.
+	// The compressed responses are counted with their decompressed size only when
+	// DecompressResponses is set and the content encoding is supported.
+	UncompressedBytes int64
+
+	// Latency contains the response time statistics.
+	Latency Latency
+
+	// DNS, Connect and TLSHandshake contain the statistics of the durations of the name
+	// lookups, establishing the connections and the TLS handshakes, respectively. Only
+	// the requests that included the given phase are taken into account, e.g. the
+	// requests made on a reused connection don't count in Connect.
+	DNS          Latency
+	Connect      Latency
+	TLSHandshake Latency
+
+	// TimeToFirstByte contains the statistics of the durations between starting the
+	// requests and receiving the first byte of the responses.
+	TimeToFirstByte Latency
+
+	// ExpectContinue contains the statistics of the durations between sending the
+	// request headers with Expect: 100-continue and receiving the 100 Continue
+	// response. The requests where the server responded with the final status instead,
+	// or the timeout expired, are not taken into account.
+	ExpectContinue Latency
+
+	// LatencyRegressions contains the requests that were significantly slower than the
+	// logged duration, grouped by their endpoint, in the form of METHOD /path.
+	LatencyRegressions map[string]LatencyRegression `json:",omitempty"`
+
+	// Labels contains the statistics of the requests grouped by their labels, in the
+	// form of name=value. A request with multiple labels is counted in every group.
+	Labels map[string]Stats `json:",omitempty"`
+}
+
+var statusClasses = [...]string{"0xx", "1xx", "2xx", "3xx", "4xx", "5xx"}
+
+// statusClass returns the class of a status code, e.g. 2xx
+func statusClass(status int) string {
+	if c := status / 100; c >= 0 && c < len(statusClasses) {
+		return statusClasses[c]
+	}
+
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// result is reported by the sessions for every request
+type result struct {
+	err      error
+	status   int
+	protocol string
+	host     string
+	diff     *Difference
+	latency  time.Duration
+
+	assertionFailed bool
+	newConns        int
+	reusedConns     int
+	timings         timings
+	redirects       int
+	labels          []string
+
+	size             int64
+	uncompressedSize int64
+	sizeDeviated     bool
+	regression       string
+	loggedDuration   time.Duration
+	logEntry         *resultEntry
+	cacheHit         bool
+	dropped          bool
+	truncated        bool
+}
+
+type resultChannel chan result
+
+// stats holds the statistics merged from the session shards, or from multiple players.
+// It is used only from a single goroutine.
+type stats struct {
+	stats          Stats
+	latency        histogram
+	dns            histogram
+	connect        histogram
+	tls            histogram
+	ttfb           histogram
+	expectContinue histogram
+
+	regressions map[string]*regressionCounter
+	labels      map[string]*stats
+}
+
+func newStats() *stats {
+	return &stats{stats: Stats{
+		StatusCodes:    make(map[int]int),
+		StatusClasses:  make(map[string]int),
+		Protocols:      make(map[string]int),
+		RedirectChains: make(map[int]int),
+		ErrorClasses:   make(map[ErrorClass]int),
+	}}
+}
+
+// label returns the statistics group of a label, created on the first use
+func (s *stats) label(key string) *stats {
+	if s.labels == nil {
+		s.labels = make(map[string]*stats)
+	}
+
+	l, ok := s.labels[key]
+	if !ok {
+		l = newStats()
+		s.labels[key] = l
+	}
+
+	return l
+}
+
+// counterMap holds counters by key, e.g. by status code. Once a key was counted, its
+// counter is updated without locking.
+type counterMap struct {
+	counters sync.Map
+}
+
+func (c *counterMap) add(key interface{}) {
+	n, ok := c.counters.Load(key)
+	if !ok {
+		n, _ = c.counters.LoadOrStore(key, new(int64))
+	}
+
+	atomic.AddInt64(n.(*int64), 1)
+}
+
+func (c *counterMap) each(f func(key interface{}, n int)) {
+	c.counters.Range(func(key, n interface{}) bool {
+		f(key, int(atomic.LoadInt64(n.(*int64))))
+		return true
+	})
+}
+
+// timingStats holds the histograms of the connection phases. Most of the requests reuse
+// a connection, so these are rarely updated, and instead of every session, they are
+// collected once by the player, shared by the sessions.
+type timingStats struct {
+	dns            atomicHistogram
+	connect        atomicHistogram
+	tls            atomicHistogram
+	ttfb           atomicHistogram
+	expectContinue atomicHistogram
+
+	// label -> *timingStats:
+	labels sync.Map
+}
+
+// label returns the timings of a label, created on the first use
+func (t *timingStats) label(key string) *timingStats {
+	l, ok := t.labels.Load(key)
+	if !ok {
+		l, _ = t.labels.LoadOrStore(key, &timingStats{})
+	}
+
+	return l.(*timingStats)
+}
+
+func (t *timingStats) add(tm timings) {
+	for _, ht := range []struct {
+		h *atomicHistogram
+		d time.Duration
+	}{
+		{&t.dns, tm.dns},
+		{&t.connect, tm.connect},
+		{&t.tls, tm.tls},
+		{&t.ttfb, tm.ttfb},
+		{&t.expectContinue, tm.expectContinue},
+	} {
+		if ht.d > 0 {
+			ht.h.add(ht.d)
+		}
+	}
+}
+
+// statsShard collects the statistics of a single session with atomic counters, so that
+// counting the results doesn't block, not even while the statistics are read. The
+// shards are merged only when the statistics are read, so the counters of a shard may
+// be read at slightly different moments.
+type statsShard struct {
+	requests          int64
+	errors            int64
+	serverErrors      int64
+	differences       int64
+	assertionFailures int64
+	sizeDeviations    int64
+	cacheHits         int64
+	dropped           int64
+	newConns          int64
+	reusedConns       int64
+	responseBytes     int64
+	uncompressedBytes int64
+	truncated         int64
+
+	statusCodes    counterMap
+	protocols      counterMap
+	redirectChains counterMap
+	errorClasses   counterMap
+
+	latency atomicHistogram
+	timings *timingStats
+
+	// endpoint -> *atomicRegressionCounter, and label -> *statsShard:
+	regressions sync.Map
+	labels      sync.Map
+}
+
+func (s *statsShard) add(r result) {
+	if r.cacheHit {
+		atomic.AddInt64(&s.cacheHits, 1)
+		return
+	}
+
+	if r.dropped {
+		atomic.AddInt64(&s.dropped, 1)
+		return
+	}
+
+	s.count(r)
+	for _, key := range r.labels {
+		l, ok := s.labels.Load(key)
+		if !ok {
+			l, _ = s.labels.LoadOrStore(key, &statsShard{timings: s.timings.label(key)})
+		}
+
+		l.(*statsShard).count(r)
+	}
+}
+
+func (s *statsShard) count(r result) {
+	atomic.AddInt64(&s.requests, 1)
+	atomic.AddInt64(&s.newConns, int64(r.newConns))
+	atomic.AddInt64(&s.reusedConns, int64(r.reusedConns))
+	s.timings.add(r.timings)
+
+	if r.diff != nil {
+		atomic.AddInt64(&s.differences, 1)
+	}
+
+	if r.assertionFailed {
+		atomic.AddInt64(&s.assertionFailures, 1)
+	}
+
+	if r.sizeDeviated {
+		atomic.AddInt64(&s.sizeDeviations, 1)
+	}
+
+	if c := classifyError(r.err, r.status); c != "" {
+		s.errorClasses.add(c)
+	}
+
+	if r.status == 0 {
+		atomic.AddInt64(&s.errors, 1)
+		return
+	}
+
+	s.latency.add(r.latency)
+	atomic.AddInt64(&s.responseBytes, r.size)
+	atomic.AddInt64(&s.uncompressedBytes, r.uncompressedSize)
+	if r.truncated {
+		atomic.AddInt64(&s.truncated, 1)
+	}
+
+	s.statusCodes.add(r.status)
+	if r.status >= 500 {
+		atomic.AddInt64(&s.serverErrors, 1)
+	}
+
+	s.protocols.add(r.protocol)
+	if r.redirects > 0 {
+		s.redirectChains.add(r.redirects)
+	}
+
+	if r.regression != "" {
+		rc, ok := s.regressions.Load(r.regression)
+		if !ok {
+			rc, _ = s.regressions.LoadOrStore(r.regression, &atomicRegressionCounter{})
+		}
+
+		rc.(*atomicRegressionCounter).add(r.loggedDuration, r.latency)
+	}
+}
+
+// regression returns the regression counter of an endpoint, created on the first use
+func (s *stats) regression(endpoint string) *regressionCounter {
+	if s.regressions == nil {
+		s.regressions = make(map[string]*regressionCounter)
+	}
+
+	rc, ok := s.regressions[endpoint]
+	if !ok {
+		rc = &regressionCounter{}
+		s.regressions[endpoint] = rc
+	}
+
+	return rc
+}
+
+func (s *stats) get() Stats {
+	c := s.snapshot()
+	if len(s.labels) > 0 {
+		c.Labels = make(map[string]Stats)
+		for key, l := range s.labels {
+			c.Labels[key] = l.snapshot()
+		}
+	}
+
+	return c
+}
+
+func (s *stats) snapshot() Stats {
+	c := s.stats
+	c.StatusCodes = make(map[int]int)
+	for code, n := range s.stats.StatusCodes {
+		c.StatusCodes[code] = n
+	}
+
+	c.StatusClasses = make(map[string]int)
+	for class, n := range s.stats.StatusClasses {
+		c.StatusClasses[class] = n
+	}
+
+	c.Protocols = make(map[string]int)
+	for p, n := range s.stats.Protocols {
+		c.Protocols[p] = n
+	}
+
+	c.RedirectChains = make(map[int]int)
+	for l, n := range s.stats.RedirectChains {
+		c.RedirectChains[l] = n
+	}
+
+	c.ErrorClasses = make(map[ErrorClass]int)
+	for class, n := range s.stats.ErrorClasses {
+		c.ErrorClasses[class] = n
+	}
+
+	c.Latency = s.latency.latency()
+	c.DNS = s.dns.latency()
+	c.Connect = s.connect.latency()
+	c.TLSHandshake = s.tls.latency()
+	c.TimeToFirstByte = s.ttfb.latency()
+	c.ExpectContinue = s.expectContinue.latency()
+	if len(s.regressions) > 0 {
+		c.LatencyRegressions = make(map[string]LatencyRegression)
+		for endpoint, rc := range s.regressions {
+			c.LatencyRegressions[endpoint] = rc.regression()
+		}
+	}
+
+	return c
+}
+
+// shardedStats collects the statistics of the player in one shard per session. The
+// sessions count their own results with atomic counters, and the shards are merged only
+// when the statistics are read. When a session exits, its shard is folded into the
+// statistics of the exited sessions, so that the shards don't accumulate. The lock
+// protects only the list of the shards, it is not used for counting the results.
+type shardedStats struct {
+	mx      sync.Mutex
+	exited  *stats
+	shards  []*statsShard
+	timings *timingStats
+	skipped int64
+}
+
+func newShardedStats() *shardedStats {
+	return &shardedStats{exited: newStats(), timings: &timingStats{}}
+}
+
+// shard creates the statistics shard of a new session
+func (s *shardedStats) shard() *statsShard {
+	sh := &statsShard{timings: s.timings}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.shards = append(s.shards, sh)
+	return sh
+}
+
+// retire folds the shard of an exited session into the statistics of the exited sessions.
+// It must be called only when the session doesn't count any more results.
+func (s *shardedStats) retire(sh *statsShard) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for i := range s.shards {
+		if s.shards[i] == sh {
+			s.exited.mergeShard(sh)
+			s.shards = append(s.shards[:i], s.shards[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *shardedStats) skip() {
+	atomic.AddInt64(&s.skipped, 1)
+}
+
+// merged combines the shards
+func (s *shardedStats) merged() *stats {
+	m := newStats()
+	s.mx.Lock()
+	m.merge(s.exited)
+	for _, sh := range s.shards {
+		m.mergeShard(sh)
+	}
+
+	s.mx.Unlock()
+	m.mergeTimings(s.timings)
+	m.stats.Skipped = int(atomic.LoadInt64(&s.skipped))
+	return m
+}
+
+func (s *shardedStats) get() Stats {
+	return s.merged().get()
+}
+
+// merge adds the statistics collected by another player
+func (s *stats) merge(from *stats) {
+	s.mergeCounts(from)
+	for key, l := range from.labels {
+		s.label(key).mergeCounts(l)
+	}
+}
+
+// mergeShard adds the statistics collected by a session
+func (s *stats) mergeShard(from *statsShard) {
+	s.mergeShardCounts(from)
+	from.labels.Range(func(key, l interface{}) bool {
+		s.label(key.(string)).mergeShardCounts(l.(*statsShard))
+		return true
+	})
+}
+
+func (s *stats) mergeShardCounts(from *statsShard) {
+	s.stats.Requests += int(atomic.LoadInt64(&from.requests))
+	s.stats.Errors += int(atomic.LoadInt64(&from.errors))
+	s.stats.ServerErrors += int(atomic.LoadInt64(&from.serverErrors))
+	s.stats.Differences += int(atomic.LoadInt64(&from.differences))
+	s.stats.AssertionFailures += int(atomic.LoadInt64(&from.assertionFailures))
+	s.stats.SizeDeviations += int(atomic.LoadInt64(&from.sizeDeviations))
+	s.stats.CacheHits += int(atomic.LoadInt64(&from.cacheHits))
+	s.stats.Dropped += int(atomic.LoadInt64(&from.dropped))
+	s.stats.NewConnections += int(atomic.LoadInt64(&from.newConns))
+	s.stats.ReusedConnections += int(atomic.LoadInt64(&from.reusedConns))
+	s.stats.ResponseBytes += atomic.LoadInt64(&from.responseBytes)
+	s.stats.UncompressedBytes += atomic.LoadInt64(&from.uncompressedBytes)
+	s.stats.TruncatedResponses += int(atomic.LoadInt64(&from.truncated))
+	from.statusCodes.each(func(code interface{}, n int) {
+		s.stats.StatusCodes[code.(int)] += n
+		s.stats.StatusClasses[statusClass(code.(int))] += n
+	})
+
+	from.protocols.each(func(p interface{}, n int) {
+		s.stats.Protocols[p.(string)] += n
+	})
+
+	from.redirectChains.each(func(l interface{}, n int) {
+		s.stats.RedirectChains[l.(int)] += n
+	})
+
+	from.errorClasses.each(func(class interface{}, n int) {
+		s.stats.ErrorClasses[class.(ErrorClass)] += n
+	})
+
+	from.regressions.Range(func(endpoint, rc interface{}) bool {
+		c := rc.(*atomicRegressionCounter).load()
+		s.regression(endpoint.(string)).merge(&c)
+		return true
+	})
+
+	c := from.latency.load()
+	s.latency.merge(&c)
+}
+
+// mergeTimings adds the connection timings collected by the sessions
+func (s *stats) mergeTimings(from *timingStats) {
+	s.mergeTimingCounts(from)
+	from.labels.Range(func(key, t interface{}) bool {
+		s.label(key.(string)).mergeTimingCounts(t.(*timingStats))
+		return true
+	})
+}
+
+func (s *stats) mergeTimingCounts(from *timingStats) {
+	for _, h := range []struct {
+		to   *histogram
+		from *atomicHistogram
+	}{
+		{&s.dns, &from.dns},
+		{&s.connect, &from.connect},
+		{&s.tls, &from.tls},
+		{&s.ttfb, &from.ttfb},
+		{&s.expectContinue, &from.expectContinue},
+	} {
+		c := h.from.load()
+		h.to.merge(&c)
+	}
+}
+
+func (s *stats) mergeCounts(from *stats) {
+	s.stats.Requests += from.stats.Requests
+	s.stats.Errors += from.stats.Errors
+	s.stats.ServerErrors += from.stats.ServerErrors
+	s.stats.Differences += from.stats.Differences
+	s.stats.AssertionFailures += from.stats.AssertionFailures
+	s.stats.SizeDeviations += from.stats.SizeDeviations
+	s.stats.Skipped += from.stats.Skipped
+	s.stats.Dropped += from.stats.Dropped
+	s.stats.CacheHits += from.stats.CacheHits
+	s.stats.NewConnections += from.stats.NewConnections
+	s.stats.ReusedConnections += from.stats.ReusedConnections
+	s.stats.ResponseBytes += from.stats.ResponseBytes
+	s.stats.UncompressedBytes += from.stats.UncompressedBytes
+	s.stats.TruncatedResponses += from.stats.TruncatedResponses
+	for code, n := range from.stats.StatusCodes {
+		s.stats.StatusCodes[code] += n
+	}
+
+	for class, n := range from.stats.StatusClasses {
+		s.stats.StatusClasses[class] += n
+	}
+
+	for p, n := range from.stats.Protocols {
+		s.stats.Protocols[p] += n
+	}
+
+	for l, n := range from.stats.RedirectChains {
+		s.stats.RedirectChains[l] += n
+	}
+
+	for class, n := range from.stats.ErrorClasses {
+		s.stats.ErrorClasses[class] += n
+	}
+
+	for endpoint, rc := range from.regressions {
+		s.regression(endpoint).merge(rc)
+	}
+
+	s.latency.merge(&from.latency)
+	s.dns.merge(&from.dns)
+	s.connect.merge(&from.connect)
+	s.tls.merge(&from.tls)
+	s.ttfb.merge(&from.ttfb)
+	s.expectContinue.merge(&from.expectContinue)
+}
+
+// mergeLatency combines the latency statistics, weighting the mean and the percentiles
+// by the number of the measurements
+func mergeLatency(l []Latency, weights []int) Latency {
+	var (
+		m   Latency
+		sum int
+		wl  [5]float64
+	)
+
+	for i, li := range l {
+		w := weights[i]
+		if w <= 0 || li.Max == 0 {
+			continue
+		}
+
+		if sum == 0 || li.Min < m.Min {
+			m.Min = li.Min
+		}
+
+		if li.Max > m.Max {
+			m.Max = li.Max
+		}
+
+		for j, d := range []time.Duration{li.Mean, li.P50, li.P90, li.P95, li.P99} {
+			wl[j] += float64(w) * float64(d)
+		}
+
+		sum += w
+	}
+
+	if sum == 0 {
+		return Latency{}
+	}
+
+	for j, d := range []*time.Duration{&m.Mean, &m.P50, &m.P90, &m.P95, &m.P99} {
+		*d = time.Duration(wl[j] / float64(sum))
+	}
+
+	return m
+}
+
+// MergeStats combines the statistics of multiple replays, e.g. the ones collected by the
+// workers of a distributed replay. The counters are summed, while the mean and the
+// percentile fields of the durations are set to the average of the input values,
+// weighted by the number of the responses. These averages are not the percentiles of
+// the combined measurements, e.g. the merged P99 can be much lower than the real one.
+// For exact percentiles, use a Group.
+func MergeStats(s ...Stats) Stats {
+	m := newStats().stats
+	var (
+		weights                                []int
+		latency, dns, connect, tls, ttfb, cont []Latency
+		labels                                 = make(map[string][]Stats)
+	)
+
+	for _, si := range s {
+		for key, l := range si.Labels {
+			labels[key] = append(labels[key], l)
+		}
+
+		if len(si.LatencyRegressions) > 0 {
+			if m.LatencyRegressions == nil {
+				m.LatencyRegressions = make(map[string]LatencyRegression)
+			}
+
+			mergeRegressions(m.LatencyRegressions, si.LatencyRegressions)
+		}
+
+		m.Requests += si.Requests
+		m.Errors += si.Errors
+		m.ServerErrors += si.ServerErrors
+		m.Differences += si.Differences
+		m.AssertionFailures += si.AssertionFailures
+		m.SizeDeviations += si.SizeDeviations
+		m.Skipped += si.Skipped
+		m.Dropped += si.Dropped
+		m.CacheHits += si.CacheHits
+		m.NewConnections += si.NewConnections
+		m.ReusedConnections += si.ReusedConnections
+		m.ResponseBytes += si.ResponseBytes
+		m.UncompressedBytes += si.UncompressedBytes
+		m.TruncatedResponses += si.TruncatedResponses
+		for code, n := range si.StatusCodes {
+			m.StatusCodes[code] += n
+		}
+
+		for class, n := range si.StatusClasses {
+			m.StatusClasses[class] += n
+		}
+
+		for p, n := range si.Protocols {
+			m.Protocols[p] += n
+		}
+
+		for l, n := range si.RedirectChains {
+			m.RedirectChains[l] += n
+		}
+
+		for class, n := range si.ErrorClasses {
+			m.ErrorClasses[class] += n
+		}
+
+		weights = append(weights, si.Requests-si.Errors)
+		latency = append(latency, si.Latency)
+		dns = append(dns, si.DNS)
+		connect = append(connect, si.Connect)
+		tls = append(tls, si.TLSHandshake)
+		ttfb = append(ttfb, si.TimeToFirstByte)
+		cont = append(cont, si.ExpectContinue)
+	}
+
+	m.Latency = mergeLatency(latency, weights)
+	m.DNS = mergeLatency(dns, weights)
+	m.Connect = mergeLatency(connect, weights)
+	m.TLSHandshake = mergeLatency(tls, weights)
+	m.TimeToFirstByte = mergeLatency(ttfb, weights)
+	m.ExpectContinue = mergeLatency(cont, weights)
+	if len(labels) > 0 {
+		m.Labels = make(map[string]Stats)
+		for key, l := range labels {
+			m.Labels[key] = MergeStats(l...)
+		}
+	}
+
+	return m
+}
@@ -0,0 +1,135 @@
+package logreplay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"unsafe"
+)
+
+// the approximate size of a request without its variable length fields
+const requestOverhead = int64(unsafe.Sizeof(Request{}))
+
+// the approximate overhead of a map entry
+const mapEntryOverhead = 48
+
+// entryStore keeps the log entries read from the access log, in order to replay them
+// repeatedly. When the memory budget is exceeded, the further entries are spilled to a
+// temporary file, and read back from it when needed. It is used only from the goroutine
+// of the Player.
+type entryStore struct {
+	maxMemory int64
+	used      int64
+	memory    []*Request
+	log       Logger
+
+	// the offsets of the spilled entries in the file
+	spill   *os.File
+	offsets []int64
+	end     int64
+}
+
+func newEntryStore(o Options, log Logger) *entryStore {
+	return &entryStore{maxMemory: o.MaxMemory, log: log}
+}
+
+func mapSize(m map[string]string) int64 {
+	var n int64
+	for k, v := range m {
+		n += int64(len(k)+len(v)) + mapEntryOverhead
+	}
+
+	return n
+}
+
+// requestSize returns the approximate memory used by a request
+func requestSize(r *Request) int64 {
+	return requestOverhead +
+		int64(len(r.Method)+len(r.Scheme)+len(r.Host)+len(r.Path)+len(r.Protocol)+len(r.UserAgent)+len(r.RemoteAddress)) +
+		int64(len(r.Session)+len(r.Body)+len(r.BodyFile)+len(r.BodyTemplate)) +
+		mapSize(r.Fields) +
+		mapSize(r.Labels)
+}
+
+func (s *entryStore) count() int {
+	return len(s.memory) + len(s.offsets)
+}
+
+// createSpill creates the spill file. It is removed right away, so that it doesn't
+// outlive the process, where the operating system allows it.
+func (s *entryStore) createSpill() error {
+	f, err := ioutil.TempFile("", "logreplay-entries")
+	if err != nil {
+		return err
+	}
+
+	os.Remove(f.Name())
+	s.spill = f
+	s.log.Warnln("memory budget exceeded, spilling the log entries to disk:", f.Name())
+	return nil
+}
+
+func (s *entryStore) add(r *Request) error {
+	if s.spill == nil {
+		size := requestSize(r)
+		if s.maxMemory <= 0 || s.used+size <= s.maxMemory {
+			s.memory = append(s.memory, r)
+			s.used += size
+			return nil
+		}
+
+		if err := s.createSpill(); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.spill.WriteAt(b, s.end); err != nil {
+		return err
+	}
+
+	s.offsets = append(s.offsets, s.end)
+	s.end += int64(len(b))
+	return nil
+}
+
+func (s *entryStore) get(i int) (*Request, error) {
+	if i < len(s.memory) {
+		return s.memory[i], nil
+	}
+
+	i -= len(s.memory)
+	from, to := s.offsets[i], s.end
+	if i+1 < len(s.offsets) {
+		to = s.offsets[i+1]
+	}
+
+	b := make([]byte, to-from)
+	if _, err := s.spill.ReadAt(b, from); err != nil {
+		return nil, err
+	}
+
+	var r Request
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// close removes the spill file, when it was created
+func (s *entryStore) close() error {
+	if s.spill == nil {
+		return nil
+	}
+
+	err := s.spill.Close()
+	os.Remove(s.spill.Name())
+	s.spill = nil
+	s.memory, s.offsets, s.end, s.used = nil, nil, 0, 0
+	return err
+}
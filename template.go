@@ -0,0 +1,259 @@
+package logreplay
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// TemplateData is passed to the request templates when they are executed. Besides the
+// fields, the templates can use the following functions:
+//
+//	uuid: the UUID of the request, same as .UUID
+//	seq: the sequence number of the request, same as .Seq
+//	now: the time of the request in RFC3339 format
+//	rand min max: a random integer from the closed range
+//
+// The same data is used for the path, the headers and the body of a request.
+type TemplateData struct {
+
+	// Seq is the sequence number of the request in the replay, starting from 1.
+	Seq uint64
+
+	// UUID is a random, version 4 UUID, different for every request.
+	UUID string
+
+	// Time is the time when the request is made.
+	Time time.Time
+
+	// Method, Host and Path are taken from the request definition.
+	Method, Host, Path string
+
+	// Fields contain the values captured from the log entry.
+	Fields map[string]string
+
+	// Vars contain the values extracted from the earlier responses of the session.
+	Vars map[string]string
+}
+
+// templateScope creates the template data of a request on the first use
+type templateScope struct {
+	random  *rand.Rand
+	request *Request
+	seq     uint64
+	vars    map[string]string
+	data    *TemplateData
+}
+
+type templateCache struct {
+	mx        sync.Mutex
+	expandEnv bool
+	templates map[string]*template.Template
+}
+
+// sessionTemplates holds the copies of the cached templates used by a session. The
+// functions of the copies read the data of the request that the session currently
+// executes. A session executes its templates one at a time, so the copies are executed
+// without locking or cloning, and the shared cache is used only on the first use of a
+// template.
+type sessionTemplates struct {
+	cache     *templateCache
+	random    *rand.Rand
+	data      TemplateData
+	templates map[string]*template.Template
+}
+
+func newUUID(rnd *rand.Rand) string {
+	var b [16]byte
+	for i := range b {
+		b[i] = byte(rnd.Intn(256))
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func newTemplateData(rnd *rand.Rand, r *Request, seq uint64) TemplateData {
+	return TemplateData{
+		Seq:    seq,
+		UUID:   newUUID(rnd),
+		Time:   time.Now(),
+		Method: r.Method,
+		Host:   r.Host,
+		Path:   r.Path,
+		Fields: r.Fields,
+	}
+}
+
+func (s *templateScope) get() TemplateData {
+	if s.data == nil {
+		d := newTemplateData(s.random, s.request, s.seq)
+		d.Vars = s.vars
+		s.data = &d
+	}
+
+	return *s.data
+}
+
+// templateFuncs returns the functions available in the templates, reading the data of
+// the request being executed
+func templateFuncs(rnd *rand.Rand, d *TemplateData) template.FuncMap {
+	return template.FuncMap{
+		"uuid": func() string { return d.UUID },
+		"seq":  func() uint64 { return d.Seq },
+		"now":  func() string { return d.Time.Format(time.RFC3339) },
+		"rand": func(min, max int) (int, error) {
+			if max < min {
+				return 0, fmt.Errorf("invalid range: %d..%d", min, max)
+			}
+
+			return min + rnd.Intn(max-min+1), nil
+		},
+	}
+}
+
+// hasTemplate tells whether a value needs to be parsed as a template
+func hasTemplate(text string) bool {
+	return strings.Contains(text, "{{")
+}
+
+func newTemplateCache(expandEnv bool) *templateCache {
+	return &templateCache{
+		expandEnv: expandEnv,
+		templates: make(map[string]*template.Template),
+	}
+}
+
+func (tc *templateCache) get(text string) (*template.Template, error) {
+	tc.mx.Lock()
+	defer tc.mx.Unlock()
+
+	if t, ok := tc.templates[text]; ok {
+		return t, nil
+	}
+
+	expanded := text
+	if tc.expandEnv {
+		var err error
+		if expanded, err = expandEnv(text); err != nil {
+			return nil, err
+		}
+	}
+
+	t, err := template.New("").
+		Option("missingkey=zero").
+		Funcs(templateFuncs(nil, &TemplateData{})).
+		Parse(expanded)
+	if err != nil {
+		return nil, err
+	}
+
+	tc.templates[text] = t
+	return t, nil
+}
+
+// registered tells whether the text was parsed as a template earlier
+func (tc *templateCache) registered(text string) bool {
+	tc.mx.Lock()
+	defer tc.mx.Unlock()
+	_, ok := tc.templates[text]
+	return ok
+}
+
+func newSessionTemplates(tc *templateCache, rnd *rand.Rand) *sessionTemplates {
+	return &sessionTemplates{
+		cache:     tc,
+		random:    rnd,
+		templates: make(map[string]*template.Template),
+	}
+}
+
+// get returns the copy of a template used by the session, created on the first use
+func (st *sessionTemplates) get(text string) (*template.Template, error) {
+	if t, ok := st.templates[text]; ok {
+		return t, nil
+	}
+
+	t, err := st.cache.get(text)
+	if err != nil {
+		return nil, err
+	}
+
+	if t, err = t.Clone(); err != nil {
+		return nil, err
+	}
+
+	t.Funcs(templateFuncs(st.random, &st.data))
+	st.templates[text] = t
+	return t, nil
+}
+
+// registered tells whether the text was parsed as a template earlier
+func (st *sessionTemplates) registered(text string) bool {
+	if _, ok := st.templates[text]; ok {
+		return true
+	}
+
+	return st.cache.registered(text)
+}
+
+func (st *sessionTemplates) execute(text string, s *templateScope) ([]byte, error) {
+	t, err := st.get(text)
+	if err != nil {
+		return nil, err
+	}
+
+	st.data = s.get()
+	var b bytes.Buffer
+	if err := t.Execute(&b, st.data); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// expandTemplate executes the path and header templates validated when the player was
+// created. Other values, e.g. the paths taken from the access log, are returned
+// unchanged.
+func (c *client) expandTemplate(text string, s *templateScope) (string, error) {
+	if !hasTemplate(text) || !c.templates.registered(text) {
+		return text, nil
+	}
+
+	b, err := c.templates.execute(text, s)
+	return string(b), err
+}
+
+// registerTemplates validates the templates in the paths, the headers and the path rules,
+// and marks them for the execution
+func registerTemplates(tc *templateCache, o Options) error {
+	var t []string
+	for _, r := range o.Requests {
+		t = append(t, r.Path)
+	}
+
+	for _, values := range o.Headers {
+		t = append(t, values...)
+	}
+
+	for _, r := range o.PathRules {
+		t = append(t, r.Replacement)
+	}
+
+	for _, ti := range t {
+		if !hasTemplate(ti) {
+			continue
+		}
+
+		if _, err := tc.get(ti); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package logreplay
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// timings contains the durations of the phases of a request. Zero means that the phase
+// was not part of the request, e.g. no DNS lookup was necessary.
+type timings struct {
+	dns     time.Duration
+	connect time.Duration
+	tls     time.Duration
+	ttfb    time.Duration
+
+	// the time of waiting for the 100 Continue response, when the request was sent
+	// with Expect: 100-continue
+	expectContinue time.Duration
+}
+
+// connTrace collects the connection events of a request, including the redirects. The
+// callbacks may be called from different goroutines.
+type connTrace struct {
+	mx           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	headersSent  time.Time
+	newConns     int
+	reusedConns  int
+	timings      timings
+}
+
+func (t *connTrace) gotConn(info httptrace.GotConnInfo) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if info.Reused {
+		t.reusedConns++
+	} else {
+		t.newConns++
+	}
+}
+
+func (t *connTrace) dnsStartEvent(httptrace.DNSStartInfo) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.dnsStart = time.Now()
+}
+
+func (t *connTrace) dnsDone(httptrace.DNSDoneInfo) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.timings.dns == 0 && !t.dnsStart.IsZero() {
+		t.timings.dns = time.Since(t.dnsStart)
+	}
+}
+
+func (t *connTrace) connectStartEvent(string, string) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.connectStart.IsZero() {
+		t.connectStart = time.Now()
+	}
+}
+
+func (t *connTrace) connectDone(_, _ string, err error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if err == nil && t.timings.connect == 0 && !t.connectStart.IsZero() {
+		t.timings.connect = time.Since(t.connectStart)
+	}
+}
+
+func (t *connTrace) tlsHandshakeStart() {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.tlsStart = time.Now()
+}
+
+func (t *connTrace) tlsHandshakeDone(_ tls.ConnectionState, err error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if err == nil && t.timings.tls == 0 && !t.tlsStart.IsZero() {
+		t.timings.tls = time.Since(t.tlsStart)
+	}
+}
+
+func (t *connTrace) wroteHeaders() {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.headersSent = time.Now()
+}
+
+func (t *connTrace) got100Continue() {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.timings.expectContinue == 0 && !t.headersSent.IsZero() {
+		t.timings.expectContinue = time.Since(t.headersSent)
+	}
+}
+
+func (t *connTrace) gotFirstResponseByte() {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.timings.ttfb == 0 {
+		t.timings.ttfb = time.Since(t.start)
+	}
+}
+
+func (t *connTrace) withTrace(hr *http.Request) *http.Request {
+	t.start = time.Now()
+	ct := &httptrace.ClientTrace{
+		GotConn:              t.gotConn,
+		DNSStart:             t.dnsStartEvent,
+		DNSDone:              t.dnsDone,
+		ConnectStart:         t.connectStartEvent,
+		ConnectDone:          t.connectDone,
+		TLSHandshakeStart:    t.tlsHandshakeStart,
+		TLSHandshakeDone:     t.tlsHandshakeDone,
+		GotFirstResponseByte: t.gotFirstResponseByte,
+		WroteHeaders:         t.wroteHeaders,
+		Got100Continue:       t.got100Continue,
+	}
+
+	return hr.WithContext(httptrace.WithClientTrace(hr.Context(), ct))
+}
+
+func (t *connTrace) apply(rsp *response) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	rsp.newConns = t.newConns
+	rsp.reusedConns = t.reusedConns
+	rsp.timings = t.timings
+}
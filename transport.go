@@ -0,0 +1,250 @@
+package logreplay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// transportConfig holds the connection settings prepared once by the player, and used
+// by the transports of every session.
+type transportConfig struct {
+	proxy   func(*http.Request) (*url.URL, error)
+	tls     *tls.Config
+	resolve map[string]string
+	dialer  *net.Dialer
+
+	// appended to the network names, e.g. tcp4, when the address family is restricted
+	family string
+}
+
+func newTransportConfig(o Options) (*transportConfig, error) {
+	tc := &transportConfig{
+		resolve: make(map[string]string),
+		dialer:  &net.Dialer{Timeout: o.DialTimeout},
+	}
+
+	for host, address := range o.Resolve {
+		tc.resolve[host] = address
+	}
+
+	switch o.AddressFamily {
+	case IPv4Only:
+		tc.family = "4"
+	case IPv6Only:
+		tc.family = "6"
+	}
+
+	switch {
+	case o.ProxyURL != "":
+		u, err := url.Parse(o.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+
+		tc.proxy = http.ProxyURL(u)
+	case o.ProxyFromEnvironment:
+		tc.proxy = http.ProxyFromEnvironment
+	}
+
+	if o.MinTLSVersion != 0 && o.MaxTLSVersion != 0 && o.MinTLSVersion > o.MaxTLSVersion {
+		return nil, ErrInvalidTLSVersion
+	}
+
+	tc.tls = &tls.Config{
+		ServerName:         o.ServerName,
+		RootCAs:            o.RootCAs,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+		MinVersion:         o.MinTLSVersion,
+		MaxVersion:         o.MaxTLSVersion,
+		CipherSuites:       o.CipherSuites,
+	}
+
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if tc.tls.RootCAs == nil {
+			tc.tls.RootCAs = x509.NewCertPool()
+		} else {
+			tc.tls.RootCAs = tc.tls.RootCAs.Clone()
+		}
+
+		if !tc.tls.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidCAFile
+		}
+	}
+
+	if o.ClientCertFile != "" || o.ClientKeyFile != "" {
+		if o.ClientCertFile == "" || o.ClientKeyFile == "" {
+			return nil, ErrIncompleteClientCert
+		}
+
+		cert, err := tls.LoadX509KeyPair(o.ClientCertFile, o.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tc.tls.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
+
+// address returns the network address to connect to instead of the requested one, when
+// it is overridden either in the host:port or the host form. When the override doesn't
+// contain a port, the requested port is used.
+func (tc *transportConfig) address(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	a, ok := tc.resolve[addr]
+	if !ok {
+		a, ok = tc.resolve[host]
+	}
+
+	if !ok {
+		return addr
+	}
+
+	if _, _, err := net.SplitHostPort(a); err != nil {
+		return net.JoinHostPort(a, port)
+	}
+
+	return a
+}
+
+// network restricts a network, like tcp, udp or ip, to the address family
+func (tc *transportConfig) network(n string) string {
+	return n + tc.family
+}
+
+func (tc *transportConfig) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return tc.dialer.DialContext(ctx, tc.network(network), tc.address(addr))
+}
+
+func (tc *transportConfig) dialQUIC(
+	ctx context.Context,
+	addr string,
+	tlsConfig *tls.Config,
+	quicConfig *quic.Config,
+) (*quic.Conn, error) {
+	a := tc.address(addr)
+	if tc.family == "" {
+		return quic.DialAddrEarly(ctx, a, tlsConfig, quicConfig)
+	}
+
+	// the address is resolved in advance to the selected family, while the server name
+	// is taken from the requested address:
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ua, err := net.ResolveUDPAddr(tc.network("udp"), a)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	return quic.DialAddrEarly(ctx, ua.String(), tlsConfig, quicConfig)
+}
+
+// checkHTTP3 returns an error when HTTP3 is set together with options that the HTTP/3
+// transport doesn't support, or with a server that is not accessed over TLS
+func checkHTTP3(o Options) error {
+	if !o.HTTP3 {
+		return nil
+	}
+
+	for _, unsupported := range []struct {
+		name string
+		set  bool
+	}{
+		{"ProxyURL", o.ProxyURL != ""},
+		{"ProxyFromEnvironment", o.ProxyFromEnvironment},
+		{"DisableKeepAlives", o.DisableKeepAlives},
+		{"TLSHandshakeTimeout", o.TLSHandshakeTimeout > 0},
+		{"ResponseHeaderTimeout", o.ResponseHeaderTimeout > 0},
+	} {
+		if unsupported.set {
+			return fmt.Errorf("%w: %s", ErrHTTP3Option, unsupported.name)
+		}
+	}
+
+	for _, a := range append([]string{o.Server, o.Shadow}, o.Servers...) {
+		if a == "" || strings.HasPrefix(a, "https://") {
+			continue
+		}
+
+		if strings.HasPrefix(a, "http://") || !strings.Contains(a, "://") && o.DefaultScheme != "https" {
+			return fmt.Errorf("%w: %s is not accessed over TLS", ErrHTTP3Option, a)
+		}
+	}
+
+	return nil
+}
+
+func newTransport(o Options, tc *transportConfig) http.RoundTripper {
+	if o.HTTP3 {
+		t := &http3.Transport{TLSClientConfig: tc.tls.Clone()}
+		if len(tc.resolve) > 0 || tc.family != "" {
+			t.Dial = tc.dialQUIC
+		}
+
+		if o.DialTimeout > 0 {
+			t.QUICConfig = &quic.Config{HandshakeIdleTimeout: o.DialTimeout}
+		}
+
+		return t
+	}
+
+	protocols := new(http.Protocols)
+	switch {
+	case o.H2C:
+		protocols.SetUnencryptedHTTP2(true)
+		protocols.SetHTTP2(true)
+	case o.HTTP2:
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	default:
+		protocols.SetHTTP1(true)
+	}
+
+	var expectContinueTimeout time.Duration
+	if o.ExpectContinueThreshold > 0 {
+		expectContinueTimeout = o.ExpectContinueTimeout
+		if expectContinueTimeout <= 0 {
+			expectContinueTimeout = DefaultExpectContinueTimeout
+		}
+	}
+
+	return &http.Transport{
+		Protocols:             protocols,
+		Proxy:                 tc.proxy,
+		DialContext:           tc.dial,
+		TLSClientConfig:       tc.tls.Clone(),
+		TLSHandshakeTimeout:   o.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: o.ResponseHeaderTimeout,
+		DisableKeepAlives:     o.DisableKeepAlives,
+		ExpectContinueTimeout: expectContinueTimeout,
+	}
+}